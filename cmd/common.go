@@ -20,8 +20,19 @@ import (
 )
 
 const (
-	flagExec    = "exec"
-	flagOverlay = "overlay"
+	flagExec        = "exec"
+	flagOverlay     = "overlay"
+	flagStrategic   = "strategic-overlay"
+	flagJSONPatch   = "json-patch-overlay"
+	flagPatchStrict = "json-patch-strict"
+	flagStdin       = "stdin-format"
+	flagInputFormat = "input-format"
+	flagRecursive   = "recursive"
+	flagExclude     = "exclude"
+	flagPinImages   = "pin-images"
+	flagDupPolicy   = "duplicates"
+	flagJobs        = "jobs"
+	flagContinueErr = "continue-on-error"
 )
 
 type commonFlagOpts struct {
@@ -50,5 +61,16 @@ func addCommonEvalFlags(flags *flag.FlagSet, opt ...commonEvalFlagOpt) {
 		shortEval = ""
 	}
 	flags.StringP(flagExec, shortEval, "", "Inline code") // like `jsonnet -e`
-	flags.String(flagOverlay, "", "Jsonnet file to compose to each of the input files")
+	flags.StringArray(flagOverlay, nil, "Jsonnet file to compose to each of the input files. May be repeated; later overlays win.")
+	flags.StringArray(flagStrategic, nil, "File of objects to strategic-merge into the matching evaluated objects. May be repeated.")
+	flags.StringArray(flagJSONPatch, nil, "File of RFC 6902 JSON patches, each with the kind and name of the objects it targets. May be repeated.")
+	flags.Bool(flagPatchStrict, false, "Fail if a --"+flagJSONPatch+" target matches no object")
+	flags.String(flagStdin, "yaml", "Format of the input read from the '-' path. One of: yaml, json, jsonnet")
+	flags.String(flagInputFormat, "", "Format of the input files, overriding their extension. One of: yaml, json, jsonnet")
+	flags.BoolP(flagRecursive, "R", false, "Read directories recursively")
+	flags.StringArray(flagExclude, nil, "Glob pattern of files and directories to skip when reading directories. May be repeated.")
+	flags.String(flagDupPolicy, "error", "What to do with objects defined more than once. One of: error, last-wins, merge")
+	flags.Int(flagJobs, 1, "Number of input files to evaluate concurrently")
+	flags.Bool(flagContinueErr, false, "Read all the input files even when some fail, reporting all their errors")
+	flags.Bool(flagPinImages, false, "Rewrite container images to their digests, using the --"+flagResolver+" resolver")
 }
@@ -42,7 +42,7 @@ func init() {
 
 func tlaNames(flags *pflag.FlagSet) ([]string, error) {
 	var names []string
-	for _, flagName := range []string{flagTLAVar, flagTLAVarFile, flagTLACode, flagTLACodeFile} {
+	for _, flagName := range []string{flagTLAVar, flagTLAVarFile, flagTLAVarEnv, flagTLACode, flagTLACodeFile, flagTLACodeEnv} {
 		entries, err := flags.GetStringArray(flagName)
 		if err != nil {
 			return nil, err
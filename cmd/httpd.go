@@ -54,7 +54,11 @@ var httpdCmd = &cobra.Command{
 		}
 
 		mkVM := func() (*jsonnet.VM, error) {
-			return JsonnetVM(cmd)
+			vm, err := JsonnetVM(cmd)
+			if err != nil {
+				return nil, err
+			}
+			return vm, nil
 		}
 
 		if len(args) < 1 {
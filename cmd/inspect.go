@@ -0,0 +1,57 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cmd
+
+import (
+	"github.com/kubecfg/kubecfg/pkg/kubecfg"
+	"github.com/kubecfg/kubecfg/utils"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := inspectCmd
+	RootCmd.AddCommand(cmd)
+	cmd.PersistentFlags().StringP(flagFormat, "o", "text", "Output format.  Supported values are: text, json")
+
+	addCommonEvalFlags(cmd.PersistentFlags())
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "List the kinds of the resources defined by the input files",
+	Args:  cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		outputFormat, err := cmd.Flags().GetString(flagFormat)
+		if err != nil {
+			return err
+		}
+
+		exec, err := cmd.Flags().GetString(flagExec)
+		if err != nil {
+			return err
+		}
+		if exec != "" {
+			args = append(args, utils.ToDataURL(exec))
+		}
+
+		vm, err := JsonnetVM(cmd)
+		if err != nil {
+			return err
+		}
+		c := kubecfg.InspectCmd{OutputFormat: outputFormat}
+		return c.Run(vm, args, cmd.OutOrStdout())
+	},
+}
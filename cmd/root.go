@@ -52,6 +52,7 @@ const (
 	flagVerbose     = "verbose"
 	flagJpath       = "jpath"
 	flagJUrl        = "jurl"
+	flagSearchPath  = "search-path"
 	flagExtVar      = "ext-str"
 	flagExtVarFile  = "ext-str-file"
 	flagExtCode     = "ext-code"
@@ -60,8 +61,22 @@ const (
 	flagTLAVarFile  = "tla-str-file"
 	flagTLACode     = "tla-code"
 	flagTLACodeFile = "tla-code-file"
+	flagExtVarEnv   = "ext-str-env"
+	flagExtCodeEnv  = "ext-code-env"
+	flagTLAVarEnv   = "tla-str-env"
+	flagTLACodeEnv  = "tla-code-env"
 	flagResolver    = "resolve-images"
 	flagResolvFail  = "resolve-images-error"
+	flagResolvKey   = "resolve-images-verify-key"
+	flagRegMirror   = "registry-mirror"
+	flagFallbackDir = "import-fallback-dir"
+	flagMaxStack    = "max-stack"
+	flagOCICacheDir = "oci-cache-dir"
+	flagGitCacheDir = "git-cache-dir"
+	flagImportCache = "import-cache-dir"
+	flagOffline     = "offline"
+	flagImportLock  = "import-lock"
+	flagUpdateLock  = "update-import-lock"
 )
 
 var clientConfig clientcmd.ClientConfig
@@ -72,9 +87,22 @@ func init() {
 
 	RootCmd.PersistentFlags().Bool(flagAlpha, false, "Enable alpha features")
 	RootCmd.PersistentFlags().CountP(flagVerbose, "v", "Increase verbosity. May be given multiple times.")
-	RootCmd.PersistentFlags().StringArrayP(flagJpath, "J", nil, "Additional Jsonnet library search path, appended to the ones in the KUBECFG_JPATH env var. May be repeated.")
+	RootCmd.PersistentFlags().StringArrayP(flagJpath, "J", nil, "Additional Jsonnet library search path, appended to the ones in the KUBECFG_JPATH env var and searched ahead of the ones in the JSONNET_PATH env var. May be repeated.")
 	RootCmd.MarkPersistentFlagFilename(flagJpath)
 	RootCmd.PersistentFlags().StringArrayP(flagJUrl, "U", nil, "Additional Jsonnet library search path given as a URL. May be repeated.")
+	RootCmd.PersistentFlags().StringArray(flagSearchPath, nil, "Jsonnet library search path entry, a directory or a URL, searched in the order given ahead of --jpath and --jurl. Use internal:/// to position the embedded libraries. May be repeated.")
+	RootCmd.PersistentFlags().String(flagFallbackDir, "", "Directory mirroring remote imports (as <host>/<path>), used when a remote import cannot be fetched")
+	RootCmd.MarkPersistentFlagDirname(flagFallbackDir)
+	RootCmd.PersistentFlags().String(flagOCICacheDir, "", "Directory caching the layers of oci:// imports between runs")
+	RootCmd.MarkPersistentFlagDirname(flagOCICacheDir)
+	RootCmd.PersistentFlags().String(flagGitCacheDir, "", "Directory holding checkouts of git:// imports (default kubecfg/git in the user cache directory)")
+	RootCmd.MarkPersistentFlagDirname(flagGitCacheDir)
+	RootCmd.PersistentFlags().String(flagImportCache, "", "Directory caching remote (http/https) imports between runs")
+	RootCmd.MarkPersistentFlagDirname(flagImportCache)
+	RootCmd.PersistentFlags().String(flagImportLock, "", "Lock file with the SHA-256 digests remote imports must match")
+	RootCmd.MarkPersistentFlagFilename(flagImportLock)
+	RootCmd.PersistentFlags().Bool(flagUpdateLock, false, "Record the digests of remote imports in the --"+flagImportLock+" file instead of verifying them")
+	RootCmd.PersistentFlags().Bool(flagOffline, false, "Serve remote imports only from the import cache, by default kubecfg/imports in the user cache directory")
 	RootCmd.PersistentFlags().StringArrayP(flagExtVar, "V", nil, "Values of external variables with string values")
 	RootCmd.PersistentFlags().StringArray(flagExtVarFile, nil, "Read external variables with string values from files")
 	RootCmd.MarkPersistentFlagFilename(flagExtVarFile)
@@ -87,8 +115,15 @@ func init() {
 	RootCmd.PersistentFlags().StringArray(flagTLACode, nil, "Values of top level arguments with values supplied as Jsonnet code")
 	RootCmd.PersistentFlags().StringArray(flagTLACodeFile, nil, "Read top level arguments with values supplied as Jsonnet code from files")
 	RootCmd.MarkPersistentFlagFilename(flagTLACodeFile)
-	RootCmd.PersistentFlags().String(flagResolver, "noop", "Change implementation of resolveImage native function. One of: noop, registry")
+	RootCmd.PersistentFlags().StringArray(flagExtVarEnv, nil, "Read external variables with string values from environment variables, given as <var>[=<envvar>]")
+	RootCmd.PersistentFlags().StringArray(flagExtCodeEnv, nil, "Read external variables with values supplied as Jsonnet code from environment variables, given as <var>[=<envvar>]")
+	RootCmd.PersistentFlags().StringArray(flagTLAVarEnv, nil, "Read top level arguments with string values from environment variables, given as <var>[=<envvar>]")
+	RootCmd.PersistentFlags().StringArray(flagTLACodeEnv, nil, "Read top level arguments with values supplied as Jsonnet code from environment variables, given as <var>[=<envvar>]")
+	RootCmd.PersistentFlags().Int(flagMaxStack, 0, "Maximum number of jsonnet stack frames (default 500)")
+	RootCmd.PersistentFlags().String(flagResolver, "noop", "Change implementation of resolveImage native function. One of: noop, normalize, registry")
 	RootCmd.PersistentFlags().String(flagResolvFail, "warn", "Action when resolveImage fails. One of ignore,warn,error")
+	RootCmd.PersistentFlags().StringArray(flagRegMirror, nil, "Rewrite images under a registry before resolving them, as FROM=TO (e.g. docker.io=registry.internal/dockerhub). May be repeated.")
+	RootCmd.PersistentFlags().String(flagResolvKey, "", "Cosign public key (PEM file) images must be signed with to be resolved. Requires --"+flagResolver+"=registry")
 
 	// The "usual" clientcmd/kubectl flags
 	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
@@ -229,8 +264,72 @@ func JsonnetVM(cmd *cobra.Command) (*jsonnet.VM, error) {
 	}
 	opts = append(opts, kubecfg.WithImportURLs(sURLs...))
 
+	searchPath, err := flags.GetStringArray(flagSearchPath)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, kubecfg.WithSearchPath(searchPath...))
+
+	fallbackDir, err := flags.GetString(flagFallbackDir)
+	if err != nil {
+		return nil, err
+	}
+	if fallbackDir != "" {
+		opts = append(opts, kubecfg.WithImportFallbackDir(fallbackDir))
+	}
+
+	ociCacheDir, err := flags.GetString(flagOCICacheDir)
+	if err != nil {
+		return nil, err
+	}
+	if ociCacheDir != "" {
+		opts = append(opts, kubecfg.WithOCILayerCache(ociCacheDir))
+	}
+
+	gitCacheDir, err := flags.GetString(flagGitCacheDir)
+	if err != nil {
+		return nil, err
+	}
+	if gitCacheDir != "" {
+		opts = append(opts, kubecfg.WithGitCacheDir(gitCacheDir))
+	}
+
+	importCache, err := flags.GetString(flagImportCache)
+	if err != nil {
+		return nil, err
+	}
+	if importCache != "" {
+		opts = append(opts, kubecfg.WithImportCache(importCache))
+	}
+	offline, err := flags.GetBool(flagOffline)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, kubecfg.WithOffline(offline))
+
+	importLock, err := flags.GetString(flagImportLock)
+	if err != nil {
+		return nil, err
+	}
+	updateLock, err := flags.GetBool(flagUpdateLock)
+	if err != nil {
+		return nil, err
+	}
+	if updateLock && importLock == "" {
+		return nil, fmt.Errorf("--%s requires --%s", flagUpdateLock, flagImportLock)
+	}
+	if importLock != "" {
+		opts = append(opts, kubecfg.WithImportLock(importLock, updateLock))
+	}
+
 	opts = append(opts, kubecfg.WithAlpha(viper.GetBool(flagAlpha)))
 
+	maxStack, err := flags.GetInt(flagMaxStack)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, kubecfg.WithMaxStack(maxStack))
+
 	withVar := func(typ vars.Type, expr vars.ExpressionType, source vars.Source) func(string, string) {
 		return func(name, value string) {
 			opts = append(opts, kubecfg.WithVar(vars.New(typ, expr, source, name, value)))
@@ -239,17 +338,21 @@ func JsonnetVM(cmd *cobra.Command) (*jsonnet.VM, error) {
 
 	for _, spec := range []struct {
 		flagName string
-		fromFile bool
+		source   vars.Source
 		setter   func(string, string)
 	}{
-		{flagExtVar, false, withVar(vars.Ext, vars.String, vars.Literal)},
-		{flagExtVarFile, true, withVar(vars.Ext, vars.String, vars.File)},
-		{flagExtCode, false, withVar(vars.Ext, vars.Code, vars.Literal)},
-		{flagExtCodeFile, true, withVar(vars.Ext, vars.Code, vars.File)},
-		{flagTLAVar, false, withVar(vars.TLA, vars.String, vars.Literal)},
-		{flagTLAVarFile, true, withVar(vars.TLA, vars.String, vars.File)},
-		{flagTLACode, false, withVar(vars.TLA, vars.Code, vars.Literal)},
-		{flagTLACodeFile, true, withVar(vars.TLA, vars.Code, vars.File)},
+		{flagExtVar, vars.Literal, withVar(vars.Ext, vars.String, vars.Literal)},
+		{flagExtVarFile, vars.File, withVar(vars.Ext, vars.String, vars.File)},
+		{flagExtVarEnv, vars.Env, withVar(vars.Ext, vars.String, vars.Env)},
+		{flagExtCode, vars.Literal, withVar(vars.Ext, vars.Code, vars.Literal)},
+		{flagExtCodeFile, vars.File, withVar(vars.Ext, vars.Code, vars.File)},
+		{flagExtCodeEnv, vars.Env, withVar(vars.Ext, vars.Code, vars.Env)},
+		{flagTLAVar, vars.Literal, withVar(vars.TLA, vars.String, vars.Literal)},
+		{flagTLAVarFile, vars.File, withVar(vars.TLA, vars.String, vars.File)},
+		{flagTLAVarEnv, vars.Env, withVar(vars.TLA, vars.String, vars.Env)},
+		{flagTLACode, vars.Literal, withVar(vars.TLA, vars.Code, vars.Literal)},
+		{flagTLACodeFile, vars.File, withVar(vars.TLA, vars.Code, vars.File)},
+		{flagTLACodeEnv, vars.Env, withVar(vars.TLA, vars.Code, vars.Env)},
 	} {
 		entries, err := flags.GetStringArray(spec.flagName)
 		if err != nil {
@@ -257,12 +360,20 @@ func JsonnetVM(cmd *cobra.Command) (*jsonnet.VM, error) {
 		}
 		for _, entry := range entries {
 			kv := strings.SplitN(entry, "=", 2)
-			if spec.fromFile {
+			switch spec.source {
+			case vars.File:
 				if len(kv) != 2 {
 					return nil, fmt.Errorf("Failed to parse %s: missing '=' in %s", spec.flagName, entry)
 				}
 				spec.setter(kv[0], kv[1])
-			} else {
+			case vars.Env:
+				// The environment is read by kubecfg.JsonnetVM, which
+				// reports unset variables.
+				if len(kv) == 1 {
+					kv = append(kv, kv[0])
+				}
+				spec.setter(kv[0], kv[1])
+			default:
 				switch len(kv) {
 				case 1:
 					if v, present := os.LookupEnv(kv[0]); present {
@@ -280,6 +391,48 @@ func JsonnetVM(cmd *cobra.Command) (*jsonnet.VM, error) {
 	return kubecfg.JsonnetVM(opts...)
 }
 
+// resolverFromFlags returns the image resolver selected by the
+// --resolve-images, --resolve-images-error, --resolve-images-verify-key
+// and --registry-mirror flags.
+func resolverFromFlags() ([]kubecfg.JsonnetVMOpt, error) {
+	var typ kubecfg.ResolverType
+	switch name := viper.GetString(flagResolver); name {
+	case "noop":
+		typ = kubecfg.NoopResolver
+	case "registry":
+		typ = kubecfg.RegistryResolver
+	case "normalize":
+		typ = kubecfg.NormalizingResolver
+	default:
+		return nil, fmt.Errorf("bad value %q for --%s", name, flagResolver)
+	}
+
+	var action kubecfg.ResolverFailureAction
+	switch name := viper.GetString(flagResolvFail); name {
+	case "ignore":
+		action = kubecfg.IgnoreResolverError
+	case "warn":
+		action = kubecfg.WarnResolverError
+	case "error":
+		action = kubecfg.ReportResolverError
+	default:
+		return nil, fmt.Errorf("bad value %q for --%s", name, flagResolvFail)
+	}
+
+	opts := []kubecfg.JsonnetVMOpt{kubecfg.WithResolver(typ, action)}
+	if key := viper.GetString(flagResolvKey); key != "" {
+		opts = append(opts, kubecfg.WithResolverVerifyKey(key))
+	}
+	for _, m := range viper.GetStringSlice(flagRegMirror) {
+		from, to, found := strings.Cut(m, "=")
+		if !found || from == "" || to == "" {
+			return nil, fmt.Errorf("bad value %q for --%s, expected FROM=TO", m, flagRegMirror)
+		}
+		opts = append(opts, kubecfg.WithRegistryMirror(from, to))
+	}
+	return opts, nil
+}
+
 func readObjs(cmd *cobra.Command, paths []string, opts ...utils.ReadOption) ([]*unstructured.Unstructured, error) {
 	flags := cmd.Flags()
 
@@ -291,17 +444,116 @@ func readObjs(cmd *cobra.Command, paths []string, opts ...utils.ReadOption) ([]*
 		paths = append(paths, utils.ToDataURL(exec))
 	}
 
-	overlay, err := flags.GetString(flagOverlay)
+	overlays, err := flags.GetStringArray(flagOverlay)
 	if err != nil {
 		return nil, err
 	}
-	if overlay != "" {
+	if len(overlays) > 0 {
 		alpha := viper.GetBool(flagAlpha)
 		if !alpha {
 			return nil, fmt.Errorf("--%s is an alpha feature please use --%s", flagOverlay, flagAlpha)
 		}
-		opts = append(opts, utils.WithOverlayURL(overlay))
+		for _, overlay := range overlays {
+			opts = append(opts, utils.WithOverlayURL(overlay))
+		}
+	}
+
+	strategicOverlays, err := flags.GetStringArray(flagStrategic)
+	if err != nil {
+		return nil, err
+	}
+	if len(strategicOverlays) > 0 {
+		if !viper.GetBool(flagAlpha) {
+			return nil, fmt.Errorf("--%s is an alpha feature please use --%s", flagStrategic, flagAlpha)
+		}
+		for _, overlay := range strategicOverlays {
+			opts = append(opts, utils.WithStrategicOverlay(overlay))
+		}
+	}
+
+	jsonPatchOverlays, err := flags.GetStringArray(flagJSONPatch)
+	if err != nil {
+		return nil, err
+	}
+	if len(jsonPatchOverlays) > 0 {
+		if !viper.GetBool(flagAlpha) {
+			return nil, fmt.Errorf("--%s is an alpha feature please use --%s", flagJSONPatch, flagAlpha)
+		}
+		for _, overlay := range jsonPatchOverlays {
+			opts = append(opts, utils.WithJSONPatchOverlay(overlay))
+		}
+	}
+	patchStrict, err := flags.GetBool(flagPatchStrict)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, utils.WithStrictJSONPatchOverlay(patchStrict))
+
+	stdinFormat, err := flags.GetString(flagStdin)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, utils.WithStdinFormat(stdinFormat))
+
+	inputFormat, err := flags.GetString(flagInputFormat)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, utils.WithFormat(inputFormat))
+
+	recursive, err := flags.GetBool(flagRecursive)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := flags.GetStringArray(flagExclude)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, utils.WithRecursive(recursive), utils.WithExclude(exclude...))
+
+	dupPolicy, err := flags.GetString(flagDupPolicy)
+	if err != nil {
+		return nil, err
+	}
+	switch dupPolicy {
+	case "error":
+		opts = append(opts, utils.WithDuplicatePolicy(utils.ErrorOnDuplicate))
+	case "last-wins":
+		opts = append(opts, utils.WithDuplicatePolicy(utils.LastWins))
+	case "merge":
+		opts = append(opts, utils.WithDuplicatePolicy(utils.MergeDuplicate))
+	default:
+		return nil, fmt.Errorf("bad value %q for --%s", dupPolicy, flagDupPolicy)
+	}
+
+	jobs, err := flags.GetInt(flagJobs)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, utils.WithParallelism(jobs))
+
+	continueOnError, err := flags.GetBool(flagContinueErr)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, utils.WithContinueOnError(continueOnError))
+
+	pinImages, err := flags.GetBool(flagPinImages)
+	if err != nil {
+		return nil, err
+	}
+	if pinImages {
+		resolverOpts, err := resolverFromFlags()
+		if err != nil {
+			return nil, err
+		}
+		resolver, err := kubecfg.NewResolver(resolverOpts...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, utils.WithImagePinning(resolver, 0))
 	}
+
 	return readObjsInternal(cmd, paths, opts...)
 }
 
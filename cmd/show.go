@@ -17,6 +17,7 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/kubecfg/kubecfg/pkg/kubecfg"
 	"github.com/kubecfg/kubecfg/utils"
@@ -29,6 +30,7 @@ const (
 	flagExportFileNameFormat = "export-filename-format"
 	flagExportFileNameExt    = "export-filename-extension"
 	flagShowProvenance       = "show-provenance"
+	flagShowRaw              = "raw"
 )
 
 func init() {
@@ -39,6 +41,7 @@ func init() {
 	cmd.PersistentFlags().String(flagExportFileNameFormat, kubecfg.DefaultFileNameFormat, "Go template expression used to render path names for resources.")
 	cmd.PersistentFlags().String(flagExportFileNameExt, "", fmt.Sprintf("Override the file extension used when creating filenames when using %s", flagExportFileNameFormat))
 	cmd.PersistentFlags().Bool(flagShowProvenance, false, "Add provenance annotations showing the file and the field path to each rendered k8s object")
+	cmd.PersistentFlags().Bool(flagShowRaw, false, "Print the JSON each jsonnet input evaluates to, before k8s objects are extracted from it")
 
 	addCommonEvalFlags(cmd.PersistentFlags())
 }
@@ -50,6 +53,14 @@ var showCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		flags := cmd.Flags()
 
+		raw, err := flags.GetBool(flagShowRaw)
+		if err != nil {
+			return err
+		}
+		if raw {
+			return showRaw(cmd, args)
+		}
+
 		outputFormat, err := flags.GetString(flagFormat)
 		if err != nil {
 			return err
@@ -85,3 +96,30 @@ var showCmd = &cobra.Command{
 		return c.Run(objs, cmd.OutOrStdout())
 	},
 }
+
+// showRaw prints what each of paths, and the --exec code, evaluates to.
+func showRaw(cmd *cobra.Command, paths []string) error {
+	exec, err := cmd.Flags().GetString(flagExec)
+	if err != nil {
+		return err
+	}
+	if exec != "" {
+		paths = append(paths, utils.ToDataURL(exec))
+	}
+
+	vm, err := JsonnetVM(cmd)
+	if err != nil {
+		return err
+	}
+	out := cmd.OutOrStdout()
+	for _, p := range paths {
+		raw, err := utils.EvaluateRaw(vm, p)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(out, strings.TrimSpace(string(raw))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -84,6 +84,7 @@ func TestShow(t *testing.T) {
 {
   "apiVersion": "v0alpha1",
   "kind": "TestObject",
+  "metadata": {"name": "test"},
   "nil": null,
   "bool": true,
   "number": 42,
@@ -290,3 +291,22 @@ metadata:
 		t.Fatalf("got: %q, want: %q", got, want)
 	}
 }
+
+func TestShowRaw(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "raw.jsonnet")
+	if err := os.WriteFile(path, []byte(`{ values: [1, 2], name: std.extVar("name") }`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	output := cmdOutput(t, []string{"show", "--raw", path, "-V", "name=foo"})
+
+	var actual interface{}
+	if err := json.Unmarshal([]byte(output), &actual); err != nil {
+		t.Fatalf("expected a single JSON document, got %q: %v", output, err)
+	}
+	expected := map[string]interface{}{"values": []interface{}{1.0, 2.0}, "name": "foo"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got %v, want %v", actual, expected)
+	}
+}
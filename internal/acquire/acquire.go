@@ -15,14 +15,155 @@
 
 package acquire
 
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/google/go-jsonnet"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/discovery"
+)
+
 type ReadOptions struct {
 	ShowProvenance bool
-	ReadTwice      bool
-	Expr           string
-	OverlayURL     string
-	OverlayCode    string
+	// ProvenanceKeysSet is true when ProvenanceFileKey and
+	// ProvenancePathKey override the default annotation keys.
+	ProvenanceKeysSet bool
+	ProvenanceFileKey string
+	ProvenancePathKey string
+	// ProvenanceLineKeySet is true when ProvenanceLineKey overrides the
+	// default line annotation key.
+	ProvenanceLineKeySet bool
+	ProvenanceLineKey    string
+	// ProvenanceRootLabelSet is true when ProvenanceRootLabel overrides
+	// the "$" provenance paths start with.
+	ProvenanceRootLabelSet bool
+	ProvenanceRootLabel    string
+	// ProvenanceSidecar receives the provenance of the objects read by
+	// ReadObjects, as a JSON document, instead of annotations.
+	ProvenanceSidecar io.Writer
+	ReadTwice         bool
+	Expr              string
+	// Overlays are composed with each input file using jsonnet's +,
+	// in order, so later overlays win.
+	Overlays []Overlay
+	// StrategicOverlays are files of patches merged into the objects
+	// after evaluation.
+	StrategicOverlays []string
+	// JSONPatchOverlays are files of RFC 6902 patches applied after the
+	// strategic overlays. JSONPatchOverlayStrict makes patches that
+	// target no object an error.
+	JSONPatchOverlays      []string
+	JSONPatchOverlayStrict bool
+
+	SecretScan       bool
+	SecretScanStrict bool
+
+	// WarnOnEmpty logs a warning for each path that yields no objects;
+	// WarnOnEmptyStrict makes it an error.
+	WarnOnEmpty       bool
+	WarnOnEmptyStrict bool
+
+	// SchemaValidation, if set, provides the OpenAPI schema ReadObjects
+	// validates objects against.
+	SchemaValidation discovery.OpenAPISchemaInterface
+
+	SharedValuesFile string
+
+	ListMetadataInheritance bool
+	// ListOrigin marks the members of the Lists read with
+	// utils.AnnotationListOrigin.
+	ListOrigin bool
+
+	// StrictWalk rejects maps that have only one of kind and apiVersion
+	// instead of recursing into them.
+	StrictWalk bool
+	// StrictJSON rejects JSON input with duplicate keys in an object.
+	StrictJSON bool
+
+	// KindFilter and NamespaceFilter restrict the objects returned by
+	// ReadObjects; empty means no filtering.
+	KindFilter      []string
+	NamespaceFilter []string
+
+	DuplicatePolicy DuplicatePolicy
+
+	// DefaultNamespace is set on namespaced objects without a namespace.
+	// RESTMapper, if set, tells which kinds are namespaced.
+	DefaultNamespace string
+	RESTMapper       meta.RESTMapper
+
+	// CommonLabels are added to the labels of every object, without
+	// overriding existing ones.
+	CommonLabels map[string]string
+
+	// Transforms are run, in order, over every object read, after
+	// flattening and before duplicates are resolved.
+	Transforms []func(*unstructured.Unstructured) error
+
+	EvalMaxDuration time.Duration
+	EvalMaxImports  int
+
+	// Parallelism is the number of paths ReadObjects evaluates
+	// concurrently; 0 and 1 mean one at a time.
+	Parallelism int
+	// ContinueOnError makes ReadObjects read all the paths even when
+	// some fail, reporting their errors together.
+	ContinueOnError bool
+
+	StdinFormat string
+	// Format, if set, overrides the format implied by the extension of
+	// the paths read.
+	Format string
+	// RawString makes paths with an unknown extension be read as text,
+	// passed to the jsonnet function RawStringWrapper.
+	RawString        bool
+	RawStringWrapper string
+
+	Recursive bool
+	Exclude   []string
+
+	AllowEmptyGlob bool
+
+	PinImages func(context.Context, []*unstructured.Unstructured) error
+
+	// Context, if set, abandons evaluations when it is done. It is set
+	// by utils.ReadContext rather than by a ReadOption.
+	Context context.Context
+	// Importer is the importer of the VM read with, whose imports are
+	// aborted too when Context is done.
+	Importer jsonnet.Importer
+	// Entrypoint, if set, is the file the path read wraps, e.g. with
+	// overlays, whose directives apply instead of those of the path.
+	// It is set by kubecfg.ReadObjects rather than by a ReadOption.
+	Entrypoint string
+	// RequireNames rejects objects having neither metadata.name nor
+	// metadata.generateName. It is set by kubecfg.ReadObjects rather than
+	// by a ReadOption.
+	RequireNames bool
+}
+
+// Overlay is either the URL of a jsonnet file or a jsonnet expression.
+type Overlay struct {
+	URL  string
+	Code string
 }
 
+// DuplicatePolicy tells ReadObjects what to do with objects sharing the
+// same version/kind/namespace/name.
+type DuplicatePolicy int
+
+const (
+	// ErrorOnDuplicate fails the read.
+	ErrorOnDuplicate DuplicatePolicy = iota
+	// LastWins keeps the last definition.
+	LastWins
+	// MergeDuplicate merges each definition into the previous ones.
+	MergeDuplicate
+)
+
 type ReadOption func(*ReadOptions)
 
 func MakeReadOptions(opts []ReadOption) (opt ReadOptions) {
@@ -57,12 +57,98 @@
   // package (python-ish).
   regexSubst:: std.native("regexSubst"),
 
+  // regexFindAll(regex, string): Return all the non-overlapping matches
+  // of regex in string, as an array of strings.
+  regexFindAll:: std.native("regexFindAll"),
+
+  // regexReplace(regex, src, repl): Same as regexSubst.
+  regexReplace:: std.native("regexReplace"),
+
+  // jsonPath(obj, path, strict=false): Extract values from obj using
+  // a kubectl-style JSONPath expression (eg `{.spec.containers[*].name}`)
+  // or a simple dotted path (eg `spec.replicas`).  Returns the matched
+  // value, or an array if more than one value matched.  When nothing
+  // matches, returns null or raises an error if `strict` is true.
+  jsonPath(obj, path, strict=false):: (
+    local f = std.native("jsonPath");
+    f(obj, path, strict)
+  ),
+
+  // mergePatchDiff(original, modified): Return the RFC 7386 JSON merge
+  // patch that transforms original into modified.  Fields removed in
+  // modified are set to null in the patch.
+  mergePatchDiff:: std.native("mergePatchDiff"),
+
+  // mergePatch(target, patch): Return target with the RFC 7386 JSON
+  // merge patch `patch` applied: objects are merged recursively, null
+  // fields of `patch` delete those of `target`, and other values
+  // replace them.
+  mergePatch:: std.native("mergePatch"),
+
+  // mergeDeep(a, b): Return `a` with `b` merged into it: fields that
+  // are objects in both are merged recursively, other fields of `b`
+  // (including arrays and nulls) replace those of `a`.
+  mergeDeep:: std.native("mergeDeep"),
+
+  // base64Encode(data, binary=false): Return the base64 encoding of
+  // `data`, for use in the `data` field of a Secret (`stringData`
+  // takes plain strings).  `data` may be a string, encoded as UTF-8,
+  // or an array of numbers (bytes).  With `binary`, each character of
+  // a string is taken as one byte, as returned by base64Decode.
+  base64Encode(data, binary=false):: (
+    local f = std.native("base64Encode");
+    f(data, binary)
+  ),
+
+  // base64Decode(data, binary=false): Decode the base64 string `data`.
+  // The decoded content must be valid UTF-8, unless `binary` is set:
+  // then each byte is returned as one character (U+0000 to U+00FF)
+  // and non-UTF-8 content is preserved.
+  base64Decode(data, binary=false):: (
+    local f = std.native("base64Decode");
+    f(data, binary)
+  ),
+
+  // gzip(data, binary=false): Compress `data` (as for base64Encode)
+  // and return the compressed bytes base64 encoded, ready for the
+  // `data` field of a Secret or the `binaryData` of a ConfigMap.
+  gzip(data, binary=false):: (
+    local f = std.native("gzip");
+    f(data, binary)
+  ),
+
+  // gunzip(data, binary=false): Decompress the base64 encoded gzip
+  // stream `data`, returning the content as for base64Decode.
+  gunzip(data, binary=false):: (
+    local f = std.native("gunzip");
+    f(data, binary)
+  ),
+
+  // hashObject(obj): Return a short hash of the contents (`data`,
+  // `binaryData`, `stringData` and `type`) of the ConfigMap or Secret
+  // `obj`, independent of field order.  Appending it to the object
+  // name makes workloads referring to it roll out when it changes.
+  hashObject:: std.native("hashObject"),
+
+  // semverCompare(constraint, version): Return true if the semantic
+  // version `version` satisfies `constraint` (eg ">= 1.2, < 2",
+  // "~1.4" or "^2.0").
+  semverCompare:: std.native("semverCompare"),
+
+  // semverSort(versions): Return the array of version strings
+  // `versions` ordered from lowest to highest semantic version.
+  semverSort:: std.native("semverSort"),
+
   // parseHelmChart(chartData, releaseName, namespace, values): Expand
   // helm chart into jsonnet objects.  `chartData` should be valid
   // chart .tgz as an array of numbers (bytes).  `values` is a jsonnet
   // object that conforms to a schema defined by the chart.
   parseHelmChart:: std.native("parseHelmChart"),
 
+  // getEnv(name, default): Return the value of the environment
+  // variable `name`, or `default` when it is unset.  Requires --alpha.
+  getEnv:: std.native("getEnv"),
+
   // isK8sObject(o): Return true iff o is a Kubernetes object.
   isK8sObject(o):: (
     std.isObject(o) &&
@@ -2,13 +2,13 @@ package kubecfg
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"strings"
 
 	"github.com/google/go-jsonnet"
 	"github.com/kubecfg/kubecfg/utils"
 	"github.com/kubecfg/yaml/v2"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
 )
 
 // EvalCmd represents the eval subcommand
@@ -59,7 +59,7 @@ func (c EvalCmd) Run(ctx context.Context, vm *jsonnet.VM, path string, tla []str
 		fmt.Println(jsonstr)
 	case "yaml":
 		var jsontree interface{}
-		if err := json.Unmarshal([]byte(jsonstr), &jsontree); err != nil {
+		if err := utiljson.Unmarshal([]byte(jsonstr), &jsontree); err != nil {
 			return err
 		}
 		b, err := yaml.Marshal(jsontree)
@@ -0,0 +1,78 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package kubecfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/google/go-jsonnet"
+	"github.com/kubecfg/kubecfg/utils"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// InspectCmd represents the inspect subcommand
+type InspectCmd struct {
+	// OutputFormat is either "text" or "json".
+	OutputFormat string
+}
+
+// Run writes the distinct kinds of the objects read from paths to out,
+// sorted by group, version and kind.
+func (c InspectCmd) Run(vm *jsonnet.VM, paths []string, out io.Writer, opts ...utils.ReadOption) error {
+	seen := map[schema.GroupVersionKind]bool{}
+	var gvks []schema.GroupVersionKind
+	for _, p := range paths {
+		found, err := utils.ListGVKs(vm, p, opts...)
+		if err != nil {
+			return err
+		}
+		for _, gvk := range found {
+			if !seen[gvk] {
+				seen[gvk] = true
+				gvks = append(gvks, gvk)
+			}
+		}
+	}
+	utils.SortGVKs(gvks)
+
+	switch c.OutputFormat {
+	case "text", "":
+		for _, gvk := range gvks {
+			apiVersion, kind := gvk.ToAPIVersionAndKind()
+			if _, err := fmt.Fprintf(out, "%s %s\n", apiVersion, kind); err != nil {
+				return err
+			}
+		}
+	case "json":
+		type kindJSON struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+		}
+		kinds := []kindJSON{}
+		for _, gvk := range gvks {
+			apiVersion, kind := gvk.ToAPIVersionAndKind()
+			kinds = append(kinds, kindJSON{apiVersion, kind})
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(kinds)
+	default:
+		return fmt.Errorf("Unknown --format: %s", c.OutputFormat)
+	}
+	return nil
+}
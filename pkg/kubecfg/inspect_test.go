@@ -0,0 +1,54 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package kubecfg
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.jsonnet": `[{ apiVersion: "v1", kind: "Service", metadata: { name: "a" } }, { apiVersion: "apps/v1", kind: "Deployment", metadata: { name: "a" } }]`,
+		"b.yaml":    "apiVersion: v1\nkind: Service\nmetadata:\n  name: b\n",
+	})
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{filepath.Join(dir, "a.jsonnet"), filepath.Join(dir, "b.yaml")}
+
+	var out bytes.Buffer
+	if err := (InspectCmd{}).Run(vm, paths, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "v1 Service\napps/v1 Deployment\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	out.Reset()
+	if err := (InspectCmd{OutputFormat: "json"}).Run(vm, paths, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "[\n  {\n    \"apiVersion\": \"v1\",\n    \"kind\": \"Service\"\n  },\n  {\n    \"apiVersion\": \"apps/v1\",\n    \"kind\": \"Deployment\"\n  }\n]\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := (InspectCmd{OutputFormat: "xml"}).Run(vm, paths, &out); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
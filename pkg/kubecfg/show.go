@@ -34,6 +34,7 @@ import (
 	// and also in other circumstances. We thus forked the go-yaml repo in:
 	"github.com/kubecfg/yaml/v2"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
 )
 
 const (
@@ -197,7 +198,7 @@ func k8sToJSONObject(obj *unstructured.Unstructured) (map[string]interface{}, er
 		return nil, err
 	}
 	o := map[string]interface{}{}
-	if err := json.Unmarshal(buf, &o); err != nil {
+	if err := utiljson.Unmarshal(buf, &o); err != nil {
 		return nil, err
 	}
 	return o, nil
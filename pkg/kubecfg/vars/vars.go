@@ -22,6 +22,9 @@ import (
 	"github.com/google/go-jsonnet"
 )
 
+// Type tells whether a Var is an external variable, visible from every
+// file via std.extVar, or a top-level argument, passed only to the
+// function the entrypoint file evaluates to.
 type Type int
 
 const (
@@ -47,6 +50,8 @@ const (
 	Literal Source = iota
 	// --*-*-file
 	File
+	// --*-*-env; Value holds the name of the environment variable.
+	Env
 )
 
 type Var struct {
@@ -69,11 +74,15 @@ func (v *Var) Setter() func(*jsonnet.VM, string, string) {
 		{Ext, String, File, "", ""}:    (*jsonnet.VM).ExtCode,
 		{Ext, Code, Literal, "", ""}:   (*jsonnet.VM).ExtCode,
 		{Ext, Code, File, "", ""}:      (*jsonnet.VM).ExtCode,
+		{Ext, String, Env, "", ""}:     (*jsonnet.VM).ExtVar,
+		{Ext, Code, Env, "", ""}:       (*jsonnet.VM).ExtCode,
 
 		{TLA, String, Literal, "", ""}: (*jsonnet.VM).TLAVar,
 		{TLA, String, File, "", ""}:    (*jsonnet.VM).TLACode,
 		{TLA, Code, Literal, "", ""}:   (*jsonnet.VM).TLACode,
 		{TLA, Code, File, "", ""}:      (*jsonnet.VM).TLACode,
+		{TLA, String, Env, "", ""}:     (*jsonnet.VM).TLAVar,
+		{TLA, Code, Env, "", ""}:       (*jsonnet.VM).TLACode,
 	}
 	s, found := mapping[Var{v.Typ, v.Expr, v.Source, "", ""}]
 	if !found {
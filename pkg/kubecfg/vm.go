@@ -16,11 +16,20 @@
 package kubecfg
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/genuinetools/reg/registry"
 	"github.com/google/go-jsonnet"
@@ -29,6 +38,7 @@ import (
 	"github.com/kubecfg/kubecfg/utils"
 	log "github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
 )
 
 type jsonnetVMOpts struct {
@@ -36,10 +46,130 @@ type jsonnetVMOpts struct {
 	workingDir string
 	importPath []string
 	importURLs []string
+	searchPath []string
 	vars       []vars.Var
 
+	importerOpts []utils.ImporterOption
+
 	resolverType          ResolverType
 	resolverFailureAction ResolverFailureAction
+	resolverAuth          utils.RegistryAuth
+	resolverMaxAttempts   int
+	resolverRetryDelay    time.Duration
+	resolverVerifyKey     string
+	registryMirrors       []utils.RegistryMirror
+	httpTransport         http.RoundTripper
+
+	timeout  time.Duration
+	maxStack int
+}
+
+// vmState is what ReadObjects needs to know about a VM made by JsonnetVM
+// beyond the jsonnet.VM itself, to make more VMs like it, e.g. to evaluate
+// paths concurrently, and to bind a read's context and import recorder to
+// it. It is kept in vmStates rather than on the VM, so that JsonnetVM can
+// return a plain jsonnet.VM.
+type vmState struct {
+	maxStack int
+	alpha    bool
+	timeout  time.Duration
+	importer jsonnet.Importer
+	resolver utils.Resolver
+	// vars sets the vars given to JsonnetVM with WithVar.
+	vars []func(*jsonnet.VM)
+
+	// ctx is the context the resolveImage native function of the VM
+	// resolves images within; nil means context.Background().
+	mu  sync.Mutex
+	ctx context.Context
+}
+
+// vmStates holds the state of the VMs made by JsonnetVM, by address. The
+// address doesn't keep a VM alive, and a finalizer drops its state once
+// it is collected.
+var vmStates = struct {
+	sync.Mutex
+	m map[uintptr]*vmState
+}{m: map[uintptr]*vmState{}}
+
+func vmKey(vm *jsonnet.VM) uintptr {
+	return reflect.ValueOf(vm).Pointer()
+}
+
+func registerVMState(vm *jsonnet.VM, state *vmState) {
+	key := vmKey(vm)
+	vmStates.Lock()
+	vmStates.m[key] = state
+	vmStates.Unlock()
+	runtime.SetFinalizer(vm, func(*jsonnet.VM) {
+		vmStates.Lock()
+		delete(vmStates.m, key)
+		vmStates.Unlock()
+	})
+}
+
+// lookupVMState returns the state of vm, or nil if vm wasn't made by
+// JsonnetVM.
+func lookupVMState(vm *jsonnet.VM) *vmState {
+	vmStates.Lock()
+	defer vmStates.Unlock()
+	return vmStates.m[vmKey(vm)]
+}
+
+// newJsonnetVM makes a jsonnet.VM with the options and vars of state,
+// importing with importer and resolving images with resolver.
+func (state *vmState) newJsonnetVM(importer jsonnet.Importer, resolver utils.Resolver) *jsonnet.VM {
+	vm := jsonnet.MakeVM()
+	if state.maxStack > 0 {
+		vm.MaxStack = state.maxStack
+	}
+	vm.Importer(importer)
+	utils.RegisterNativeFuncs(vm, resolver, utils.WithAlphaNativeFuncs(state.alpha))
+	for _, set := range state.vars {
+		set(vm)
+	}
+	return vm
+}
+
+// fork makes a jsonnet.VM like the one of state for a read: its importer
+// shares the caches and lock file of the VM's and records the imports in
+// recorder, and both its imports and its image resolutions give up once
+// ctx is done. Vars set on the VM after JsonnetVM returned aren't set on
+// it.
+func (state *vmState) fork(ctx context.Context, recorder *utils.ImportRecorder) *jsonnet.VM {
+	importer := utils.DeriveImporter(state.importer, utils.WithImportRecorder(recorder), utils.WithImportContext(ctx))
+	return state.newJsonnetVM(importer, utils.ResolverWithContext(ctx, state.resolver))
+}
+
+// bind makes vm, the VM of state, record its imports in recorder and give
+// up its imports and image resolutions once ctx is done, until restore is
+// called. Setting the importer drops the VM's own import cache, so files
+// imported by earlier reads are imported, and recorded, again; the
+// importer's caches still spare fetching them again.
+func (state *vmState) bind(ctx context.Context, vm *jsonnet.VM, recorder *utils.ImportRecorder) (restore func()) {
+	vm.Importer(utils.DeriveImporter(state.importer, utils.WithImportRecorder(recorder), utils.WithImportContext(ctx)))
+	state.mu.Lock()
+	prev := state.ctx
+	state.ctx = ctx
+	state.mu.Unlock()
+	return func() {
+		vm.Importer(state.importer)
+		state.mu.Lock()
+		state.ctx = prev
+		state.mu.Unlock()
+	}
+}
+
+// Resolve resolves image with the resolver of state, within the context
+// bound to the VM, for the resolveImage native function of the VM.
+func (state *vmState) Resolve(image *utils.ImageName) error {
+	state.mu.Lock()
+	ctx := state.ctx
+	state.mu.Unlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return utils.ResolveContext(ctx, state.resolver, image)
 }
 
 type JsonnetVMOpt func(*jsonnetVMOpts)
@@ -68,6 +198,105 @@ func WithImportURLs(importURLs ...string) JsonnetVMOpt {
 	}
 }
 
+// WithVirtualImport makes `import name` resolve to content, ahead of any
+// file (see utils.WithVirtualImport).
+func WithVirtualImport(name string, content []byte) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.importerOpts = append(opts.importerOpts, utils.WithVirtualImport(name, content))
+	}
+}
+
+// WithImportMaxConcurrency caps the number of remote imports fetched at
+// once by all the VMs made with this option (see
+// utils.WithImportMaxConcurrency).
+func WithImportMaxConcurrency(n int) JsonnetVMOpt {
+	o := utils.WithImportMaxConcurrency(n)
+	return func(opts *jsonnetVMOpts) {
+		opts.importerOpts = append(opts.importerOpts, o)
+	}
+}
+
+// WithImportProgress reports the remote imports fetched by all the VMs
+// made with this option to progress (see utils.WithImportProgress).
+func WithImportProgress(progress func(url string, done, total int)) JsonnetVMOpt {
+	o := utils.WithImportProgress(progress)
+	return func(opts *jsonnetVMOpts) {
+		opts.importerOpts = append(opts.importerOpts, o)
+	}
+}
+
+// WithHTTPTransport sends the requests made by both the importer and the
+// RegistryResolver through transport, e.g. one configured with a proxy,
+// custom CA certificates or a client certificate. By default they use
+// transports equivalent to http.DefaultTransport.
+func WithHTTPTransport(transport http.RoundTripper) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.httpTransport = transport
+	}
+}
+
+// WithSearchPath sets an ordered library search path mixing local
+// directories and URLs, which are told apart by the presence of a
+// "scheme://" prefix. The entries are searched in exactly the order given,
+// ahead of those set with WithImportPath and WithImportURLs. Listing
+// "internal:///" places the libraries embedded in kubecfg at that point
+// of the search path, e.g. after a vendored override of them; otherwise
+// they are searched last. See JsonnetVM for the full resolution order.
+func WithSearchPath(entries ...string) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.searchPath = entries
+	}
+}
+
+// WithImportFallbackDir makes remote imports that cannot be fetched fall
+// back to a local mirror in dir (see utils.WithImportFallbackDir).
+func WithImportFallbackDir(dir string) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.importerOpts = append(opts.importerOpts, utils.WithImportFallbackDir(dir))
+	}
+}
+
+// WithOCILayerCache caches the layers of oci:// imports in dir (see
+// utils.WithOCILayerCache).
+func WithOCILayerCache(dir string) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.importerOpts = append(opts.importerOpts, utils.WithOCILayerCache(dir))
+	}
+}
+
+// WithGitCacheDir sets where git imports are checked out (see
+// utils.WithGitCacheDir).
+func WithGitCacheDir(dir string) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.importerOpts = append(opts.importerOpts, utils.WithGitCacheDir(dir))
+	}
+}
+
+// WithImportCache caches remote imports in dir (see
+// utils.WithImportCache).
+func WithImportCache(dir string) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.importerOpts = append(opts.importerOpts, utils.WithImportCache(dir))
+	}
+}
+
+// WithOffline serves remote imports only from the import cache (see
+// utils.WithOffline).
+func WithOffline(offline bool) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.importerOpts = append(opts.importerOpts, utils.WithOffline(offline))
+	}
+}
+
+// WithImportLock verifies remote imports against the digests in the lock
+// file at path, or records them there when update is set (see
+// utils.WithImportLock).
+func WithImportLock(path string, update bool) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.importerOpts = append(opts.importerOpts, utils.WithImportLock(path, update))
+	}
+}
+
 func WithVar(v vars.Var) JsonnetVMOpt {
 	return func(opts *jsonnetVMOpts) {
 		opts.vars = append(opts.vars, v)
@@ -79,6 +308,9 @@ type ResolverType int
 const (
 	NoopResolver ResolverType = iota
 	RegistryResolver
+	// NormalizingResolver qualifies image names fully, without network
+	// access; see utils.NewNormalizingResolver.
+	NormalizingResolver
 )
 
 type ResolverFailureAction int
@@ -96,38 +328,88 @@ func WithResolver(typ ResolverType, failureMode ResolverFailureAction) JsonnetVM
 	}
 }
 
+// WithResolverAuth sets the credentials used by the RegistryResolver.
+func WithResolverAuth(auth utils.RegistryAuth) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.resolverAuth = auth
+	}
+}
+
+// WithResolverVerifyKey makes the RegistryResolver only pin images having
+// a cosign signature made with the public key in the PEM file keyRef (see
+// utils.NewVerifyingResolver). Images failing verification are handled
+// according to the ResolverFailureAction.
+func WithResolverVerifyKey(keyRef string) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.resolverVerifyKey = keyRef
+	}
+}
+
+// WithRegistryMirror makes the image resolver rewrite the images under
+// from, a registry host optionally followed by a repository path, to be
+// under to before resolving them, so the rewritten names are the ones
+// pinned. May be repeated; the first matching mirror applies (see
+// utils.NewMirroringResolver).
+func WithRegistryMirror(from, to string) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.registryMirrors = append(opts.registryMirrors, utils.RegistryMirror{From: from, To: to})
+	}
+}
+
+// WithResolverRetry makes the RegistryResolver retry transient failures
+// (network errors, 429 and 5xx responses) up to maxAttempts attempts in
+// total, with exponential backoff starting at baseDelay.
+func WithResolverRetry(maxAttempts int, baseDelay time.Duration) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.resolverMaxAttempts = maxAttempts
+		opts.resolverRetryDelay = baseDelay
+	}
+}
+
+// WithTimeout bounds the time ReadObjects spends evaluating each file
+// with the VM, like utils.WithEvalBudget, whose duration wins if shorter;
+// evaluations taking longer fail with a *utils.BudgetExceededError. It is
+// only honoured by ReadObjects and its variants: evaluating with the VM
+// directly isn't bounded.
+//
+// A timeout doesn't stop an evaluation, it abandons it: ReadObjects
+// returns, but the evaluation keeps running in the background, using CPU,
+// until it completes. Only its pending imports are aborted. Since it still
+// uses the VM, the VM must not be reused once a read was abandoned.
+func WithTimeout(d time.Duration) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.timeout = d
+	}
+}
+
+// WithMaxStack sets the maximum number of stack frames of the VM. When
+// unset, the go-jsonnet default of 500 applies.
+func WithMaxStack(n int) JsonnetVMOpt {
+	return func(opts *jsonnetVMOpts) {
+		opts.maxStack = n
+	}
+}
+
 // JsonnetVM constructs a new jsonnet.VM, according to command line
-// flags
+// flags.
+//
+// An import is first resolved relative to the importing file. Failing
+// that, it is looked up in the library search path, which is, in order:
+// the entries given to WithSearchPath, the directories given to
+// WithImportPath, those listed in the JSONNET_PATH environment variable,
+// the URLs given to WithImportURLs and finally the
+// libraries embedded in kubecfg ("internal:///"), unless WithSearchPath
+// placed those elsewhere. The first entry having the file wins.
 func JsonnetVM(opt ...JsonnetVMOpt) (*jsonnet.VM, error) {
-	vm := jsonnet.MakeVM()
-
 	var opts jsonnetVMOpts
 	for _, o := range opt {
 		o(&opts)
 	}
+	state := &vmState{maxStack: opts.maxStack, alpha: opts.alpha, timeout: opts.timeout}
 
-	var searchUrls []*url.URL
-	for _, p := range opts.importPath {
-		p, err := filepath.Abs(p)
-		if err != nil {
-			return nil, err
-		}
-		searchUrls = append(searchUrls, dirURL(p))
-	}
-
-	sURLs := opts.importURLs
-	// Special URL scheme used to find embedded content
-	sURLs = append(sURLs, "internal:///")
-
-	for _, ustr := range sURLs {
-		u, err := url.Parse(ustr)
-		if err != nil {
-			return nil, err
-		}
-		if u.Path[len(u.Path)-1] != '/' {
-			u.Path = u.Path + "/"
-		}
-		searchUrls = append(searchUrls, u)
+	searchUrls, err := searchURLs(&opts)
+	if err != nil {
+		return nil, err
 	}
 
 	for _, u := range searchUrls {
@@ -135,7 +417,6 @@ func JsonnetVM(opt ...JsonnetVMOpt) (*jsonnet.VM, error) {
 	}
 
 	if opts.workingDir == "" {
-		var err error
 		opts.workingDir, err = os.Getwd()
 		if err != nil {
 			return nil, fmt.Errorf("unable to determine current working directory: %w", err)
@@ -146,10 +427,20 @@ func JsonnetVM(opt ...JsonnetVMOpt) (*jsonnet.VM, error) {
 	for _, v := range opts.vars {
 		name, value := v.Name, v.Value
 
+		if v.Source == vars.Env {
+			var found bool
+			value, found = os.LookupEnv(v.Value)
+			if !found {
+				return nil, fmt.Errorf("environment variable %s for %s is not set", v.Value, name)
+			}
+		}
+
 		if v.Source == vars.File {
 			// Ensure that the import path we construct here is absolute, so that our Importer
 			// won't try to glean from an extVar or TLA reference the context necessary to
-			// resolve a relative path.
+			// resolve a relative path. Being imported by URL, the file's
+			// own imports then resolve relative to its directory, like
+			// those of any imported file.
 			path := value
 			if !filepath.IsAbs(path) {
 				path = filepath.Join(cwd, path)
@@ -157,6 +448,8 @@ func JsonnetVM(opt ...JsonnetVMOpt) (*jsonnet.VM, error) {
 			u := &url.URL{Scheme: "file", Path: path}
 			var imp string
 			if v.Expr == vars.Code {
+				// JSON is valid jsonnet, so data files such as
+				// values.json import as objects too.
 				imp = "import"
 			} else {
 				imp = "importstr"
@@ -165,22 +458,111 @@ func JsonnetVM(opt ...JsonnetVMOpt) (*jsonnet.VM, error) {
 			value = fmt.Sprintf("%s @'%s'", imp, strings.ReplaceAll(u.String(), "'", "''"))
 		}
 
-		v.Setter()(vm, name, value)
+		setter := v.Setter()
+		state.vars = append(state.vars, func(vm *jsonnet.VM) { setter(vm, name, value) })
 	}
 
-	vm.Importer(utils.MakeUniversalImporter(searchUrls, opts.alpha))
-
-	resolver, err := buildResolver(&opts)
+	state.importer = utils.MakeUniversalImporter(searchUrls, opts.alpha, append(opts.importerOpts, utils.WithImportTransport(opts.httpTransport))...)
+	state.resolver, err = buildResolver(&opts)
 	if err != nil {
 		return nil, err
 	}
-	utils.RegisterNativeFuncs(vm, resolver)
-
+	vm := state.newJsonnetVM(state.importer, state)
+	registerVMState(vm, state)
 	return vm, nil
 }
 
+// searchURLs returns the library search path described by opts, in the
+// order documented on JsonnetVM.
+func searchURLs(opts *jsonnetVMOpts) ([]*url.URL, error) {
+	// Entries are normalized and only the first occurrence of each is
+	// kept, since searching the same location again cannot find anything.
+	var searchUrls []*url.URL
+	seen := map[string]bool{}
+	add := func(u *url.URL) {
+		if s := u.String(); !seen[s] {
+			seen[s] = true
+			searchUrls = append(searchUrls, u)
+		}
+	}
+	addDir := func(p string) error {
+		p, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		add(dirURL(p))
+		return nil
+	}
+	addURL := func(ustr string) error {
+		u, err := url.Parse(ustr)
+		if err != nil {
+			return err
+		}
+		if u.Scheme == "file" && u.Path != "" {
+			u.Path = path.Clean(u.Path)
+		}
+		if u.Path == "" || u.Path[len(u.Path)-1] != '/' {
+			u.Path = u.Path + "/"
+		}
+		add(u)
+		return nil
+	}
+
+	// Special URL scheme used to find embedded content
+	const internalURL = "internal:///"
+	hasInternal := false
+	for _, e := range opts.searchPath {
+		var err error
+		if strings.Contains(e, "://") {
+			hasInternal = hasInternal || strings.HasPrefix(e, "internal:")
+			err = addURL(e)
+		} else {
+			err = addDir(e)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range opts.importPath {
+		if err := addDir(p); err != nil {
+			return nil, err
+		}
+	}
+	// Like the jsonnet CLI, JSONNET_PATH comes after explicit paths.
+	for _, p := range filepath.SplitList(os.Getenv("JSONNET_PATH")) {
+		if p == "" {
+			continue
+		}
+		if err := addDir(p); err != nil {
+			return nil, err
+		}
+	}
+	sURLs := opts.importURLs
+	if !hasInternal {
+		sURLs = append(sURLs[:len(sURLs):len(sURLs)], internalURL)
+	}
+	for _, ustr := range sURLs {
+		if err := addURL(ustr); err != nil {
+			return nil, err
+		}
+	}
+
+	return searchUrls, nil
+}
+
+// NewResolver builds the image resolver configured by WithResolver,
+// honouring its ResolverFailureAction. It is the resolver used by the
+// resolveImage native function. The resolver is a utils.ContextResolver.
+func NewResolver(opt ...JsonnetVMOpt) (utils.Resolver, error) {
+	var opts jsonnetVMOpts
+	for _, o := range opt {
+		o(&opts)
+	}
+	return buildResolver(&opts)
+}
+
 func buildResolver(opts *jsonnetVMOpts) (utils.Resolver, error) {
-	ret := resolverErrorWrapper{}
+	var ret resolverErrorWrapper
 
 	switch action := opts.resolverFailureAction; action {
 	case IgnoreResolverError:
@@ -199,12 +581,34 @@ func buildResolver(opts *jsonnetVMOpts) (utils.Resolver, error) {
 	switch resolver := opts.resolverType; resolver {
 	case NoopResolver:
 		ret.Inner = utils.NewIdentityResolver()
+	case NormalizingResolver:
+		ret.Inner = utils.NewNormalizingResolver()
 	case RegistryResolver:
-		ret.Inner = utils.NewRegistryResolver(registry.Opt{})
+		inner := utils.NewRegistryResolverWithTransport(registry.Opt{}, opts.resolverAuth, opts.httpTransport)
+		if opts.resolverMaxAttempts > 1 {
+			inner = utils.NewRetryingResolver(inner, opts.resolverMaxAttempts, opts.resolverRetryDelay)
+		}
+		if opts.resolverVerifyKey != "" {
+			var err error
+			inner, err = utils.NewVerifyingResolverWithTransport(inner, opts.resolverVerifyKey, registry.Opt{}, opts.resolverAuth, opts.httpTransport)
+			if err != nil {
+				return nil, err
+			}
+		}
+		ret.Inner = utils.NewCachingResolver(inner)
 	default:
 		return nil, fmt.Errorf("bad value %d for resolver tyoe", resolver)
 	}
+	if opts.resolverVerifyKey != "" && opts.resolverType != RegistryResolver {
+		return nil, fmt.Errorf("image signature verification requires the registry resolver")
+	}
+	if len(opts.registryMirrors) > 0 {
+		ret.Inner = utils.NewMirroringResolver(ret.Inner, opts.registryMirrors)
+	}
 
+	if _, ok := ret.Inner.(utils.BatchResolver); ok {
+		return batchResolverErrorWrapper{&ret}, nil
+	}
 	return &ret, nil
 }
 
@@ -214,13 +618,47 @@ type resolverErrorWrapper struct {
 }
 
 func (r *resolverErrorWrapper) Resolve(image *utils.ImageName) error {
-	err := r.Inner.Resolve(image)
+	return r.ResolveContext(context.Background(), image)
+}
+
+func (r *resolverErrorWrapper) ResolveContext(ctx context.Context, image *utils.ImageName) error {
+	err := utils.ResolveContext(ctx, r.Inner, image)
 	if err != nil {
 		err = r.OnErr(err)
 	}
 	return err
 }
 
+// batchResolverErrorWrapper is a resolverErrorWrapper of a
+// utils.BatchResolver.
+type batchResolverErrorWrapper struct {
+	*resolverErrorWrapper
+}
+
+func (r batchResolverErrorWrapper) ResolveAll(ctx context.Context, images []*utils.ImageName) []error {
+	errs := utils.ResolveAll(ctx, r.Inner, images)
+	for i, err := range errs {
+		if err != nil {
+			errs[i] = r.OnErr(err)
+		}
+	}
+	return errs
+}
+
+// explainImportCycle names the cycle of imports reachable from path, if
+// any, in err when evaluating path ran out of stack frames, which is how
+// files needing each other's value fail.
+func explainImportCycle(recorder *utils.ImportRecorder, path string, err error) error {
+	var rerr *utils.ReadError
+	if !errors.As(err, &rerr) || rerr.Category != utils.ReadErrorEval || !strings.Contains(err.Error(), "max stack frames exceeded") {
+		return err
+	}
+	if cycle := recorder.Cycle(path); cycle != nil {
+		rerr.Err = fmt.Errorf("import cycle detected: %s: %w", strings.Join(cycle, " -> "), rerr.Err)
+	}
+	return err
+}
+
 // NB: `path` is assumed to be in native-OS path separator form
 func dirURL(path string) *url.URL {
 	path = filepath.ToSlash(path)
@@ -232,38 +670,363 @@ func dirURL(path string) *url.URL {
 }
 
 // ReadObjects evaluates all jsonnet files in paths and return all the k8s objects found in it.
-// Unlike utils.Read this checks for duplicates and flattens the v1 Lists.
+// Unlike utils.Read this checks for duplicates, flattens the v1 Lists and
+// rejects objects without metadata.name or metadata.generateName, with a
+// utils.ReadErrorInvalidObject error.
+// Failures to read one of paths are returned as *utils.ReadError.
+//
+// During a read, the VM caches the value of each imported file, so a
+// library imported by several paths is parsed and evaluated once. Setting
+// ext vars flushes that cache; TLAs only reach the entrypoints, which
+// aren't cached. The importer of the VM keeps the contents of the files
+// across reads.
+//
+// The paths are evaluated on vm, and with utils.WithSharedValues its
+// utils.SharedValuesExtVar ext var is set. With utils.WithParallelism and a
+// vm made by JsonnetVM, paths are instead evaluated concurrently on VMs made
+// with the same JsonnetVMOpts, including their WithVar vars, and importers
+// sharing its import caches and lock file; vars set on vm after JsonnetVM
+// returned are not carried over. Either way the objects are returned in
+// path order.
 func ReadObjects(vm *jsonnet.VM, paths []string, opts ...utils.ReadOption) ([]*unstructured.Unstructured, error) {
+	return ReadObjectsContext(context.Background(), vm, paths, opts...)
+}
+
+// ReadObjectsContext is like ReadObjects, giving up when ctx is done: the
+// evaluations are abandoned (see utils.ReadContext), and their pending
+// imports and image resolutions, as well as those of
+// utils.WithImagePinning, are aborted. As with WithTimeout, vm must not be
+// reused then.
+func ReadObjectsContext(ctx context.Context, vm *jsonnet.VM, paths []string, opts ...utils.ReadOption) ([]*unstructured.Unstructured, error) {
+	return readObjects(ctx, vm, utils.NewImportRecorder(), paths, opts...)
+}
+
+// readObjects implements ReadObjectsContext, recording the imports of the
+// read in recorder when vm was made by JsonnetVM.
+func readObjects(ctx context.Context, vm *jsonnet.VM, recorder *utils.ImportRecorder, paths []string, opts ...utils.ReadOption) ([]*unstructured.Unstructured, error) {
+	// Evaluations abandoned by the read keep running: cancelling ctx once
+	// it returns aborts their imports and image resolutions.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	state := lookupVMState(vm)
+	if state == nil {
+		return readPaths(ctx, vm, nil, recorder, paths, opts...)
+	}
+
+	restore := state.bind(ctx, vm, recorder)
+	res, err := readPaths(ctx, vm, state, recorder, paths, opts...)
+	// An abandoned evaluation may still be using vm, so it's left bound
+	// to ctx rather than restored under it.
+	var budgetErr *utils.BudgetExceededError
+	if ctx.Err() == nil && !errors.As(err, &budgetErr) {
+		restore()
+	}
+	return res, err
+}
+
+// readPaths reads paths for readObjects, with vm bound to ctx and
+// recorder when state, the state of vm, isn't nil.
+func readPaths(ctx context.Context, vm *jsonnet.VM, state *vmState, recorder *utils.ImportRecorder, paths []string, opts ...utils.ReadOption) ([]*unstructured.Unstructured, error) {
+	opts = append(opts[:len(opts):len(opts)], func(o *acquire.ReadOptions) {
+		o.RequireNames = true
+	})
 	opt := acquire.MakeReadOptions(opts)
+	if state != nil {
+		if t := state.timeout; t > 0 && (opt.EvalMaxDuration <= 0 || t < opt.EvalMaxDuration) {
+			opt.EvalMaxDuration = t
+			opts = append(opts[:len(opts):len(opts)], func(o *acquire.ReadOptions) {
+				o.EvalMaxDuration = t
+			})
+		}
+	}
+
+	paths, err := utils.ExpandPaths(paths, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// entrypoints maps the paths wrapped with overlays to the files they
+	// wrap, whose directives apply to the objects read.
+	var entrypoints map[string]string
+	if len(opt.Overlays) > 0 {
+		for _, p := range paths {
+			if p == utils.StdinPath {
+				return nil, fmt.Errorf("overlays cannot be applied to standard input")
+			}
+		}
 
-	if overlay := opt.OverlayURL; overlay != "" {
-		overlayExpression := func(url string) string {
-			return utils.ToDataURL(fmt.Sprintf(`(import %q) + (import %q)`, url, overlay))
+		var overlays []string
+		for _, o := range opt.Overlays {
+			if o.URL != "" {
+				overlays = append(overlays, fmt.Sprintf("(import %q)", o.URL))
+			} else {
+				overlays = append(overlays, fmt.Sprintf("(%s)", o.Code))
+			}
 		}
+		entrypoints = map[string]string{}
 		for i := range paths {
-			paths[i] = overlayExpression(paths[i])
+			expr := append([]string{fmt.Sprintf("(import %q)", paths[i])}, overlays...)
+			wrapped := utils.ToDataURL(strings.Join(expr, " + "))
+			entrypoints[wrapped] = paths[i]
+			paths[i] = wrapped
 		}
 	}
-	if overlay := opt.OverlayCode; overlay != "" {
-		overlayExpression := func(src string) string {
-			return utils.ToDataURL(fmt.Sprintf(`(import %q) + (%s)`, src, overlay))
+
+	var sharedValues string
+	if opt.SharedValuesFile != "" {
+		// Evaluated like the paths, within the budget and ctx of the read.
+		raw, err := utils.EvaluateRaw(vm, opt.SharedValuesFile, append(opts[:len(opts):len(opts)], func(o *acquire.ReadOptions) {
+			o.Context = ctx
+		})...)
+		if err != nil {
+			return nil, fmt.Errorf("error reading shared values: %w", err)
 		}
-		for i := range paths {
-			paths[i] = overlayExpression(paths[i])
+		sharedValues = string(raw)
+		vm.ExtCode(utils.SharedValuesExtVar, sharedValues)
+	}
+
+	// Provenance annotations only added for the sidecar or validation
+	// errors are set aside until then, so transforms, duplicate checks and
+	// overlays only see the objects as written.
+	provenance := &utils.ProvenanceStash{}
+	transforms := utils.ReadTransforms(opts...)
+	readPath := func(vm *jsonnet.VM, path string) ([]*unstructured.Unstructured, error) {
+		pathOpts := opts
+		if entrypoint, ok := entrypoints[path]; ok {
+			pathOpts = append(opts[:len(opts):len(opts)], func(o *acquire.ReadOptions) {
+				o.Entrypoint = entrypoint
+			})
+		}
+		var flat []*unstructured.Unstructured
+		err := utils.ReadStreamContext(ctx, vm, path, func(obj k8sruntime.Object) error {
+			objs, err := utils.FlattenToV1([]k8sruntime.Object{obj})
+			flat = append(flat, objs...)
+			return err
+		}, pathOpts...)
+		if err != nil {
+			return nil, explainImportCycle(recorder, path, err)
+		}
+		if len(flat) == 0 {
+			if opt.WarnOnEmptyStrict {
+				return nil, fmt.Errorf("%s yields no objects", path)
+			} else if opt.WarnOnEmpty {
+				log.Warnf("%s yields no objects", path)
+			}
+		}
+		provenance.Strip(flat, opts...)
+		if err := utils.ApplyTransforms(flat, transforms); err != nil {
+			return nil, err
+		}
+		return filterObjects(flat, opt), nil
+	}
+
+	var perPath [][]*unstructured.Unstructured
+	var errs []error
+	if state != nil && opt.Parallelism > 1 && len(paths) > 1 {
+		perPath, errs = readConcurrently(ctx, state, recorder, paths, opt.Parallelism, sharedValues, opt.SharedValuesFile != "", readPath)
+	} else {
+		perPath = make([][]*unstructured.Unstructured, len(paths))
+		errs = make([]error, len(paths))
+		for i, path := range paths {
+			if ctx.Err() != nil {
+				break
+			}
+			if perPath[i], errs[i] = readPath(vm, path); errs[i] != nil && !opt.ContinueOnError {
+				break
+			}
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var pathErrs []error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if !opt.ContinueOnError {
+			return nil, err
+		}
+		pathErrs = append(pathErrs, err)
+	}
 
+	// Merging in path order keeps the result, and which of several
+	// duplicates wins, independent of the order evaluations finish in.
 	res := []*unstructured.Unstructured{}
-	for _, path := range paths {
-		objs, err := utils.Read(vm, path, opts...)
+	for _, objs := range perPath {
+		res = append(res, objs...)
+	}
+	res, err = finishObjects(ctx, vm, res, provenance, opt, opts)
+	if len(pathErrs) > 0 {
 		if err != nil {
-			return nil, fmt.Errorf("error reading %s: %v", path, err)
+			return nil, &utils.ReadErrors{Errors: append(pathErrs, err)}
 		}
+		return res, &utils.ReadErrors{Errors: pathErrs}
+	}
+	return res, err
+}
 
-		res = append(res, utils.FlattenToV1(objs)...)
+// finishObjects applies to the objects read by ReadObjects the steps
+// taking all of them into account: duplicate resolution, overlays, image
+// pinning, validation and provenance sidecar.
+func finishObjects(ctx context.Context, vm *jsonnet.VM, res []*unstructured.Unstructured, provenance *utils.ProvenanceStash, opt acquire.ReadOptions, opts []utils.ReadOption) ([]*unstructured.Unstructured, error) {
+	res, err := utils.ResolveDuplicates(res, opt.DuplicatePolicy)
+	if err != nil {
+		return nil, err
+	}
+	for _, overlay := range opt.StrategicOverlays {
+		objs, err := utils.ReadContext(ctx, vm, overlay)
+		if err != nil {
+			return nil, fmt.Errorf("strategic overlay: %w", err)
+		}
+		patches, err := utils.FlattenToV1(objs)
+		if err != nil {
+			return nil, fmt.Errorf("error reading strategic overlay %s: %w", overlay, err)
+		}
+		if err := utils.ApplyStrategicPatches(res, patches); err != nil {
+			return nil, fmt.Errorf("error applying strategic overlay %s: %w", overlay, err)
+		}
 	}
-	if err := utils.CheckDuplicates(res); err != nil {
+	for _, overlay := range opt.JSONPatchOverlays {
+		patches, err := utils.LoadJSONPatchOverlays(overlay)
+		if err != nil {
+			return nil, fmt.Errorf("error reading JSON patch overlay: %w", err)
+		}
+		if err := utils.ApplyJSONPatchOverlays(res, patches, opt.JSONPatchOverlayStrict); err != nil {
+			return nil, fmt.Errorf("error applying JSON patch overlay %s: %w", overlay, err)
+		}
+	}
+	if opt.PinImages != nil {
+		if err := opt.PinImages(ctx, res); err != nil {
+			return nil, err
+		}
+	}
+	provenance.Restore(res)
+	if err := utils.ValidateSchemas(res, opts...); err != nil {
 		return nil, err
 	}
+	if opt.SecretScan {
+		if err := checkSecrets(res, opt.SecretScanStrict); err != nil {
+			return nil, err
+		}
+	}
+	if err := utils.FinishProvenance(res, opts...); err != nil {
+		return nil, fmt.Errorf("error writing provenance sidecar: %w", err)
+	}
 	return res, nil
 }
+
+// ReadObjectsWithDeps is like ReadObjects, and also returns every file and
+// URL the evaluation read: entrypoints, imports, ext vars read from files
+// and overlays. Local files are returned as paths. The list is sorted and
+// has no duplicates.
+func ReadObjectsWithDeps(vm *jsonnet.VM, paths []string, opts ...utils.ReadOption) ([]*unstructured.Unstructured, []string, error) {
+	// With utils.WithContinueOnError, the objects read are returned along
+	// with the errors, and so are the dependencies.
+	recorder := utils.NewImportRecorder()
+	res, err := readObjects(context.Background(), vm, recorder, paths, opts...)
+	var readErrs *utils.ReadErrors
+	if err != nil && (!errors.As(err, &readErrs) || res == nil) {
+		return nil, nil, err
+	}
+
+	deps := recorder.Imports()
+	opt := acquire.MakeReadOptions(opts)
+	for _, p := range opt.JSONPatchOverlays {
+		// JSON patch overlays are read directly, not imported.
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i := sort.SearchStrings(deps, abs); i == len(deps) || deps[i] != abs {
+			deps = append(deps, abs)
+			sort.Strings(deps)
+		}
+	}
+	return res, deps, err
+}
+
+// filterObjects keeps the objects matching the kind and namespace filters
+// of opt.
+func filterObjects(objs []*unstructured.Unstructured, opt acquire.ReadOptions) []*unstructured.Unstructured {
+	if len(opt.KindFilter) == 0 && len(opt.NamespaceFilter) == 0 {
+		return objs
+	}
+	matches := func(filter []string, value string, eq func(a, b string) bool) bool {
+		if len(filter) == 0 {
+			return true
+		}
+		for _, f := range filter {
+			if eq(f, value) {
+				return true
+			}
+		}
+		return false
+	}
+	exact := func(a, b string) bool { return a == b }
+
+	var res []*unstructured.Unstructured
+	for _, o := range objs {
+		if matches(opt.KindFilter, o.GetKind(), strings.EqualFold) && matches(opt.NamespaceFilter, o.GetNamespace(), exact) {
+			res = append(res, o)
+		}
+	}
+	return res
+}
+
+// readConcurrently evaluates paths with up to n workers, each with its
+// own VM forked from state since a jsonnet.VM cannot be used concurrently.
+// The objects of paths[i] are returned at index i, and so is its error in
+// the errors returned. No more paths are started once ctx is done.
+func readConcurrently(ctx context.Context, state *vmState, recorder *utils.ImportRecorder, paths []string, n int, sharedValues string, hasSharedValues bool, read func(*jsonnet.VM, string) ([]*unstructured.Unstructured, error)) ([][]*unstructured.Unstructured, []error) {
+	if n > len(paths) {
+		n = len(paths)
+	}
+	res := make([][]*unstructured.Unstructured, len(paths))
+	errs := make([]error, len(paths))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vm := state.fork(ctx, recorder)
+			if hasSharedValues {
+				vm.ExtCode(utils.SharedValuesExtVar, sharedValues)
+			}
+			for i := range jobs {
+				res[i], errs[i] = read(vm, paths[i])
+			}
+		}()
+	}
+dispatch:
+	for i := range paths {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return res, errs
+}
+
+func checkSecrets(objs []*unstructured.Unstructured, strict bool) error {
+	findings := utils.ScanForSecrets(objs)
+	if len(findings) == 0 {
+		return nil
+	}
+	if !strict {
+		for _, f := range findings {
+			log.Warnf("possible plaintext secret: %s", f)
+		}
+		return nil
+	}
+	msgs := make([]string, len(findings))
+	for i, f := range findings {
+		msgs[i] = f.String()
+	}
+	return fmt.Errorf("possible plaintext secrets found:\n%s", strings.Join(msgs, "\n"))
+}
@@ -0,0 +1,1485 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package kubecfg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb_proto "github.com/golang/protobuf/proto"
+	openapi_v2 "github.com/google/gnostic/openapiv2"
+	"github.com/google/go-jsonnet"
+	"github.com/kubecfg/kubecfg/pkg/kubecfg/vars"
+	"github.com/kubecfg/kubecfg/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// writeFiles creates files (name -> content) in a fresh temporary directory
+// and returns its path.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReadObjectsSharedValues(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"values.jsonnet": `{ password: std.md5("seed") }`,
+		"a.jsonnet":      `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "a" }, data: { pw: std.extVar("sharedValues").password } }`,
+		"b.jsonnet":      `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "b" }, data: { pw: std.extVar("sharedValues").password } }`,
+	})
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := ReadObjects(vm,
+		[]string{filepath.Join(dir, "a.jsonnet"), filepath.Join(dir, "b.jsonnet")},
+		utils.WithSharedValuesFile(filepath.Join(dir, "values.jsonnet")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 2 {
+		t.Fatalf("expected 2 objects, got %d", len(objs))
+	}
+	a, _, _ := unstructured.NestedString(objs[0].Object, "data", "pw")
+	b, _, _ := unstructured.NestedString(objs[1].Object, "data", "pw")
+	if a == "" || a != b {
+		t.Errorf("expected the same shared value in both files, got %q and %q", a, b)
+	}
+}
+
+func TestReadObjectsSharedValuesBudget(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"values.jsonnet": `(import "a.libsonnet") + (import "b.libsonnet")`,
+		"a.libsonnet":    `{ a: 1 }`,
+		"b.libsonnet":    `{ b: 2 }`,
+		"main.jsonnet":   `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "main" } }`,
+	})
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The shared values are evaluated within the budget of the read.
+	_, err = ReadObjects(vm, []string{filepath.Join(dir, "main.jsonnet")},
+		utils.WithSharedValuesFile(filepath.Join(dir, "values.jsonnet")),
+		utils.WithEvalBudget(0, 1),
+	)
+	var budgetErr *utils.BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Errorf("expected a budget error, got %v", err)
+	}
+}
+
+func TestReadObjectsImportCache(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"lib.libsonnet": `{ evals: std.native("countEval")(), env: std.extVar("env") }`,
+		"a.jsonnet":     `local lib = import "lib.libsonnet"; { a: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "a" }, data: { env: lib.env, evals: std.toString(lib.evals) } } }`,
+		"b.jsonnet":     `local lib = import "lib.libsonnet"; { b: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "b" }, data: { env: lib.env, evals: std.toString(lib.evals) } } }`,
+	})
+	paths := []string{filepath.Join(dir, "a.jsonnet"), filepath.Join(dir, "b.jsonnet")}
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	evals := 0
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name: "countEval",
+		Func: func([]interface{}) (interface{}, error) {
+			evals++
+			return float64(evals), nil
+		},
+	})
+
+	read := func(env string) {
+		t.Helper()
+		vm.ExtVar("env", env)
+		objs, err := ReadObjects(vm, paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range objs {
+			if got, _, _ := unstructured.NestedString(o.Object, "data", "env"); got != env {
+				t.Errorf("%s: got env %q, want %q", o.GetName(), got, env)
+			}
+		}
+	}
+
+	read("dev")
+	if evals != 1 {
+		t.Errorf("shared library evaluated %d times, want 1", evals)
+	}
+	// A different ext var must not reuse the cached value.
+	read("prod")
+	if evals != 2 {
+		t.Errorf("shared library evaluated %d times after changing ext vars, want 2", evals)
+	}
+}
+
+func TestReadObjectsRecursive(t *testing.T) {
+	cm := func(name string) string {
+		return `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "` + name + `" } }`
+	}
+	dir := writeFiles(t, map[string]string{
+		"b.jsonnet":           cm("b"),
+		"a/z.yaml":            "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: z\n",
+		"a/y.json":            `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "y"}}`,
+		"a/b_test.jsonnet":    cm("test"),
+		"README.md":           "not a manifest",
+		"dup/one.jsonnet":     cm("dup"),
+		"dup/two.jsonnet":     cm("dup") + ` + { data: { from: "two" } }`,
+		"dup/three.libsonnet": cm("ignored"),
+	})
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadObjects(vm, []string{dir}); err == nil {
+		t.Errorf("expected an error reading a directory without the recursive option")
+	}
+
+	objs, err := ReadObjects(vm, []string{dir},
+		utils.WithRecursive(true),
+		utils.WithExclude("*_test.jsonnet", "dup"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, o := range objs {
+		names = append(names, o.GetName())
+	}
+	if got, want := strings.Join(names, ","), "y,z,b"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	_, err = ReadObjects(vm, []string{filepath.Join(dir, "dup")}, utils.WithRecursive(true))
+	if err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("expected duplicate error, got %v", err)
+	}
+}
+
+// slowResolver pins every image after a delay, recording the highest
+// number of concurrent calls.
+type slowResolver struct {
+	mu              sync.Mutex
+	running, maxRun int
+	calls           int
+}
+
+func (r *slowResolver) Resolve(n *utils.ImageName) error {
+	r.mu.Lock()
+	r.calls++
+	r.running++
+	if r.running > r.maxRun {
+		r.maxRun = r.running
+	}
+	r.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	r.mu.Lock()
+	r.running--
+	r.mu.Unlock()
+	n.Digest = "sha256:0123"
+	return nil
+}
+
+func TestReadObjectsFilters(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"objs.yaml": `apiVersion: v1
+kind: Namespace
+metadata:
+  name: foo
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: a
+  namespace: foo
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: b
+  namespace: bar
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: c
+  namespace: foo
+`,
+	})
+	path := filepath.Join(dir, "objs.yaml")
+
+	testCases := []struct {
+		opts []utils.ReadOption
+		want []string
+	}{
+		{nil, []string{"foo", "a", "b", "c"}},
+		{[]utils.ReadOption{utils.WithKindFilter("deployment")}, []string{"a", "b"}},
+		{[]utils.ReadOption{utils.WithNamespaceFilter("foo")}, []string{"a", "c"}},
+		{[]utils.ReadOption{utils.WithKindFilter("Deployment", "Namespace"), utils.WithNamespaceFilter("foo", "")}, []string{"foo", "a"}},
+	}
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range testCases {
+		objs, err := ReadObjects(vm, []string{path}, tc.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, o := range objs {
+			names = append(names, o.GetName())
+		}
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("%d: got %v, want %v", i, names, tc.want)
+		}
+	}
+}
+
+func TestReadObjectsOverlays(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base.jsonnet":    `{ cm: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "cm" }, data: { layer: "base", base: "yes" } } }`,
+		"region.jsonnet":  `{ cm+: { data+: { layer: "region", region: "eu" } } }`,
+		"cluster.jsonnet": `{ cm+: { data+: { layer: "cluster" } } }`,
+	})
+	path := filepath.Join(dir, "base.jsonnet")
+
+	testCases := []struct {
+		opts []utils.ReadOption
+		want map[string]string
+	}{
+		{
+			opts: []utils.ReadOption{
+				utils.WithOverlayURL(filepath.Join(dir, "region.jsonnet")),
+				utils.WithOverlayURL(filepath.Join(dir, "cluster.jsonnet")),
+			},
+			want: map[string]string{"layer": "cluster", "base": "yes", "region": "eu"},
+		},
+		{
+			opts: []utils.ReadOption{
+				utils.WithOverlayURL(filepath.Join(dir, "cluster.jsonnet")),
+				utils.WithOverlayURL(filepath.Join(dir, "region.jsonnet")),
+			},
+			want: map[string]string{"layer": "region", "base": "yes", "region": "eu"},
+		},
+		{
+			opts: []utils.ReadOption{
+				utils.WithOverlayCode(`{ cm+: { data+: { layer: "code" } } }`),
+				utils.WithOverlayURL(filepath.Join(dir, "cluster.jsonnet")),
+			},
+			want: map[string]string{"layer": "cluster", "base": "yes"},
+		},
+		{
+			opts: []utils.ReadOption{
+				utils.WithOverlayURL(filepath.Join(dir, "cluster.jsonnet")),
+				utils.WithOverlayCode(`{ cm+: { data+: { layer: "code" } } }`),
+			},
+			want: map[string]string{"layer": "code", "base": "yes"},
+		},
+	}
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range testCases {
+		objs, err := ReadObjects(vm, []string{path}, tc.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _, _ := unstructured.NestedStringMap(objs[0].Object, "data")
+		if !reflect.DeepEqual(data, tc.want) {
+			t.Errorf("%d: got %v, want %v", i, data, tc.want)
+		}
+	}
+}
+
+func TestReadObjectsOverlaysDirectives(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.jsonnet": "// kubecfg: namespace=foo, labels=team:platform\n" + `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "cm" } }`,
+	})
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The directives of the file apply when it is wrapped with overlays.
+	objs, err := ReadObjects(vm, []string{filepath.Join(dir, "main.jsonnet")}, utils.WithOverlayCode(`{ data: { layer: "code" } }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 {
+		t.Fatalf("expected one object, got %d", len(objs))
+	}
+	if ns := objs[0].GetNamespace(); ns != "foo" {
+		t.Errorf("got namespace %q, want foo", ns)
+	}
+	if team := objs[0].GetLabels()["team"]; team != "platform" {
+		t.Errorf("got team label %q, want platform", team)
+	}
+	if layer, _, _ := unstructured.NestedString(objs[0].Object, "data", "layer"); layer != "code" {
+		t.Errorf("overlay not applied, got layer %q", layer)
+	}
+}
+
+func TestReadObjectsListOrigin(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.jsonnet": `{
+  single: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "single" } },
+  group: { apiVersion: "v1", kind: "List", items: [
+    { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "a" } },
+    { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "b" } },
+  ] },
+}`,
+		"list.yaml": "apiVersion: v1\nkind: List\nitems:\n- apiVersion: v1\n  kind: ConfigMap\n  metadata:\n    name: c\n",
+	})
+	paths := []string{filepath.Join(dir, "main.jsonnet"), filepath.Join(dir, "list.yaml")}
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origins := func(opts ...utils.ReadOption) map[string]string {
+		objs, err := ReadObjects(vm, paths, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := map[string]string{}
+		for _, o := range objs {
+			if origin, found := o.GetAnnotations()[utils.AnnotationListOrigin]; found {
+				res[o.GetName()] = origin
+			}
+		}
+		return res
+	}
+	if got := origins(); len(got) != 0 {
+		t.Errorf("unexpected list origins %v", got)
+	}
+	want := map[string]string{
+		"a": paths[0] + ":$.group",
+		"b": paths[0] + ":$.group",
+		"c": paths[1] + ":$[0]",
+	}
+	if got := origins(utils.WithListOriginAnnotations(true)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadObjectsWithDeps(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.jsonnet":       `{ cm: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "cm" }, data: (import "lib/data.libsonnet") + { txt: importstr "data.txt" } } }`,
+		"lib/data.libsonnet": `{ a: (import "../lib/b.libsonnet").b }`,
+		"lib/b.libsonnet":    `{ b: "b" }`,
+		"data.txt":           `text`,
+		"overlay.jsonnet":    `{ cm+: { data+: { overlay: "yes" } } }`,
+		"unused.libsonnet":   `{}`,
+		"other.jsonnet":      `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "other" }, data: import "lib/b.libsonnet" }`,
+	})
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "data.txt"),
+		filepath.Join(dir, "lib/b.libsonnet"),
+		filepath.Join(dir, "lib/data.libsonnet"),
+		filepath.Join(dir, "main.jsonnet"),
+		filepath.Join(dir, "overlay.jsonnet"),
+	}
+	// Evaluating twice checks that imports cached by the VM are reported.
+	for i := 0; i < 2; i++ {
+		objs, deps, err := ReadObjectsWithDeps(vm, []string{filepath.Join(dir, "main.jsonnet")}, utils.WithOverlayURL(filepath.Join(dir, "overlay.jsonnet")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objs) != 1 {
+			t.Fatalf("expected 1 object, got %d", len(objs))
+		}
+		if !reflect.DeepEqual(deps, want) {
+			t.Errorf("got deps %q, want %q", deps, want)
+		}
+	}
+
+	// Each read reports its own imports only, whether the paths are read
+	// one at a time or concurrently.
+	_, deps, err := ReadObjectsWithDeps(vm, []string{filepath.Join(dir, "other.jsonnet")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(dir, "lib/b.libsonnet"), filepath.Join(dir, "other.jsonnet")}; !reflect.DeepEqual(deps, want) {
+		t.Errorf("got deps %q, want %q", deps, want)
+	}
+	_, deps, err = ReadObjectsWithDeps(vm, []string{filepath.Join(dir, "main.jsonnet"), filepath.Join(dir, "other.jsonnet")}, utils.WithParallelism(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(want[:4:4], filepath.Join(dir, "other.jsonnet")); !reflect.DeepEqual(deps, want) {
+		t.Errorf("got deps %q, want %q", deps, want)
+	}
+}
+
+func TestReadObjectsProvenanceSidecar(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"app.jsonnet": `{ cm: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "cm", namespace: "ns" } } }`,
+		"extra.yaml":  "\n---\napiVersion: v1\nkind: Secret\nmetadata:\n  name: s\n  annotations:\n    keep: me\n",
+	})
+	paths := []string{filepath.Join(dir, "app.jsonnet"), filepath.Join(dir, "extra.yaml")}
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	objs, err := ReadObjects(vm, paths, utils.WithProvenanceSidecar(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sidecar utils.ProvenanceSidecar
+	if err := json.Unmarshal(buf.Bytes(), &sidecar); err != nil {
+		t.Fatalf("invalid sidecar %q: %v", buf.String(), err)
+	}
+	want := utils.ProvenanceSidecar{
+		APIVersion: utils.ProvenanceSidecarAPIVersion,
+		Kind:       utils.ProvenanceSidecarKind,
+		Objects: []utils.ProvenanceRecord{
+			{APIVersion: "v1", Kind: "ConfigMap", Namespace: "ns", Name: "cm", File: paths[0], Path: "$.cm"},
+			{APIVersion: "v1", Kind: "Secret", Name: "s", File: paths[1], Path: "$[0]", Line: 3},
+		},
+	}
+	if !reflect.DeepEqual(sidecar, want) {
+		t.Errorf("got sidecar %+v, want %+v", sidecar, want)
+	}
+	if got := objs[0].GetAnnotations(); got != nil {
+		t.Errorf("unexpected annotations %v", got)
+	}
+	if got := objs[1].GetAnnotations(); !reflect.DeepEqual(got, map[string]string{"keep": "me"}) {
+		t.Errorf("unexpected annotations %v", got)
+	}
+
+	buf.Reset()
+	objs, err = ReadObjects(vm, paths[:1], utils.WithProvenanceSidecar(&buf), utils.WithProvenance(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := objs[0].GetAnnotations()[utils.AnnotationProvenancePath]; got != "$.cm" {
+		t.Errorf("WithProvenance annotation was removed, got %q", got)
+	}
+	if !strings.Contains(buf.String(), `"path": "$.cm"`) {
+		t.Errorf("unexpected sidecar %q", buf.String())
+	}
+
+	// Transforms don't see the annotations added for the sidecar, and
+	// can't lose the provenance by replacing the annotations.
+	buf.Reset()
+	objs, err = ReadObjects(vm, paths, utils.WithProvenanceSidecar(&buf), utils.WithTransform(func(o *unstructured.Unstructured) error {
+		for k := range o.GetAnnotations() {
+			if strings.HasPrefix(k, "kubecfg.github.com/provenance") {
+				t.Errorf("transform saw annotation %s on %s", k, o.GetName())
+			}
+		}
+		o.SetAnnotations(map[string]string{"transformed": "yes"})
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecar = utils.ProvenanceSidecar{}
+	if err := json.Unmarshal(buf.Bytes(), &sidecar); err != nil {
+		t.Fatalf("invalid sidecar %q: %v", buf.String(), err)
+	}
+	if !reflect.DeepEqual(sidecar, want) {
+		t.Errorf("got sidecar %+v, want %+v", sidecar, want)
+	}
+	for _, o := range objs {
+		if got := o.GetAnnotations(); !reflect.DeepEqual(got, map[string]string{"transformed": "yes"}) {
+			t.Errorf("unexpected annotations %v", got)
+		}
+	}
+}
+
+// schemaFile serves the OpenAPI schema stored in a protobuf file.
+type schemaFile string
+
+func (f schemaFile) OpenAPISchema() (*openapi_v2.Document, error) {
+	b, err := os.ReadFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+	var doc openapi_v2.Document
+	if err := pb_proto.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func TestReadObjectsSchemaValidation(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"good.jsonnet": `{ svc: { apiVersion: "v1", kind: "Service", metadata: { name: "svc" }, spec: { ports: [{ port: 80 }] } } }`,
+		"bad.jsonnet":  `{ app: { svc: { apiVersion: "v1", kind: "Service", metadata: { name: "svc" }, spec: { prots: [] } } } }`,
+	})
+	schema := utils.WithSchemaValidation(schemaFile(filepath.FromSlash("../../testdata/schema.pb")))
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := ReadObjects(vm, []string{filepath.Join(dir, "good.jsonnet")}, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := objs[0].GetAnnotations(); got != nil {
+		t.Errorf("provenance annotations left on validated object: %v", got)
+	}
+
+	bad := filepath.Join(dir, "bad.jsonnet")
+	_, err = ReadObjects(vm, []string{bad}, schema)
+	if err == nil {
+		t.Fatal("expected a schema validation error")
+	}
+	if want := fmt.Sprintf("v1 Service svc (%s $.app.svc)", bad); !strings.Contains(err.Error(), want) {
+		t.Errorf("expected %q in error %q", want, err)
+	}
+}
+
+func TestReadObjectsStrategicOverlay(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"app.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: prod
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app:1
+      - name: proxy
+        image: proxy:1
+`,
+		"patch.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - name: proxy
+        image: proxy:2
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unmatched
+`,
+	})
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := ReadObjects(vm, []string{filepath.Join(dir, "app.yaml")}, utils.WithStrategicOverlay(filepath.Join(dir, "patch.yaml")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 {
+		t.Fatalf("expected 1 object, got %d", len(objs))
+	}
+	containers, _, _ := unstructured.NestedSlice(objs[0].Object, "spec", "template", "spec", "containers")
+	var images []string
+	for _, c := range containers {
+		images = append(images, c.(map[string]interface{})["image"].(string))
+	}
+	if want := []string{"app:1", "proxy:2"}; !reflect.DeepEqual(images, want) {
+		t.Errorf("got images %v, want %v", images, want)
+	}
+}
+
+func TestReadObjectsPinImagesParallel(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"pods.jsonnet": `{
+      [std.toString(i)]: {
+        apiVersion: "v1",
+        kind: "Pod",
+        metadata: { name: "pod-" + i },
+        spec: { containers: [
+          { name: "a", image: "example.com/image-" + i + ":v1" },
+          { name: "b", image: "example.com/image-" + (i + 1) % 50 + ":v1" },
+        ] },
+      }
+      for i in std.range(0, 49)
+    }`,
+	})
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &slowResolver{}
+	wrapped := &resolverErrorWrapper{Inner: resolver, OnErr: func(err error) error { return err }}
+	objs, err := ReadObjects(vm, []string{filepath.Join(dir, "pods.jsonnet")}, utils.WithImagePinning(wrapped, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resolver.calls != 50 {
+		t.Errorf("expected each of the 50 images to be resolved once, got %d calls", resolver.calls)
+	}
+	if resolver.maxRun < 2 || resolver.maxRun > 4 {
+		t.Errorf("expected between 2 and 4 concurrent resolutions, got %d", resolver.maxRun)
+	}
+	for _, o := range objs {
+		containers, _, _ := unstructured.NestedSlice(o.Object, "spec", "containers")
+		for _, c := range containers {
+			if image := c.(map[string]interface{})["image"].(string); !strings.HasSuffix(image, "@sha256:0123") {
+				t.Errorf("%s: image %q was not pinned", o.GetName(), image)
+			}
+		}
+	}
+}
+
+func TestReadObjectsPinImagesIgnoreErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"pods.jsonnet": `[
+      { apiVersion: "v1", kind: "Pod", metadata: { name: "a" }, spec: { containers: [{ name: "a", image: "broken:v1" }] } },
+      { apiVersion: "v1", kind: "Pod", metadata: { name: "b" }, spec: { containers: [{ name: "b", image: "fine:v1" }] } },
+    ]`,
+	})
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner := resolverFunc(func(n *utils.ImageName) error {
+		if strings.Contains(n.Name, "broken") {
+			return fmt.Errorf("unavailable")
+		}
+		n.Digest = "sha256:0123"
+		return nil
+	})
+	for action, expectErr := range map[ResolverFailureAction]bool{
+		IgnoreResolverError: false,
+		ReportResolverError: true,
+	} {
+		resolver, err := NewResolver(WithResolver(NoopResolver, action))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolver.(*resolverErrorWrapper).Inner = inner
+
+		objs, err := ReadObjects(vm, []string{filepath.Join(dir, "pods.jsonnet")}, utils.WithImagePinning(resolver, 0))
+		if expectErr {
+			if err == nil {
+				t.Errorf("action %d: expected an error", action)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("action %d: %v", action, err)
+		}
+		images := map[string]string{}
+		for _, o := range objs {
+			containers, _, _ := unstructured.NestedSlice(o.Object, "spec", "containers")
+			images[o.GetName()] = containers[0].(map[string]interface{})["image"].(string)
+		}
+		if images["a"] != "broken:v1" || !strings.HasSuffix(images["b"], "@sha256:0123") {
+			t.Errorf("action %d: unexpected images %v", action, images)
+		}
+	}
+}
+
+type resolverFunc func(*utils.ImageName) error
+
+func (f resolverFunc) Resolve(n *utils.ImageName) error { return f(n) }
+
+func TestReadObjectsTimeout(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"fast.jsonnet": `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "fast" } }`,
+		"slow.jsonnet": `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "slow" }, data: { n: std.toString(std.foldl(function(a, b) a + b, std.range(0, 1000000), 0)) } }`,
+	})
+
+	vm, err := JsonnetVM(WithTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadObjects(vm, []string{filepath.Join(dir, "fast.jsonnet")}); err != nil {
+		t.Fatal(err)
+	}
+
+	vm, err = JsonnetVM(WithTimeout(10 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadObjects(vm, []string{filepath.Join(dir, "slow.jsonnet")})
+	var budgetErr *utils.BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("expected a budget error, got %v", err)
+	}
+	if budgetErr.Limit != "10ms" {
+		t.Errorf("unexpected limit %q", budgetErr.Limit)
+	}
+
+	// The shorter of the VM timeout and the read budget applies.
+	vm, err = JsonnetVM(WithTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadObjects(vm, []string{filepath.Join(dir, "slow.jsonnet")}, utils.WithEvalBudget(10*time.Millisecond, 0))
+	if !errors.As(err, &budgetErr) || budgetErr.Limit != "10ms" {
+		t.Errorf("expected a 10ms budget error, got %v", err)
+	}
+}
+
+func TestReadObjectsTimeoutLeakedEvaluation(t *testing.T) {
+	started, aborted := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		// Hang until the client gives up.
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer srv.Close()
+
+	dir := writeFiles(t, map[string]string{
+		"slow.jsonnet": fmt.Sprintf(`{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "slow" }, data: import %q }`, srv.URL+"/lib.libsonnet"),
+		"fast.jsonnet": `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "fast" }, data: { owner: std.extVar("owner") } }`,
+	})
+	vm, err := JsonnetVM(WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ReadObjects(vm, []string{filepath.Join(dir, "slow.jsonnet")})
+	var budgetErr *utils.BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("expected a budget error, got %v", err)
+	}
+	// The abandoned evaluation keeps running, but its import is aborted
+	// once the read returns, if it was sent at all by then.
+	select {
+	case <-started:
+		select {
+		case <-aborted:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("the import of the abandoned evaluation wasn't aborted")
+		}
+	case <-time.After(2 * time.Second):
+	}
+
+	// The abandoned evaluation may still use vm, so read with a new one.
+	vm, err = JsonnetVM(WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.ExtVar("owner", "me")
+	objs, deps, err := ReadObjectsWithDeps(vm, []string{filepath.Join(dir, "fast.jsonnet")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner, _, _ := unstructured.NestedString(objs[0].Object, "data", "owner"); owner != "me" {
+		t.Errorf("unexpected owner %q", owner)
+	}
+	if want := []string{filepath.Join(dir, "fast.jsonnet")}; !reflect.DeepEqual(deps, want) {
+		t.Errorf("got deps %v, want %v", deps, want)
+	}
+}
+
+func TestReadObjectsContext(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		// Hang until the client gives up.
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer srv.Close()
+
+	dir := writeFiles(t, map[string]string{
+		"main.jsonnet": fmt.Sprintf(`{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "x" }, data: import %q }`, srv.URL+"/slow.libsonnet"),
+	})
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err = ReadObjectsContext(ctx, vm, []string{filepath.Join(dir, "main.jsonnet")})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the read to be cancelled, got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(10 * time.Second):
+		t.Errorf("the import in flight wasn't aborted")
+	}
+}
+
+func TestJsonnetVMMaxStack(t *testing.T) {
+	const deep = `local f(n) = if n == 0 then 0 else 1 + f(n - 1); f(1000)`
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.EvaluateAnonymousSnippet("deep.jsonnet", deep); err == nil || !strings.Contains(err.Error(), "max stack frames exceeded") {
+		t.Errorf("expected the default stack limit to be hit, got %v", err)
+	}
+
+	vm, err = JsonnetVM(WithMaxStack(5000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.EvaluateAnonymousSnippet("deep.jsonnet", deep); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJsonnetVMTopLevelArgs(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.jsonnet":  `function(name, replicas) (import "lib.libsonnet") { metadata: { name: name }, data+: { replicas: std.toString(replicas) } }`,
+		"lib.libsonnet": `{ apiVersion: "v1", kind: "ConfigMap", data: { env: std.extVar("env") } }`,
+	})
+
+	vm, err := JsonnetVM(
+		WithVar(vars.New(vars.Ext, vars.String, vars.Literal, "env", "prod")),
+		WithVar(vars.New(vars.TLA, vars.String, vars.Literal, "name", "app")),
+		WithVar(vars.New(vars.TLA, vars.Code, vars.Literal, "replicas", "1 + 2")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := ReadObjects(vm, []string{filepath.Join(dir, "main.jsonnet")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, _ := unstructured.NestedStringMap(objs[0].Object, "data")
+	if objs[0].GetName() != "app" || data["replicas"] != "3" || data["env"] != "prod" {
+		t.Errorf("unexpected object %v", objs[0].Object)
+	}
+}
+
+func TestJsonnetVMEnvVars(t *testing.T) {
+	t.Setenv("KUBECFG_TEST_TOKEN", "s3cr3t")
+	t.Setenv("KUBECFG_TEST_REPLICAS", "{ n: 3 }")
+
+	vm, err := JsonnetVM(
+		WithVar(vars.New(vars.Ext, vars.String, vars.Env, "token", "KUBECFG_TEST_TOKEN")),
+		WithVar(vars.New(vars.Ext, vars.Code, vars.Env, "replicas", "KUBECFG_TEST_REPLICAS")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := vm.EvaluateAnonymousSnippet("test.jsonnet", `[std.extVar("token"), std.extVar("replicas").n]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(out), "[\n   \"s3cr3t\",\n   3\n]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err = JsonnetVM(WithVar(vars.New(vars.Ext, vars.String, vars.Env, "missing", "KUBECFG_TEST_UNSET")))
+	if err == nil || !strings.Contains(err.Error(), "KUBECFG_TEST_UNSET") {
+		t.Errorf("expected an error naming the unset variable, got %v", err)
+	}
+}
+
+func TestJsonnetVMJSONFileCodeVar(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"values.json":  `{"image": "nginx", "ports": [80, 443]}`,
+		"main.jsonnet": `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: std.extVar("values").image }, data: { port: std.toString(std.extVar("values").ports[1]) } }`,
+	})
+
+	vm, err := JsonnetVM(WithVar(vars.New(vars.Ext, vars.Code, vars.File, "values", filepath.Join(dir, "values.json"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := ReadObjects(vm, []string{filepath.Join(dir, "main.jsonnet")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _, _ := unstructured.NestedString(objs[0].Object, "data", "port")
+	if objs[0].GetName() != "nginx" || port != "443" {
+		t.Errorf("unexpected object %v", objs[0].Object)
+	}
+}
+
+func TestJsonnetVMFileCodeVarImports(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"shared/config.jsonnet": `{ name: (import "name.libsonnet") }`,
+		"shared/name.libsonnet": `"from-shared"`,
+		"app/name.libsonnet":    `"from-app"`,
+		"app/main.jsonnet":      `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: std.extVar("config").name } }`,
+	})
+
+	// The var's path is relative to the working directory, the imports
+	// of the file it names to the file's own directory.
+	vm, err := JsonnetVM(
+		WithWorkingDir(filepath.Join(dir, "app", "sub")),
+		WithVar(vars.New(vars.Ext, vars.Code, vars.File, "config", filepath.Join("..", "..", "shared", "config.jsonnet"))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := ReadObjects(vm, []string{filepath.Join(dir, "app", "main.jsonnet")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := objs[0].GetName(); got != "from-shared" {
+		t.Errorf("got name %q, want %q", got, "from-shared")
+	}
+}
+
+func TestJsonnetVMSearchPath(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"vendor/kubecfg.libsonnet": `{ name: "vendored" }`,
+		"other/kubecfg.libsonnet":  `{ name: "other" }`,
+		"main.jsonnet":             `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: (import "kubecfg.libsonnet").name } }`,
+	})
+	vendor, other := filepath.Join(dir, "vendor"), filepath.Join(dir, "other")
+
+	testCases := []struct {
+		name string
+		opts []JsonnetVMOpt
+		want string
+	}{
+		{"order given", []JsonnetVMOpt{WithSearchPath(vendor, other)}, "vendored"},
+		{"reversed", []JsonnetVMOpt{WithSearchPath(other, vendor)}, "other"},
+		{"ahead of import path", []JsonnetVMOpt{WithImportPath(other), WithSearchPath(vendor)}, "vendored"},
+		{"embedded placed first", []JsonnetVMOpt{WithSearchPath("internal:///", vendor)}, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vm, err := JsonnetVM(tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			objs, err := ReadObjects(vm, []string{filepath.Join(dir, "main.jsonnet")})
+			if tc.want == "" {
+				// The embedded library has no name field.
+				if err == nil {
+					t.Fatalf("expected the embedded library to be imported, got %v", objs[0].Object)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := objs[0].GetName(); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestJsonnetVMJsonnetPath(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a/lib.libsonnet": `{ name: "a" }`,
+		"b/lib.libsonnet": `{ name: "b" }`,
+		"c/lib.libsonnet": `{ name: "c" }`,
+		"main.jsonnet":    `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: (import "lib.libsonnet").name } }`,
+	})
+	t.Setenv("JSONNET_PATH", filepath.Join(dir, "b")+string(filepath.ListSeparator)+filepath.Join(dir, "c"))
+
+	read := func(opts ...JsonnetVMOpt) string {
+		t.Helper()
+		vm, err := JsonnetVM(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objs, err := ReadObjects(vm, []string{filepath.Join(dir, "main.jsonnet")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return objs[0].GetName()
+	}
+
+	if got := read(); got != "b" {
+		t.Errorf("got %q from JSONNET_PATH, want %q", got, "b")
+	}
+	if got := read(WithImportPath(filepath.Join(dir, "a"))); got != "a" {
+		t.Errorf("got %q, want the explicit import path to win", got)
+	}
+}
+
+func TestSearchURLsDedup(t *testing.T) {
+	dir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	t.Setenv("JSONNET_PATH", "lib")
+
+	opts := jsonnetVMOpts{
+		importPath: []string{"./lib", filepath.Join(dir, "lib") + "/", "vendor", "lib"},
+		importURLs: []string{"file://" + filepath.ToSlash(filepath.Join(dir, "vendor")), "https://example.com/lib", "https://example.com/lib/", "internal:///"},
+	}
+	urls, err := searchURLs(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, u := range urls {
+		got = append(got, u.String())
+	}
+	want := []string{
+		dirURL(filepath.Join(dir, "lib")).String(),
+		dirURL(filepath.Join(dir, "vendor")).String(),
+		"https://example.com/lib/",
+		"internal:///",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadObjectsParallel(t *testing.T) {
+	files := map[string]string{
+		"shared.jsonnet": `{ env: "prod" }`,
+	}
+	var paths []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("f%02d.jsonnet", i)
+		// Every file defines the same object, so that LastWins keeps the
+		// one of the last path.
+		files[name] = fmt.Sprintf(`{ cm: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "cm-%d" }, data: { env: std.extVar("sharedValues").env, owner: std.extVar("owner") } }, dup: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "dup" }, data: { from: "%d" } } }`, i, i)
+		paths = append(paths, name)
+	}
+	dir := writeFiles(t, files)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, paths[i])
+	}
+
+	vm, err := JsonnetVM(WithVar(vars.New(vars.Ext, vars.String, vars.Literal, "owner", "me")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(n int) []string {
+		objs, err := ReadObjects(vm, paths,
+			utils.WithParallelism(n),
+			utils.WithSharedValuesFile(filepath.Join(dir, "shared.jsonnet")),
+			utils.WithDuplicatePolicy(utils.LastWins),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res []string
+		for _, o := range objs {
+			data, _, _ := unstructured.NestedStringMap(o.Object, "data")
+			res = append(res, fmt.Sprintf("%s:%s", o.GetName(), data["env"]+data["owner"]+data["from"]))
+		}
+		return res
+	}
+	want := read(1)
+	if len(want) != 21 || want[0] != "cm-0:prodme" {
+		t.Fatalf("unexpected sequential result %v", want)
+	}
+	for i := 0; i < 5; i++ {
+		if got := read(4); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	// Imports made by the worker VMs are reported too.
+	_, deps, err := ReadObjectsWithDeps(vm, paths, utils.WithParallelism(4), utils.WithSharedValuesFile(filepath.Join(dir, "shared.jsonnet")), utils.WithDuplicatePolicy(utils.LastWins))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != len(paths)+1 {
+		t.Errorf("expected %d deps, got %v", len(paths)+1, deps)
+	}
+
+	// The error of the first failing path is reported, whichever fails
+	// first.
+	bad := writeFiles(t, map[string]string{
+		"a.jsonnet": `{}`,
+		"b.jsonnet": `error "b failed"`,
+		"c.jsonnet": `error "c failed"`,
+	})
+	for i := 0; i < 5; i++ {
+		_, err = ReadObjects(vm, []string{filepath.Join(bad, "a.jsonnet"), filepath.Join(bad, "b.jsonnet"), filepath.Join(bad, "c.jsonnet")}, utils.WithParallelism(3))
+		if err == nil || !strings.Contains(err.Error(), "b failed") {
+			t.Fatalf("expected the error of b.jsonnet, got %v", err)
+		}
+	}
+}
+
+func TestReadObjectsVMVars(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.jsonnet": `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "a" }, data: { owner: std.extVar("owner") } }`,
+	})
+	paths := []string{filepath.Join(dir, "a.jsonnet")}
+
+	jvm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := jsonnet.MakeVM()
+	vm.Importer(utils.MakeUniversalImporter(nil, false))
+	// Without parallelism, paths are read on the VM itself, with the vars
+	// set after it was made, whether JsonnetVM made it or not.
+	for _, vm := range []*jsonnet.VM{jvm, vm} {
+		vm.ExtVar("owner", "me")
+		objs, err := ReadObjects(vm, paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner, _, _ := unstructured.NestedString(objs[0].Object, "data", "owner"); owner != "me" {
+			t.Errorf("unexpected owner %q", owner)
+		}
+	}
+}
+
+func TestReadObjectsParallelWorkerVMs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{ name: %q }`, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".libsonnet"))
+	}))
+	defer srv.Close()
+
+	dir := writeFiles(t, map[string]string{
+		"a.jsonnet": fmt.Sprintf(`{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: (import %q).name }, data: { owner: std.extVar("owner") } }`, srv.URL+"/a.libsonnet"),
+		"b.jsonnet": fmt.Sprintf(`{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: (import %q).name }, data: { owner: std.extVar("owner") } }`, srv.URL+"/b.libsonnet"),
+	})
+	lockFile := filepath.Join(t.TempDir(), "imports.lock")
+
+	vm, err := JsonnetVM(
+		WithImportLock(lockFile, true),
+		WithVar(vars.New(vars.Ext, vars.String, vars.Literal, "owner", "me")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objs, err := ReadObjects(vm, []string{filepath.Join(dir, "a.jsonnet"), filepath.Join(dir, "b.jsonnet")}, utils.WithParallelism(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, o := range objs {
+		data, _, _ := unstructured.NestedStringMap(o.Object, "data")
+		got = append(got, o.GetName()+":"+data["owner"])
+	}
+	if want := []string{"a:me", "b:me"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The imports of both workers are recorded in the same lock file.
+	lock, err := os.ReadFile(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lib := range []string{"/a.libsonnet", "/b.libsonnet"} {
+		if !strings.Contains(string(lock), srv.URL+lib) {
+			t.Errorf("expected %s in the lock file, got %s", lib, lock)
+		}
+	}
+}
+
+func TestNewResolverRegistryMirror(t *testing.T) {
+	resolver, err := NewResolver(
+		WithResolver(NormalizingResolver, ReportResolverError),
+		WithRegistryMirror("docker.io", "registry.internal/dockerhub"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := utils.ImageName{Name: "nginx", Tag: "1.25"}
+	if err := resolver.Resolve(&n); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n.String(), "registry.internal/dockerhub/library/nginx:1.25"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := NewResolver(WithResolver(NoopResolver, ReportResolverError), WithResolverVerifyKey("cosign.pub")); err == nil {
+		t.Errorf("expected signature verification to require the registry resolver")
+	}
+}
+
+func TestReadObjectsIdenticalDuplicates(t *testing.T) {
+	const cm = `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "shared", namespace: "ns" }, data: { a: "1" } }`
+	dir := writeFiles(t, map[string]string{
+		"a.jsonnet": cm,
+		"b.jsonnet": cm,
+		"c.yaml":    "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: shared\n  namespace: ns\ndata:\n  a: \"2\"\n",
+	})
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := ReadObjects(vm, []string{filepath.Join(dir, "a.jsonnet"), filepath.Join(dir, "b.jsonnet")}, utils.WithProvenance(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 {
+		t.Errorf("expected the identical ConfigMaps to be read as one, got %d objects", len(objs))
+	}
+
+	_, err = ReadObjects(vm, []string{filepath.Join(dir, "a.jsonnet"), filepath.Join(dir, "c.yaml")})
+	var dupErr *utils.DuplicateResourceError
+	if !errors.As(err, &dupErr) {
+		t.Errorf("expected a *DuplicateResourceError for conflicting ConfigMaps, got %v", err)
+	}
+}
+
+func TestReadObjectsDefaultNamespace(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\ndata:\n  from: a\n",
+		"b.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\n  namespace: prod\ndata:\n  from: b\n",
+		"c.yaml": "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: prod\n",
+	})
+	paths := []string{filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.yaml"), filepath.Join(dir, "c.yaml")}
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := ReadObjects(vm, paths, utils.WithDefaultNamespace("dev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns := []string{objs[0].GetNamespace(), objs[1].GetNamespace(), objs[2].GetNamespace()}; ns[0] != "dev" || ns[1] != "prod" || ns[2] != "" {
+		t.Errorf("unexpected namespaces %q", ns)
+	}
+
+	// Once defaulted, the ConfigMaps are the same object.
+	_, err = ReadObjects(vm, paths, utils.WithDefaultNamespace("prod"))
+	var dupErr *utils.DuplicateResourceError
+	if !errors.As(err, &dupErr) {
+		t.Errorf("expected a *DuplicateResourceError, got %v", err)
+	}
+}
+
+func TestReadObjectsCommonLabels(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.yaml":    "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n  labels:\n    team: own\n",
+		"b.json":    `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "b"}}`,
+		"c.jsonnet": `{ apiVersion: "v1", kind: "List", items: [{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "c", labels: { "app.kubernetes.io/managed-by": "helm" } } }] }`,
+	})
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := ReadObjects(vm,
+		[]string{filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.json"), filepath.Join(dir, "c.jsonnet")},
+		utils.WithCommonLabels(map[string]string{"team": "platform"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]string{
+		"a": {"team": "own", utils.LabelManagedBy: "kubecfg"},
+		"b": {"team": "platform", utils.LabelManagedBy: "kubecfg"},
+		"c": {"team": "platform", utils.LabelManagedBy: "helm"},
+	}
+	if len(objs) != 3 {
+		t.Fatalf("expected 3 objects, got %d", len(objs))
+	}
+	for _, o := range objs {
+		if got := o.GetLabels(); !reflect.DeepEqual(got, want[o.GetName()]) {
+			t.Errorf("%s: got labels %v, want %v", o.GetName(), got, want[o.GetName()])
+		}
+	}
+}
+
+func TestReadObjectsTransform(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.yaml":    "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n",
+		"b.jsonnet": `{ apiVersion: "v1", kind: "List", items: [{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "b" } }] }`,
+	})
+	paths := []string{filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.jsonnet")}
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := ReadObjects(vm, paths,
+		utils.WithCommonLabels(map[string]string{"team": "platform"}),
+		utils.WithTransform(func(o *unstructured.Unstructured) error {
+			// Runs after the built-in transforms.
+			o.SetName(o.GetName() + "-" + o.GetLabels()["team"])
+			return nil
+		}),
+		utils.WithTransform(func(o *unstructured.Unstructured) error {
+			o.SetName(o.GetName() + "-2")
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, o := range objs {
+		names = append(names, o.GetName())
+	}
+	if want := []string{"a-platform-2", "b-platform-2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+
+	// Transforms run before the duplicate check.
+	_, err = ReadObjects(vm, paths, utils.WithTransform(func(o *unstructured.Unstructured) error {
+		o.SetAnnotations(map[string]string{"was": o.GetName()})
+		o.SetName("same")
+		return nil
+	}))
+	if err == nil {
+		t.Errorf("expected an error for objects renamed to the same name")
+	}
+
+	_, err = ReadObjects(vm, paths, utils.WithTransform(func(o *unstructured.Unstructured) error {
+		return fmt.Errorf("boom")
+	}))
+	if err == nil || !strings.Contains(err.Error(), "ConfigMap a: boom") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestReadObjectsWarnOnEmpty(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"null.jsonnet":  `null`,
+		"empty.jsonnet": `{ local cm = { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "a" } } }`,
+		"one.jsonnet":   `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "b" } }`,
+	})
+	paths := []string{filepath.Join(dir, "one.jsonnet"), filepath.Join(dir, "null.jsonnet"), filepath.Join(dir, "empty.jsonnet")}
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs, err := ReadObjects(vm, paths, utils.WithWarnOnEmpty(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 {
+		t.Errorf("expected 1 object, got %d", len(objs))
+	}
+
+	_, err = ReadObjects(vm, paths, utils.WithWarnOnEmptyStrict(true))
+	if err == nil || !strings.Contains(err.Error(), "null.jsonnet yields no objects") {
+		t.Errorf("expected an error naming null.jsonnet, got %v", err)
+	}
+}
+
+func TestReadObjectsImportCycle(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.jsonnet": `(import "a.libsonnet").objs`,
+		"a.libsonnet":  `{ objs: (import "b.libsonnet").objs }`,
+		"b.libsonnet":  `{ objs: (import "a.libsonnet").objs }`,
+	})
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadObjects(vm, []string{filepath.Join(dir, "main.jsonnet")})
+	want := fmt.Sprintf("import cycle detected: %s -> %s -> %s", filepath.Join(dir, "a.libsonnet"), filepath.Join(dir, "b.libsonnet"), filepath.Join(dir, "a.libsonnet"))
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected an error containing %q, got %v", want, err)
+	}
+}
+
+func TestReadObjectsContinueOnError(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.jsonnet": `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "a" } }`,
+		"b.jsonnet": `error "b is broken"`,
+		"c.yaml":    "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: c\n",
+		"d.yaml":    "apiVersion: v1\nkind: [\n",
+	})
+	paths := []string{
+		filepath.Join(dir, "a.jsonnet"),
+		filepath.Join(dir, "b.jsonnet"),
+		filepath.Join(dir, "c.yaml"),
+		filepath.Join(dir, "d.yaml"),
+	}
+
+	vm, err := JsonnetVM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadObjects(vm, paths); err == nil || !strings.Contains(err.Error(), "b is broken") {
+		t.Fatalf("expected the error of b.jsonnet, got %v", err)
+	} else if errors.As(err, new(*utils.ReadErrors)) {
+		t.Errorf("expected a single error by default, got %v", err)
+	}
+
+	for _, parallelism := range []int{1, 4} {
+		objs, err := ReadObjects(vm, paths, utils.WithContinueOnError(true), utils.WithParallelism(parallelism))
+		var readErrs *utils.ReadErrors
+		if !errors.As(err, &readErrs) {
+			t.Fatalf("parallelism %d: expected *ReadErrors, got %v", parallelism, err)
+		}
+		var failed []string
+		for _, err := range readErrs.Errors {
+			var re *utils.ReadError
+			if errors.As(err, &re) {
+				failed = append(failed, filepath.Base(re.Path))
+			}
+		}
+		if want := []string{"b.jsonnet", "d.yaml"}; !reflect.DeepEqual(failed, want) {
+			t.Errorf("parallelism %d: got errors for %v, want %v: %v", parallelism, failed, want, err)
+		}
+		var names []string
+		for _, o := range objs {
+			names = append(names, o.GetName())
+		}
+		if want := []string{"a", "c"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("parallelism %d: got objects %v, want %v", parallelism, names, want)
+		}
+	}
+}
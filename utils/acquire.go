@@ -17,7 +17,13 @@ package utils
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -25,21 +31,46 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	jsonnet "github.com/google/go-jsonnet"
 	"github.com/kubecfg/kubecfg/internal/acquire"
 	log "github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
 	"k8s.io/apimachinery/pkg/util/yaml"
 )
 
 const (
 	AnnotationProvenanceFile = "kubecfg.github.com/provenance-file"
 	AnnotationProvenancePath = "kubecfg.github.com/provenance-path"
+	// AnnotationProvenanceLine holds the line a YAML document starts at.
+	AnnotationProvenanceLine = "kubecfg.github.com/provenance-line"
+	// AnnotationListOrigin marks the members of Lists expanded by Read
+	// with WithListOriginAnnotations, or by FlattenToV1 with
+	// WithListOrigin: objects with the same value come from the same List.
+	AnnotationListOrigin = "kubecfg.github.com/list-origin"
+
+	// SharedValuesExtVar is the name of the ext var holding the result of
+	// the file passed to WithSharedValuesFile.
+	SharedValuesExtVar = "sharedValues"
+
+	// StdinPath is the path Read interprets as standard input.
+	StdinPath = "-"
+	// stdinName is the file name recorded in provenance annotations
+	// for objects read from standard input.
+	stdinName = "<stdin>"
+	// readerName is the file name recorded in provenance annotations, and
+	// the path of ReadErrors, for objects read with ReadFrom.
+	readerName = "<reader>"
 )
 
+// stdin is where StdinPath is read from; overridden by tests.
+var stdin io.Reader = os.Stdin
+
 // breaks import cycle
 type ReadOption = acquire.ReadOption
 
@@ -49,6 +80,37 @@ func WithProvenance(show bool) ReadOption {
 	}
 }
 
+// WithProvenanceKeys overrides the annotation keys used by WithProvenance
+// (AnnotationProvenanceFile and AnnotationProvenancePath). An empty key
+// disables the corresponding annotation.
+func WithProvenanceKeys(fileKey, pathKey string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.ProvenanceKeysSet = true
+		opts.ProvenanceFileKey = fileKey
+		opts.ProvenancePathKey = pathKey
+	}
+}
+
+// WithProvenanceLineKey overrides AnnotationProvenanceLine, the key
+// used by WithProvenance to record the line YAML documents start at. An
+// empty key disables the annotation.
+func WithProvenanceLineKey(key string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.ProvenanceLineKeySet = true
+		opts.ProvenanceLineKey = key
+	}
+}
+
+// WithProvenanceRootLabel overrides the "$" provenance paths start with,
+// whatever the format read: "$.web" for an object found in the web field
+// of a jsonnet file, "$[1]" for the second document of a YAML file.
+func WithProvenanceRootLabel(label string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.ProvenanceRootLabelSet = true
+		opts.ProvenanceRootLabel = label
+	}
+}
+
 func WithReadTwice(twice bool) ReadOption {
 	return func(opts *acquire.ReadOptions) {
 		opts.ReadTwice = twice
@@ -61,91 +123,764 @@ func WithExpr(expr string) ReadOption {
 	}
 }
 
+// WithOverlayURL composes the jsonnet file at overlayURL with each input
+// file, as in `(import input) + (import overlayURL)`. It may be given
+// several times, mixed with WithOverlayCode: overlays apply in the order
+// the options are given, so later overlays win.
 func WithOverlayURL(overlayURL string) ReadOption {
 	return func(opts *acquire.ReadOptions) {
-		opts.OverlayURL = overlayURL
+		opts.Overlays = append(opts.Overlays, acquire.Overlay{URL: overlayURL})
 	}
 }
 
+// WithOverlayCode composes the jsonnet expression overlayCode with each
+// input file, as in `(import input) + (overlayCode)`. See WithOverlayURL
+// for how several overlays compose.
 func WithOverlayCode(overlayCode string) ReadOption {
 	return func(opts *acquire.ReadOptions) {
-		opts.OverlayCode = overlayCode
+		opts.Overlays = append(opts.Overlays, acquire.Overlay{Code: overlayCode})
+	}
+}
+
+// WithSecretScan enables scanning ConfigMaps for values that look like
+// secrets (see ScanForSecrets). Findings are logged as warnings.
+func WithSecretScan(enable bool) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.SecretScan = enable
+	}
+}
+
+// WithSecretScanStrict turns secret scan findings into errors.
+func WithSecretScanStrict(strict bool) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.SecretScanStrict = strict
+	}
+}
+
+// WithWarnOnEmpty logs a warning naming each path that yields no objects,
+// which usually means the objects were never referenced from the output
+// of a jsonnet file.
+func WithWarnOnEmpty(enable bool) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.WarnOnEmpty = enable
+	}
+}
+
+// WithWarnOnEmptyStrict makes paths yielding no objects an error.
+func WithWarnOnEmptyStrict(strict bool) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.WarnOnEmptyStrict = strict
+	}
+}
+
+// WithSharedValuesFile evaluates the jsonnet file at path before any other
+// input and exposes the result to all of them as
+// std.extVar("sharedValues"). The file is evaluated exactly once per
+// ReadObjects call, so values computed there (e.g. generated passwords)
+// are consistent across files.
+func WithSharedValuesFile(path string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.SharedValuesFile = path
+	}
+}
+
+// WithListMetadataInheritance makes items of a List inherit the List's
+// metadata.labels and metadata.namespace, unless they set their own.
+func WithListMetadataInheritance(inherit bool) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.ListMetadataInheritance = inherit
+	}
+}
+
+// WithListOriginAnnotations makes Read annotate the members of each List
+// it expands with AnnotationListOrigin, set to where the List was found:
+// the file and the provenance path of the List within it, e.g.
+// "main.jsonnet:$.frontend". Objects that weren't in a List are left as
+// they are, so that re-serialized objects can be grouped back into Lists.
+func WithListOriginAnnotations(enable bool) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.ListOrigin = enable
+	}
+}
+
+// WithStrictWalk makes Read fail on maps that set kind or apiVersion but
+// not both. Such maps are usually misspelled objects that would otherwise
+// be silently dropped.
+func WithStrictWalk(strict bool) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.StrictWalk = strict
+	}
+}
+
+// WithStrictJSON makes Read fail on JSON input where an object has the
+// same key more than once, which encoding/json would otherwise silently
+// resolve by keeping the last value.
+func WithStrictJSON(strict bool) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.StrictJSON = strict
 	}
 }
 
-// Read fetches and decodes K8s objects by path.
-// TODO: Replace this with something supporting more sophisticated
-// content negotiation.
+// WithKindFilter makes ReadObjects return only objects of the given
+// kinds, compared case-insensitively. No kinds means no filtering.
+func WithKindFilter(kinds ...string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.KindFilter = append(opts.KindFilter, kinds...)
+	}
+}
+
+// WithNamespaceFilter makes ReadObjects return only objects in the given
+// namespaces. Cluster-scoped objects, and objects that leave their
+// namespace unset, only match "". No namespaces means no filtering.
+func WithNamespaceFilter(namespaces ...string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.NamespaceFilter = append(opts.NamespaceFilter, namespaces...)
+	}
+}
+
+// WithEvalBudget limits how many files a jsonnet evaluation may import
+// and how long Read waits for it; zero means no limit. Exceeding either
+// limit makes Read return a *BudgetExceededError.
+//
+// maxDuration doesn't bound the evaluation itself, which go-jsonnet can't
+// interrupt: Read returns, but the evaluation keeps running in the
+// background, using CPU and memory, until it completes. Each Read
+// exceeding the limit leaves one more such goroutine behind, so repeated
+// runaway evaluations pile up. The VM read with must not be reused then.
+func WithEvalBudget(maxDuration time.Duration, maxImports int) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.EvalMaxDuration = maxDuration
+		opts.EvalMaxImports = maxImports
+	}
+}
+
+// WithParallelism makes ReadObjects evaluate up to n paths concurrently
+// when its VM was made by kubecfg.JsonnetVM, and sequentially on that VM
+// otherwise. The concurrent evaluations run on VMs made with the same
+// JsonnetVMOpts, vars included, but ext vars, TLAs and native functions
+// set on the VM after JsonnetVM returned are not carried over to them.
+func WithParallelism(n int) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.Parallelism = n
+	}
+}
+
+// WithContinueOnError makes ReadObjects read every path even when some
+// fail instead of stopping at the first failure. The objects of the paths
+// read successfully are then returned with a *ReadErrors listing the
+// errors of the others.
+func WithContinueOnError(enable bool) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.ContinueOnError = enable
+	}
+}
+
+// WithFormat makes Read decode every path as format ("yaml", "json" or
+// "jsonnet") whatever its extension. Standard input still uses the
+// format set by WithStdinFormat.
+func WithFormat(format string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.Format = format
+	}
+}
+
+// WithRawString makes Read load the files and URLs whose extension is not
+// one of a known format as a string, as with importstr, and evaluate the
+// wrapper set by WithRawStringWrapper with it, instead of guessing their
+// format. This lets text assets such as templates be read through the
+// importer, e.g. from URLs.
+func WithRawString(enable bool) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.RawString = enable
+	}
+}
+
+// WithRawStringWrapper sets the jsonnet function WithRawString calls with
+// the content of the raw files, e.g.
+// `function(s) { apiVersion: "v1", kind: "ConfigMap", ... data: { tpl: s } }`.
+// It returns the objects read from the file.
+func WithRawStringWrapper(wrapper string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.RawStringWrapper = wrapper
+	}
+}
+
+// WithStdinFormat sets the format ("yaml", "json" or "jsonnet") of the
+// content read from StdinPath. Defaults to "yaml".
+func WithStdinFormat(format string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.StdinFormat = format
+	}
+}
+
+// WithRecursive allows directories to be read, see ExpandPaths.
+func WithRecursive(recursive bool) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.Recursive = recursive
+	}
+}
+
+// WithExclude skips the files matching any of the glob patterns when
+// reading directories, see ExpandPaths.
+func WithExclude(patterns ...string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.Exclude = append(opts.Exclude, patterns...)
+	}
+}
+
+// WithAllowEmptyGlob makes glob patterns matching no files expand to
+// nothing instead of failing, see ExpandPaths.
+func WithAllowEmptyGlob(allow bool) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.AllowEmptyGlob = allow
+	}
+}
+
+// WithImporter tells ReadContext that the VM read with imports with
+// importer, made by MakeUniversalImporter, so that its imports are aborted
+// too when the context is done. The VM then imports with a derived
+// importer for the duration of the read, which flushes the VM's cache of
+// evaluated imports.
+func WithImporter(importer jsonnet.Importer) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.Importer = importer
+	}
+}
+
+// Read fetches and decodes K8s objects by path. The format is chosen by
+// WithFormat, else by the extension of path, else by sniffing the content
+// of local files with an unknown extension. Errors are *ReadError.
 func Read(vm *jsonnet.VM, path string, opts ...ReadOption) ([]runtime.Object, error) {
-	opt := acquire.MakeReadOptions(opts)
+	return ReadContext(context.Background(), vm, path, opts...)
+}
 
+// ReadContext is like Read, abandoning jsonnet evaluations when ctx is
+// done. Like with WithEvalBudget, vm must not be reused after an
+// abandoned evaluation, which keeps running in the background. Imports
+// are aborted too if the importer of vm is given with WithImporter.
+func ReadContext(ctx context.Context, vm *jsonnet.VM, path string, opts ...ReadOption) ([]runtime.Object, error) {
+	var ret []runtime.Object
+	err := ReadStreamContext(ctx, vm, path, func(obj runtime.Object) error {
+		ret = append(ret, obj)
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ReadStream is like Read, but passes each object to emit as soon as it is
+// decoded instead of returning them all. Jsonnet output is decoded one
+// object at a time, so large outputs aren't held in memory in decoded form
+// as a whole. An error from emit stops the read and is returned.
+func ReadStream(vm *jsonnet.VM, path string, emit func(runtime.Object) error, opts ...ReadOption) error {
+	return ReadStreamContext(context.Background(), vm, path, emit, opts...)
+}
+
+// ReadStreamContext is like ReadStream, abandoning jsonnet evaluations
+// when ctx is done, like ReadContext.
+func ReadStreamContext(ctx context.Context, vm *jsonnet.VM, path string, emit func(runtime.Object) error, opts ...ReadOption) error {
+	if importer := acquire.MakeReadOptions(opts).Importer; importer != nil && ctx.Done() != nil {
+		vm.Importer(DeriveImporter(importer, WithImportContext(ctx)))
+		defer vm.Importer(importer)
+	}
+	opts = append(opts[:len(opts):len(opts)], func(opts *acquire.ReadOptions) {
+		opts.Context = ctx
+	})
+	if err := readStream(vm, path, emit, opts...); err != nil {
+		return newReadError(path, err)
+	}
+	return nil
+}
+
+func readStream(vm *jsonnet.VM, path string, emit func(runtime.Object) error, opts ...ReadOption) error {
+	opt := provenanceReadOptions(acquire.MakeReadOptions(opts))
+
+	if path == StdinPath {
+		return stdinReader(vm, opt, emit)
+	}
+	// Data URLs hold jsonnet made by kubecfg itself (--exec, overlays).
+	if opt.Format != "" && !strings.HasPrefix(path, "data:") {
+		return formatReader(vm, path, strings.ToLower(opt.Format), opt, emit)
+	}
 	if isURL(path) {
-		return jsonnetReader(vm, path, opt)
+		switch ext := urlExt(path); ext {
+		case ".json", ".yaml", ".yml":
+			return remoteReader(vm, path, ext[1:], opt, emit)
+		case ".jsonnet", ".libsonnet":
+		default:
+			if opt.RawString && !strings.HasPrefix(path, "data:") {
+				return rawStringReader(vm, path, opt, emit)
+			}
+		}
+		return jsonnetReader(vm, path, opt, emit)
 	}
 
-	switch filepath.Ext(path) {
+	switch strings.ToLower(filepath.Ext(path)) {
 	case ".json":
-		f, err := os.Open(path)
-		if err != nil {
-			return nil, err
+		return formatReader(vm, path, "json", opt, emit)
+	case ".yaml", ".yml":
+		return formatReader(vm, path, "yaml", opt, emit)
+	case ".jsonnet", ".libsonnet":
+		return jsonnetReader(vm, path, opt, emit)
+	case ".gz":
+		return gzipReader(vm, path, opt, emit)
+	}
+
+	if opt.RawString {
+		return rawStringReader(vm, path, opt, emit)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	format := sniffFormat(content)
+	if format == "" {
+		return categorize(ReadErrorFormat, fmt.Errorf("unknown file extension and undetectable format: %s", path))
+	}
+	log.Debugf("Reading %s as %s", path, format)
+	return formatReader(vm, path, format, opt, emit)
+}
+
+// rawStringReader reads the file or URL at path as a string, through the
+// importer, and evaluates the raw string wrapper with it.
+func rawStringReader(vm *jsonnet.VM, path string, opts acquire.ReadOptions, emit func(runtime.Object) error) error {
+	if opts.RawStringWrapper == "" {
+		return categorize(ReadErrorFormat, fmt.Errorf("reading %s as a raw string requires a wrapper", path))
+	}
+	pathURL, err := PathToURL(path)
+	if err != nil {
+		return err
+	}
+	code := fmt.Sprintf("(%s)(importstr @'%s')", opts.RawStringWrapper, strings.ReplaceAll(pathURL, "'", "''"))
+	return jsonnetEval(vm, path, pathURL, code, opts, emit)
+}
+
+// formatReader reads the file or URL at path as format: "json", "yaml"
+// (or "yml") or "jsonnet".
+func formatReader(vm *jsonnet.VM, path, format string, opts acquire.ReadOptions, emit func(runtime.Object) error) error {
+	switch format {
+	case "json", "yaml", "yml":
+	case "jsonnet":
+		return jsonnetReader(vm, path, opts, emit)
+	default:
+		return categorize(ReadErrorFormat, fmt.Errorf("unknown format %q", format))
+	}
+	if isURL(path) {
+		return remoteReader(vm, path, format, opts, emit)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if format == "json" {
+		return jsonReader(f, path, opts, emit)
+	}
+	return yamlReader(f, path, opts, emit)
+}
+
+// gzipReader decompresses path and decodes the content according to the
+// extension preceding ".gz".
+func gzipReader(vm *jsonnet.VM, path string, opts acquire.ReadOptions, emit func(runtime.Object) error) error {
+	inner := strings.TrimSuffix(path, filepath.Ext(path))
+	ext := strings.ToLower(filepath.Ext(inner))
+	switch ext {
+	case ".json", ".yaml", ".yml", ".jsonnet":
+	default:
+		return categorize(ReadErrorFormat, fmt.Errorf("unknown file extension: %s", path))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return categorize(ReadErrorParse, fmt.Errorf("invalid gzip stream in %s: %w", path, err))
+	}
+	defer gz.Close()
+
+	switch ext {
+	case ".json":
+		err = jsonReader(gz, path, opts, emit)
+	case ".yaml", ".yml":
+		err = yamlReader(gz, path, opts, emit)
+	case ".jsonnet":
+		var content []byte
+		if content, err = ioutil.ReadAll(gz); err != nil {
+			break
+		}
+		var foundAt string
+		if foundAt, err = PathToURL(inner); err != nil {
+			return err
 		}
-		defer f.Close()
-		return jsonReader(f)
-	case ".yaml":
-		f, err := os.Open(path)
+		return jsonnetEval(vm, path, foundAt, string(content), opts, emit)
+	}
+
+	var corrupt flate.CorruptInputError
+	if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.As(err, &corrupt) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return categorize(ReadErrorParse, fmt.Errorf("invalid gzip stream in %s: %w", path, err))
+	}
+	return err
+}
+
+func stdinReader(vm *jsonnet.VM, opts acquire.ReadOptions, emit func(runtime.Object) error) error {
+	switch format := strings.ToLower(opts.StdinFormat); format {
+	case "", "yaml", "yml":
+		return yamlReader(ioutil.NopCloser(stdin), stdinName, opts, emit)
+	case "json":
+		return jsonReader(stdin, stdinName, opts, emit)
+	case "jsonnet":
+		content, err := ioutil.ReadAll(stdin)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		defer f.Close()
-		return yamlReader(f)
-	case ".jsonnet":
-		return jsonnetReader(vm, path, opt)
+		return jsonnetContentReader(vm, stdinName, content, opts, emit)
+	default:
+		return categorize(ReadErrorFormat, fmt.Errorf("unknown stdin format %q", format))
 	}
-	return nil, fmt.Errorf("unknown file extension: %s", path)
 }
 
-func jsonReader(r io.Reader) ([]runtime.Object, error) {
-	data, err := ioutil.ReadAll(r)
+// jsonnetContentReader evaluates jsonnet content that isn't read from a
+// file, resolving its relative imports against the current working
+// directory. name is only used for provenance and error messages.
+func jsonnetContentReader(vm *jsonnet.VM, name string, content []byte, opts acquire.ReadOptions, emit func(runtime.Object) error) error {
+	cwd, err := os.Getwd()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	obj, _, err := unstructured.UnstructuredJSONScheme.Decode(data, nil, nil)
+	foundAt, err := PathToURL(cwd)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	return jsonnetEval(vm, name, foundAt+"/", string(content), opts, emit)
+}
+
+// ReadFrom is like Read, but reads the content of r rather than a path,
+// decoding it as format: "json", "yaml" (or "yml") or "jsonnet". The
+// format is sniffed from the content when empty. Relative imports of
+// jsonnet content are resolved against the current working directory.
+func ReadFrom(vm *jsonnet.VM, r io.Reader, format string, opts ...ReadOption) ([]runtime.Object, error) {
+	opt := provenanceReadOptions(acquire.MakeReadOptions(opts))
+
+	var ret []runtime.Object
+	emit := func(obj runtime.Object) error {
+		ret = append(ret, obj)
+		return nil
+	}
+	if err := readFrom(vm, r, strings.ToLower(format), opt, emit); err != nil {
+		return nil, newReadError(readerName, err)
+	}
+	return ret, nil
+}
+
+func readFrom(vm *jsonnet.VM, r io.Reader, format string, opts acquire.ReadOptions, emit func(runtime.Object) error) error {
+	switch format {
+	case "json":
+		return jsonReader(r, readerName, opts, emit)
+	case "yaml", "yml":
+		return yamlReader(ioutil.NopCloser(r), readerName, opts, emit)
+	case "jsonnet", "":
+	default:
+		return categorize(ReadErrorFormat, fmt.Errorf("unknown format %q", format))
+	}
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		if format = sniffFormat(content); format == "" {
+			return categorize(ReadErrorFormat, errors.New("undetectable format"))
+		}
+		if format != "jsonnet" {
+			return readFrom(vm, bytes.NewReader(content), format, opts, emit)
+		}
+	}
+	return jsonnetContentReader(vm, readerName, content, opts, emit)
+}
+
+// urlExt returns the lowercased extension of the path component of a URL.
+func urlExt(rawURL string) string {
+	if strings.HasPrefix(rawURL, "data:") {
+		return ""
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
 	}
-	return []runtime.Object{obj}, nil
+	return strings.ToLower(filepath.Ext(u.Path))
 }
 
-func yamlReader(r io.ReadCloser) ([]runtime.Object, error) {
-	decoder := yaml.NewYAMLReader(bufio.NewReader(r))
-	ret := []runtime.Object{}
+// remoteReader fetches a YAML or JSON document through the VM's importer,
+// so remote entrypoints are fetched the same way as remote imports.
+func remoteReader(vm *jsonnet.VM, pathURL, format string, opts acquire.ReadOptions, emit func(runtime.Object) error) error {
+	content, _, err := vm.ImportData(pathURL, pathURL)
+	if err != nil {
+		return categorize(ReadErrorNotFound, err)
+	}
+	if format == "json" {
+		return jsonReader(strings.NewReader(content), pathURL, opts, emit)
+	}
+	return yamlReader(ioutil.NopCloser(strings.NewReader(content)), pathURL, opts, emit)
+}
+
+// jsonReader decodes a stream of JSON documents, either concatenated or
+// newline delimited. A document that is a top-level array yields one
+// object per element. file is only used for provenance.
+func jsonReader(r io.Reader, file string, opts acquire.ReadOptions, emit func(runtime.Object) error) error {
+	decoder := json.NewDecoder(r)
+	root := &walkContext{file: file, label: provenanceRootLabel(opts), listOrigin: opts.ListOrigin, requireNames: opts.RequireNames}
+	n := 0
 	for {
-		bytes, err := decoder.Read()
-		if err == io.EOF {
+		var doc json.RawMessage
+		if err := decoder.Decode(&doc); err == io.EOF {
 			break
 		} else if err != nil {
-			return nil, err
+			return categorize(ReadErrorParse, err)
 		}
-		if len(bytes) == 0 {
-			continue
+
+		docs := []json.RawMessage{doc}
+		if trimmed := strings.TrimSpace(string(doc)); strings.HasPrefix(trimmed, "[") {
+			docs = nil
+			if err := json.Unmarshal(doc, &docs); err != nil {
+				return categorize(ReadErrorParse, err)
+			}
 		}
-		jsondata, err := yaml.ToJSON(bytes)
+		for _, d := range docs {
+			if opts.StrictJSON {
+				if err := checkDuplicateKeys(root.child(fmt.Sprintf("[%d]", n)), json.NewDecoder(bytes.NewReader(d))); err != nil {
+					return categorize(ReadErrorParse, err)
+				}
+			}
+			obj, _, err := unstructured.UnstructuredJSONScheme.Decode(d, nil, nil)
+			if err != nil {
+				return categorize(ReadErrorNotObject, err)
+			}
+			if err := checkDocumentNames(root.child(fmt.Sprintf("[%d]", n)), obj); err != nil {
+				return err
+			}
+			annotateDocument(root.child(fmt.Sprintf("[%d]", n)), obj, opts)
+			n++
+			if err := emit(obj); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkDuplicateKeys reads a JSON value from dec, failing if one of its
+// objects has the same key more than once.
+func checkDuplicateKeys(ctx *walkContext, dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		seen := map[string]bool{}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key := tok.(string)
+			if seen[key] {
+				return fmt.Errorf("%s: duplicate key %q", ctx.path(), key)
+			}
+			seen[key] = true
+			if err := checkDuplicateKeys(ctx.child("."+key), dec); err != nil {
+				return err
+			}
+		}
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if err := checkDuplicateKeys(ctx.child(fmt.Sprintf("[%d]", i)), dec); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+	// The closing delimiter.
+	_, err = dec.Token()
+	return err
+}
+
+// yamlReader decodes a stream of YAML documents. Anchors, aliases and
+// merge keys ("<<") are expanded within each document. file is only used
+// for provenance.
+func yamlReader(r io.ReadCloser, file string, opts acquire.ReadOptions, emit func(runtime.Object) error) error {
+	decoder := newYAMLDocumentReader(r)
+	root := &walkContext{file: file, label: provenanceRootLabel(opts), listOrigin: opts.ListOrigin, requireNames: opts.RequireNames}
+	for n := 0; ; n++ {
+		doc, line, err := decoder.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return categorize(ReadErrorParse, err)
+		}
+		jsondata, err := yaml.ToJSON(doc)
 		if err != nil {
-			return nil, err
+			return categorize(ReadErrorParse, err)
+		}
+		// Like empty documents, explicit null ones (and those holding only
+		// comments) are left out, as templates often produce them.
+		if bytes.Equal(bytes.TrimSpace(jsondata), []byte("null")) {
+			continue
 		}
 		obj, _, err := unstructured.UnstructuredJSONScheme.Decode(jsondata, nil, nil)
 		if err != nil {
-			return nil, err
+			return categorize(ReadErrorNotObject, err)
+		}
+		if err := checkDocumentNames(root.child(fmt.Sprintf("[%d]", n)), obj); err != nil {
+			return err
+		}
+		annotateDocument(root.child(fmt.Sprintf("[%d]", n)), obj, opts)
+		annotateLine(obj, line, opts)
+		if err := emit(obj); err != nil {
+			return err
 		}
-		ret = append(ret, obj)
 	}
-	return ret, nil
+	return nil
+}
+
+// yamlDocumentReader splits a stream on "---" separators like
+// yaml.YAMLReader, also keeping track of the line each document starts at.
+type yamlDocumentReader struct {
+	reader *bufio.Reader
+	line   int
+}
+
+func newYAMLDocumentReader(r io.Reader) *yamlDocumentReader {
+	return &yamlDocumentReader{reader: bufio.NewReader(r)}
+}
+
+// Read returns the next non-empty document and the 1-based line of its
+// first non-blank line.
+func (r *yamlDocumentReader) Read() ([]byte, int, error) {
+	const separator = "---"
+	var (
+		buffer bytes.Buffer
+		start  int
+	)
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		if len(line) > 0 {
+			r.line++
+		}
+
+		if bytes.HasPrefix(line, []byte(separator)) {
+			trimmed := strings.TrimSpace(string(line[len(separator):]))
+			// Only comments and spaces may follow the separator.
+			if len(trimmed) > 0 && trimmed[0] != '#' {
+				return nil, 0, fmt.Errorf("invalid document separator at line %d: %q", r.line, strings.TrimSpace(string(line)))
+			}
+			if start != 0 {
+				return buffer.Bytes(), start, nil
+			}
+			buffer.Reset()
+		} else {
+			if start == 0 && len(bytes.TrimSpace(line)) > 0 {
+				start = r.line
+			}
+			buffer.Write(line)
+		}
+
+		if err == io.EOF {
+			if start != 0 {
+				return buffer.Bytes(), start, nil
+			}
+			return nil, 0, io.EOF
+		}
+	}
+}
+
+// annotateLine records the line the YAML document of obj starts at.
+func annotateLine(obj runtime.Object, line int, opts acquire.ReadOptions) {
+	key := AnnotationProvenanceLine
+	if opts.ProvenanceLineKeySet {
+		key = opts.ProvenanceLineKey
+	}
+	if !opts.ShowProvenance || key == "" {
+		return
+	}
+	switch o := obj.(type) {
+	case *unstructured.UnstructuredList:
+		for i := range o.Items {
+			SetMetaDataAnnotation(&o.Items[i], key, strconv.Itoa(line))
+		}
+	case *unstructured.Unstructured:
+		SetMetaDataAnnotation(o, key, strconv.Itoa(line))
+	}
+}
+
+// annotateDocument adds provenance and list origin annotations to an
+// object decoded from a YAML or JSON document, labelling List members
+// like jsonWalk does.
+func annotateDocument(ctx *walkContext, obj runtime.Object, opts acquire.ReadOptions) {
+	if list, ok := obj.(*unstructured.UnstructuredList); ok {
+		for i := range list.Items {
+			ctx.markListItem(&list.Items[i])
+		}
+	}
+	if !opts.ShowProvenance {
+		return
+	}
+	fileKey, pathKey := provenanceKeys(opts)
+	switch o := obj.(type) {
+	case *unstructured.UnstructuredList:
+		for i := range o.Items {
+			annotateProvenance(ctx.child(fmt.Sprintf(".items[%d]", i)), &o.Items[i], fileKey, pathKey)
+		}
+	case *unstructured.Unstructured:
+		annotateProvenance(ctx, o, fileKey, pathKey)
+	}
+}
+
+// checkDocumentNames checks that the objects decoded from a YAML or JSON
+// document, or the members of a List, have a name. See checkName.
+func checkDocumentNames(ctx *walkContext, obj runtime.Object) error {
+	switch o := obj.(type) {
+	case *unstructured.UnstructuredList:
+		for i := range o.Items {
+			if err := checkName(ctx.child(fmt.Sprintf(".items[%d]", i)), &o.Items[i]); err != nil {
+				return err
+			}
+		}
+	case *unstructured.Unstructured:
+		return checkName(ctx, o)
+	}
+	return nil
+}
+
+// checkName fails, when reading for kubecfg.ReadObjects, for objects
+// having neither metadata.name nor metadata.generateName, a common copy
+// and paste mistake otherwise only reported, confusingly, when applying.
+func checkName(ctx *walkContext, o *unstructured.Unstructured) error {
+	if !ctx.requireNames || o.IsList() || o.GetName() != "" || o.GetGenerateName() != "" {
+		return nil
+	}
+	return categorize(ReadErrorInvalidObject, fmt.Errorf("%s: %s has no metadata.name", ctx.path(), o.GetKind()))
 }
 
 type walkContext struct {
 	parent *walkContext
 	label  string
 	file   string
+
+	inheritListMeta bool
+	listOrigin      bool
+	requireNames    bool
+	strict          bool
 }
 
 func (c *walkContext) path() string {
@@ -156,21 +891,50 @@ func (c *walkContext) path() string {
 	return parent + c.label
 }
 
+// markListItem annotates item, a member of the List found at c, with
+// AnnotationListOrigin if enabled.
+func (c *walkContext) markListItem(item *unstructured.Unstructured) {
+	if c.listOrigin {
+		SetMetaDataAnnotation(item, AnnotationListOrigin, c.file+":"+c.path())
+	}
+}
+
 func (c *walkContext) child(label string) *walkContext {
-	return &walkContext{
-		parent: c,
-		label:  label,
-		file:   c.file,
+	ret := *c
+	ret.parent = c
+	ret.label = label
+	return &ret
+}
+
+// provenanceKeys returns the annotation keys used for provenance.
+func provenanceKeys(opts acquire.ReadOptions) (fileKey, pathKey string) {
+	if opts.ProvenanceKeysSet {
+		return opts.ProvenanceFileKey, opts.ProvenancePathKey
 	}
+	return AnnotationProvenanceFile, AnnotationProvenancePath
 }
 
-func annotateProvenance(ctx *walkContext, o *unstructured.Unstructured) {
-	if file := ctx.file; file != "" {
-		SetMetaDataAnnotation(o, AnnotationProvenanceFile, file)
+// provenanceRootLabel returns the label provenance paths start with.
+func provenanceRootLabel(opts acquire.ReadOptions) string {
+	if opts.ProvenanceRootLabelSet {
+		return opts.ProvenanceRootLabel
 	}
-	SetMetaDataAnnotation(o, AnnotationProvenancePath, ctx.path())
+	return "$"
 }
 
+// annotateProvenance records where o was found; empty keys are skipped.
+func annotateProvenance(ctx *walkContext, o *unstructured.Unstructured, fileKey, pathKey string) {
+	if file := ctx.file; file != "" && fileKey != "" {
+		SetMetaDataAnnotation(o, fileKey, file)
+	}
+	if pathKey != "" {
+		SetMetaDataAnnotation(o, pathKey, ctx.path())
+	}
+}
+
+// jsonWalk visits the Kubernetes objects found in obj. Array elements are
+// visited in order, and map values in key order, so objects are never
+// reordered and the output doesn't depend on map iteration order.
 func jsonWalk(parentCtx *walkContext, obj interface{}, visitor func(c *walkContext, obj *unstructured.Unstructured) error) error {
 	switch o := obj.(type) {
 	case nil:
@@ -179,12 +943,23 @@ func jsonWalk(parentCtx *walkContext, obj interface{}, visitor func(c *walkConte
 		if o["kind"] != nil && o["apiVersion"] != nil {
 			obj := unstructured.Unstructured{Object: o}
 			if obj.IsList() {
+				i := 0
 				return obj.EachListItem(func(item runtime.Object) error {
-					return visitor(parentCtx.child(".item"), item.(*unstructured.Unstructured))
+					u := item.(*unstructured.Unstructured)
+					if parentCtx.inheritListMeta {
+						inheritListMetadata(&obj, u)
+					}
+					parentCtx.markListItem(u)
+					ctx := parentCtx.child(fmt.Sprintf(".items[%d]", i))
+					i++
+					return visitor(ctx, u)
 				})
 			}
 			return visitor(parentCtx, &obj)
 		}
+		if parentCtx.strict && (o["kind"] != nil || o["apiVersion"] != nil) {
+			return categorize(ReadErrorNotObject, fmt.Errorf("%s: object has only one of kind and apiVersion", parentCtx.path()))
+		}
 		// Use consistent traversal order
 		keys := make([]string, 0, len(o))
 		for k := range o {
@@ -208,7 +983,96 @@ func jsonWalk(parentCtx *walkContext, obj interface{}, visitor func(c *walkConte
 		}
 		return nil
 	default:
-		return fmt.Errorf("Looking for kubernetes object at %q, but instead found %T", parentCtx.path(), o)
+		return categorize(ReadErrorNotObject, fmt.Errorf("Looking for kubernetes object at %q, but instead found %T", parentCtx.path(), o))
+	}
+}
+
+// jsonStreamWalk is like jsonWalk, but decodes the value to walk from dec
+// as it goes: array elements are decoded and walked one at a time, and so
+// are the fields of objects that aren't Kubernetes objects, which are only
+// held as raw JSON until walked. Only the Kubernetes object being visited
+// is ever fully decoded, which bounds the memory needed for large inputs.
+func jsonStreamWalk(parentCtx *walkContext, dec *json.Decoder, visitor func(c *walkContext, obj *unstructured.Unstructured) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case nil:
+		return nil
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if err := jsonStreamWalk(parentCtx.child(fmt.Sprintf("[%d]", i)), dec, visitor); err != nil {
+				return err
+			}
+		}
+		_, err := dec.Token()
+		return err
+	case json.Delim('{'):
+		fields := map[string]json.RawMessage{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return err
+			}
+			fields[key.(string)] = value
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+
+		isSet := func(k string) bool {
+			v, found := fields[k]
+			return found && string(v) != "null"
+		}
+		if isSet("kind") && isSet("apiVersion") || parentCtx.strict && (isSet("kind") || isSet("apiVersion")) {
+			o := make(map[string]interface{}, len(fields))
+			for k, v := range fields {
+				// Like unstructured.UnstructuredJSONScheme, keep integers
+				// as int64 rather than float64.
+				var value interface{}
+				if err := utiljson.Unmarshal(v, &value); err != nil {
+					return err
+				}
+				o[k] = value
+			}
+			return jsonWalk(parentCtx, o, visitor)
+		}
+
+		// Use consistent traversal order
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			v := fields[k]
+			delete(fields, k)
+			if err := jsonStreamWalk(parentCtx.child(fmt.Sprintf(".%s", k)), json.NewDecoder(bytes.NewReader(v)), visitor); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return categorize(ReadErrorNotObject, fmt.Errorf("Looking for kubernetes object at %q, but instead found %T", parentCtx.path(), tok))
+	}
+}
+
+// inheritListMetadata copies the list's labels and namespace into item,
+// without overriding anything item already sets.
+func inheritListMetadata(list, item *unstructured.Unstructured) {
+	if ns := list.GetNamespace(); ns != "" && item.GetNamespace() == "" {
+		item.SetNamespace(ns)
+	}
+	for k, v := range list.GetLabels() {
+		if _, found := item.GetLabels()[k]; !found {
+			SetMetaDataLabel(item, k, v)
+		}
 	}
 }
 
@@ -226,13 +1090,27 @@ func PathToURL(path string) (string, error) {
 
 func isURL(path string) bool {
 	// TODO: figure a better way to tell filepaths and URLs apart (it also must work on windows...)
-	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "oci://") || strings.HasPrefix(path, "file://") || strings.HasPrefix(path, "data:,")
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "oci://") || strings.HasPrefix(path, "file://") || strings.HasPrefix(path, "tar://") || strings.HasPrefix(path, "data:")
 }
 
+// expandDataURL returns the jsonnet source held by the data URL pathURL,
+// e.g. "data:,{}" or "data:;base64,e30=", and the current working
+// directory, against which its relative imports are resolved.
 func expandDataURL(pathURL string) (string, string, error) {
-	content, err := url.PathUnescape(strings.TrimPrefix(pathURL, "data:,"))
+	header, data, found := strings.Cut(strings.TrimPrefix(pathURL, "data:"), ",")
+	if !found {
+		return "", "", categorize(ReadErrorParse, fmt.Errorf("malformed data URL: missing ','"))
+	}
+	content, err := url.PathUnescape(data)
 	if err != nil {
-		return "", "", err
+		return "", "", categorize(ReadErrorParse, err)
+	}
+	if strings.HasSuffix(header, ";base64") {
+		b, err := base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			return "", "", categorize(ReadErrorParse, fmt.Errorf("malformed data URL: %w", err))
+		}
+		content = string(b)
 	}
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -248,81 +1126,174 @@ func expandDataURL(pathURL string) (string, string, error) {
 	return content, foundAt, nil
 }
 
-func jsonnetReader(vm *jsonnet.VM, path string, opts acquire.ReadOptions) ([]runtime.Object, error) {
+func jsonnetReader(vm *jsonnet.VM, path string, opts acquire.ReadOptions, emit func(runtime.Object) error) error {
 	// TODO(mkm): evaluate expressions in opts.expr
 
+	content, foundAt, err := jsonnetSource(vm, path)
+	if err != nil {
+		return err
+	}
+	return jsonnetEval(vm, path, foundAt, content, opts, emit)
+}
+
+// jsonnetSource returns the content of the jsonnet file or URL at path,
+// and where it was found.
+func jsonnetSource(vm *jsonnet.VM, path string) (content, foundAt string, err error) {
 	pathURL, err := PathToURL(path)
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
+	if strings.HasPrefix(pathURL, "data:") {
+		return expandDataURL(pathURL)
+	}
+	content, foundAt, err = vm.ImportData(pathURL, pathURL)
+	return content, foundAt, categorize(ReadErrorNotFound, err)
+}
 
-	var content, foundAt string
-	if strings.HasPrefix(pathURL, "data:,") {
-		content, foundAt, err = expandDataURL(pathURL)
-	} else {
-		content, foundAt, err = vm.ImportData(pathURL, pathURL)
+// EvaluateRaw evaluates the jsonnet file or URL at path and returns the
+// JSON it produces, before any kubernetes object is extracted from it.
+// Errors are *ReadError.
+func EvaluateRaw(vm *jsonnet.VM, path string, opts ...ReadOption) (json.RawMessage, error) {
+	if path == StdinPath {
+		return nil, newReadError(path, fmt.Errorf("standard input cannot be evaluated as raw jsonnet"))
+	}
+	opt := acquire.MakeReadOptions(opts)
+	content, foundAt, err := jsonnetSource(vm, path)
+	if err != nil {
+		return nil, newReadError(path, err)
 	}
+	jsonstr, err := evaluateSnippet(vm, path, foundAt, content, opt)
 	if err != nil {
-		return nil, err
+		return nil, newReadError(path, categorize(ReadErrorEval, explainFunctionError(path, err)))
 	}
+	return json.RawMessage(jsonstr), nil
+}
 
-	jsonstr, err := vm.EvaluateSnippet(foundAt, content)
+// jsonnetEval evaluates content, found at foundAt, and emits the
+// resulting objects. path is the name recorded in provenance annotations.
+func jsonnetEval(vm *jsonnet.VM, path, foundAt, content string, opts acquire.ReadOptions, emit func(runtime.Object) error) error {
+	source := content
+	if opts.Entrypoint != "" {
+		var err error
+		if source, _, err = jsonnetSource(vm, opts.Entrypoint); err != nil {
+			return err
+		}
+	}
+	directives, err := parseDirectives(source)
 	if err != nil {
-		return nil, err
+		return categorize(ReadErrorParse, err)
+	}
+	if directives.namespace != "" || len(directives.labels) > 0 {
+		inner := emit
+		emit = func(obj runtime.Object) error {
+			if err := directives.apply(obj, opts.RESTMapper); err != nil {
+				return err
+			}
+			return inner(obj)
+		}
+	}
+
+	jsonstr, err := evaluateSnippet(vm, path, foundAt, content, opts)
+	if err != nil {
+		return categorize(ReadErrorEval, explainFunctionError(path, err))
 	}
 
 	log.Debugf("jsonnet result is: %s", jsonstr)
 
 	if opts.ReadTwice {
-		str2, err := vm.EvaluateSnippet(foundAt, content)
+		str2, err := evaluateSnippet(vm, path, foundAt, content, opts)
 		if err != nil {
-			return nil, fmt.Errorf("error re-reading %s: %w", foundAt, err)
+			return categorize(ReadErrorEval, fmt.Errorf("error re-reading %s: %w", foundAt, err))
 		}
 
 		if jsonstr != str2 {
-			return nil, fmt.Errorf("repeat read of %s returned non-idempotent result", foundAt)
+			return categorize(ReadErrorEval, fmt.Errorf("repeat read of %s returned non-idempotent result", foundAt))
 		}
 	}
 
-	var top interface{}
-	if err = json.Unmarshal([]byte(jsonstr), &top); err != nil {
-		return nil, err
-	}
-
-	var ret []runtime.Object
+	fileKey, pathKey := provenanceKeys(opts)
 	visitor := func(c *walkContext, obj *unstructured.Unstructured) error {
+		if err := checkName(c, obj); err != nil {
+			return err
+		}
 		if opts.ShowProvenance {
-			annotateProvenance(c, obj)
+			annotateProvenance(c, obj, fileKey, pathKey)
 		}
-		ret = append(ret, obj)
-		return nil
+		return emit(obj)
 	}
 
-	if err := jsonWalk(&walkContext{file: path, label: "$"}, top, visitor); err != nil {
-		return nil, err
+	root := &walkContext{
+		file:            path,
+		label:           provenanceRootLabel(opts),
+		inheritListMeta: opts.ListMetadataInheritance,
+		listOrigin:      opts.ListOrigin,
+		requireNames:    opts.RequireNames,
+		strict:          opts.StrictWalk,
 	}
+	return jsonStreamWalk(root, json.NewDecoder(strings.NewReader(jsonstr)), visitor)
+}
 
-	return ret, nil
+// explainFunctionError adds a hint to the errors jsonnet returns when a
+// file evaluates to a function, or to a value holding one, since jsonnet's
+// own messages don't say what to do about it.
+func explainFunctionError(path string, err error) error {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "Missing argument:") && strings.Contains(msg, "Top-level function call"):
+		return fmt.Errorf("%s evaluates to a function, pass its parameters as top-level arguments (--tla-str, --tla-code): %w", path, err)
+	case strings.Contains(msg, "couldn't manifest function"):
+		return fmt.Errorf("%s evaluates to a value containing a function, which cannot be output: call it, or hide the field holding it with '::': %w", path, err)
+	}
+	return err
+}
+
+// FlattenOption configures FlattenToV1.
+type FlattenOption func(*flattenOpts)
+
+type flattenOpts struct {
+	listOrigin bool
+}
+
+// WithListOrigin makes FlattenToV1 annotate the members of each List with
+// AnnotationListOrigin, set to the position of the List among the objects
+// flattened, so that they can be grouped back into Lists. Objects that
+// weren't in a List are left as they are.
+func WithListOrigin(enable bool) FlattenOption {
+	return func(opts *flattenOpts) {
+		opts.listOrigin = enable
+	}
 }
 
 // FlattenToV1 expands any List-type objects into their members, and
-// cooerces everything to v1.Unstructured.  Panics if coercion
-// encounters an unexpected object type.
-func FlattenToV1(objs []runtime.Object) []*unstructured.Unstructured {
+// cooerces everything to v1.Unstructured. Typed objects are converted
+// with the default unstructured converter.
+func FlattenToV1(objs []runtime.Object, opt ...FlattenOption) ([]*unstructured.Unstructured, error) {
+	var opts flattenOpts
+	for _, o := range opt {
+		o(&opts)
+	}
+
 	ret := make([]*unstructured.Unstructured, 0, len(objs))
-	for _, obj := range objs {
+	for n, obj := range objs {
 		switch o := obj.(type) {
 		case *unstructured.UnstructuredList:
 			for i := range o.Items {
+				if opts.listOrigin {
+					SetMetaDataAnnotation(&o.Items[i], AnnotationListOrigin, strconv.Itoa(n))
+				}
 				ret = append(ret, &o.Items[i])
 			}
 		case *unstructured.Unstructured:
 			ret = append(ret, o)
 		default:
-			panic("Unexpected unstructured object type")
+			u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert %T to unstructured: %w", obj, err)
+			}
+			ret = append(ret, &unstructured.Unstructured{Object: u})
 		}
 	}
-	return ret
+	return ret, nil
 }
 
 func ToDataURL(code string) string {
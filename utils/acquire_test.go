@@ -16,13 +16,30 @@
 package utils
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	goruntime "runtime"
 	"sort"
+	"strings"
 	"testing"
 
+	jsonnet "github.com/google/go-jsonnet"
+	"github.com/kubecfg/kubecfg/internal/acquire"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 func TestJsonWalk(t *testing.T) {
@@ -54,6 +71,25 @@ func TestJsonWalk(t *testing.T) {
 		},
 	}
 
+	fooItemP := map[string]interface{}{
+		"apiVersion": "test",
+		"kind":       "Foo",
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				AnnotationProvenancePath: "$.list.items[0]",
+			},
+		},
+	}
+	barItemP := map[string]interface{}{
+		"apiVersion": "test",
+		"kind":       "Bar",
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				AnnotationProvenancePath: "$.list.items[1]",
+			},
+		},
+	}
+
 	tests := []struct {
 		input      string
 		provenance bool
@@ -103,6 +139,12 @@ func TestJsonWalk(t *testing.T) {
 			provenance: true,
 			result:     []interface{}{barObjP, fooObjP},
 		},
+		{
+			// List items with provenance
+			input:      `{"list": {"apiVersion": "v1", "kind": "List", "items": [{"apiVersion": "test", "kind": "Foo"}, {"apiVersion": "test", "kind": "Bar"}]}}`,
+			provenance: true,
+			result:     []interface{}{barItemP, fooItemP},
+		},
 		{
 			// Error: nested misplaced value
 			input: `{"foo": {"bar": [null, 42]}}`,
@@ -110,46 +152,1080 @@ func TestJsonWalk(t *testing.T) {
 		},
 	}
 
-	for i, test := range tests {
-		t.Run(fmt.Sprint(i), func(t *testing.T) {
-			t.Logf("%d: %s, %v", i, test.input, test.provenance)
+	walkers := map[string]func(input string, visitor func(c *walkContext, obj *unstructured.Unstructured) error) error{
+		"decoded": func(input string, visitor func(c *walkContext, obj *unstructured.Unstructured) error) error {
 			var top interface{}
-			if err := json.Unmarshal([]byte(test.input), &top); err != nil {
-				t.Fatalf("Failed to unmarshal %q: %v", test.input, err)
+			if err := json.Unmarshal([]byte(input), &top); err != nil {
+				t.Fatalf("Failed to unmarshal %q: %v", input, err)
 			}
-			objs := []interface{}{}
-			err := jsonWalk(&walkContext{label: "$"}, top, func(c *walkContext, obj *unstructured.Unstructured) error {
-				if test.provenance {
-					annotateProvenance(c, obj)
+			return jsonWalk(&walkContext{label: "$"}, top, visitor)
+		},
+		"stream": func(input string, visitor func(c *walkContext, obj *unstructured.Unstructured) error) error {
+			return jsonStreamWalk(&walkContext{label: "$"}, json.NewDecoder(strings.NewReader(input)), visitor)
+		},
+	}
+
+	for i, test := range tests {
+		for name, walk := range walkers {
+			t.Run(fmt.Sprint(i, name), func(t *testing.T) {
+				t.Logf("%d: %s, %v", i, test.input, test.provenance)
+				objs := []interface{}{}
+				err := walk(test.input, func(c *walkContext, obj *unstructured.Unstructured) error {
+					if test.provenance {
+						annotateProvenance(c, obj, AnnotationProvenanceFile, AnnotationProvenancePath)
+					}
+					objs = append(objs, obj.Object)
+					return nil
+				})
+				if test.error != "" {
+					// expect error
+					if err == nil {
+						t.Fatalf("Test %d failed to fail", i)
+					}
+					if err.Error() != test.error {
+						t.Fatalf("Test %d failed with %q but expected %q", i, err, test.error)
+					}
+					return
 				}
-				objs = append(objs, obj.Object)
-				return nil
-			})
-			if test.error != "" {
-				// expect error
-				if err == nil {
-					t.Fatalf("Test %d failed to fail", i)
+
+				// expect success
+				if err != nil {
+					t.Fatalf("Test %d failed: %v", i, err)
 				}
-				if err.Error() != test.error {
-					t.Fatalf("Test %d failed with %q but expected %q", i, err, test.error)
+				keyFunc := func(i int) string {
+					v := objs[i].(map[string]interface{})
+					return v["kind"].(string)
 				}
-				return
+				sort.Slice(objs, func(i, j int) bool {
+					return keyFunc(i) < keyFunc(j)
+				})
+				if !reflect.DeepEqual(objs, test.result) {
+					t.Errorf("Expected %v, got %v", test.result, objs)
+				}
+			})
+		}
+	}
+}
+
+func TestJsonStreamWalkMemory(t *testing.T) {
+	const n = 10000
+	var b strings.Builder
+	b.WriteString(`{"app": {"objects": [`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "cm%d", "labels": {"app": "test"}}, "data": {"key": "%s"}}`, i, strings.Repeat("x", 100))
+	}
+	b.WriteString(`]}}`)
+	input := b.String()
+
+	heap := func() uint64 {
+		var m goruntime.MemStats
+		goruntime.GC()
+		goruntime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+
+	// The input is already in memory: only count what walking it adds.
+	base := heap()
+	var peak uint64
+	count := 0
+	err := jsonStreamWalk(&walkContext{label: "$"}, json.NewDecoder(strings.NewReader(input)), func(c *walkContext, obj *unstructured.Unstructured) error {
+		if count++; count%1000 == 0 {
+			if h := heap(); h > peak {
+				peak = h
 			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Fatalf("expected %d objects, got %d", n, count)
+	}
 
-			// expect success
+	// Decoding the whole input takes several times its size; streaming
+	// only needs the raw JSON of the branch being walked.
+	if peak > base && peak-base > uint64(2*len(input)) {
+		t.Errorf("walking %d bytes of JSON used %d bytes of heap", len(input), peak-base)
+	}
+}
+
+func TestJsonWalkListMetadataInheritance(t *testing.T) {
+	input := `{
+		"apiVersion": "v1",
+		"kind": "List",
+		"metadata": {"namespace": "listns", "labels": {"team": "a", "tier": "list"}},
+		"items": [
+			{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "inherits"}},
+			{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "overrides", "namespace": "own", "labels": {"tier": "own"}}}
+		]
+	}`
+	var top interface{}
+	if err := json.Unmarshal([]byte(input), &top); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, inherit := range []bool{false, true} {
+		t.Run(fmt.Sprint(inherit), func(t *testing.T) {
+			var objs []*unstructured.Unstructured
+			ctx := &walkContext{label: "$", inheritListMeta: inherit}
+			err := jsonWalk(ctx, top, func(c *walkContext, obj *unstructured.Unstructured) error {
+				objs = append(objs, obj)
+				return nil
+			})
 			if err != nil {
-				t.Fatalf("Test %d failed: %v", i, err)
+				t.Fatal(err)
+			}
+			if len(objs) != 2 {
+				t.Fatalf("expected 2 objects, got %d", len(objs))
+			}
+
+			inherits, overrides := objs[0], objs[1]
+			if !inherit {
+				if inherits.GetNamespace() != "" || len(inherits.GetLabels()) != 0 {
+					t.Errorf("unexpected inheritance: %v", inherits.Object)
+				}
+				return
 			}
-			keyFunc := func(i int) string {
-				v := objs[i].(map[string]interface{})
-				return v["kind"].(string)
+			if got := inherits.GetNamespace(); got != "listns" {
+				t.Errorf("expected namespace listns, got %q", got)
 			}
-			sort.Slice(objs, func(i, j int) bool {
-				return keyFunc(i) < keyFunc(j)
+			if got, want := inherits.GetLabels(), map[string]string{"team": "a", "tier": "list"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected labels %v, got %v", want, got)
+			}
+			if got := overrides.GetNamespace(); got != "own" {
+				t.Errorf("expected namespace own, got %q", got)
+			}
+			if got, want := overrides.GetLabels(), map[string]string{"team": "a", "tier": "own"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("expected labels %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestJsonWalkStrict(t *testing.T) {
+	input := `{
+		"good": {"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "good"}},
+		"nested": {"typo": {"apiVersion": "apps/v1", "kimd": "Deployment"}}
+	}`
+	var top interface{}
+	if err := json.Unmarshal([]byte(input), &top); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprint(strict), func(t *testing.T) {
+			var objs []*unstructured.Unstructured
+			ctx := &walkContext{label: "$", strict: strict}
+			err := jsonWalk(ctx, top, func(c *walkContext, obj *unstructured.Unstructured) error {
+				objs = append(objs, obj)
+				return nil
 			})
-			if !reflect.DeepEqual(objs, test.result) {
-				t.Errorf("Expected %v, got %v", test.result, objs)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if got := strings.Contains(err.Error(), `$.nested.typo: object has only one of kind and apiVersion`); got != strict {
+				t.Errorf("unexpected error for strict=%v: %v", strict, err)
 			}
 		})
 	}
 }
+
+func TestReadMapOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "objs.jsonnet")
+	var b strings.Builder
+	b.WriteString("{\n")
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&b, "  k%02d: { apiVersion: 'v1', kind: 'ConfigMap', metadata: { name: 'cm%02d' } },\n", 19-i, i)
+	}
+	b.WriteString("}\n")
+	if err := os.WriteFile(path, []byte(b.String()), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	names := func() []string {
+		objs, err := Read(vm, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, o := range objs {
+			names = append(names, o.(*unstructured.Unstructured).GetName())
+		}
+		return names
+	}
+	first := names()
+	if first[0] != "cm19" || first[19] != "cm00" {
+		t.Errorf("objects not in key order: %v", first)
+	}
+	for i := 0; i < 5; i++ {
+		if got := names(); !reflect.DeepEqual(got, first) {
+			t.Fatalf("order changed between runs: %v != %v", got, first)
+		}
+	}
+}
+
+func TestReadArrayOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "objs.jsonnet")
+	cm := func(name string) string {
+		return fmt.Sprintf("{ apiVersion: 'v1', kind: 'ConfigMap', metadata: { name: '%s' } }", name)
+	}
+	// Arrays keep the order they were written in, including those held
+	// by map keys, which are walked in key order.
+	content := fmt.Sprintf("[%s, %s, { b: [%s, %s], a: [%s, %s] }, %s]",
+		cm("z"), cm("a"), cm("y"), cm("b"), cm("x"), cm("c"), cm("m"))
+	if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	objs, err := Read(vm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, o := range objs {
+		names = append(names, o.(*unstructured.Unstructured).GetName())
+	}
+	if want := []string{"z", "a", "x", "c", "y", "b", "m"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+}
+
+func TestReadMissingName(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		file, content, want string
+	}{
+		{"a.jsonnet", `{ ok: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "a" } }, bad: [{ apiVersion: "v1", kind: "Namespace" }] }`, "$.bad[0]: Namespace has no metadata.name"},
+		{"b.jsonnet", `{ apiVersion: "v1", kind: "List", items: [{ apiVersion: "v1", kind: "Pod", metadata: { namespace: "x" } }] }`, "$.items[0]: Pod has no metadata.name"},
+		{"c.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: c\n---\napiVersion: v1\nkind: ConfigMap\n", "$[1]: ConfigMap has no metadata.name"},
+		{"d.json", `[{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"labels": {"a": "b"}}}]`, "$[0]: ConfigMap has no metadata.name"},
+		{"e.yaml", "apiVersion: batch/v1\nkind: Job\nmetadata:\n  generateName: e-\n", ""},
+	} {
+		path := filepath.Join(dir, tc.file)
+		if err := os.WriteFile(path, []byte(tc.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		vm := jsonnet.MakeVM()
+		vm.Importer(MakeUniversalImporter(nil, false))
+		// Only kubecfg.ReadObjects requires names.
+		if _, err := Read(vm, path); err != nil {
+			t.Errorf("%s: %v", tc.file, err)
+		}
+		_, err := Read(vm, path, func(o *acquire.ReadOptions) { o.RequireNames = true })
+		if tc.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.file, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want %q", tc.file, err, tc.want)
+		}
+		var re *ReadError
+		if !errors.As(err, &re) || re.Category != ReadErrorInvalidObject {
+			t.Errorf("%s: got error %#v, want a ReadErrorInvalidObject ReadError", tc.file, err)
+		}
+	}
+}
+
+func TestReadIntegers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deploy.jsonnet")
+	content := `{
+  apiVersion: "apps/v1", kind: "Deployment", metadata: { name: "x" },
+  spec: { replicas: 3, ratio: 0.5, port: 65535, memory: 64 * 1024 * 1024 * 1024, maxInt: 9007199254740992 },
+}`
+	if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	objs, err := Read(vm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := objs[0].(*unstructured.Unstructured).Object["spec"].(map[string]interface{})
+	want := map[string]interface{}{
+		"replicas": int64(3),
+		"ratio":    0.5,
+		"port":     int64(65535),
+		"memory":   int64(68719476736),
+		"maxInt":   int64(9007199254740992),
+	}
+	if !reflect.DeepEqual(spec, want) {
+		t.Errorf("got %#v, want %#v", spec, want)
+	}
+
+	b, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"maxInt":9007199254740992,"memory":68719476736,"port":65535,"ratio":0.5,"replicas":3}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestReadExtensions(t *testing.T) {
+	dir := t.TempDir()
+	const yamlDoc = "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\n"
+	const jsonDoc = `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "foo"}}`
+	for name, content := range map[string]string{
+		"a.yml":  yamlDoc,
+		"b.YAML": yamlDoc,
+		"c.JSON": jsonDoc,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		objs, err := Read(nil, path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(objs) != 1 {
+			t.Errorf("%s: expected 1 object, got %d", name, len(objs))
+		}
+	}
+
+	if _, err := Read(nil, filepath.Join(dir, "d.txt")); err == nil {
+		t.Errorf("expected unknown file extension error")
+	}
+}
+
+func TestReadSniffedFormat(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.tmp": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\n",
+		"b.tmp": `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "foo"}}`,
+		"c.tmp": `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "f" + "oo" } }`,
+		"d":     `local name = "foo"; { apiVersion: "v1", kind: "ConfigMap", metadata: { name: name } }`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		objs, err := Read(vm, path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(objs) != 1 || objs[0].(*unstructured.Unstructured).GetName() != "foo" {
+			t.Errorf("%s: unexpected objects %v", name, objs)
+		}
+	}
+
+	path := filepath.Join(dir, "e.tmp")
+	if err := os.WriteFile(path, []byte("not a manifest"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(vm, path); err == nil || !strings.Contains(err.Error(), "undetectable format") {
+		t.Errorf("expected an undetectable format error, got %v", err)
+	}
+
+	// WithFormat overrides both the extension and sniffing.
+	path = filepath.Join(dir, "f.json")
+	if err := os.WriteFile(path, []byte("{ apiVersion: 'v1', kind: 'ConfigMap', metadata: { name: 'foo' } }"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(vm, path); err == nil {
+		t.Errorf("expected %s to fail as JSON", path)
+	}
+	objs, err := Read(vm, path, WithFormat("jsonnet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 {
+		t.Errorf("expected 1 object, got %d", len(objs))
+	}
+	if _, err := Read(vm, path, WithFormat("toml")); err == nil || !strings.Contains(err.Error(), `unknown format "toml"`) {
+		t.Errorf("expected an unknown format error, got %v", err)
+	}
+}
+
+func TestReadRawString(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "remote {{ .Name }}\n")
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.tpl")
+	if err := os.WriteFile(path, []byte("local {{ .Name }}\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	wrapper := `function(s) { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "tpl" }, data: { tpl: s } }`
+	for p, want := range map[string]string{
+		path:                 "local {{ .Name }}\n",
+		srv.URL + "/app.tpl": "remote {{ .Name }}\n",
+	} {
+		objs, err := Read(vm, p, WithRawString(true), WithRawStringWrapper(wrapper))
+		if err != nil {
+			t.Errorf("%s: %v", p, err)
+			continue
+		}
+		o := mustFlatten(t, objs)
+		if got, _, _ := unstructured.NestedString(o[0].Object, "data", "tpl"); len(o) != 1 || got != want {
+			t.Errorf("%s: unexpected objects %v", p, o)
+		}
+	}
+
+	if _, err := Read(vm, path, WithRawString(true)); err == nil {
+		t.Errorf("expected an error without a wrapper")
+	}
+}
+
+func TestEvaluateRaw(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.jsonnet")
+	if err := os.WriteFile(path, []byte(`{ values: [1, 2], cm: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "foo" } } }`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	raw, err := EvaluateRaw(vm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := got["values"]; !found || len(got) != 2 {
+		t.Errorf("expected the whole evaluated tree, got %s", raw)
+	}
+
+	raw, err = EvaluateRaw(vm, ToDataURL(`[]`))
+	if err != nil || strings.TrimSpace(string(raw)) != "[ ]" {
+		t.Errorf("got %q, %v", raw, err)
+	}
+
+	_, err = EvaluateRaw(vm, ToDataURL(`error "boom"`))
+	var re *ReadError
+	if !errors.As(err, &re) || re.Category != ReadErrorEval {
+		t.Errorf("expected an evaluation ReadError, got %v", err)
+	}
+}
+
+func TestReadFunctionEntrypoint(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"app.libsonnet": `function(name) { cm: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: name } } }`,
+		"field.jsonnet": `{ cm: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "foo" } }, f(x): x }`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := filepath.Join(dir, "app.libsonnet")
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	_, err := Read(vm, app)
+	if err == nil || !strings.Contains(err.Error(), "evaluates to a function, pass its parameters as top-level arguments") {
+		t.Errorf("expected a hint about top-level arguments, got %v", err)
+	}
+
+	vm.TLAVar("name", "foo")
+	objs, err := Read(vm, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 || objs[0].(*unstructured.Unstructured).GetName() != "foo" {
+		t.Errorf("unexpected objects %v", objs)
+	}
+
+	_, err = Read(vm, filepath.Join(dir, "field.jsonnet"))
+	if err == nil || !strings.Contains(err.Error(), "hide the field holding it with '::'") {
+		t.Errorf("expected a hint about hiding the function, got %v", err)
+	}
+}
+
+func TestReadStdin(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+
+	for _, tc := range []struct {
+		format, input string
+	}{
+		{"", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\n"},
+		{"json", `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "foo"}}`},
+		{"jsonnet", `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "f" + "oo" } }`},
+	} {
+		stdin = strings.NewReader(tc.input)
+		objs, err := Read(jsonnet.MakeVM(), StdinPath, WithStdinFormat(tc.format), WithProvenance(true))
+		if err != nil {
+			t.Errorf("format %q: %v", tc.format, err)
+			continue
+		}
+		o := mustFlatten(t, objs)
+		if len(o) != 1 || o[0].GetName() != "foo" {
+			t.Errorf("format %q: unexpected objects %v", tc.format, o)
+			continue
+		}
+		if tc.format == "jsonnet" {
+			if got := o[0].GetAnnotations()[AnnotationProvenanceFile]; got != "<stdin>" {
+				t.Errorf("unexpected provenance file %q", got)
+			}
+		}
+	}
+
+	stdin = strings.NewReader("")
+	if _, err := Read(nil, StdinPath, WithStdinFormat("toml")); err == nil {
+		t.Errorf("expected unknown format error")
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "name.libsonnet"), []byte(`"foo"`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter([]*url.URL{dirURL(dir)}, false))
+
+	for _, tc := range []struct {
+		format, input string
+	}{
+		{"yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\n"},
+		{"json", `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "foo"}}`},
+		{"jsonnet", `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: import "name.libsonnet" } }`},
+		{"", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\n"},
+		{"", `local name = import "name.libsonnet"; { apiVersion: "v1", kind: "ConfigMap", metadata: { name: name } }`},
+	} {
+		objs, err := ReadFrom(vm, strings.NewReader(tc.input), tc.format, WithProvenance(true))
+		if err != nil {
+			t.Errorf("format %q: %v", tc.format, err)
+			continue
+		}
+		o := mustFlatten(t, objs)
+		if len(o) != 1 || o[0].GetName() != "foo" {
+			t.Errorf("format %q: unexpected objects %v", tc.format, o)
+			continue
+		}
+		if got := o[0].GetAnnotations()[AnnotationProvenanceFile]; got != "<reader>" {
+			t.Errorf("format %q: unexpected provenance file %q", tc.format, got)
+		}
+	}
+
+	_, err := ReadFrom(vm, strings.NewReader("{"), "jsonnet")
+	var rerr *ReadError
+	if !errors.As(err, &rerr) || rerr.Path != "<reader>" || rerr.Category != ReadErrorEval {
+		t.Errorf("expected an eval ReadError, got %v", err)
+	}
+	if _, err := ReadFrom(vm, strings.NewReader(""), "toml"); err == nil {
+		t.Errorf("expected unknown format error")
+	}
+}
+
+func TestReadDataURL(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+
+	code := `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "f" + "oo" } }`
+	b64 := base64.StdEncoding.EncodeToString([]byte(code))
+	for _, path := range []string{
+		ToDataURL(code),
+		"data:;base64," + b64,
+		"data:application/x-jsonnet;base64," + b64,
+	} {
+		objs, err := Read(vm, path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		o := mustFlatten(t, objs)
+		if len(o) != 1 || o[0].GetName() != "foo" {
+			t.Errorf("%s: unexpected objects %v", path, o)
+		}
+	}
+
+	_, err := Read(vm, "data:;base64,not base64!")
+	var rerr *ReadError
+	if !errors.As(err, &rerr) || rerr.Category != ReadErrorParse {
+		t.Errorf("expected a parse ReadError, got %v", err)
+	}
+}
+
+func TestReadURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app.yaml":
+			fmt.Fprint(w, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\n")
+		case "/app.json":
+			fmt.Fprint(w, `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "foo"}}`)
+		case "/app.jsonnet":
+			fmt.Fprint(w, `(import "lib.libsonnet") { metadata: { name: "foo" } }`)
+		case "/lib.libsonnet":
+			fmt.Fprint(w, `{ apiVersion: "v1", kind: "ConfigMap" }`)
+		case "/loop.yaml":
+			http.Redirect(w, r, "/loop.yaml", http.StatusFound)
+		default:
+			http.Error(w, "boom", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+
+	for _, p := range []string{"/app.yaml", "/app.json", "/app.jsonnet"} {
+		objs, err := Read(vm, srv.URL+p)
+		if err != nil {
+			t.Errorf("%s: %v", p, err)
+			continue
+		}
+		if o := mustFlatten(t, objs); len(o) != 1 || o[0].GetName() != "foo" {
+			t.Errorf("%s: unexpected objects %v", p, o)
+		}
+	}
+
+	for p, msg := range map[string]string{
+		"/broken.yaml": srv.URL + "/broken.yaml: 500",
+		"/loop.yaml":   "redirects",
+	} {
+		_, err := Read(vm, srv.URL+p)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected error containing %q, got %v", p, msg, err)
+		}
+	}
+}
+
+func TestJsonReaderMultiDoc(t *testing.T) {
+	obj := func(n string) string {
+		return fmt.Sprintf(`{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": %q}}`, n)
+	}
+	for _, tc := range []struct {
+		name, input string
+	}{
+		{"single", obj("a")},
+		{"array", "[" + obj("a") + ", " + obj("b") + "]"},
+		{"ndjson", obj("a") + "\n" + obj("b") + "\n"},
+		{"concatenated", obj("a") + obj("b")},
+	} {
+		var objs []runtime.Object
+		if err := jsonReader(strings.NewReader(tc.input), "", acquire.ReadOptions{}, collect(&objs)); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var names []string
+		for _, o := range mustFlatten(t, objs) {
+			names = append(names, o.GetName())
+		}
+		expected := []string{"a", "b"}
+		if tc.name == "single" {
+			expected = expected[:1]
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, expected, names)
+		}
+	}
+
+	if err := jsonReader(strings.NewReader(obj("a")+"{"), "", acquire.ReadOptions{}, collect(new([]runtime.Object))); err == nil {
+		t.Errorf("expected error for truncated document")
+	}
+}
+
+func TestJsonReaderStrict(t *testing.T) {
+	for _, tc := range []struct {
+		input, want string
+	}{
+		{`{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "a"}, "metadata": {"name": "b"}}`, `$[0]: duplicate key "metadata"`},
+		{`{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "a", "labels": {"x": "1", "x": "2"}}}`, `$[0].metadata.labels: duplicate key "x"`},
+		{`[{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "a"}}, {"apiVersion": "v1", "kind": "List", "items": [{"apiVersion": "v1", "kind": "Pod", "kind": "Pod", "metadata": {"name": "p"}}]}]`, `$[1].items[0]: duplicate key "kind"`},
+		{`{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "a"}, "data": {"a": "{\"x\": 1, \"x\": 2}"}}`, ""},
+	} {
+		// Without WithStrictJSON, the last value wins.
+		if err := jsonReader(strings.NewReader(tc.input), "", acquire.ReadOptions{}, collect(new([]runtime.Object))); err != nil {
+			t.Errorf("%s: %v", tc.input, err)
+		}
+
+		err := jsonReader(strings.NewReader(tc.input), "", acquire.MakeReadOptions([]ReadOption{WithStrictJSON(true)}), collect(new([]runtime.Object)))
+		if tc.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.input, err)
+			}
+		} else if err == nil || err.Error() != tc.want {
+			t.Errorf("%s: got error %v, want %q", tc.input, err, tc.want)
+		}
+	}
+}
+
+func TestReadGzip(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	gz := func(s string) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(s))
+		w.Close()
+		return buf.Bytes()
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+
+	write("lib.libsonnet", []byte(`{ apiVersion: "v1", kind: "ConfigMap" }`))
+	for name, content := range map[string]string{
+		"a.yaml.gz":    "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\n",
+		"b.json.gz":    `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "foo"}}`,
+		"c.jsonnet.gz": `(import "lib.libsonnet") { metadata: { name: "foo" } }`,
+	} {
+		objs, err := Read(vm, write(name, gz(content)))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if o := mustFlatten(t, objs); len(o) != 1 || o[0].GetName() != "foo" {
+			t.Errorf("%s: unexpected objects %v", name, o)
+		}
+	}
+
+	corrupt := gz("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: foo\n")
+	corrupt[len(corrupt)-5] ^= 0xff
+	for _, path := range []string{
+		write("bad.yaml.gz", []byte("not gzip")),
+		write("corrupt.yaml.gz", corrupt),
+	} {
+		_, err := Read(nil, path)
+		if err == nil || !strings.Contains(err.Error(), "invalid gzip stream in "+path) {
+			t.Errorf("%s: expected invalid gzip error, got %v", path, err)
+		}
+	}
+
+	if _, err := Read(nil, write("d.txt.gz", gz(""))); err == nil {
+		t.Errorf("expected unknown file extension error")
+	}
+}
+
+func mustFlatten(t *testing.T, objs []runtime.Object) []*unstructured.Unstructured {
+	t.Helper()
+	res, err := FlattenToV1(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// collect returns an emit function for the streaming readers that appends
+// to objs.
+func collect(objs *[]runtime.Object) func(runtime.Object) error {
+	return func(obj runtime.Object) error {
+		*objs = append(*objs, obj)
+		return nil
+	}
+}
+
+func TestFlattenToV1(t *testing.T) {
+	pod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "typed"},
+	}
+	list := &unstructured.UnstructuredList{Items: []unstructured.Unstructured{
+		{Object: map[string]interface{}{"apiVersion": "v1", "kind": "ConfigMap", "metadata": map[string]interface{}{"name": "a"}}},
+		{Object: map[string]interface{}{"apiVersion": "v1", "kind": "ConfigMap", "metadata": map[string]interface{}{"name": "b"}}},
+	}}
+
+	res, err := FlattenToV1([]runtime.Object{list, pod})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, o := range res {
+		names = append(names, o.GetKind()+"/"+o.GetName())
+	}
+	expected := []string{"ConfigMap/a", "ConfigMap/b", "Pod/typed"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestFlattenToV1ListOrigin(t *testing.T) {
+	cm := func(name string) unstructured.Unstructured {
+		return unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "ConfigMap", "metadata": map[string]interface{}{"name": name}}}
+	}
+	objs := func() []runtime.Object {
+		single := cm("c")
+		return []runtime.Object{
+			&unstructured.UnstructuredList{Items: []unstructured.Unstructured{cm("a"), cm("b")}},
+			&single,
+			&unstructured.UnstructuredList{Items: []unstructured.Unstructured{cm("d")}},
+		}
+	}
+
+	res, err := FlattenToV1(objs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range res {
+		if o.GetAnnotations() != nil {
+			t.Errorf("%s: unexpected annotations %v", o.GetName(), o.GetAnnotations())
+		}
+	}
+
+	res, err = FlattenToV1(objs(), WithListOrigin(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, o := range res {
+		if origin, found := o.GetAnnotations()[AnnotationListOrigin]; found {
+			got[o.GetName()] = origin
+		}
+	}
+	if want := map[string]string{"a": "0", "b": "0", "d": "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProvenanceKeys(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.jsonnet")
+	if err := os.WriteFile(path, []byte(`{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "a" } }`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+
+	for _, tc := range []struct {
+		opts     []ReadOption
+		expected map[string]string
+	}{
+		{
+			opts:     []ReadOption{WithProvenance(true)},
+			expected: map[string]string{AnnotationProvenanceFile: path, AnnotationProvenancePath: "$"},
+		},
+		{
+			opts:     []ReadOption{WithProvenance(true), WithProvenanceKeys("example.com/file", "example.com/path")},
+			expected: map[string]string{"example.com/file": path, "example.com/path": "$"},
+		},
+		{
+			opts:     []ReadOption{WithProvenance(true), WithProvenanceKeys("", "example.com/path")},
+			expected: map[string]string{"example.com/path": "$"},
+		},
+	} {
+		objs, err := Read(vm, path, tc.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mustFlatten(t, objs)[0].GetAnnotations(); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("expected %v, got %v", tc.expected, got)
+		}
+	}
+}
+
+func TestYamlJsonProvenance(t *testing.T) {
+	dir := t.TempDir()
+	cm := func(name string) string {
+		return fmt.Sprintf(`{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": %q}}`, name)
+	}
+	files := map[string]string{
+		"a.yaml": "---\n" + cm("a") + "\n---\n" + cm("b") + "\n",
+		"b.json": "[" + cm("a") + "," + cm("b") + "]",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		objs, err := Read(nil, path, WithProvenance(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, o := range mustFlatten(t, objs) {
+			expected := map[string]string{
+				AnnotationProvenanceFile: path,
+				AnnotationProvenancePath: fmt.Sprintf("$[%d]", i),
+			}
+			if name == "a.yaml" {
+				expected[AnnotationProvenanceLine] = fmt.Sprint(2 * (i + 1))
+			}
+			if got := o.GetAnnotations(); !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s: expected %v, got %v", name, expected, got)
+			}
+		}
+	}
+}
+
+func TestYamlReaderNullDocuments(t *testing.T) {
+	input := `---
+null
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+---
+~
+--- # only a comment
+# and another
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+---
+null
+`
+	var objs []runtime.Object
+	if err := yamlReader(io.NopCloser(strings.NewReader(input)), "a.yaml", acquire.ReadOptions{}, collect(&objs)); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, o := range mustFlatten(t, objs) {
+		names = append(names, o.GetName())
+	}
+	if expected := []string{"a", "b"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected objects %v, got %v", expected, names)
+	}
+}
+
+func TestYamlReaderMergeKeys(t *testing.T) {
+	input := `apiVersion: v1
+kind: List
+items:
+- &base
+  apiVersion: v1
+  kind: ConfigMap
+  metadata: {name: base, labels: &labels {app: web}}
+  data: &data {a: "1", b: "2"}
+- <<: *base
+  metadata: {name: one, labels: *labels}
+- <<: [*base]
+  metadata:
+    name: two
+    labels:
+      <<: *labels
+      tier: front
+  data:
+    <<: *data
+    a: override
+`
+	var objs []runtime.Object
+	if err := yamlReader(io.NopCloser(strings.NewReader(input)), "a.yaml", acquire.ReadOptions{}, collect(&objs)); err != nil {
+		t.Fatal(err)
+	}
+	flat := mustFlatten(t, objs)
+	if len(flat) != 3 {
+		t.Fatalf("expected 3 objects, got %d", len(flat))
+	}
+	for i, want := range []struct {
+		name   string
+		labels map[string]string
+		data   map[string]interface{}
+	}{
+		{"base", map[string]string{"app": "web"}, map[string]interface{}{"a": "1", "b": "2"}},
+		{"one", map[string]string{"app": "web"}, map[string]interface{}{"a": "1", "b": "2"}},
+		{"two", map[string]string{"app": "web", "tier": "front"}, map[string]interface{}{"a": "override", "b": "2"}},
+	} {
+		o := flat[i]
+		if o.GetName() != want.name || o.GetKind() != "ConfigMap" || !reflect.DeepEqual(o.GetLabels(), want.labels) || !reflect.DeepEqual(o.Object["data"], want.data) {
+			t.Errorf("object %d: got %v", i, o.Object)
+		}
+	}
+}
+
+func TestYamlProvenanceLine(t *testing.T) {
+	input := `# leading comment
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+---
+
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+--- # trailing comment
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: c
+`
+	var objs []runtime.Object
+	if err := yamlReader(io.NopCloser(strings.NewReader(input)), "a.yaml", acquire.ReadOptions{ShowProvenance: true}, collect(&objs)); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, o := range mustFlatten(t, objs) {
+		lines = append(lines, o.GetAnnotations()[AnnotationProvenanceLine])
+	}
+	if expected := []string{"1", "8", "14"}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected lines %v, got %v", expected, lines)
+	}
+
+	objs = nil
+	if err := yamlReader(io.NopCloser(strings.NewReader(input)), "a.yaml", acquire.ReadOptions{ShowProvenance: true, ProvenanceLineKeySet: true}, collect(&objs)); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := mustFlatten(t, objs)[0].GetAnnotations()[AnnotationProvenanceLine]; found {
+		t.Errorf("expected no line annotation with an empty key")
+	}
+
+	if err := yamlReader(io.NopCloser(strings.NewReader("a: b\n--- c\n")), "", acquire.ReadOptions{}, collect(new([]runtime.Object))); err == nil {
+		t.Errorf("expected an error for an invalid separator")
+	}
+}
+
+func TestProvenanceRootLabel(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.jsonnet": `{ web: { apiVersion: "v1", kind: "Service", metadata: { name: "web" } } }`,
+		"b.yaml":    "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n---\napiVersion: v1\nkind: List\nitems:\n- apiVersion: v1\n  kind: ConfigMap\n  metadata:\n    name: b\n",
+		"c.json":    `[{"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "c"}}]`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	for _, tc := range []struct {
+		opts []ReadOption
+		want []string
+	}{
+		{nil, []string{"$.web", "$[0]", "$[1].items[0]", "$[0]"}},
+		{[]ReadOption{WithProvenanceRootLabel("doc")}, []string{"doc.web", "doc[0]", "doc[1].items[0]", "doc[0]"}},
+		{[]ReadOption{WithProvenanceRootLabel("")}, []string{".web", "[0]", "[1].items[0]", "[0]"}},
+	} {
+		var got []string
+		for _, name := range []string{"a.jsonnet", "b.yaml", "c.json"} {
+			objs, err := Read(vm, filepath.Join(dir, name), append([]ReadOption{WithProvenance(true)}, tc.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, o := range mustFlatten(t, objs) {
+				got = append(got, o.GetAnnotations()[AnnotationProvenancePath])
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}
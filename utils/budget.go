@@ -0,0 +1,167 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	jsonnet "github.com/google/go-jsonnet"
+	jsonnetAst "github.com/google/go-jsonnet/ast"
+	"github.com/google/go-jsonnet/toolutils"
+	"github.com/kubecfg/kubecfg/internal/acquire"
+)
+
+// BudgetExceededError is returned when an evaluation exceeds the limits
+// set with WithEvalBudget. An evaluation exceeding its time limit is
+// abandoned, not stopped: see WithEvalBudget.
+type BudgetExceededError struct {
+	Path  string
+	Limit string
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("evaluation of %s exceeded its budget of %s and was abandoned", e.Path, e.Limit)
+}
+
+// snippetDependencies returns all the files transitively imported (via
+// import, importstr or importbin) by the jsonnet snippet content, which
+// lives at foundAt.
+func snippetDependencies(vm *jsonnet.VM, foundAt, content string) ([]string, error) {
+	node, err := jsonnet.SnippetToAST(foundAt, content)
+	if err != nil {
+		return nil, err
+	}
+
+	deps := map[string]struct{}{}
+	addDep := func(file string) error {
+		dep, err := vm.ResolveImport(foundAt, file)
+		if err != nil {
+			return err
+		}
+		deps[dep] = struct{}{}
+		return nil
+	}
+
+	var code []string
+	var walk func(n jsonnetAst.Node) error
+	walk = func(n jsonnetAst.Node) error {
+		switch i := n.(type) {
+		case *jsonnetAst.Import:
+			code = append(code, i.File.Value)
+		case *jsonnetAst.ImportStr:
+			if err := addDep(i.File.Value); err != nil {
+				return err
+			}
+		case *jsonnetAst.ImportBin:
+			if err := addDep(i.File.Value); err != nil {
+				return err
+			}
+		}
+		for _, c := range toolutils.Children(n) {
+			if err := walk(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(node); err != nil {
+		return nil, err
+	}
+
+	for _, file := range code {
+		if err := addDep(file); err != nil {
+			return nil, err
+		}
+	}
+	if len(code) > 0 {
+		transitive, err := vm.FindDependencies(foundAt, code)
+		if err != nil {
+			return nil, err
+		}
+		for _, dep := range transitive {
+			deps[dep] = struct{}{}
+		}
+	}
+
+	ret := make([]string, 0, len(deps))
+	for dep := range deps {
+		ret = append(ret, dep)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// evaluateSnippet evaluates content within the limits set by
+// WithEvalBudget, giving up when the context set by ReadContext is done.
+//
+// go-jsonnet cannot interrupt an evaluation, so the limits are not hard
+// ones: the import limit is checked against all the files the snippet may
+// import before evaluation starts, while the time limit and the context
+// only make evaluateSnippet return early. The abandoned evaluation keeps
+// running in the background, using CPU and memory, until it completes,
+// and keeps using vm, which must not be reused after a
+// BudgetExceededError or a cancelled read.
+func evaluateSnippet(vm *jsonnet.VM, path, foundAt, content string, opts acquire.ReadOptions) (string, error) {
+	var done <-chan struct{}
+	if ctx := opts.Context; ctx != nil {
+		if err := ctx.Err(); err != nil {
+			return "", fmt.Errorf("evaluation of %s abandoned: %w", path, err)
+		}
+		done = ctx.Done()
+	}
+
+	if max := opts.EvalMaxImports; max > 0 {
+		deps, err := snippetDependencies(vm, foundAt, content)
+		if err != nil {
+			return "", err
+		}
+		if len(deps) > max {
+			return "", &BudgetExceededError{Path: path, Limit: fmt.Sprintf("%d imports", max)}
+		}
+	}
+
+	limit := opts.EvalMaxDuration
+	if limit <= 0 && done == nil {
+		return vm.EvaluateSnippet(foundAt, content)
+	}
+
+	type result struct {
+		json string
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		json, err := vm.EvaluateSnippet(foundAt, content)
+		ch <- result{json, err}
+	}()
+
+	var timeout <-chan time.Time
+	if limit > 0 {
+		timer := time.NewTimer(limit)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case r := <-ch:
+		return r.json, r.err
+	case <-timeout:
+		return "", &BudgetExceededError{Path: path, Limit: limit.String()}
+	case <-done:
+		return "", fmt.Errorf("evaluation of %s abandoned: %w", path, opts.Context.Err())
+	}
+}
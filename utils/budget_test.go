@@ -0,0 +1,152 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jsonnet "github.com/google/go-jsonnet"
+)
+
+func TestEvalBudget(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.libsonnet":  `import "b.libsonnet"`,
+		"b.libsonnet":  `{ data: importstr "c.txt" }`,
+		"c.txt":        `hello`,
+		"main.jsonnet": `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "x" }, data: (import "a.libsonnet").data }`,
+		"slow.jsonnet": `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "x" }, data: { n: std.toString(std.foldl(function(a, b) a + b, std.range(0, 1000000), 0)) } }`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newVM := func() *jsonnet.VM {
+		vm := jsonnet.MakeVM()
+		vm.Importer(MakeUniversalImporter(nil, false))
+		return vm
+	}
+
+	if _, err := Read(newVM(), filepath.Join(dir, "main.jsonnet"), WithEvalBudget(0, 3)); err != nil {
+		t.Errorf("3 imports should fit in the budget: %v", err)
+	}
+
+	var budgetErr *BudgetExceededError
+	_, err := Read(newVM(), filepath.Join(dir, "main.jsonnet"), WithEvalBudget(0, 2))
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("expected BudgetExceededError, got %v", err)
+	}
+	if budgetErr.Limit != "2 imports" {
+		t.Errorf("unexpected limit %q", budgetErr.Limit)
+	}
+
+	_, err = Read(newVM(), filepath.Join(dir, "slow.jsonnet"), WithEvalBudget(10*time.Millisecond, 0))
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("expected BudgetExceededError, got %v", err)
+	}
+	if budgetErr.Limit != "10ms" {
+		t.Errorf("unexpected limit %q", budgetErr.Limit)
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"fast.jsonnet": `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "x" } }`,
+		"slow.jsonnet": `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "x" }, data: { n: std.toString(std.foldl(function(a, b) a + b, std.range(0, 1000000), 0)) } }`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newVM := func() *jsonnet.VM {
+		vm := jsonnet.MakeVM()
+		vm.Importer(MakeUniversalImporter(nil, false))
+		return vm
+	}
+
+	if _, err := ReadContext(context.Background(), newVM(), filepath.Join(dir, "fast.jsonnet")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := ReadContext(ctx, newVM(), filepath.Join(dir, "fast.jsonnet"))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled read, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = ReadContext(ctx, newVM(), filepath.Join(dir, "slow.jsonnet"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to abandon the evaluation, got %v", err)
+	}
+}
+
+func TestReadContextImports(t *testing.T) {
+	started, aborted, release := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "remote.jsonnet")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(`import %q`, srv.URL+"/lib.libsonnet")), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	importer := MakeUniversalImporter(nil, false)
+	vm := jsonnet.MakeVM()
+	vm.Importer(importer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := ReadContext(ctx, vm, path, WithImporter(importer))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancelled read, got %v", err)
+	}
+
+	// The import in flight is aborted, rather than left running in the
+	// background with the abandoned evaluation.
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("import not aborted")
+	}
+}
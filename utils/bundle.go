@@ -0,0 +1,134 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// bundleImporter serves the values of JSON objects mapping names to
+// contents, from URLs like:
+//
+//	bundle:///abs/path/snippets.json//key
+//	bundle://relative/path/snippets.json//key
+//
+// Relative bundle paths are resolved against the working directory.
+// Relative imports from a value resolve to other keys of the bundle.
+// Each bundle is parsed once and kept in memory.
+type bundleImporter struct {
+	mu      sync.Mutex
+	bundles map[string]map[string]string // bundle path -> key -> contents
+}
+
+func newBundleImporter() *bundleImporter {
+	return &bundleImporter{bundles: map[string]map[string]string{}}
+}
+
+func (b *bundleImporter) RoundTrip(req *http.Request) (*http.Response, error) {
+	bundle, key, err := bundleSplitURL(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	values, err := b.bundle(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	v, found := values[key]
+	if !found {
+		// Not found rather than an error, so imports relative to a value
+		// fall back to the library search path.
+		return simpleHTTPResponse(req, http.StatusNotFound, http.NoBody), nil
+	}
+	return simpleHTTPResponse(req, http.StatusOK, io.NopCloser(strings.NewReader(v))), nil
+}
+
+// bundleImportError returns the error of a failed import of importedPath
+// if it is a bundle URL, nil otherwise: bundleImporter only reports the
+// keys missing from the bundle as not found.
+func bundleImportError(importedPath string) error {
+	u, err := url.Parse(importedPath)
+	if err != nil || u.Scheme != "bundle" {
+		return nil
+	}
+	bundle, key, err := bundleSplitURL(u)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("key %q not found in bundle %s", key, bundle)
+}
+
+// bundleSplitURL splits a bundle import URL into the absolute path of the
+// bundle and the key within it.
+func bundleSplitURL(u *url.URL) (bundle, key string, err error) {
+	bundlePath, key, found := strings.Cut(u.Path, "//")
+	if !found || key == "" {
+		return "", "", fmt.Errorf("bundle import %q must have the form <bundle>//<key>", u)
+	}
+	bundle, err = filepath.Abs(filepath.FromSlash(u.Host + bundlePath))
+	if err != nil {
+		return "", "", err
+	}
+	return bundle, key, nil
+}
+
+// bundle returns the values of bundle, reading it if needed.
+func (b *bundleImporter) bundle(bundle string) (map[string]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if values, found := b.bundles[bundle]; found {
+		return values, nil
+	}
+	log.Debugf("Reading bundle %s", bundle)
+	values, err := readBundle(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("reading bundle %s: %w", bundle, err)
+	}
+	b.bundles[bundle] = values
+	return values, nil
+}
+
+// readBundle parses a bundle, a JSON object whose values are strings.
+func readBundle(bundle string) (map[string]string, error) {
+	data, err := os.ReadFile(bundle)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("bundle must be a JSON object: %w", err)
+	}
+	values := make(map[string]string, len(raw))
+	for k, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			return nil, fmt.Errorf("value of key %q is not a string", k)
+		}
+		values[k] = s
+	}
+	return values, nil
+}
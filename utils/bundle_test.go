@@ -0,0 +1,120 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsonnet "github.com/google/go-jsonnet"
+)
+
+func TestBundleImport(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "snippets.json")
+	content := `{
+		"main.jsonnet": "(import \"lib/foo.libsonnet\") + { main: true }",
+		"lib/foo.libsonnet": "{ version: (import \"version.libsonnet\") }",
+		"lib/version.libsonnet": "1",
+		"other.libsonnet": "\"other\""
+	}`
+	if err := os.WriteFile(bundle, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	out, err := vm.EvaluateAnonymousSnippet("test.jsonnet", fmt.Sprintf(`(import "bundle://%s//main.jsonnet").version`, bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(out); got != "1" {
+		t.Errorf("got %s, want 1", got)
+	}
+
+	// The bundle is parsed once, later imports don't read it.
+	if err := os.Remove(bundle); err != nil {
+		t.Fatal(err)
+	}
+	out, err = vm.EvaluateAnonymousSnippet("test.jsonnet", fmt.Sprintf(`import "bundle://%s//other.libsonnet"`, bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(out); got != `"other"` {
+		t.Errorf("got %s, want \"other\"", got)
+	}
+
+	_, err = vm.EvaluateAnonymousSnippet("test.jsonnet", fmt.Sprintf(`import "bundle://%s//missing.libsonnet"`, bundle))
+	if err == nil || !strings.Contains(err.Error(), `key "missing.libsonnet" not found in bundle`) {
+		t.Errorf("expected missing key error, got %v", err)
+	}
+}
+
+func TestBundleImportSearchPath(t *testing.T) {
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "snippets.json")
+	if err := os.WriteFile(bundle, []byte(`{ "main.jsonnet": "import \"util.libsonnet\"" }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lib := filepath.Join(dir, "lib")
+	if err := os.Mkdir(lib, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(lib, "util.libsonnet"), []byte(`"util"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// util.libsonnet isn't in the bundle, and is found in the search path.
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter([]*url.URL{{Scheme: "file", Path: filepath.ToSlash(lib) + "/"}}, false))
+	out, err := vm.EvaluateAnonymousSnippet("test.jsonnet", fmt.Sprintf(`import "bundle://%s//main.jsonnet"`, bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(out); got != `"util"` {
+		t.Errorf("got %s, want \"util\"", got)
+	}
+}
+
+func TestBundleImportInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"array.json":  `["a"]`,
+		"number.json": `{"a": 1}`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	for _, tc := range []struct {
+		url, want string
+	}{
+		{"bundle://" + filepath.Join(dir, "array.json") + "//a", "bundle must be a JSON object"},
+		{"bundle://" + filepath.Join(dir, "number.json") + "//a", `value of key "a" is not a string`},
+		{"bundle://" + filepath.Join(dir, "number.json"), "must have the form <bundle>//<key>"},
+	} {
+		_, err := vm.EvaluateAnonymousSnippet("test.jsonnet", fmt.Sprintf(`import %q`, tc.url))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want %q", tc.url, err, tc.want)
+		}
+	}
+}
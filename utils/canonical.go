@@ -0,0 +1,84 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Canonicalize returns the canonical JSON form of o, suitable for
+// comparing or hashing objects: map keys are sorted, fields set to null
+// are dropped and numbers are written the same whether they were decoded
+// as integers or floats, so that 1, 1.0 and int64(1) all give 1. Null
+// array elements are kept, as dropping them would shift the others.
+//
+// Like the unstructured package, Canonicalize panics if o holds values
+// that aren't JSON values.
+func Canonicalize(o *unstructured.Unstructured) []byte {
+	b, err := json.Marshal(canonicalValue(o.Object))
+	if err != nil {
+		panic(fmt.Sprintf("cannot canonicalize %s: %v", resourceKey(o), err))
+	}
+	return b
+}
+
+func canonicalValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if e != nil {
+				res[k] = canonicalValue(e)
+			}
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, e := range v {
+			res[i] = canonicalValue(e)
+		}
+		return res
+	case float64:
+		return canonicalFloat(v)
+	case float32:
+		return canonicalFloat(float64(v))
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return canonicalFloat(f)
+		}
+	}
+	return v
+}
+
+// canonicalFloat returns f as an int64 if it is an integer that fits,
+// turning -0 into 0 along the way.
+func canonicalFloat(f float64) interface{} {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return int64(f)
+	}
+	return f
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"math"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestCanonicalize(t *testing.T) {
+	decoded := mustUnstructured(t, `{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "x", "labels": null}, "data": {"b": "2", "a": "1"}, "spec": {"replicas": 3, "ratio": 0.5, "list": [1, null, 2.0]}}`)
+	built := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "x"},
+		"data":       map[string]interface{}{"a": "1", "b": "2"},
+		"spec": map[string]interface{}{
+			"replicas": float64(3),
+			"ratio":    float32(0.5),
+			"list":     []interface{}{int32(1), nil, int64(2)},
+			"unset":    nil,
+		},
+	}}
+
+	const want = `{"apiVersion":"v1","data":{"a":"1","b":"2"},"kind":"ConfigMap","metadata":{"name":"x"},"spec":{"list":[1,null,2],"ratio":0.5,"replicas":3}}`
+	for _, o := range []*unstructured.Unstructured{decoded, built} {
+		if got := string(Canonicalize(o)); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	if _, found := built.Object["spec"].(map[string]interface{})["unset"]; !found {
+		t.Errorf("Canonicalize modified its argument")
+	}
+
+	for _, tc := range []struct {
+		value interface{}
+		want  string
+	}{
+		{math.Copysign(0, -1), `{"n":0}`},
+		{1e20, `{"n":100000000000000000000}`},
+		{1e300, `{"n":1e+300}`},
+		{-2.5, `{"n":-2.5}`},
+	} {
+		o := &unstructured.Unstructured{Object: map[string]interface{}{"n": tc.value}}
+		if got := string(Canonicalize(o)); got != tc.want {
+			t.Errorf("%v: got %s, want %s", tc.value, got, tc.want)
+		}
+	}
+}
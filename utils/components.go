@@ -0,0 +1,152 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	jsonnet "github.com/google/go-jsonnet"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// AnnotationComponent records which component of a components manifest
+// an object was rendered from.
+const AnnotationComponent = "kubecfg.github.com/component"
+
+// ComponentsManifest lists the entrypoints of a multi-component app.
+//
+// Example:
+//
+//	components:
+//	- name: frontend              # defaults to path
+//	  path: frontend/main.jsonnet # relative to the manifest
+//	  vars:                       # string ext vars
+//	    env: prod
+//	  overlays:                   # composed with `+`, in order
+//	  - overlays/prod.jsonnet
+type ComponentsManifest struct {
+	Components []Component `json:"components"`
+}
+
+// Component is one entry of a ComponentsManifest.
+type Component struct {
+	Name     string            `json:"name,omitempty"`
+	Path     string            `json:"path"`
+	Vars     map[string]string `json:"vars,omitempty"`
+	Overlays []string          `json:"overlays,omitempty"`
+}
+
+// LoadComponents parses and validates a components manifest. Relative
+// paths in the manifest are resolved against the manifest's directory.
+func LoadComponents(componentsFile string) (*ComponentsManifest, error) {
+	data, err := os.ReadFile(componentsFile)
+	if err != nil {
+		return nil, err
+	}
+	var m ComponentsManifest
+	if err := yaml.UnmarshalStrict(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid components manifest %s: %v", componentsFile, err)
+	}
+	if len(m.Components) == 0 {
+		return nil, fmt.Errorf("invalid components manifest %s: no components", componentsFile)
+	}
+
+	dir := filepath.Dir(componentsFile)
+	resolve := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	names := map[string]bool{}
+	for i := range m.Components {
+		c := &m.Components[i]
+		if c.Path == "" {
+			return nil, fmt.Errorf("invalid components manifest %s: component #%d has no path", componentsFile, i)
+		}
+		if c.Name == "" {
+			c.Name = c.Path
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("invalid components manifest %s: duplicate component %q", componentsFile, c.Name)
+		}
+		names[c.Name] = true
+
+		c.Path = resolve(c.Path)
+		for j := range c.Overlays {
+			c.Overlays[j] = resolve(c.Overlays[j])
+		}
+	}
+	return &m, nil
+}
+
+// ReadComponents renders all the components listed in componentsFile
+// (see ComponentsManifest) and annotates each object with the name of
+// its component. Duplicates are checked across all the components.
+//
+// Each component is rendered in a fresh VM returned by mkVM, with the
+// component vars set as ext vars, so that they don't leak into other
+// components or into the caller's VMs.
+func ReadComponents(mkVM func() (*jsonnet.VM, error), componentsFile string, opts ...ReadOption) ([]*unstructured.Unstructured, error) {
+	m, err := LoadComponents(componentsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*unstructured.Unstructured
+	for _, c := range m.Components {
+		vm, err := mkVM()
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range c.Vars {
+			vm.ExtVar(k, v)
+		}
+
+		path := c.Path
+		if len(c.Overlays) > 0 {
+			imports := make([]string, 0, len(c.Overlays)+1)
+			for _, p := range append([]string{c.Path}, c.Overlays...) {
+				u, err := PathToURL(p)
+				if err != nil {
+					return nil, err
+				}
+				imports = append(imports, fmt.Sprintf("(import %q)", u))
+			}
+			path = ToDataURL(strings.Join(imports, " + "))
+		}
+
+		objs, err := Read(vm, path, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("component %q: %w", c.Name, err)
+		}
+		flat, err := FlattenToV1(objs)
+		if err != nil {
+			return nil, fmt.Errorf("error reading component %q: %w", c.Name, err)
+		}
+		for _, o := range flat {
+			SetMetaDataAnnotation(o, AnnotationComponent, c.Name)
+			res = append(res, o)
+		}
+	}
+
+	return dropIdenticalDuplicates(res)
+}
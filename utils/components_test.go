@@ -0,0 +1,100 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsonnet "github.com/google/go-jsonnet"
+)
+
+func TestReadComponents(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"components.yaml": `
+components:
+- name: web
+  path: web.jsonnet
+  vars:
+    env: prod
+  overlays:
+  - overlay.jsonnet
+- path: db.jsonnet
+- name: other
+  path: other.jsonnet
+  vars:
+    other: "1"
+`,
+		"web.jsonnet":     `{ cm: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "web" }, data: { env: std.extVar("env") } } }`,
+		"overlay.jsonnet": `{ cm+: { data+: { overlaid: "yes" } } }`,
+		"db.jsonnet":      `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "db" } }`,
+		"other.jsonnet":   `{ apiVersion: "v1", kind: "ConfigMap", metadata: { name: "other" }, data: { env: std.extVar("env"), other: std.extVar("other") } }`,
+		"bad.yaml":        "components:\n- name: nopath\n",
+		"dup.yaml":        "components:\n- path: db.jsonnet\n- path: db.jsonnet\n",
+		"clash.yaml":      "components:\n- path: db.jsonnet\n- name: again\n  path: db.jsonnet\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mkVM := func() (*jsonnet.VM, error) {
+		vm := jsonnet.MakeVM()
+		vm.Importer(MakeUniversalImporter(nil, false))
+		vm.ExtVar("env", "default")
+		return vm, nil
+	}
+
+	objs, err := ReadComponents(mkVM, filepath.Join(dir, "components.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 3 {
+		t.Fatalf("expected 3 objects, got %d", len(objs))
+	}
+
+	web, db, other := objs[0], objs[1], objs[2]
+	if got := web.GetAnnotations()[AnnotationComponent]; got != "web" {
+		t.Errorf("unexpected component %q", got)
+	}
+	if got := db.GetAnnotations()[AnnotationComponent]; got != "db.jsonnet" {
+		t.Errorf("unexpected component %q", got)
+	}
+	data := web.Object["data"].(map[string]interface{})
+	if data["env"] != "prod" || data["overlaid"] != "yes" {
+		t.Errorf("vars or overlays not applied: %v", data)
+	}
+	// The vars of the web component don't leak into the other one.
+	data = other.Object["data"].(map[string]interface{})
+	if data["env"] != "default" || data["other"] != "1" {
+		t.Errorf("vars leaked between components: %v", data)
+	}
+
+	for file, msg := range map[string]string{
+		"bad.yaml":   "has no path",
+		"dup.yaml":   `duplicate component "db.jsonnet"`,
+		"clash.yaml": "duplicate resource",
+	} {
+		_, err := ReadComponents(mkVM, filepath.Join(dir, file))
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: expected error containing %q, got %v", file, msg, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// DiffType tells how an object differs between two sets of objects.
+type DiffType string
+
+const (
+	DiffAdded   DiffType = "added"
+	DiffRemoved DiffType = "removed"
+	DiffChanged DiffType = "changed"
+)
+
+// ObjectDiff describes an object that differs between two sets of objects.
+type ObjectDiff struct {
+	Type       DiffType `json:"type"`
+	APIVersion string   `json:"apiVersion"`
+	Kind       string   `json:"kind"`
+	// Namespace is defaulted to "default" for namespaced objects
+	// without one.
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+
+	// Old and New are the object in each set; nil if it isn't there.
+	Old *unstructured.Unstructured `json:"-"`
+	New *unstructured.Unstructured `json:"-"`
+
+	// Fields lists the changed fields of changed objects.
+	Fields []FieldDiff `json:"fields,omitempty"`
+}
+
+// FieldDiff describes a field that differs between two versions of an
+// object. Path is a JSONPath-like reference such as
+// ".spec.containers[0].image"; Old is nil for added fields and New for
+// removed ones.
+type FieldDiff struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// DiffObjects compares the objects in a with those in b, e.g. two
+// evaluations of the same configuration, without a cluster. Objects are
+// matched by group, kind, namespace and name, a namespaced object without
+// a namespace being in the "default" namespace. A change of the version
+// of an object thus shows as a change of its apiVersion field. The
+// provenance annotations added by Read are ignored.
+//
+// The changed and removed objects are returned in the order of a,
+// followed by the added ones in the order of b. It is an error for a set
+// to hold the same object more than once.
+func DiffObjects(a, b []*unstructured.Unstructured) ([]ObjectDiff, error) {
+	indexB, err := diffIndex(b)
+	if err != nil {
+		return nil, err
+	}
+	indexA, err := diffIndex(a)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []ObjectDiff
+	for _, o := range a {
+		k, _ := diffKey(o)
+		n, found := indexB[k]
+		if !found {
+			res = append(res, newObjectDiff(DiffRemoved, o, nil))
+			continue
+		}
+		fields, err := diffFields(o, n)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) > 0 {
+			d := newObjectDiff(DiffChanged, o, n)
+			d.Fields = fields
+			res = append(res, d)
+		}
+	}
+	for _, o := range b {
+		if k, _ := diffKey(o); indexA[k] == nil {
+			res = append(res, newObjectDiff(DiffAdded, nil, o))
+		}
+	}
+	return res, nil
+}
+
+// diffKey returns the key objects are matched by, and the namespace o is
+// considered to be in.
+func diffKey(o *unstructured.Unstructured) (string, string) {
+	ns := o.GetNamespace()
+	if ns == "" {
+		if namespaced, err := IsNamespaced(o.GroupVersionKind(), nil); err == nil && namespaced {
+			ns = "default"
+		}
+	}
+	return fmt.Sprintf("%s, %q, %q", o.GroupVersionKind().GroupKind(), ns, o.GetName()), ns
+}
+
+func diffIndex(objs []*unstructured.Unstructured) (map[string]*unstructured.Unstructured, error) {
+	index := make(map[string]*unstructured.Unstructured, len(objs))
+	for _, o := range objs {
+		k, _ := diffKey(o)
+		if _, found := index[k]; found {
+			return nil, fmt.Errorf("duplicate object %s", k)
+		}
+		index[k] = o
+	}
+	return index, nil
+}
+
+func newObjectDiff(typ DiffType, before, after *unstructured.Unstructured) ObjectDiff {
+	o := after
+	if o == nil {
+		o = before
+	}
+	_, ns := diffKey(o)
+	return ObjectDiff{
+		Type:       typ,
+		APIVersion: o.GetAPIVersion(),
+		Kind:       o.GetKind(),
+		Namespace:  ns,
+		Name:       o.GetName(),
+		Old:        before,
+		New:        after,
+	}
+}
+
+// diffFields lists the fields that differ between before and after.
+func diffFields(before, after *unstructured.Unstructured) ([]FieldDiff, error) {
+	// Decoding the canonical forms makes numbers compare equal whether
+	// they were decoded as integers or floats.
+	normalize := func(o *unstructured.Unstructured) (interface{}, error) {
+		var v interface{}
+		return v, json.Unmarshal(Canonicalize(withoutProvenance(o)), &v)
+	}
+	a, err := normalize(before)
+	if err != nil {
+		return nil, err
+	}
+	b, err := normalize(after)
+	if err != nil {
+		return nil, err
+	}
+	var res []FieldDiff
+	diffValues("", a, b, &res)
+	return res, nil
+}
+
+func diffValues(path string, a, b interface{}, res *[]FieldDiff) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, found := av[k]; !found {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diffValues(path+"."+k, av[k], bv[k], res)
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			var ai, bi interface{}
+			if i < len(av) {
+				ai = av[i]
+			}
+			if i < len(bv) {
+				bi = bv[i]
+			}
+			diffValues(fmt.Sprintf("%s[%d]", path, i), ai, bi, res)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		*res = append(*res, FieldDiff{Path: path, Old: a, New: b})
+	}
+}
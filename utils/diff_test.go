@@ -0,0 +1,75 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestDiffObjects(t *testing.T) {
+	before := []*unstructured.Unstructured{
+		mustUnstructured(t, `{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "web"}, "spec": {"replicas": 1, "template": {"spec": {"containers": [{"name": "web", "image": "nginx:1.23"}]}}}}`),
+		mustUnstructured(t, `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "gone", "namespace": "app"}}`),
+		mustUnstructured(t, `{"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "app", "annotations": {"kubecfg.github.com/provenance-file": "a.jsonnet"}}}`),
+	}
+	after := []*unstructured.Unstructured{
+		mustUnstructured(t, `{"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "app", "annotations": {"kubecfg.github.com/provenance-file": "b.jsonnet"}}}`),
+		mustUnstructured(t, `{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "web", "namespace": "default", "labels": {"app": "web"}}, "spec": {"replicas": 2, "template": {"spec": {"containers": [{"name": "web", "image": "nginx:1.25"}, {"name": "side", "image": "busybox"}]}}}}`),
+		mustUnstructured(t, `{"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "new", "namespace": "app"}}`),
+	}
+
+	diffs, err := DiffObjects(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type summary struct {
+		Type                  DiffType
+		Kind, Namespace, Name string
+	}
+	var got []summary
+	for _, d := range diffs {
+		got = append(got, summary{d.Type, d.Kind, d.Namespace, d.Name})
+	}
+	want := []summary{
+		{DiffChanged, "Deployment", "default", "web"},
+		{DiffRemoved, "ConfigMap", "app", "gone"},
+		{DiffAdded, "Secret", "app", "new"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	wantFields := []FieldDiff{
+		{Path: ".metadata.labels", New: map[string]interface{}{"app": "web"}},
+		{Path: ".metadata.namespace", New: "default"},
+		{Path: ".spec.replicas", Old: float64(1), New: float64(2)},
+		{Path: ".spec.template.spec.containers[0].image", Old: "nginx:1.23", New: "nginx:1.25"},
+		{Path: ".spec.template.spec.containers[1]", New: map[string]interface{}{"name": "side", "image": "busybox"}},
+	}
+	if !reflect.DeepEqual(diffs[0].Fields, wantFields) {
+		t.Errorf("got fields %v, want %v", diffs[0].Fields, wantFields)
+	}
+	if diffs[1].New != nil || diffs[2].Old != nil {
+		t.Errorf("expected no new object for removals and no old one for additions")
+	}
+
+	if _, err := DiffObjects(append(before, before[0]), after); err == nil {
+		t.Errorf("expected an error for duplicate objects")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// directivePrefix starts the comments holding directives, once the
+// comment marker is stripped.
+const directivePrefix = "kubecfg:"
+
+// fileDirectives holds the directives found in the leading comments of a
+// jsonnet file, which apply to the objects it yields, e.g.
+//
+//	// kubecfg: namespace=monitoring, labels=team:platform;tier:web
+//
+// namespace is set on the namespaced objects without one, like
+// WithDefaultNamespace, and labels are added to all of them, like
+// WithCommonLabels. They take precedence over those read options.
+type fileDirectives struct {
+	namespace string
+	labels    map[string]string
+}
+
+// parseDirectives parses the directives in the comment lines at the top
+// of content. Unknown directives are ignored with a warning, so that
+// files can carry directives meant for newer versions.
+func parseDirectives(content string) (fileDirectives, error) {
+	var d fileDirectives
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var comment string
+		switch {
+		case strings.HasPrefix(line, "//"):
+			comment = line[2:]
+		case strings.HasPrefix(line, "#"):
+			comment = line[1:]
+		default:
+			return d, nil
+		}
+		comment = strings.TrimSpace(comment)
+		if !strings.HasPrefix(comment, directivePrefix) {
+			continue
+		}
+		for _, directive := range strings.Split(strings.TrimPrefix(comment, directivePrefix), ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			key, value, found := strings.Cut(directive, "=")
+			if !found {
+				return d, fmt.Errorf("invalid kubecfg directive %q: expected key=value", directive)
+			}
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			switch key {
+			case "namespace":
+				if errs := validation.IsDNS1123Label(value); len(errs) > 0 {
+					return d, fmt.Errorf("invalid kubecfg directive %q: %s", directive, strings.Join(errs, "; "))
+				}
+				d.namespace = value
+			case "labels":
+				labels, err := parseDirectiveLabels(value)
+				if err != nil {
+					return d, fmt.Errorf("invalid kubecfg directive %q: %v", directive, err)
+				}
+				if d.labels == nil {
+					d.labels = map[string]string{}
+				}
+				for k, v := range labels {
+					d.labels[k] = v
+				}
+			default:
+				log.Warnf("Ignoring unknown kubecfg directive %q", key)
+			}
+		}
+	}
+	return d, nil
+}
+
+// parseDirectiveLabels parses labels given as key:value pairs separated
+// by semicolons.
+func parseDirectiveLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(s, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, found := strings.Cut(pair, ":")
+		if !found {
+			return nil, fmt.Errorf("label %q must have the form key:value", pair)
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return nil, fmt.Errorf("label key %q: %s", k, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(v); len(errs) > 0 {
+			return nil, fmt.Errorf("label value %q: %s", v, strings.Join(errs, "; "))
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// apply applies the directives to obj, or to its items if it is a list.
+func (d fileDirectives) apply(obj runtime.Object, mapper meta.RESTMapper) error {
+	var objs []*unstructured.Unstructured
+	switch o := obj.(type) {
+	case *unstructured.UnstructuredList:
+		for i := range o.Items {
+			objs = append(objs, &o.Items[i])
+		}
+	case *unstructured.Unstructured:
+		objs = append(objs, o)
+	}
+	if len(d.labels) > 0 {
+		AddLabels(objs, d.labels)
+	}
+	if d.namespace != "" {
+		return DefaultNamespace(objs, d.namespace, mapper)
+	}
+	return nil
+}
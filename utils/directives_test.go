@@ -0,0 +1,96 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	jsonnet "github.com/google/go-jsonnet"
+)
+
+func TestParseDirectives(t *testing.T) {
+	for _, tc := range []struct {
+		content   string
+		namespace string
+		labels    map[string]string
+		err       bool
+	}{
+		{content: `{}`},
+		{
+			content:   "// Copyright header\n\n// kubecfg: namespace=foo, labels=team:platform;tier:web\n{}",
+			namespace: "foo",
+			labels:    map[string]string{"team": "platform", "tier": "web"},
+		},
+		{
+			content: "# kubecfg: labels=app.kubernetes.io/part-of:shop\n// kubecfg: prune=true\n{}",
+			labels:  map[string]string{"app.kubernetes.io/part-of": "shop"},
+		},
+		// Only the leading comments hold directives.
+		{content: "{}\n// kubecfg: namespace=foo\n"},
+		{content: "// kubecfg: namespace\n{}", err: true},
+		{content: "// kubecfg: namespace=Not_Valid\n{}", err: true},
+		{content: "// kubecfg: labels=team\n{}", err: true},
+	} {
+		d, err := parseDirectives(tc.content)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.content)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.content, err)
+			continue
+		}
+		if d.namespace != tc.namespace || !reflect.DeepEqual(d.labels, tc.labels) {
+			t.Errorf("%q: got %+v", tc.content, d)
+		}
+	}
+}
+
+func TestReadDirectives(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.jsonnet")
+	content := `// kubecfg: namespace=foo, labels=team:platform
+{
+  cm: { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "a", labels: { team: "own" } } },
+  ns: { apiVersion: "v1", kind: "Namespace", metadata: { name: "foo" } },
+}`
+	if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	objs, err := Read(vm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range mustFlatten(t, objs) {
+		switch o.GetKind() {
+		case "ConfigMap":
+			if o.GetNamespace() != "foo" || o.GetLabels()["team"] != "own" {
+				t.Errorf("unexpected ConfigMap metadata: namespace %q, labels %v", o.GetNamespace(), o.GetLabels())
+			}
+		case "Namespace":
+			if o.GetNamespace() != "" || o.GetLabels()["team"] != "platform" {
+				t.Errorf("unexpected Namespace metadata: namespace %q, labels %v", o.GetNamespace(), o.GetLabels())
+			}
+		}
+	}
+}
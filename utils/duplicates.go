@@ -16,21 +16,173 @@
 package utils
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 
+	"github.com/kubecfg/kubecfg/internal/acquire"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
-// CheckDuplicates returns error if the provided object slice contains multiple
-// objects sharing the same version/kind/namespace/name combination.
+// DuplicatePolicy tells ReadObjects what to do with objects sharing the
+// same version/kind/namespace/name. See WithDuplicatePolicy.
+type DuplicatePolicy = acquire.DuplicatePolicy
+
+const (
+	// ErrorOnDuplicate makes ReadObjects fail with a
+	// *DuplicateResourceError. This is the default.
+	ErrorOnDuplicate = acquire.ErrorOnDuplicate
+	// LastWins keeps only the last definition of an object.
+	LastWins = acquire.LastWins
+	// MergeDuplicate merges every definition of an object into the
+	// previous ones with MergeObjects.
+	MergeDuplicate = acquire.MergeDuplicate
+)
+
+// WithDuplicatePolicy sets how ReadObjects handles duplicate objects.
+func WithDuplicatePolicy(policy DuplicatePolicy) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.DuplicatePolicy = policy
+	}
+}
+
+// DuplicateResourceError is returned by CheckDuplicates. It lists every
+// version/kind/namespace/name combination defined more than once.
+type DuplicateResourceError struct {
+	Duplicates []DuplicateResource
+}
+
+// DuplicateResource is a resource key and all the objects sharing it, in
+// the order they were read.
+type DuplicateResource struct {
+	Key     string
+	Objects []*unstructured.Unstructured
+}
+
+func (e *DuplicateResourceError) Error() string {
+	lines := make([]string, len(e.Duplicates))
+	for i, d := range e.Duplicates {
+		lines[i] = d.String()
+	}
+	if len(lines) == 1 {
+		return lines[0]
+	}
+	return fmt.Sprintf("%d duplicate resources:\n  %s", len(lines), strings.Join(lines, "\n  "))
+}
+
+func (d DuplicateResource) String() string {
+	var where []string
+	for _, o := range d.Objects {
+		a := o.GetAnnotations()
+		if file, path := a[AnnotationProvenanceFile], a[AnnotationProvenancePath]; file != "" || path != "" {
+			where = append(where, strings.TrimSpace(file+" "+path))
+		}
+	}
+	if len(where) == 0 {
+		return fmt.Sprintf("duplicate resource %s", d.Key)
+	}
+	return fmt.Sprintf("duplicate resource %s (defined at %s)", d.Key, strings.Join(where, ", "))
+}
+
+// CheckDuplicates returns a *DuplicateResourceError if the provided object
+// slice contains multiple objects sharing the same version/kind/namespace/name
+// combination. Identical duplicates (see identicalObjects) are allowed.
 func CheckDuplicates(objs []*unstructured.Unstructured) error {
-	seen := map[string]struct{}{}
+	_, err := dropIdenticalDuplicates(objs)
+	return err
+}
+
+// dropIdenticalDuplicates returns objs without the objects identical to an
+// earlier one with the same key, and a *DuplicateResourceError listing the
+// keys that are defined more than once in different ways.
+func dropIdenticalDuplicates(objs []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	var keys []string
+	seen := map[string][]*unstructured.Unstructured{}
+	conflicting := map[string]bool{}
+	var res []*unstructured.Unstructured
 	for _, o := range objs {
-		k := fmt.Sprintf("%s, %q, %q", o.GroupVersionKind().GroupKind(), o.GetNamespace(), o.GetName())
-		if _, found := seen[k]; found {
-			return fmt.Errorf("duplicate resource %s", k)
+		k := resourceKey(o)
+		prev, found := seen[k]
+		if !found {
+			keys = append(keys, k)
+		}
+		seen[k] = append(prev, o)
+		if found {
+			if identicalObjects(prev[0], o) {
+				continue
+			}
+			conflicting[k] = true
+		}
+		res = append(res, o)
+	}
+
+	var dups []DuplicateResource
+	for _, k := range keys {
+		if conflicting[k] {
+			dups = append(dups, DuplicateResource{Key: k, Objects: seen[k]})
+		}
+	}
+	if len(dups) > 0 {
+		return nil, &DuplicateResourceError{Duplicates: dups}
+	}
+	return res, nil
+}
+
+// identicalObjects tells whether a and b have the same canonical form,
+// ignoring the provenance annotations added by Read with their default
+// keys, which tell where each was defined.
+func identicalObjects(a, b *unstructured.Unstructured) bool {
+	return bytes.Equal(Canonicalize(withoutProvenance(a)), Canonicalize(withoutProvenance(b)))
+}
+
+// withoutProvenance returns a copy of o without the provenance annotations
+// added by Read with their default keys.
+func withoutProvenance(o *unstructured.Unstructured) *unstructured.Unstructured {
+	o = o.DeepCopy()
+	for _, k := range []string{AnnotationProvenanceFile, AnnotationProvenancePath, AnnotationProvenanceLine} {
+		DeleteMetaDataAnnotation(o, k)
+	}
+	if len(o.GetAnnotations()) == 0 {
+		o.SetAnnotations(nil)
+	}
+	return o
+}
+
+func resourceKey(o *unstructured.Unstructured) string {
+	return fmt.Sprintf("%s, %q, %q", o.GroupVersionKind().GroupKind(), o.GetNamespace(), o.GetName())
+}
+
+// ResolveDuplicates applies policy to objs. Surviving objects keep the
+// position of the first definition. Identical duplicates are never an
+// error: only the first of them is kept.
+func ResolveDuplicates(objs []*unstructured.Unstructured, policy DuplicatePolicy) ([]*unstructured.Unstructured, error) {
+	switch policy {
+	case ErrorOnDuplicate:
+		return dropIdenticalDuplicates(objs)
+	case LastWins, MergeDuplicate:
+	default:
+		return nil, fmt.Errorf("unknown duplicate policy %d", policy)
+	}
+
+	index := map[string]int{}
+	var res []*unstructured.Unstructured
+	for _, o := range objs {
+		k := resourceKey(o)
+		i, found := index[k]
+		if !found {
+			index[k] = len(res)
+			res = append(res, o)
+			continue
+		}
+		if policy == LastWins {
+			res[i] = o
+			continue
+		}
+		merged, err := MergeObjects(res[i], o)
+		if err != nil {
+			return nil, fmt.Errorf("merging duplicate resource %s: %w", k, err)
 		}
-		seen[k] = struct{}{}
+		res[i] = merged
 	}
-	return nil
+	return res, nil
 }
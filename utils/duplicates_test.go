@@ -0,0 +1,123 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestCheckDuplicates(t *testing.T) {
+	obj := func(kind, name, file string) *unstructured.Unstructured {
+		o := &unstructured.Unstructured{}
+		o.SetAPIVersion("v1")
+		o.SetKind(kind)
+		o.SetNamespace("ns")
+		o.SetName(name)
+		if file != "" {
+			SetMetaDataAnnotation(o, AnnotationProvenanceFile, file)
+			SetMetaDataAnnotation(o, AnnotationProvenancePath, "$[0]")
+		}
+		return o
+	}
+	changed := func(o *unstructured.Unstructured) *unstructured.Unstructured {
+		o.Object["data"] = map[string]interface{}{"changed": "true"}
+		return o
+	}
+
+	if err := CheckDuplicates([]*unstructured.Unstructured{obj("ConfigMap", "a", ""), obj("Secret", "a", "")}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Identical duplicates are allowed, wherever they were defined.
+	if err := CheckDuplicates([]*unstructured.Unstructured{obj("ConfigMap", "a", "one.yaml"), obj("ConfigMap", "a", "two.yaml")}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err := CheckDuplicates([]*unstructured.Unstructured{obj("ConfigMap", "a", ""), changed(obj("ConfigMap", "a", ""))})
+	if got, want := err.Error(), `duplicate resource ConfigMap, "ns", "a"`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	err = CheckDuplicates([]*unstructured.Unstructured{
+		obj("ConfigMap", "a", "one.yaml"),
+		obj("Secret", "b", "one.yaml"),
+		changed(obj("ConfigMap", "a", "two.yaml")),
+		changed(obj("Secret", "b", "three.yaml")),
+		obj("Service", "c", "one.yaml"),
+	})
+	want := `2 duplicate resources:
+  duplicate resource ConfigMap, "ns", "a" (defined at one.yaml $[0], two.yaml $[0])
+  duplicate resource Secret, "ns", "b" (defined at one.yaml $[0], three.yaml $[0])`
+	if got := err.Error(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	var dupErr *DuplicateResourceError
+	if !errors.As(err, &dupErr) || len(dupErr.Duplicates) != 2 {
+		t.Errorf("expected a *DuplicateResourceError with 2 duplicates, got %#v", err)
+	}
+}
+
+func TestResolveDuplicates(t *testing.T) {
+	objs := func() []*unstructured.Unstructured {
+		return []*unstructured.Unstructured{
+			mustUnstructured(t, `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "a"}, "data": {"x": "1", "y": "1"}}`),
+			mustUnstructured(t, `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "b"}}`),
+			mustUnstructured(t, `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "a"}, "data": {"y": "2"}}`),
+		}
+	}
+
+	if _, err := ResolveDuplicates(objs(), ErrorOnDuplicate); err == nil {
+		t.Errorf("expected duplicate error")
+	}
+
+	// Identical duplicates are kept once, even when their numbers were
+	// decoded differently.
+	identical := objs()
+	identical[2] = identical[0].DeepCopy()
+	identical[2].Object["spec"] = map[string]interface{}{"n": int64(1)}
+	identical[0].Object["spec"] = map[string]interface{}{"n": float64(1)}
+	res, err := ResolveDuplicates(identical, ErrorOnDuplicate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0] != identical[0] || res[1] != identical[1] {
+		t.Errorf("unexpected objects %v", res)
+	}
+
+	for _, tc := range []struct {
+		policy DuplicatePolicy
+		want   map[string]string
+	}{
+		{LastWins, map[string]string{"y": "2"}},
+		{MergeDuplicate, map[string]string{"x": "1", "y": "2"}},
+	} {
+		res, err := ResolveDuplicates(objs(), tc.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 2 || res[0].GetName() != "a" || res[1].GetName() != "b" {
+			t.Fatalf("%d: unexpected objects %v", tc.policy, res)
+		}
+		data, _, _ := unstructured.NestedStringMap(res[0].Object, "data")
+		if !reflect.DeepEqual(data, tc.want) {
+			t.Errorf("%d: got %v, want %v", tc.policy, data, tc.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/kubecfg/kubecfg/internal/acquire"
+)
+
+// directoryExtensions lists the extensions of the files picked up when
+// reading a directory.
+var directoryExtensions = map[string]bool{
+	".json":    true,
+	".yaml":    true,
+	".yml":     true,
+	".jsonnet": true,
+}
+
+// ExpandPaths expands the glob patterns in paths (including "**", in
+// sorted order) and replaces each directory with the manifests found in
+// it, recursively and in lexical order. A pattern matching nothing is an
+// error unless WithAllowEmptyGlob is set. Directories are only accepted
+// when WithRecursive is set. Files and directories matching a
+// WithExclude pattern are skipped. Other paths are returned unchanged.
+func ExpandPaths(paths []string, opts ...ReadOption) ([]string, error) {
+	opt := acquire.MakeReadOptions(opts)
+
+	var res []string
+	for _, p := range paths {
+		if p == StdinPath || isURL(p) {
+			res = append(res, p)
+			continue
+		}
+
+		candidates := []string{p}
+		if isGlob(p) {
+			matches, err := doublestar.FilepathGlob(p)
+			if err != nil {
+				return nil, fmt.Errorf("bad glob pattern %q: %w", p, err)
+			}
+			if len(matches) == 0 && !opt.AllowEmptyGlob {
+				return nil, fmt.Errorf("pattern %q matches no files", p)
+			}
+			sort.Strings(matches)
+			candidates = matches
+		}
+
+		for _, c := range candidates {
+			files, err := expandDir(c, opt)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, files...)
+		}
+	}
+	return res, nil
+}
+
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[{")
+}
+
+// expandDir returns the manifests found under path if it is a directory,
+// or path itself otherwise.
+func expandDir(p string, opt acquire.ReadOptions) ([]string, error) {
+	fi, err := os.Stat(p)
+	if err != nil || !fi.IsDir() {
+		return []string{p}, nil
+	}
+	if !opt.Recursive {
+		return nil, fmt.Errorf("%s is a directory, reading directories requires the recursive option", p)
+	}
+
+	var res []string
+	err = filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == p {
+			return nil
+		}
+		excluded, err := isExcluded(opt.Exclude, p, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if excluded {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !excluded && directoryExtensions[strings.ToLower(filepath.Ext(path))] {
+			res = append(res, path)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// isExcluded reports whether path, found while walking root, matches
+// one of the patterns, either by base name or by path relative to root.
+func isExcluded(patterns []string, root, path string) (bool, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false, err
+	}
+	for _, pattern := range patterns {
+		for _, name := range []string{filepath.Base(path), rel} {
+			match, err := filepath.Match(pattern, name)
+			if err != nil {
+				return false, fmt.Errorf("bad exclude pattern %q: %w", pattern, err)
+			}
+			if match {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
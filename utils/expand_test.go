@@ -0,0 +1,76 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandPathsGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"manifests/b.jsonnet",
+		"manifests/a.jsonnet",
+		"manifests/c.yaml",
+		"envs/prod/app.yaml",
+		"envs/dev/eu/app.yaml",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	abs := func(names ...string) []string {
+		var res []string
+		for _, n := range names {
+			res = append(res, filepath.Join(dir, n))
+		}
+		return res
+	}
+
+	got, err := ExpandPaths([]string{
+		filepath.Join(dir, "manifests/*.jsonnet"),
+		filepath.Join(dir, "envs/**/app.yaml"),
+		"literal.jsonnet",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(abs(
+		"manifests/a.jsonnet",
+		"manifests/b.jsonnet",
+		"envs/dev/eu/app.yaml",
+		"envs/prod/app.yaml",
+	), "literal.jsonnet")
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	empty := filepath.Join(dir, "*.json")
+	if _, err := ExpandPaths([]string{empty}); err == nil {
+		t.Errorf("expected an error for a pattern matching nothing")
+	}
+	got, err = ExpandPaths([]string{empty}, WithAllowEmptyGlob(true))
+	if err != nil || len(got) != 0 {
+		t.Errorf("expected no paths, got %v (%v)", got, err)
+	}
+}
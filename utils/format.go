@@ -0,0 +1,80 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+)
+
+// yamlKeyLine matches a line starting a YAML mapping or sequence.
+var yamlKeyLine = regexp.MustCompile(`^(- |-$|[A-Za-z0-9_."'-]+:(\s|$))`)
+
+// jsonnetPrefixes are tokens that can only start a jsonnet file.
+var jsonnetPrefixes = []string{"local ", "local\t", "import ", "importstr ", "function", "//", "/*", "std."}
+
+// sniffFormat guesses the format of content: "json" if it is valid JSON,
+// "jsonnet" for other content starting with '{' or '[' or with a jsonnet
+// keyword or comment, and "yaml" for content starting with a document
+// marker or a mapping key. Returns "" if the format cannot be told.
+func sniffFormat(content []byte) string {
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) == 0 {
+		return ""
+	}
+
+	switch trimmed[0] {
+	case '{', '[':
+		if isJSONStream(trimmed) {
+			return "json"
+		}
+		return "jsonnet"
+	}
+	for _, p := range jsonnetPrefixes {
+		if bytes.HasPrefix(trimmed, []byte(p)) {
+			return "jsonnet"
+		}
+	}
+
+	// Skip YAML comments: '#' also starts a jsonnet comment, so the first
+	// other line decides.
+	for _, line := range bytes.Split(trimmed, []byte("\n")) {
+		line = bytes.TrimRight(line, " \t\r")
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("---")) || yamlKeyLine.Match(line) {
+			return "yaml"
+		}
+		break
+	}
+	return ""
+}
+
+// isJSONStream tells whether content is a sequence of JSON documents, as
+// accepted by jsonReader.
+func isJSONStream(content []byte) bool {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	for dec.More() {
+		var doc json.RawMessage
+		if err := dec.Decode(&doc); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"testing"
+)
+
+func TestSniffFormat(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		want    string
+	}{
+		{`{"kind": "ConfigMap"}`, "json"},
+		{"\n  [1, 2]\n{\"a\": 1}\n", "json"},
+		{`{ kind: "ConfigMap" }`, "jsonnet"},
+		{`[ x for x in [1] ]`, "jsonnet"},
+		{"local a = 1;\n{}", "jsonnet"},
+		{"// comment\n{}", "jsonnet"},
+		{"---\nkind: ConfigMap\n", "yaml"},
+		{"# comment\n\nkind: ConfigMap\n", "yaml"},
+		{"\xef\xbb\xbfapiVersion: v1\n", "yaml"},
+		{"- a\n- b\n", "yaml"},
+		{"# comment\nlocal a = 1; {}", ""},
+		{"hello world", ""},
+		{"", ""},
+	} {
+		if got := sniffFormat([]byte(tc.content)); got != tc.want {
+			t.Errorf("sniffFormat(%q) = %q, want %q", tc.content, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// gitSchemes are the URL schemes served by gitImporter. git:// is a
+// shorthand for git+https://, since most hosts no longer serve the native
+// git protocol.
+var gitSchemes = []string{"git", "git+https", "git+http", "git+ssh", "git+file"}
+
+var gitCommitRE = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// gitImporter serves files from git repositories pinned to a tag or a
+// commit, from URLs like:
+//
+//	git://github.com/org/repo@v1.2.3//lib/foo.libsonnet
+//	git+ssh://git@github.com/org/repo@<commit sha>//lib/foo.libsonnet
+//
+// Each (repository, ref) pair is shallow fetched once into cacheDir and
+// reused by later imports and later runs.
+type gitImporter struct {
+	cacheDir string
+
+	mu        sync.Mutex
+	checkouts map[string]string // "<repo>@<ref>" -> checkout dir
+}
+
+func newGitImporter() *gitImporter {
+	return &gitImporter{checkouts: map[string]string{}}
+}
+
+func (g *gitImporter) RoundTrip(req *http.Request) (*http.Response, error) {
+	repo, ref, file, err := gitSplitURL(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := g.checkout(req.Context(), repo, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(file)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return simpleHTTPResponse(req, http.StatusNotFound, http.NoBody), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return simpleHTTPResponse(req, http.StatusOK, io.NopCloser(bytes.NewReader(b))), nil
+}
+
+// gitSplitURL splits a git import URL into the repository to clone, the
+// ref and the path of the file within the repository.
+func gitSplitURL(u *url.URL) (repo, ref, file string, err error) {
+	repoPath, file, found := strings.Cut(u.Path, "//")
+	if !found || file == "" {
+		return "", "", "", fmt.Errorf("git import %q must have the form <repo>@<ref>//<path>", u)
+	}
+	repoPath, ref, found = strings.Cut(repoPath, "@")
+	if !found || ref == "" {
+		return "", "", "", fmt.Errorf("git import %q must pin a tag or commit with @<ref>", u)
+	}
+	file = path.Clean(file)
+	if file == "." || strings.HasPrefix(file, "../") {
+		return "", "", "", fmt.Errorf("git import %q has an invalid path", u)
+	}
+
+	r := *u
+	r.Scheme = strings.TrimPrefix(u.Scheme, "git+")
+	if u.Scheme == "git" {
+		r.Scheme = "https"
+	}
+	r.Path = repoPath
+	r.RawPath = ""
+	r.RawQuery = ""
+	r.Fragment = ""
+	return r.String(), ref, file, nil
+}
+
+// checkout returns a directory holding repo at ref, fetching it if needed.
+func (g *gitImporter) checkout(ctx context.Context, repo, ref string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := repo + "@" + ref
+	if dir, found := g.checkouts[key]; found {
+		return dir, nil
+	}
+
+	cacheDir := g.cacheDir
+	if cacheDir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			userCache = os.TempDir()
+		}
+		cacheDir = filepath.Join(userCache, "kubecfg", "git")
+	}
+	sum := sha256.Sum256([]byte(key))
+	dir := filepath.Join(cacheDir, hex.EncodeToString(sum[:]))
+
+	if _, err := os.Stat(dir); err != nil {
+		if err := gitFetch(ctx, cacheDir, dir, repo, ref); err != nil {
+			return "", err
+		}
+	} else {
+		log.Debugf("Using cached checkout of %s in %s", key, dir)
+	}
+	g.checkouts[key] = dir
+	return dir, nil
+}
+
+// gitFetch shallow fetches ref from repo into dir. Only tags and full
+// commit hashes are accepted, so that imports are reproducible. The
+// checkout is prepared in a temporary directory and renamed into place
+// once complete. The fetch is killed once ctx is done.
+func gitFetch(ctx context.Context, cacheDir, dir, repo, ref string) error {
+	refspec := "refs/tags/" + ref
+	if gitCommitRE.MatchString(ref) {
+		refspec = ref
+	}
+
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(cacheDir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	log.Debugf("Fetching %s of %s", refspec, repo)
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"fetch", "-q", "--depth", "1", repo, refspec},
+		{"-c", "advice.detachedHead=false", "checkout", "-q", "FETCH_HEAD"},
+	} {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = tmp
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if args[0] == "fetch" {
+				return fmt.Errorf("cannot fetch %s of %s (only tags and full commit hashes can be imported): %v: %s", ref, repo, err, strings.TrimSpace(stderr.String()))
+			}
+			return fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(tmp, ".git")); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		// Another process may have fetched the same ref meanwhile.
+		if _, serr := os.Stat(dir); serr == nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
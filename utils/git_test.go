@@ -0,0 +1,128 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsonnet "github.com/google/go-jsonnet"
+)
+
+func TestGitSplitURL(t *testing.T) {
+	testCases := []struct {
+		url              string
+		repo, ref, file  string
+		wantErrSubstring string
+	}{
+		{url: "git://github.com/org/repo@v1.2.3//lib/foo.libsonnet", repo: "https://github.com/org/repo", ref: "v1.2.3", file: "lib/foo.libsonnet"},
+		{url: "git+ssh://git@github.com/org/repo@v1//foo.libsonnet", repo: "ssh://git@github.com/org/repo", ref: "v1", file: "foo.libsonnet"},
+		{url: "git+file:///srv/repo@v1//a/../b.libsonnet", repo: "file:///srv/repo", ref: "v1", file: "b.libsonnet"},
+		{url: "git://github.com/org/repo//foo.libsonnet", wantErrSubstring: "must pin"},
+		{url: "git://github.com/org/repo@v1", wantErrSubstring: "must have the form"},
+		{url: "git://github.com/org/repo@v1//../foo.libsonnet", wantErrSubstring: "invalid path"},
+	}
+	for i, tc := range testCases {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo, ref, file, err := gitSplitURL(u)
+			if tc.wantErrSubstring != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErrSubstring) {
+					t.Fatalf("expected error containing %q, got %v", tc.wantErrSubstring, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if repo != tc.repo || ref != tc.ref || file != tc.file {
+				t.Errorf("got (%q, %q, %q), want (%q, %q, %q)", repo, ref, file, tc.repo, tc.ref, tc.file)
+			}
+		})
+	}
+}
+
+func TestGitImport(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	repo := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(repo, filepath.Dir(name)), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(repo, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	git("init", "-q", "-b", "main")
+	write("lib/foo.libsonnet", `{ version: (import "version.libsonnet") }`)
+	write("lib/version.libsonnet", `1`)
+	git("add", "-A")
+	git("commit", "-q", "-m", "v1")
+	git("tag", "v1")
+	commit := git("rev-parse", "HEAD")
+	write("lib/version.libsonnet", `2`)
+	git("commit", "-q", "-am", "v2")
+
+	cacheDir := t.TempDir()
+	for _, tc := range []struct {
+		ref  string
+		want string
+	}{
+		{"v1", "1"},
+		{commit, "1"},
+		{"v1", "1"}, // served from the cache
+	} {
+		vm := jsonnet.MakeVM()
+		vm.Importer(MakeUniversalImporter(nil, false, WithGitCacheDir(cacheDir)))
+		out, err := vm.EvaluateAnonymousSnippet("test.jsonnet", fmt.Sprintf(`(import "git+file://%s@%s//lib/foo.libsonnet").version`, repo, tc.ref))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.ref, err)
+		}
+		if got := strings.TrimSpace(out); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.ref, got, tc.want)
+		}
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false, WithGitCacheDir(cacheDir)))
+	_, err := vm.EvaluateAnonymousSnippet("test.jsonnet", fmt.Sprintf(`import "git+file://%s@main//lib/foo.libsonnet"`, repo))
+	if err == nil || !strings.Contains(err.Error(), "only tags and full commit hashes") {
+		t.Errorf("expected branch import to fail, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"sort"
+
+	jsonnet "github.com/google/go-jsonnet"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ListGVKs returns the distinct kinds of the objects read from path, with
+// the items of Lists counted instead of the Lists themselves, sorted by
+// group, version and kind. The objects are read like by ReadStream, one
+// at a time, and aren't retained.
+func ListGVKs(vm *jsonnet.VM, path string, opts ...ReadOption) ([]schema.GroupVersionKind, error) {
+	seen := map[schema.GroupVersionKind]bool{}
+	err := ReadStream(vm, path, func(obj runtime.Object) error {
+		if list, ok := obj.(*unstructured.UnstructuredList); ok {
+			for _, item := range list.Items {
+				seen[item.GroupVersionKind()] = true
+			}
+			return nil
+		}
+		seen[obj.GetObjectKind().GroupVersionKind()] = true
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]schema.GroupVersionKind, 0, len(seen))
+	for gvk := range seen {
+		res = append(res, gvk)
+	}
+	SortGVKs(res)
+	return res, nil
+}
+
+// SortGVKs sorts gvks by group, version and kind.
+func SortGVKs(gvks []schema.GroupVersionKind) {
+	sort.Slice(gvks, func(i, j int) bool {
+		a, b := gvks[i], gvks[j]
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		return a.Kind < b.Kind
+	})
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	jsonnet "github.com/google/go-jsonnet"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestListGVKs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "objs.jsonnet")
+	content := `{
+  web: { apiVersion: "apps/v1", kind: "Deployment", metadata: { name: "web" } },
+  config: [
+    { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "a" } },
+    { apiVersion: "v1", kind: "ConfigMap", metadata: { name: "b" } },
+  ],
+  list: { apiVersion: "v1", kind: "List", items: [
+    { apiVersion: "batch/v1", kind: "Job", metadata: { name: "j" } },
+    { apiVersion: "apps/v1", kind: "DaemonSet", metadata: { name: "d" } },
+  ] },
+}`
+	if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	got, err := ListGVKs(vm, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []schema.GroupVersionKind{
+		{Version: "v1", Kind: "ConfigMap"},
+		{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+		{Group: "apps", Version: "v1", Kind: "Deployment"},
+		{Group: "batch", Version: "v1", Kind: "Job"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := ListGVKs(vm, filepath.Join(dir, "missing.jsonnet")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
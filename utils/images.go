@@ -0,0 +1,207 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/kubecfg/kubecfg/internal/acquire"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// DefaultImageResolveWorkers is the number of images PinImages resolves
+// concurrently when not told otherwise.
+const DefaultImageResolveWorkers = 8
+
+// podSpecPaths lists where pod specs are found in the common workload
+// kinds: Pods, templated controllers and CronJobs.
+var podSpecPaths = [][]string{
+	{"spec"},
+	{"spec", "template", "spec"},
+	{"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// WithImagePinning rewrites the container images of the objects read by
+// kubecfg.ReadObjects to the digests returned by resolver, see PinImages,
+// within the context given to kubecfg.ReadObjectsContext.
+func WithImagePinning(resolver Resolver, workers int) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.PinImages = func(ctx context.Context, objs []*unstructured.Unstructured) error {
+			return PinImages(ctx, objs, resolver, workers)
+		}
+	}
+}
+
+// ImageResolution reports the outcome of resolving one image: the
+// digest form it resolved to, if any, or the error resolving it.
+type ImageResolution struct {
+	Original string `json:"original"`
+	Resolved string `json:"resolved,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	err error
+}
+
+// PinImages replaces the image of each container and init container
+// found in objs with its digest form, as resolved by resolver. Distinct
+// images are resolved concurrently by up to workers goroutines
+// (DefaultImageResolveWorkers if workers <= 0), so resolver must be safe
+// for concurrent use; a BatchResolver is instead given all of them at
+// once. Images the resolver leaves without a digest are kept as they are.
+// Resolutions give up once ctx is done, if resolver is a ContextResolver
+// or a BatchResolver.
+func PinImages(ctx context.Context, objs []*unstructured.Unstructured, resolver Resolver, workers int) error {
+	report, err := ResolveImages(ctx, objs, resolver, workers)
+	if err != nil {
+		return err
+	}
+
+	pinned := map[string]string{}
+	for _, r := range report {
+		pinned[r.Original] = r.Resolved
+	}
+	for _, o := range objs {
+		for _, c := range containers(o) {
+			if image, ok := c["image"].(string); ok && pinned[image] != "" {
+				c["image"] = pinned[image]
+			}
+		}
+	}
+	return nil
+}
+
+// ResolveImages resolves the distinct images of the containers and init
+// containers found in objs, like PinImages but without changing objs, and
+// reports the outcome for each of them in the order they are found.
+// Images that failed to resolve are reported with their error; the first
+// of these errors, in image order, is also returned.
+func ResolveImages(ctx context.Context, objs []*unstructured.Unstructured, resolver Resolver, workers int) ([]ImageResolution, error) {
+	if workers <= 0 {
+		workers = DefaultImageResolveWorkers
+	}
+
+	var images []string
+	seen := map[string]bool{}
+	for _, o := range objs {
+		for _, c := range containers(o) {
+			if image, ok := c["image"].(string); ok && image != "" && !seen[image] {
+				seen[image] = true
+				images = append(images, image)
+			}
+		}
+	}
+
+	report := resolveImages(ctx, images, resolver, workers)
+	var errs []error
+	for _, r := range report {
+		if r.err != nil {
+			errs = append(errs, r.err)
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+		return report, errs[0]
+	}
+	return report, nil
+}
+
+// resolveImages resolves images, in a single batch if resolver is a
+// BatchResolver and concurrently otherwise, and reports the outcome for
+// each of them, in order.
+func resolveImages(ctx context.Context, images []string, resolver Resolver, workers int) []ImageResolution {
+	report := make([]ImageResolution, len(images))
+	setResult := func(i int, n ImageName, err error) {
+		r := ImageResolution{Original: images[i]}
+		if err != nil {
+			r.err = fmt.Errorf("resolving image %s: %w", images[i], err)
+			r.Error = err.Error()
+		} else if n.Digest != "" {
+			r.Resolved = n.String()
+		}
+		report[i] = r
+	}
+
+	if b, ok := resolver.(BatchResolver); ok {
+		var indexes []int
+		var names []*ImageName
+		for i, image := range images {
+			n, err := ParseImageName(image)
+			if err != nil {
+				setResult(i, n, err)
+				continue
+			}
+			indexes = append(indexes, i)
+			names = append(names, &n)
+		}
+		for j, err := range b.ResolveAll(ctx, names) {
+			setResult(indexes[j], *names[j], err)
+		}
+		return report
+	}
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(images); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				n, err := ParseImageName(images[i])
+				if err == nil {
+					err = ResolveContext(ctx, resolver, &n)
+				}
+				setResult(i, n, err)
+			}
+		}()
+	}
+	for i := range images {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	return report
+}
+
+// containers returns the containers and init containers of o's pod
+// spec, if it has one. The returned maps alias o's content.
+func containers(o *unstructured.Unstructured) []map[string]interface{} {
+	var res []map[string]interface{}
+	for _, specPath := range podSpecPaths {
+		spec, found, err := unstructured.NestedFieldNoCopy(o.Object, specPath...)
+		if err != nil || !found {
+			continue
+		}
+		specMap, ok := spec.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, field := range []string{"containers", "initContainers"} {
+			list, ok := specMap[field].([]interface{})
+			if !ok {
+				continue
+			}
+			for _, c := range list {
+				if c, ok := c.(map[string]interface{}); ok {
+					res = append(res, c)
+				}
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,169 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+type fakeDigestResolver struct{}
+
+func (fakeDigestResolver) Resolve(n *ImageName) error {
+	switch {
+	case strings.Contains(n.Name, "broken"):
+		return errors.New("registry unavailable")
+	case strings.Contains(n.Name, "unknown"):
+		return nil
+	}
+	n.Digest = "sha256:0123"
+	return nil
+}
+
+func TestPinImages(t *testing.T) {
+	deploy := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "web"},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"initContainers": []interface{}{
+						map[string]interface{}{"name": "init", "image": "busybox"},
+					},
+					"containers": []interface{}{
+						map[string]interface{}{"name": "web", "image": "nginx:1.23"},
+						map[string]interface{}{"name": "side", "image": "example.com/unknown:v1"},
+					},
+				},
+			},
+		},
+	}}
+
+	if err := PinImages(context.Background(), []*unstructured.Unstructured{deploy}, fakeDigestResolver{}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	podSpec := deploy.Object["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})
+	image := func(field string, i int) string {
+		return podSpec[field].([]interface{})[i].(map[string]interface{})["image"].(string)
+	}
+	for _, tc := range []struct {
+		field    string
+		index    int
+		expected string
+	}{
+		{"initContainers", 0, "docker.io/library/busybox@sha256:0123"},
+		{"containers", 0, "docker.io/library/nginx@sha256:0123"},
+		{"containers", 1, "example.com/unknown:v1"},
+	} {
+		if got := image(tc.field, tc.index); got != tc.expected {
+			t.Errorf("%s[%d]: expected %q, got %q", tc.field, tc.index, tc.expected, got)
+		}
+	}
+
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": "p"},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "c", "image": "broken"},
+			},
+		},
+	}}
+	err := PinImages(context.Background(), []*unstructured.Unstructured{pod}, fakeDigestResolver{}, 0)
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected resolver error mentioning the image, got %v", err)
+	}
+}
+
+func TestPinImagesBatch(t *testing.T) {
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": "p"},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "a", "image": "nginx:1.23"},
+				map[string]interface{}{"name": "b", "image": "busybox"},
+				map[string]interface{}{"name": "c", "image": "nginx:1.23"},
+			},
+		},
+	}}
+
+	resolver := &batchCountingResolver{countingResolver: countingResolver{calls: map[string]int{}}}
+	if err := PinImages(context.Background(), []*unstructured.Unstructured{pod}, resolver, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(resolver.batches) != 1 || len(resolver.batches[0]) != 2 {
+		t.Errorf("expected the distinct images to be resolved in one batch, got %v", resolver.batches)
+	}
+	for i, want := range []string{"docker.io/library/nginx@sha256:0123", "docker.io/library/busybox@sha256:0123", "docker.io/library/nginx@sha256:0123"} {
+		c := pod.Object["spec"].(map[string]interface{})["containers"].([]interface{})[i].(map[string]interface{})
+		if got := c["image"]; got != want {
+			t.Errorf("container %d: expected %q, got %q", i, want, got)
+		}
+	}
+}
+
+func TestResolveImages(t *testing.T) {
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": "p"},
+		"spec": map[string]interface{}{
+			"initContainers": []interface{}{
+				map[string]interface{}{"name": "init", "image": "busybox"},
+			},
+			"containers": []interface{}{
+				map[string]interface{}{"name": "a", "image": "nginx:1.23"},
+				map[string]interface{}{"name": "b", "image": "example.com/unknown:v1"},
+				map[string]interface{}{"name": "c", "image": "broken"},
+				map[string]interface{}{"name": "d", "image": "nginx:1.23"},
+			},
+		},
+	}}
+
+	report, err := ResolveImages(context.Background(), []*unstructured.Unstructured{pod}, fakeDigestResolver{}, 0)
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected resolver error mentioning the image, got %v", err)
+	}
+	want := []ImageResolution{
+		{Original: "nginx:1.23", Resolved: "docker.io/library/nginx@sha256:0123"},
+		{Original: "example.com/unknown:v1"},
+		{Original: "broken", Error: "registry unavailable"},
+		{Original: "busybox", Resolved: "docker.io/library/busybox@sha256:0123"},
+	}
+	if len(report) != len(want) {
+		t.Fatalf("expected %d resolutions, got %v", len(want), report)
+	}
+	for i, r := range report {
+		if r.Original != want[i].Original || r.Resolved != want[i].Resolved || r.Error != want[i].Error {
+			t.Errorf("resolution %d: expected %+v, got %+v", i, want[i], r)
+		}
+	}
+
+	// The objects are left untouched.
+	c := pod.Object["spec"].(map[string]interface{})["containers"].([]interface{})[0].(map[string]interface{})
+	if got := c["image"]; got != "nginx:1.23" {
+		t.Errorf("expected the image to be left as is, got %q", got)
+	}
+}
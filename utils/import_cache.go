@@ -0,0 +1,83 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultImportCacheDir returns the directory used to cache remote imports
+// when none is given: kubecfg/imports in the user cache directory
+// ($XDG_CACHE_HOME on Linux).
+func DefaultImportCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "kubecfg", "imports"), nil
+}
+
+// importCache persists the contents of remote imports. Contents are stored
+// by digest under blobs/sha256/, and urls/ maps the digest of each URL to
+// the digest of its contents. Blobs are checked against their digest when
+// read, so a corrupted entry is treated as missing.
+type importCache struct {
+	dir string
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *importCache) urlPath(url string) string {
+	return filepath.Join(c.dir, "urls", sha256Hex([]byte(url)))
+}
+
+func (c *importCache) blobPath(digest string) string {
+	return filepath.Join(c.dir, "blobs", "sha256", digest)
+}
+
+// get returns the cached contents of url.
+func (c *importCache) get(url string) ([]byte, error) {
+	ref, err := os.ReadFile(c.urlPath(url))
+	if err != nil {
+		return nil, err
+	}
+	digest := strings.TrimPrefix(strings.TrimSpace(string(ref)), "sha256:")
+	b, err := os.ReadFile(c.blobPath(digest))
+	if err != nil {
+		return nil, err
+	}
+	if sha256Hex(b) != digest {
+		return nil, fmt.Errorf("cached copy of %s is corrupted", url)
+	}
+	return b, nil
+}
+
+// put stores the contents of url.
+func (c *importCache) put(url string, b []byte) error {
+	digest := sha256Hex(b)
+	if err := writeFileAtomic(c.blobPath(digest), b); err != nil {
+		return err
+	}
+	return writeFileAtomic(c.urlPath(url), []byte("sha256:"+digest+"\n"))
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// importLock verifies remote imports against a lock file listing the
+// expected SHA-256 digest of each imported URL, one per line:
+//
+//	https://example.com/lib/foo.libsonnet sha256:<hex digest>
+//
+// Blank lines and lines starting with # are ignored. In update mode,
+// missing or changed digests are recorded instead of rejected and the
+// file is rewritten.
+type importLock struct {
+	path   string
+	update bool
+
+	mu      sync.Mutex
+	loaded  bool
+	digests map[string]string
+}
+
+func (l *importLock) load() error {
+	if l.loaded {
+		return nil
+	}
+	l.digests = map[string]string{}
+	b, err := os.ReadFile(l.path)
+	if errors.Is(err, fs.ErrNotExist) && l.update {
+		b, err = nil, nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading import lock file: %w", err)
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "sha256:") {
+			return fmt.Errorf("%s:%d: expected \"<url> sha256:<digest>\"", l.path, n)
+		}
+		l.digests[fields[0]] = fields[1]
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	l.loaded = true
+	return nil
+}
+
+// verify checks that b, the contents of url, match the lock file.
+func (l *importLock) verify(url string, b []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.load(); err != nil {
+		return err
+	}
+	digest := "sha256:" + sha256Hex(b)
+	want, found := l.digests[url]
+	switch {
+	case found && want == digest:
+		return nil
+	case l.update:
+		l.digests[url] = digest
+		return l.write()
+	case !found:
+		return fmt.Errorf("import %s is missing from the import lock file %s", url, l.path)
+	default:
+		return fmt.Errorf("checksum mismatch for import %s: lock file %s has %s, downloaded content has %s", url, l.path, want, digest)
+	}
+}
+
+func (l *importLock) write() error {
+	urls := make([]string, 0, len(l.digests))
+	for u := range l.digests {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+
+	var buf bytes.Buffer
+	for _, u := range urls {
+		fmt.Fprintf(&buf, "%s %s\n", u, l.digests[u])
+	}
+	return writeFileAtomic(l.path, buf.Bytes())
+}
@@ -1,15 +1,18 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
-	"time"
+	"sync"
 
 	jsonnet "github.com/google/go-jsonnet"
 	libsonnet "github.com/kubecfg/kubecfg/lib"
@@ -18,6 +21,10 @@ import (
 
 var errNotFound = errors.New("Not found")
 
+// maxImportRedirects is the number of HTTP redirects followed when
+// fetching a remote import.
+const maxImportRedirects = 10
+
 var extVarKindRE = regexp.MustCompile("^<(?:extvar|top-level-arg):.+>$")
 
 func newInternalFS() http.FileSystem {
@@ -31,6 +38,12 @@ In addition to the standard importer, supports:
   - URLs in import statements
   - URLs in library search paths
   - importing binary files (for local files and URLs)
+  - importing files from git repositories pinned to a tag or commit,
+    e.g. git://github.com/org/repo@v1.2.3//lib/foo.libsonnet
+  - importing files from tar or tar.gz archives, which are read only once,
+    e.g. tar://path/to/app.tar.gz//main.jsonnet
+  - importing the values of JSON objects mapping names to contents, which
+    are parsed only once, e.g. bundle://path/to/snippets.json//common.libsonnet
 
 A real-world example:
   - You have https://raw.githubusercontent.com/ksonnet/ksonnet-lib/master in your search URLs.
@@ -42,39 +55,369 @@ A real-world example:
     will be resolved as https://raw.githubusercontent.com/ksonnet/ksonnet-lib/master/ksonnet.beta.2/k8s.libsonnet
     and downloaded from that location.
 */
-func MakeUniversalImporter(searchURLs []*url.URL, alpha bool) jsonnet.Importer {
-	// Reconstructed copy of http.DefaultTransport (to avoid
-	// modifying the default)
-	t := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-
-	t.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
-	t.RegisterProtocol("internal", http.NewFileTransport(newInternalFS()))
-	t.RegisterProtocol("oci", newOCIImporter())
-
-	return &universalImporter{
+func MakeUniversalImporter(searchURLs []*url.URL, alpha bool, opts ...ImporterOption) jsonnet.Importer {
+	t := &importTransport{protocols: map[string]http.RoundTripper{}}
+	t.protocols["file"] = http.NewFileTransport(http.Dir("/"))
+	t.protocols["internal"] = http.NewFileTransport(newInternalFS())
+	oci := newOCIImporter()
+	t.protocols["oci"] = oci
+	git := newGitImporter()
+	for _, scheme := range gitSchemes {
+		t.protocols[scheme] = git
+	}
+	t.protocols["tar"] = newTarImporter()
+	t.protocols["bundle"] = newBundleImporter()
+
+	checkRedirect := func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxImportRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxImportRedirects)
+		}
+		return nil
+	}
+
+	importer := &universalImporter{
 		BaseSearchURLs: searchURLs,
-		HTTPClient:     &http.Client{Transport: t},
-		cache:          map[string]jsonnet.Contents{},
+		HTTPClient:     &http.Client{Transport: t, CheckRedirect: checkRedirect},
+		cache:          &importedContents{contents: map[string]jsonnet.Contents{}},
 		alpha:          alpha,
+		oci:            oci,
+		git:            git,
+	}
+	for _, o := range opts {
+		o(importer)
+	}
+	if importer.virtual != nil {
+		t.protocols["virtual"] = importer.virtual
+	}
+	if importer.transport != nil {
+		t.remote = importer.transport
+		oci.httpClient = &http.Client{Transport: importer.transport}
+	}
+	if importer.offline && importer.importCache == nil {
+		if dir, err := DefaultImportCacheDir(); err == nil {
+			importer.importCache = &importCache{dir: dir}
+		}
+	}
+	return importer
+}
+
+// DeriveImporter returns an importer sharing the caches, the lock file and
+// the other state of importer, which must have been made by
+// MakeUniversalImporter, with opts applied on top, e.g. WithImportRecorder
+// to record the imports of a single evaluation. Other importers are
+// returned as they are.
+func DeriveImporter(importer jsonnet.Importer, opts ...ImporterOption) jsonnet.Importer {
+	base, ok := importer.(*universalImporter)
+	if !ok {
+		return importer
+	}
+	derived := *base
+	for _, o := range opts {
+		o(&derived)
+	}
+	return &derived
+}
+
+// importedContents caches the contents of imports by the URL they were
+// found at. It is shared by the importers derived from one another.
+type importedContents struct {
+	mu       sync.Mutex
+	contents map[string]jsonnet.Contents
+}
+
+func (c *importedContents) get(foundAt string) (jsonnet.Contents, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	contents, found := c.contents[foundAt]
+	return contents, found
+}
+
+func (c *importedContents) put(foundAt string, contents jsonnet.Contents) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.contents[foundAt] = contents
+}
+
+// remoteTransport fetches the http and https imports of all the importers,
+// which thus share its pool of connections. It is a clone of
+// http.DefaultTransport, so that changes to either don't affect the other.
+var remoteTransport = http.DefaultTransport.(*http.Transport).Clone()
+
+// importTransport dispatches the requests of an importer to the handler of
+// their URL scheme, and the others to remote, or remoteTransport if unset.
+type importTransport struct {
+	protocols map[string]http.RoundTripper
+	remote    http.RoundTripper
+}
+
+func (t *importTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, found := t.protocols[req.URL.Scheme]; found {
+		return rt.RoundTrip(req)
+	}
+	if t.remote != nil {
+		return t.remote.RoundTrip(req)
+	}
+	return remoteTransport.RoundTrip(req)
+}
+
+// ImporterOption configures the importer built by MakeUniversalImporter.
+type ImporterOption func(*universalImporter)
+
+// WithImportRecorder records in r every file and URL resolved by the
+// importer.
+func WithImportRecorder(r *ImportRecorder) ImporterOption {
+	return func(importer *universalImporter) {
+		importer.recorder = r
+	}
+}
+
+// ImportRecorder collects the files and URLs an evaluation imported,
+// including its entrypoints, and which file imported each of them. Local
+// files are recorded as paths, other imports as URLs; data URLs, virtual
+// files and the embedded library are left out.
+type ImportRecorder struct {
+	mu      sync.Mutex
+	imports map[string]bool
+	edges   map[string]map[string]bool // importing file -> imported files
+}
+
+// NewImportRecorder returns an empty ImportRecorder.
+func NewImportRecorder() *ImportRecorder {
+	return &ImportRecorder{imports: map[string]bool{}, edges: map[string]map[string]bool{}}
+}
+
+// importDep returns how an import found at foundAt is recorded, or "" if
+// it isn't.
+func importDep(foundAt string) string {
+	u, err := url.Parse(foundAt)
+	if err != nil {
+		return ""
+	}
+	switch u.Scheme {
+	case "data", "internal", "virtual":
+		return ""
+	case "file":
+		return filepath.FromSlash(u.Path)
+	}
+	return foundAt
+}
+
+func (r *ImportRecorder) record(importedFrom, foundAt string) {
+	dep := importDep(foundAt)
+	if dep == "" {
+		return
+	}
+	from := importDep(importedFrom)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.imports[dep] = true
+	if from != "" && from != dep {
+		if r.edges[from] == nil {
+			r.edges[from] = map[string]bool{}
+		}
+		r.edges[from][dep] = true
+	}
+}
+
+// Imports returns the sorted, deduplicated list of recorded imports.
+func (r *ImportRecorder) Imports() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make([]string, 0, len(r.imports))
+	for i := range r.imports {
+		res = append(res, i)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Cycle returns a chain of recorded imports reachable from the file or URL
+// at path that leads back to one of its links, such as [a, b, a], or nil if
+// there is none.
+func (r *ImportRecorder) Cycle(path string) []string {
+	if dep, err := PathToURL(path); err == nil {
+		path = importDep(dep)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var stack []string
+	var visit func(n string) []string
+	visit = func(n string) []string {
+		state[n] = visiting
+		stack = append(stack, n)
+		next := make([]string, 0, len(r.edges[n]))
+		for m := range r.edges[n] {
+			next = append(next, m)
+		}
+		sort.Strings(next)
+		for _, m := range next {
+			switch state[m] {
+			case visiting:
+				for i, s := range stack {
+					if s == m {
+						return append(append([]string{}, stack[i:]...), m)
+					}
+				}
+			case 0:
+				if c := visit(m); c != nil {
+					return c
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[n] = done
+		return nil
+	}
+	return visit(path)
+}
+
+// WithImportTransport makes the importer send its http and https requests,
+// as well as those fetching oci:// bundles, through transport, e.g. to go
+// through a proxy or present a client certificate.
+func WithImportTransport(transport http.RoundTripper) ImporterOption {
+	return func(importer *universalImporter) {
+		importer.transport = transport
+	}
+}
+
+// WithImportContext aborts the remote imports, including those in flight
+// and those waiting for WithImportMaxConcurrency, once ctx is done. It is
+// meant for an importer derived with DeriveImporter for a single read.
+func WithImportContext(ctx context.Context) ImporterOption {
+	return func(importer *universalImporter) {
+		importer.ctx = ctx
+	}
+}
+
+// WithImportMaxConcurrency caps the number of http and https imports
+// fetched at the same time, across all the importers made with the
+// returned option, e.g. by the VMs ReadObjects evaluates paths with
+// concurrently. Local imports aren't limited, and neither are remote ones
+// when n isn't positive.
+func WithImportMaxConcurrency(n int) ImporterOption {
+	var sem chan struct{}
+	if n > 0 {
+		sem = make(chan struct{}, n)
+	}
+	return func(importer *universalImporter) {
+		if sem != nil {
+			importer.fetchSem = sem
+		}
+	}
+}
+
+// ImportProgressFunc is told about the progress of remote imports: url
+// is the import that was just started or finished, done is the number of
+// remote imports finished so far and total the number started so far.
+type ImportProgressFunc func(url string, done, total int)
+
+// WithImportProgress calls progress as each http or https import starts
+// and finishes being fetched. The counts are shared by all the importers
+// made with the returned option. Imports served from caches, and local
+// ones, aren't reported.
+func WithImportProgress(progress ImportProgressFunc) ImporterOption {
+	p := &importProgress{report: progress}
+	return func(importer *universalImporter) {
+		importer.progress = p
+	}
+}
+
+type importProgress struct {
+	mu          sync.Mutex
+	done, total int
+	report      ImportProgressFunc
+}
+
+func (p *importProgress) start(url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total++
+	p.report(url, p.done, p.total)
+}
+
+func (p *importProgress) finish(url string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.report(url, p.done, p.total)
+}
+
+// WithImportFallbackDir makes remote (http/https) imports that cannot be
+// fetched fall back to a local copy under dir, laid out as
+// dir/<host>/<path>. A warning is logged whenever the fallback is used.
+func WithImportFallbackDir(dir string) ImporterOption {
+	return func(importer *universalImporter) {
+		importer.fallbackDir = dir
+	}
+}
+
+// WithOCILayerCache keeps the layers of oci:// imports in dir, so that
+// later runs don't download them again.
+func WithOCILayerCache(dir string) ImporterOption {
+	return func(importer *universalImporter) {
+		importer.oci.layerCacheDir = dir
+	}
+}
+
+// WithGitCacheDir sets where git imports are checked out. It defaults to
+// kubecfg/git in the user cache directory.
+func WithGitCacheDir(dir string) ImporterOption {
+	return func(importer *universalImporter) {
+		importer.git.cacheDir = dir
+	}
+}
+
+// WithImportCache keeps the contents of remote (http/https) imports in
+// dir and serves later imports of the same URL from there, without
+// checking the remote copy again. Remove the directory to refresh it.
+func WithImportCache(dir string) ImporterOption {
+	return func(importer *universalImporter) {
+		importer.importCache = &importCache{dir: dir}
+	}
+}
+
+// WithOffline makes remote imports fail unless they are in the import
+// cache, which defaults to DefaultImportCacheDir if WithImportCache is not
+// given.
+func WithOffline(offline bool) ImporterOption {
+	return func(importer *universalImporter) {
+		importer.offline = offline
+	}
+}
+
+// WithImportLock verifies every remote import against the SHA-256 digests
+// listed in the lock file at path. With update set, the lock file is
+// created or updated with the digests of the imports instead.
+func WithImportLock(path string, update bool) ImporterOption {
+	return func(importer *universalImporter) {
+		importer.lock = &importLock{path: path, update: update}
 	}
 }
 
 type universalImporter struct {
 	BaseSearchURLs []*url.URL
 	HTTPClient     *http.Client
-	cache          map[string]jsonnet.Contents
-	alpha          bool // alpha features are enable only if true
+	cache          *importedContents
+	alpha          bool   // alpha features are enable only if true
+	fallbackDir    string // local mirror of remote imports, if set
+	oci            *ociImporter
+	git            *gitImporter
+	importCache    *importCache // nil if remote imports are not cached
+	offline        bool         // only serve remote imports from importCache
+	lock           *importLock  // nil if remote imports are not verified
+	recorder       *ImportRecorder
+	virtual        virtualImporter // nil if no virtual files are registered
+	fetchSem       chan struct{}   // bounds concurrent remote fetches, if set
+	progress       *importProgress // reports remote fetches, if set
+	transport      http.RoundTripper
+	ctx            context.Context // nil means context.Background()
 }
 
 func (importer *universalImporter) Import(importedFrom, importedPath string) (jsonnet.Contents, string, error) {
@@ -107,48 +450,156 @@ func (importer *universalImporter) Import(importedFrom, importedPath string) (js
 		if binary {
 			foundAt = u.String() + "##binaryImport"
 		}
-		if c, ok := importer.cache[foundAt]; ok {
+		if c, ok := importer.cache.get(foundAt); ok {
+			importer.record(importedFrom, u.String())
 			return c, foundAt, nil
 		}
 
 		tried = append(tried, foundAt)
 		importedData, err := importer.tryImport(foundAt, binary)
 		if err == nil {
-			importer.cache[foundAt] = importedData
+			importer.cache.put(foundAt, importedData)
+			importer.record(importedFrom, u.String())
 			return importedData, foundAt, nil
 		} else if err != errNotFound {
 			return jsonnet.Contents{}, "", err
 		}
 	}
 
+	if err := bundleImportError(importedPath); err != nil {
+		return jsonnet.Contents{}, "", err
+	}
 	return jsonnet.Contents{}, "", fmt.Errorf("Couldn't open import %q, no match locally or in library search paths. Tried: %s",
 		importedPath,
 		strings.Join(tried, ";"),
 	)
 }
 
+func (importer *universalImporter) context() context.Context {
+	if importer.ctx == nil {
+		return context.Background()
+	}
+	return importer.ctx
+}
+
+func (importer *universalImporter) record(importedFrom, foundAt string) {
+	if importer.recorder != nil {
+		importer.recorder.record(importedFrom, foundAt)
+	}
+}
+
 func (importer *universalImporter) tryImport(url string, binary bool) (jsonnet.Contents, error) {
 	url = strings.TrimSuffix(url, "##binaryImport")
-	res, err := importer.HTTPClient.Get(url)
+	bodyBytes, err := importer.fetch(url)
+	if err != nil && err != errNotFound {
+		if b, ferr := importer.readFallback(url); ferr == nil {
+			log.Warningf("Failed to fetch %q (%v), using fallback copy from %s", url, err, importer.fallbackDir)
+			bodyBytes, err = b, nil
+		}
+	}
 	if err != nil {
 		return jsonnet.Contents{}, err
 	}
+	if importer.lock != nil && isRemoteImport(url) {
+		if err := importer.lock.verify(url, bodyBytes); err != nil {
+			return jsonnet.Contents{}, err
+		}
+	}
+	if binary {
+		return toIntArray(bodyBytes), nil
+	}
+	// The content is kept as raw bytes, which importbin yields as is.
+	return jsonnet.MakeContentsRaw(bodyBytes), nil
+}
+
+func (importer *universalImporter) fetch(url string) ([]byte, error) {
+	remote := strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+	if remote && importer.importCache != nil {
+		b, err := importer.importCache.get(url)
+		if err == nil {
+			log.Debugf("Using cached copy of %q", url)
+			return b, nil
+		}
+		if importer.offline {
+			return nil, fmt.Errorf("cannot import %s in offline mode: %v", url, err)
+		}
+	} else if remote && importer.offline {
+		return nil, fmt.Errorf("cannot import %s in offline mode: no import cache", url)
+	}
+
+	if remote {
+		if importer.fetchSem != nil {
+			select {
+			case importer.fetchSem <- struct{}{}:
+			case <-importer.context().Done():
+				return nil, importer.context().Err()
+			}
+			defer func() { <-importer.fetchSem }()
+		}
+		if importer.progress != nil {
+			importer.progress.start(url)
+			defer importer.progress.finish(url)
+		}
+	}
+	b, err := importer.fetchURL(url)
+	if err == nil && remote && importer.importCache != nil {
+		if cerr := importer.importCache.put(url, b); cerr != nil {
+			log.Warningf("Cannot cache %q: %v", url, cerr)
+		}
+	}
+	return b, err
+}
+
+func (importer *universalImporter) fetchURL(url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(importer.context(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := importer.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
 	defer res.Body.Close()
 	log.Debugf("GET %q -> %s", url, res.Status)
 	if res.StatusCode == http.StatusNotFound {
-		return jsonnet.Contents{}, errNotFound
+		return nil, errNotFound
 	} else if res.StatusCode != http.StatusOK {
-		return jsonnet.Contents{}, fmt.Errorf("error reading content: %s", res.Status)
+		return nil, fmt.Errorf("error reading content from %s: %s", url, res.Status)
 	}
 
-	bodyBytes, err := ioutil.ReadAll(res.Body)
+	return ioutil.ReadAll(res.Body)
+}
+
+// readFallback reads the local copy of a remote url from the fallback
+// dir, if one is configured.
+func (importer *universalImporter) readFallback(rawURL string) ([]byte, error) {
+	if importer.fallbackDir == "" {
+		return nil, errNotFound
+	}
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		return jsonnet.Contents{}, err
+		return nil, err
 	}
-	if binary {
-		return toIntArray(bodyBytes), nil
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errNotFound
+	}
+	return ioutil.ReadFile(filepath.Join(importer.fallbackDir, u.Host, filepath.FromSlash(path.Clean("/"+u.Path))))
+}
+
+// isRemoteImport tells whether rawURL is fetched from another host, as
+// opposed to local files, data URLs and the embedded library.
+func isRemoteImport(rawURL string) bool {
+	scheme, _, _ := strings.Cut(rawURL, ":")
+	switch scheme {
+	case "http", "https", "oci":
+		return true
+	}
+	for _, s := range gitSchemes {
+		if scheme == s {
+			return true
+		}
 	}
-	return jsonnet.MakeContents(string(bodyBytes)), nil
+	return false
 }
 
 func toIntArray(bytes []byte) jsonnet.Contents {
@@ -179,8 +630,11 @@ func (importer *universalImporter) expandImportToCandidateURLs(importedFrom, imp
 		return nil, fmt.Errorf("Invalid import dir %q: %v", importedFrom, err)
 	}
 
-	candidateURLs := make([]*url.URL, 1, len(importer.BaseSearchURLs)+1)
-	candidateURLs[0] = importDirURL.ResolveReference(importedPathURL)
+	candidateURLs := make([]*url.URL, 0, len(importer.BaseSearchURLs)+2)
+	if _, found := importer.virtual[virtualName(importedPath)]; found {
+		candidateURLs = append(candidateURLs, &url.URL{Scheme: "virtual", Path: "/" + virtualName(importedPath)})
+	}
+	candidateURLs = append(candidateURLs, importDirURL.ResolveReference(importedPathURL))
 
 	for _, u := range importer.BaseSearchURLs {
 		candidateURLs = append(candidateURLs, u.ResolveReference(importedPathURL))
@@ -1,10 +1,21 @@
 package utils
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	jsonnet "github.com/google/go-jsonnet"
 )
 
 func TestInternalFS(t *testing.T) {
@@ -54,3 +65,265 @@ func TestExpandImportToCandidateURLs(t *testing.T) {
 		}
 	})
 }
+
+func TestImportFallbackDir(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.libsonnet" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	dir := t.TempDir()
+	for _, name := range []string{"lib/foo.libsonnet", "missing.libsonnet"} {
+		p := filepath.Join(dir, u.Host, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("{ fallback: true }"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	importer := MakeUniversalImporter(nil, false, WithImportFallbackDir(dir))
+	c, _, err := importer.Import("", srv.URL+"/lib/foo.libsonnet")
+	if err != nil {
+		t.Fatalf("expected fallback to be used: %v", err)
+	}
+	if got := c.String(); got != "{ fallback: true }" {
+		t.Errorf("unexpected contents %q", got)
+	}
+
+	// Content that is definitely missing upstream is not replaced.
+	if _, _, err := importer.Import("", srv.URL+"/missing.libsonnet"); err == nil {
+		t.Errorf("expected not found error")
+	}
+
+	if _, _, err := MakeUniversalImporter(nil, false).Import("", srv.URL+"/lib/foo.libsonnet"); err == nil {
+		t.Errorf("expected error without fallback dir")
+	}
+}
+
+func TestImportCache(t *testing.T) {
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte("{ remote: true }"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	for i := 0; i < 2; i++ {
+		c, _, err := MakeUniversalImporter(nil, false, WithImportCache(dir)).Import("", srv.URL+"/lib.libsonnet")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.String(); got != "{ remote: true }" {
+			t.Errorf("unexpected contents %q", got)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("expected the second import to be served from the cache, got %d requests", hits)
+	}
+
+	offline := MakeUniversalImporter(nil, false, WithImportCache(dir), WithOffline(true))
+	if _, _, err := offline.Import("", srv.URL+"/lib.libsonnet"); err != nil {
+		t.Errorf("expected cached import to work offline: %v", err)
+	}
+	if _, _, err := offline.Import("", srv.URL+"/other.libsonnet"); err == nil {
+		t.Errorf("expected uncached import to fail offline")
+	}
+	if hits != 1 {
+		t.Errorf("offline importer made %d requests", hits-1)
+	}
+
+	// A corrupted blob is ignored and fetched again.
+	blobs, err := filepath.Glob(filepath.Join(dir, "blobs", "sha256", "*"))
+	if err != nil || len(blobs) != 1 {
+		t.Fatalf("expected one cached blob, got %v, %v", blobs, err)
+	}
+	if err := os.WriteFile(blobs[0], []byte("tampered"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	offline = MakeUniversalImporter(nil, false, WithImportCache(dir), WithOffline(true))
+	if _, _, err := offline.Import("", srv.URL+"/lib.libsonnet"); err == nil {
+		t.Errorf("expected corrupted cache entry to be rejected offline")
+	}
+	c, _, err := MakeUniversalImporter(nil, false, WithImportCache(dir)).Import("", srv.URL+"/lib.libsonnet")
+	if err != nil || c.String() != "{ remote: true }" || hits != 2 {
+		t.Errorf("expected corrupted entry to be refetched, got %q, %v after %d requests", c.String(), err, hits)
+	}
+}
+
+func TestImportLock(t *testing.T) {
+	body := "{ remote: true }"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	libURL := srv.URL + "/lib.libsonnet"
+	lockFile := filepath.Join(t.TempDir(), "imports.lock")
+
+	if _, _, err := MakeUniversalImporter(nil, false, WithImportLock(lockFile, false)).Import("", libURL); err == nil {
+		t.Errorf("expected error without a lock file")
+	}
+
+	if _, _, err := MakeUniversalImporter(nil, false, WithImportLock(lockFile, true)).Import("", libURL); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), libURL+" sha256:"+sha256Hex([]byte(body))+"\n"; got != want {
+		t.Errorf("got lock file %q, want %q", got, want)
+	}
+
+	if _, _, err := MakeUniversalImporter(nil, false, WithImportLock(lockFile, false)).Import("", libURL); err != nil {
+		t.Errorf("expected locked import to verify: %v", err)
+	}
+
+	body = "{ tampered: true }"
+	_, _, err = MakeUniversalImporter(nil, false, WithImportLock(lockFile, false)).Import("", libURL)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+	if _, _, err := MakeUniversalImporter(nil, false, WithImportLock(lockFile, false)).Import("", srv.URL+"/other.libsonnet"); err == nil {
+		t.Errorf("expected error for import missing from the lock file")
+	}
+
+	// Local imports are not subject to the lock.
+	local := filepath.Join(t.TempDir(), "local.libsonnet")
+	if err := os.WriteFile(local, []byte("{}"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := MakeUniversalImporter(nil, false, WithImportLock(lockFile, false)).Import("", "file://"+local); err != nil {
+		t.Errorf("unexpected error for local import: %v", err)
+	}
+}
+
+func TestImportBinHTTP(t *testing.T) {
+	// The start of a PNG file, including bytes that aren't valid UTF-8.
+	blob := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0x00, 0x00, 0x0d, 0xff, 0xfe, 0x80}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/logo.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(blob)
+	}))
+	defer srv.Close()
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	out, err := vm.EvaluateAnonymousSnippet("test.jsonnet", fmt.Sprintf(`importbin %q`, srv.URL+"/logo.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	var ints []int
+	if err := json.Unmarshal([]byte(out), &ints); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range ints {
+		got = append(got, byte(i))
+	}
+	if !bytes.Equal(got, blob) {
+		t.Errorf("importbin returned %v, want %v", got, blob)
+	}
+}
+
+func TestImportConcurrencyAndProgress(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	type call struct{ done, total int }
+	var calls []call
+	progress := WithImportProgress(func(url string, done, total int) {
+		calls = append(calls, call{done, total})
+	})
+	limit := WithImportMaxConcurrency(2)
+
+	const n = 6
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Separate importers share the limit and the counts.
+			importer := MakeUniversalImporter(nil, false, limit, progress)
+			if _, _, err := importer.Import("", fmt.Sprintf("%s/lib%d.libsonnet", srv.URL, i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if maxInFlight > 2 {
+		t.Errorf("got %d concurrent fetches, want at most 2", maxInFlight)
+	}
+	if len(calls) != 2*n {
+		t.Fatalf("got %d progress calls, want %d: %v", len(calls), 2*n, calls)
+	}
+	if last := calls[len(calls)-1]; last != (call{n, n}) {
+		t.Errorf("got final progress %v, want %v", last, call{n, n})
+	}
+
+	// Local imports aren't reported.
+	local := filepath.Join(t.TempDir(), "local.libsonnet")
+	if err := os.WriteFile(local, []byte("{}"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := MakeUniversalImporter(nil, false, limit, progress).Import("", "file://"+local); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2*n {
+		t.Errorf("local import was reported: %v", calls[2*n:])
+	}
+}
+
+func TestImportMaxConcurrencyUnlimited(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		importer := MakeUniversalImporter(nil, false, WithImportMaxConcurrency(n)).(*universalImporter)
+		if importer.fetchSem != nil {
+			t.Errorf("%d: expected remote imports not to be limited", n)
+		}
+	}
+}
+
+func TestImportTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{ remote: true }"))
+	}))
+	defer srv.Close()
+
+	// The server's certificate is only trusted by its own client.
+	if _, _, err := MakeUniversalImporter(nil, false).Import("", srv.URL+"/lib.libsonnet"); err == nil {
+		t.Errorf("expected the default transport to reject the certificate")
+	}
+	c, _, err := MakeUniversalImporter(nil, false, WithImportTransport(srv.Client().Transport)).Import("", srv.URL+"/lib.libsonnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.String(); got != "{ remote: true }" {
+		t.Errorf("unexpected contents %q", got)
+	}
+}
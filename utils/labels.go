@@ -0,0 +1,62 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"github.com/kubecfg/kubecfg/internal/acquire"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// LabelManagedBy is the recommended label naming the tool managing
+	// an object.
+	LabelManagedBy = "app.kubernetes.io/managed-by"
+	// ManagedByKubecfg is the value of LabelManagedBy added by
+	// WithCommonLabels.
+	ManagedByKubecfg = "kubecfg"
+)
+
+// WithCommonLabels makes ReadObjects add labels, and LabelManagedBy set to
+// ManagedByKubecfg, to the labels of every object. Labels the objects
+// already have keep their value. May be repeated; later labels override
+// earlier ones.
+func WithCommonLabels(labels map[string]string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		if opts.CommonLabels == nil {
+			opts.CommonLabels = map[string]string{LabelManagedBy: ManagedByKubecfg}
+		}
+		for k, v := range labels {
+			opts.CommonLabels[k] = v
+		}
+	}
+}
+
+// AddLabels adds labels to the labels of every object of objs, unless
+// the object already has a label with the same key.
+func AddLabels(objs []*unstructured.Unstructured, labels map[string]string) {
+	for _, o := range objs {
+		l := o.GetLabels()
+		if l == nil {
+			l = make(map[string]string, len(labels))
+		}
+		for k, v := range labels {
+			if _, found := l[k]; !found {
+				l[k] = v
+			}
+		}
+		o.SetLabels(l)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// MergeObjects returns base with patch merged into it. Kinds known to
+// client-go are merged with a strategic merge patch, so that for example
+// containers are merged by name; other kinds fall back to a JSON merge
+// patch (RFC 7386). Null values in patch delete fields. Neither argument
+// is modified.
+func MergeObjects(base, patch *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	baseJSON, err := base.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	patchJSON, err := patch.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var merged []byte
+	typed, err := scheme.Scheme.New(base.GroupVersionKind())
+	switch {
+	case err == nil:
+		merged, err = strategicpatch.StrategicMergePatch(baseJSON, patchJSON, typed)
+	case runtime.IsNotRegisteredError(err):
+		merged, err = jsonpatch.MergePatch(baseJSON, patchJSON)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := &unstructured.Unstructured{}
+	if err := res.UnmarshalJSON(merged); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
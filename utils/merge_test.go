@@ -0,0 +1,71 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func mustUnstructured(t *testing.T, j string) *unstructured.Unstructured {
+	t.Helper()
+	o := &unstructured.Unstructured{}
+	if err := o.UnmarshalJSON([]byte(j)); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestMergeObjects(t *testing.T) {
+	testCases := []struct {
+		name              string
+		base, patch, want string
+	}{
+		{
+			name: "strategic",
+			base: `{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "d", "labels": {"a": "1"}},
+				"spec": {"template": {"spec": {"containers": [{"name": "app", "image": "app:1"}, {"name": "sidecar", "image": "sidecar:1"}]}}}}`,
+			patch: `{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "d", "labels": {"b": "2"}},
+				"spec": {"template": {"spec": {"containers": [{"name": "sidecar", "image": "sidecar:2"}]}}}}`,
+			want: `{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "d", "labels": {"a": "1", "b": "2"}},
+				"spec": {"template": {"spec": {"containers": [{"name": "app", "image": "app:1"}, {"name": "sidecar", "image": "sidecar:2"}]}}}}`,
+		},
+		{
+			name:  "merge patch",
+			base:  `{"apiVersion": "example.com/v1", "kind": "Widget", "metadata": {"name": "w"}, "spec": {"a": 1, "b": 2, "list": [1, 2]}}`,
+			patch: `{"apiVersion": "example.com/v1", "kind": "Widget", "metadata": {"name": "w"}, "spec": {"b": null, "c": 3, "list": [3]}}`,
+			want:  `{"apiVersion": "example.com/v1", "kind": "Widget", "metadata": {"name": "w"}, "spec": {"a": 1, "c": 3, "list": [3]}}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			base, patch := mustUnstructured(t, tc.base), mustUnstructured(t, tc.patch)
+			baseCopy := base.DeepCopy()
+			got, err := MergeObjects(base, patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := mustUnstructured(t, tc.want); !reflect.DeepEqual(got.Object, want.Object) {
+				t.Errorf("got %v, want %v", got.Object, want.Object)
+			}
+			if !reflect.DeepEqual(base.Object, baseCopy.Object) {
+				t.Errorf("base was modified: %v", base.Object)
+			}
+		})
+	}
+}
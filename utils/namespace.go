@@ -0,0 +1,107 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"github.com/kubecfg/kubecfg/internal/acquire"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// clusterScopedKinds are the built-in kinds that are not namespaced.
+var clusterScopedKinds = map[schema.GroupKind]bool{
+	{Group: "", Kind: "ComponentStatus"}:                                              true,
+	{Group: "", Kind: "Namespace"}:                                                    true,
+	{Group: "", Kind: "Node"}:                                                         true,
+	{Group: "", Kind: "PersistentVolume"}:                                             true,
+	{Group: "admissionregistration.k8s.io", Kind: "MutatingWebhookConfiguration"}:     true,
+	{Group: "admissionregistration.k8s.io", Kind: "ValidatingAdmissionPolicy"}:        true,
+	{Group: "admissionregistration.k8s.io", Kind: "ValidatingAdmissionPolicyBinding"}: true,
+	{Group: "admissionregistration.k8s.io", Kind: "ValidatingWebhookConfiguration"}:   true,
+	{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}:                 true,
+	{Group: "apiregistration.k8s.io", Kind: "APIService"}:                             true,
+	{Group: "authentication.k8s.io", Kind: "TokenReview"}:                             true,
+	{Group: "authentication.k8s.io", Kind: "SelfSubjectReview"}:                       true,
+	{Group: "authorization.k8s.io", Kind: "SelfSubjectAccessReview"}:                  true,
+	{Group: "authorization.k8s.io", Kind: "SelfSubjectRulesReview"}:                   true,
+	{Group: "authorization.k8s.io", Kind: "SubjectAccessReview"}:                      true,
+	{Group: "certificates.k8s.io", Kind: "CertificateSigningRequest"}:                 true,
+	{Group: "flowcontrol.apiserver.k8s.io", Kind: "FlowSchema"}:                       true,
+	{Group: "flowcontrol.apiserver.k8s.io", Kind: "PriorityLevelConfiguration"}:       true,
+	{Group: "networking.k8s.io", Kind: "IngressClass"}:                                true,
+	{Group: "node.k8s.io", Kind: "RuntimeClass"}:                                      true,
+	{Group: "policy", Kind: "PodSecurityPolicy"}:                                      true,
+	{Group: "rbac.authorization.k8s.io", Kind: "ClusterRole"}:                         true,
+	{Group: "rbac.authorization.k8s.io", Kind: "ClusterRoleBinding"}:                  true,
+	{Group: "scheduling.k8s.io", Kind: "PriorityClass"}:                               true,
+	{Group: "storage.k8s.io", Kind: "CSIDriver"}:                                      true,
+	{Group: "storage.k8s.io", Kind: "CSINode"}:                                        true,
+	{Group: "storage.k8s.io", Kind: "StorageClass"}:                                   true,
+	{Group: "storage.k8s.io", Kind: "VolumeAttachment"}:                               true,
+}
+
+// WithDefaultNamespace makes ReadObjects set the namespace of namespaced
+// objects lacking one to ns. Whether a kind is namespaced is told by the
+// mapper given to WithRESTMapper, else by a list of the built-in cluster
+// scoped kinds; other kinds are assumed to be namespaced.
+func WithDefaultNamespace(ns string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.DefaultNamespace = ns
+	}
+}
+
+// WithRESTMapper makes ReadObjects use mapper, typically backed by the
+// discovery client, to tell namespaced kinds from cluster scoped ones.
+// Kinds unknown to mapper fall back to the built-in list.
+func WithRESTMapper(mapper meta.RESTMapper) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.RESTMapper = mapper
+	}
+}
+
+// IsNamespaced tells whether objects of kind gvk are namespaced, asking
+// mapper if not nil. See WithDefaultNamespace.
+func IsNamespaced(gvk schema.GroupVersionKind, mapper meta.RESTMapper) (bool, error) {
+	if mapper != nil {
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err == nil {
+			return mapping.Scope.Name() == meta.RESTScopeNameNamespace, nil
+		}
+		if !meta.IsNoMatchError(err) {
+			return false, err
+		}
+	}
+	return !clusterScopedKinds[gvk.GroupKind()], nil
+}
+
+// DefaultNamespace sets the namespace of the namespaced objects in objs
+// that have none to ns.
+func DefaultNamespace(objs []*unstructured.Unstructured, ns string, mapper meta.RESTMapper) error {
+	for _, o := range objs {
+		if o.GetNamespace() != "" {
+			continue
+		}
+		namespaced, err := IsNamespaced(o.GroupVersionKind(), mapper)
+		if err != nil {
+			return err
+		}
+		if namespaced {
+			o.SetNamespace(ns)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestDefaultNamespace(t *testing.T) {
+	objs := func() []*unstructured.Unstructured {
+		return []*unstructured.Unstructured{
+			mustUnstructured(t, `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "a"}}`),
+			mustUnstructured(t, `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "b", "namespace": "other"}}`),
+			mustUnstructured(t, `{"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "c"}}`),
+			mustUnstructured(t, `{"apiVersion": "rbac.authorization.k8s.io/v1", "kind": "ClusterRole", "metadata": {"name": "d"}}`),
+			mustUnstructured(t, `{"apiVersion": "example.com/v1", "kind": "Widget", "metadata": {"name": "e"}}`),
+		}
+	}
+	namespaces := func(objs []*unstructured.Unstructured) []string {
+		var res []string
+		for _, o := range objs {
+			res = append(res, o.GetNamespace())
+		}
+		return res
+	}
+
+	res := objs()
+	if err := DefaultNamespace(res, "ns", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := namespaces(res), []string{"ns", "other", "", "", "ns"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The mapper knows that Widgets are cluster scoped.
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}, meta.RESTScopeRoot)
+	res = objs()
+	if err := DefaultNamespace(res, "ns", mapper); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := namespaces(res), []string{"ns", "other", "", "", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -16,15 +16,24 @@
 package utils
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/url"
+	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
+	"github.com/Masterminds/semver/v3"
+	jsonpatch "github.com/evanphx/json-patch/v5"
 	goyaml "github.com/ghodss/yaml"
 	jsonnet "github.com/google/go-jsonnet"
 	jsonnetAst "github.com/google/go-jsonnet/ast"
@@ -34,6 +43,7 @@ import (
 	helmEngine "helm.sh/helm/v3/pkg/engine"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/util/jsonpath"
 )
 
 func resolveImage(resolver Resolver, image string) (string, error) {
@@ -76,8 +86,46 @@ func (r *ArrayReader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+// NativeFuncsOption configures RegisterNativeFuncs.
+type NativeFuncsOption func(*nativeFuncsOpts)
+
+type nativeFuncsOpts struct {
+	alpha bool
+}
+
+// WithAlphaNativeFuncs also registers the native functions that are alpha
+// features, such as getEnv, which makes the output depend on the
+// environment kubecfg runs in.
+func WithAlphaNativeFuncs(enable bool) NativeFuncsOption {
+	return func(opts *nativeFuncsOpts) {
+		opts.alpha = enable
+	}
+}
+
 // RegisterNativeFuncs adds kubecfg's native jsonnet functions to provided VM
-func RegisterNativeFuncs(vm *jsonnet.VM, resolver Resolver) {
+func RegisterNativeFuncs(vm *jsonnet.VM, resolver Resolver, opt ...NativeFuncsOption) {
+	var opts nativeFuncsOpts
+	for _, o := range opt {
+		o(&opts)
+	}
+
+	if opts.alpha {
+		vm.NativeFunction(&jsonnet.NativeFunction{
+			Name:   "getEnv",
+			Params: []jsonnetAst.Identifier{"name", "default"},
+			Func: func(args []interface{}) (interface{}, error) {
+				name, ok := args[0].(string)
+				if !ok {
+					return nil, fmt.Errorf("getEnv: name must be a string, got %T", args[0])
+				}
+				if value, found := os.LookupEnv(name); found {
+					return value, nil
+				}
+				return args[1], nil
+			},
+		})
+	}
+
 	// TODO(mkm): go-jsonnet 0.12.x now contains native std.parseJson; deprecate and remove this one.
 	vm.NativeFunction(&jsonnet.NativeFunction{
 		Name:   "parseJson",
@@ -138,27 +186,209 @@ func RegisterNativeFuncs(vm *jsonnet.VM, resolver Resolver) {
 		},
 	})
 
+	regexps := newRegexpCache()
+
 	vm.NativeFunction(&jsonnet.NativeFunction{
 		Name:   "regexMatch",
 		Params: []jsonnetAst.Identifier{"regex", "string"},
 		Func: func(args []interface{}) (res interface{}, err error) {
-			return regexp.MatchString(args[0].(string), args[1].(string))
+			r, err := regexps.compile(args[0].(string))
+			if err != nil {
+				return false, err
+			}
+			return r.MatchString(args[1].(string)), nil
+		},
+	})
+
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "regexFindAll",
+		Params: []jsonnetAst.Identifier{"regex", "string"},
+		Func: func(args []interface{}) (res interface{}, err error) {
+			r, err := regexps.compile(args[0].(string))
+			if err != nil {
+				return nil, err
+			}
+			matches := []interface{}{}
+			for _, m := range r.FindAllString(args[1].(string), -1) {
+				matches = append(matches, m)
+			}
+			return matches, nil
 		},
 	})
 
+	regexReplace := func(args []interface{}) (res interface{}, err error) {
+		regex := args[0].(string)
+		src := args[1].(string)
+		repl := args[2].(string)
+
+		r, err := regexps.compile(regex)
+		if err != nil {
+			return "", err
+		}
+		return r.ReplaceAllString(src, repl), nil
+	}
+
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "regexReplace",
+		Params: []jsonnetAst.Identifier{"regex", "src", "repl"},
+		Func:   regexReplace,
+	})
+
 	vm.NativeFunction(&jsonnet.NativeFunction{
 		Name:   "regexSubst",
 		Params: []jsonnetAst.Identifier{"regex", "src", "repl"},
+		Func:   regexReplace,
+	})
+
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "jsonPath",
+		Params: []jsonnetAst.Identifier{"obj", "path", "strict"},
+		Func: func(args []interface{}) (res interface{}, err error) {
+			path, ok := args[1].(string)
+			if !ok {
+				return nil, fmt.Errorf("jsonPath: path must be a string, got %T", args[1])
+			}
+			strict, ok := args[2].(bool)
+			if !ok {
+				return nil, fmt.Errorf("jsonPath: strict must be a boolean, got %T", args[2])
+			}
+			return jsonPathQuery(args[0], path, strict)
+		},
+	})
+
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "mergePatchDiff",
+		Params: []jsonnetAst.Identifier{"original", "modified"},
+		Func: func(args []interface{}) (res interface{}, err error) {
+			return mergePatchDiff(args[0], args[1])
+		},
+	})
+
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "mergePatch",
+		Params: []jsonnetAst.Identifier{"target", "patch"},
+		Func: func(args []interface{}) (res interface{}, err error) {
+			return mergePatch(args[0], args[1])
+		},
+	})
+
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "mergeDeep",
+		Params: []jsonnetAst.Identifier{"a", "b"},
 		Func: func(args []interface{}) (res interface{}, err error) {
-			regex := args[0].(string)
-			src := args[1].(string)
-			repl := args[2].(string)
+			return mergeDeep(args[0], args[1]), nil
+		},
+	})
 
-			r, err := regexp.Compile(regex)
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "base64Encode",
+		Params: []jsonnetAst.Identifier{"data", "binary"},
+		Func: func(args []interface{}) (res interface{}, err error) {
+			b, err := nativeBytes("base64Encode", args[0], args[1])
 			if err != nil {
-				return "", err
+				return nil, err
+			}
+			return base64.StdEncoding.EncodeToString(b), nil
+		},
+	})
+
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "base64Decode",
+		Params: []jsonnetAst.Identifier{"data", "binary"},
+		Func: func(args []interface{}) (res interface{}, err error) {
+			data, ok := args[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("base64Decode: data must be a string, got %T", args[0])
+			}
+			b, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return nil, fmt.Errorf("base64Decode: %v", err)
+			}
+			return nativeString("base64Decode", b, args[1])
+		},
+	})
+
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "gzip",
+		Params: []jsonnetAst.Identifier{"data", "binary"},
+		Func: func(args []interface{}) (res interface{}, err error) {
+			b, err := nativeBytes("gzip", args[0], args[1])
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			if _, err := w.Write(b); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+		},
+	})
+
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "gunzip",
+		Params: []jsonnetAst.Identifier{"data", "binary"},
+		Func: func(args []interface{}) (res interface{}, err error) {
+			data, ok := args[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("gunzip: data must be a base64 string, got %T", args[0])
+			}
+			z, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return nil, fmt.Errorf("gunzip: %v", err)
+			}
+			r, err := gzip.NewReader(bytes.NewReader(z))
+			if err != nil {
+				return nil, fmt.Errorf("gunzip: %v", err)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				return nil, fmt.Errorf("gunzip: %v", err)
+			}
+			return nativeString("gunzip", b, args[1])
+		},
+	})
+
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "hashObject",
+		Params: []jsonnetAst.Identifier{"obj"},
+		Func: func(args []interface{}) (res interface{}, err error) {
+			obj, ok := args[0].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("hashObject: obj must be an object, got %T", args[0])
+			}
+			return hashObject(obj), nil
+		},
+	})
+
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "semverCompare",
+		Params: []jsonnetAst.Identifier{"constraint", "version"},
+		Func: func(args []interface{}) (res interface{}, err error) {
+			constraint, ok := args[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("semverCompare: constraint must be a string, got %T", args[0])
 			}
-			return r.ReplaceAllString(src, repl), nil
+			c, err := semver.NewConstraint(constraint)
+			if err != nil {
+				return nil, fmt.Errorf("semverCompare: invalid constraint %q: %v", constraint, err)
+			}
+			v, err := parseSemver("semverCompare", args[1])
+			if err != nil {
+				return nil, err
+			}
+			return c.Check(v), nil
+		},
+	})
+
+	vm.NativeFunction(&jsonnet.NativeFunction{
+		Name:   "semverSort",
+		Params: []jsonnetAst.Identifier{"versions"},
+		Func: func(args []interface{}) (res interface{}, err error) {
+			return semverSort(args[0])
 		},
 	})
 
@@ -244,17 +474,285 @@ func RegisterNativeFuncs(vm *jsonnet.VM, resolver Resolver) {
 	})
 }
 
+// regexpCache holds the regexps compiled by the regex native functions of
+// a VM, so that patterns used in loops are compiled only once.
+type regexpCache struct {
+	mu    sync.Mutex
+	cache map[string]*regexp.Regexp
+}
+
+func newRegexpCache() *regexpCache {
+	return &regexpCache{cache: map[string]*regexp.Regexp{}}
+}
+
+func (c *regexpCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, found := c.cache[pattern]; found {
+		return r, nil
+	}
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	c.cache[pattern] = r
+	return r, nil
+}
+
+// nativeBytes returns the bytes held by data, the argument of native
+// function fn. Strings are UTF-8 encoded, unless binary is set in which
+// case each character holds one byte (the convention of
+// std.base64Decode). Arrays of numbers 0-255 are accepted too.
+func nativeBytes(fn string, data, binary interface{}) ([]byte, error) {
+	switch d := data.(type) {
+	case string:
+		if binary != true {
+			return []byte(d), nil
+		}
+		b := make([]byte, 0, len(d))
+		for _, c := range d {
+			if c > 0xff {
+				return nil, fmt.Errorf("%s: binary string has character %q beyond U+00FF", fn, c)
+			}
+			b = append(b, byte(c))
+		}
+		return b, nil
+	case []interface{}:
+		b, err := io.ReadAll(&ArrayReader{d})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("%s: data must be a string or an array of bytes, got %T", fn, data)
+	}
+}
+
+// nativeString is the inverse of nativeBytes. Without binary, b must be
+// valid UTF-8: arbitrary bytes are never silently replaced.
+func nativeString(fn string, b []byte, binary interface{}) (string, error) {
+	if binary != true {
+		if !utf8.Valid(b) {
+			return "", fmt.Errorf("%s: result is not valid UTF-8, use binary=true", fn)
+		}
+		return string(b), nil
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r), nil
+}
+
+// hashedFields are the fields of a ConfigMap or Secret that hashObject
+// covers.
+var hashedFields = []string{"kind", "type", "data", "binaryData", "stringData"}
+
+// hashObject returns a hash of the contents of a ConfigMap or Secret,
+// suitable as a name suffix in the style of kustomize's configMapGenerator.
+// The hash is taken over the Canonicalize form, so it depends neither on
+// the order of fields nor on fields set to null.
+func hashObject(obj map[string]interface{}) string {
+	content := map[string]interface{}{}
+	for _, f := range hashedFields {
+		if v, found := obj[f]; found {
+			content[f] = v
+		}
+	}
+	return encodeHash(sha256Hex(Canonicalize(&unstructured.Unstructured{Object: content}))[:10])
+}
+
+// encodeHash replaces the characters of a hex hash that could make it
+// read like a word or be mistaken for one another, as kustomize does.
+func encodeHash(hex string) string {
+	return strings.NewReplacer("0", "g", "1", "h", "3", "k", "a", "m", "e", "t").Replace(hex)
+}
+
+// jsonPathQuery evaluates a kubectl-style JSONPath expression (e.g.
+// `{.spec.containers[*].name}`) against obj. A plain dotted path such as
+// `spec.replicas` or `$.spec.replicas` is accepted too.
+//
+// A single match is returned as is, multiple matches are returned as an
+// array. When nothing matches, null is returned unless strict is set, in
+// which case it's an error.
+func jsonPathQuery(obj interface{}, path string, strict bool) (interface{}, error) {
+	expr := path
+	if !strings.HasPrefix(expr, "{") {
+		expr = strings.TrimPrefix(expr, "$")
+		if !strings.HasPrefix(expr, ".") && !strings.HasPrefix(expr, "[") {
+			expr = "." + expr
+		}
+		expr = "{" + expr + "}"
+	}
+
+	jp := jsonpath.New("jsonPath").AllowMissingKeys(!strict)
+	if err := jp.Parse(expr); err != nil {
+		return nil, fmt.Errorf("invalid JSONPath %q: %v", path, err)
+	}
+	results, err := jp.FindResults(obj)
+	if err != nil {
+		return nil, fmt.Errorf("evaluating JSONPath %q: %v", path, err)
+	}
+
+	var matches []interface{}
+	for _, r := range results {
+		for _, v := range r {
+			matches = append(matches, v.Interface())
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		if strict {
+			return nil, fmt.Errorf("JSONPath %q did not match anything", path)
+		}
+		return nil, nil
+	case 1:
+		return matches[0], nil
+	default:
+		return matches, nil
+	}
+}
+
+// parseSemver parses the jsonnet value v as a semantic version,
+// reporting the offending string when it isn't one.
+func parseSemver(fn string, v interface{}) (*semver.Version, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: version must be a string, got %T", fn, v)
+	}
+	ver, err := semver.NewVersion(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid version %q: %v", fn, s, err)
+	}
+	return ver, nil
+}
+
+// semverSort returns the version strings in versions ordered from
+// lowest to highest semantic version. The strings are returned as
+// given, so "v1.2" stays "v1.2".
+func semverSort(versions interface{}) (interface{}, error) {
+	arr, ok := versions.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("semverSort: versions must be an array, got %T", versions)
+	}
+	type entry struct {
+		ver *semver.Version
+		str string
+	}
+	entries := make([]entry, len(arr))
+	for i, v := range arr {
+		ver, err := parseSemver("semverSort", v)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = entry{ver, v.(string)}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].ver.LessThan(entries[j].ver)
+	})
+	res := make([]interface{}, len(entries))
+	for i, e := range entries {
+		res[i] = e.str
+	}
+	return res, nil
+}
+
+// mergePatchDiff returns the RFC 7386 JSON merge patch that turns
+// original into modified. Removed fields are set to null in the patch.
+func mergePatchDiff(original, modified interface{}) (interface{}, error) {
+	a, err := json.Marshal(original)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(modified)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := jsonpatch.CreateMergePatch(a, b)
+	if err != nil {
+		return nil, fmt.Errorf("mergePatchDiff: %w", err)
+	}
+	var res interface{}
+	if err := json.Unmarshal(patch, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// mergePatch applies the RFC 7386 JSON merge patch patch to target.
+// Null values in patch delete fields, and values other than objects
+// replace the target value. Neither argument is modified.
+func mergePatch(target, patch interface{}) (interface{}, error) {
+	if _, ok := patch.(map[string]interface{}); !ok {
+		// jsonpatch only takes object patches.
+		return patch, nil
+	}
+	a, err := json.Marshal(target)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := jsonpatch.MergePatch(a, b)
+	if err != nil {
+		return nil, fmt.Errorf("mergePatch: %w", err)
+	}
+	var res interface{}
+	if err := json.Unmarshal(merged, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// mergeDeep merges b into a: fields that are objects in both are merged
+// recursively, other values of b, including arrays and nulls, replace
+// those of a. Neither argument is modified.
+func mergeDeep(a, b interface{}) interface{} {
+	am, ok := a.(map[string]interface{})
+	if !ok {
+		return b
+	}
+	bm, ok := b.(map[string]interface{})
+	if !ok {
+		return b
+	}
+	res := make(map[string]interface{}, len(am)+len(bm))
+	for k, v := range am {
+		res[k] = v
+	}
+	for k, v := range bm {
+		if av, found := res[k]; found {
+			v = mergeDeep(av, v)
+		}
+		res[k] = v
+	}
+	return res
+}
+
+// unmarshalYAMLString parses each document of a (possibly multi-document)
+// YAML stream, using the same document splitting and YAML-to-JSON
+// conversion as yamlReader.
 func unmarshalYAMLString(yamlStr string) ([]interface{}, error) {
-	d := yaml.NewYAMLToJSONDecoder(strings.NewReader(yamlStr))
+	r := newYAMLDocumentReader(strings.NewReader(yamlStr))
 	var ret []interface{}
 	for {
-		var doc interface{}
-		if err := d.Decode(&doc); err != nil {
-			if err == io.EOF {
-				break
-			}
+		buf, line, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
 			return nil, err
 		}
+		jsondata, err := yaml.ToJSON(buf)
+		if err != nil {
+			return nil, fmt.Errorf("document at line %d: %v", line, err)
+		}
+		var doc interface{}
+		if err := json.Unmarshal(jsondata, &doc); err != nil {
+			return nil, fmt.Errorf("document at line %d: %v", line, err)
+		}
 		ret = append(ret, doc)
 	}
 	return ret, nil
@@ -17,7 +17,10 @@ package utils
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"reflect"
+	"strings"
 	"testing"
 
 	jsonnet "github.com/google/go-jsonnet"
@@ -73,6 +76,99 @@ func TestParseYaml(t *testing.T) {
     local a = std.native("parseYaml")("---\nhello\n---\nworld");
     a[0] + a[1]`)
 	check(t, err, x, "\"helloworld\"\n")
+
+	x, err = vm.EvaluateSnippet("test", `
+    std.native("parseYaml")("---\n---\na: 1\n---\n- b\n")`)
+	check(t, err, x, "[\n   {\n      \"a\": 1\n   },\n   [\n      \"b\"\n   ]\n]\n")
+}
+
+func TestBase64(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	RegisterNativeFuncs(vm, NewIdentityResolver())
+
+	x, err := vm.EvaluateSnippet("test", `std.native("base64Encode")([0, 255, 128], false)`)
+	check(t, err, x, "\"AP+A\"\n")
+
+	_, err = vm.EvaluateSnippet("failtest", `std.native("base64Decode")("AP+A", false)`)
+	if err == nil {
+		t.Errorf("base64Decode returned invalid UTF-8 without binary")
+	}
+
+	x, err = vm.EvaluateSnippet("test", `
+    local b = std.native("base64Decode")("AP+A", true);
+    [std.codepoint(c) for c in std.stringChars(b)]`)
+	check(t, err, x, "[\n   0,\n   255,\n   128\n]\n")
+
+	x, err = vm.EvaluateSnippet("test", `
+    local b = std.native("base64Decode")("AP+A", true);
+    std.native("base64Encode")(b, true)`)
+	check(t, err, x, "\"AP+A\"\n")
+
+	_, err = vm.EvaluateSnippet("failtest", `std.native("base64Encode")("\u0100", true)`)
+	if err == nil {
+		t.Errorf("base64Encode accepted a binary string with a character beyond U+00FF")
+	}
+
+	_, err = vm.EvaluateSnippet("failtest", `std.native("base64Decode")("!!", false)`)
+	if err == nil {
+		t.Errorf("base64Decode succeeded on invalid base64")
+	}
+}
+
+func TestGzip(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	RegisterNativeFuncs(vm, NewIdentityResolver())
+
+	x, err := vm.EvaluateSnippet("test", `
+    local z = std.native("gzip")("hello\n", false);
+    std.native("gunzip")(z, false)`)
+	check(t, err, x, "\"hello\\n\"\n")
+
+	x, err = vm.EvaluateSnippet("test", `
+    local z = std.native("gzip")([0, 255], false);
+    std.native("base64Encode")(std.native("gunzip")(z, true), true)`)
+	check(t, err, x, "\"AP8=\"\n")
+
+	_, err = vm.EvaluateSnippet("failtest", `std.native("gunzip")("aGVsbG8=", false)`)
+	if err == nil {
+		t.Errorf("gunzip succeeded on data that isn't gzip compressed")
+	}
+}
+
+func TestHashObject(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	RegisterNativeFuncs(vm, NewIdentityResolver())
+
+	hash := func(obj string) string {
+		t.Helper()
+		x, err := vm.EvaluateSnippet("test", `std.native("hashObject")(`+obj+`)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return x
+	}
+
+	a := hash(`{kind: "ConfigMap", metadata: {name: "a"}, data: {x: "1", y: "2"}}`)
+	if len(a) != len(`"0123456789"`+"\n") {
+		t.Errorf("unexpected hash %q", a)
+	}
+	if b := hash(`{data: {y: "2", x: "1"}, metadata: {name: "b"}, kind: "ConfigMap"}`); a != b {
+		t.Errorf("hash depends on field order or name: %q != %q", a, b)
+	}
+	if b := hash(`{kind: "ConfigMap", data: {x: "1", y: "2", z: null}, binaryData: null}`); a != b {
+		t.Errorf("hash depends on null fields: %q != %q", a, b)
+	}
+	if b := hash(`{kind: "ConfigMap", data: {x: "1", y: "3"}}`); a == b {
+		t.Errorf("hash doesn't change with data")
+	}
+	if b := hash(`{kind: "Secret", data: {x: "1", y: "2"}}`); a == b {
+		t.Errorf("hash doesn't change with kind")
+	}
+
+	_, err := vm.EvaluateSnippet("failtest", `std.native("hashObject")("foo")`)
+	if err == nil {
+		t.Errorf("hashObject succeeded on a string")
+	}
 }
 
 func TestRegexMatch(t *testing.T) {
@@ -107,6 +203,142 @@ func TestRegexSubst(t *testing.T) {
 	check(t, err, x, "\"-W-xxW-\"\n")
 }
 
+func TestRegexFindAll(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	RegisterNativeFuncs(vm, NewIdentityResolver())
+
+	_, err := vm.EvaluateSnippet("failtest", `std.native("regexFindAll")("[f", "foo")`)
+	if err == nil {
+		t.Errorf("regexFindAll succeeded with invalid regex")
+	}
+
+	x, err := vm.EvaluateSnippet("test", `std.native("regexFindAll")("a(x*)b", "-ab-axxb-")`)
+	check(t, err, x, "[\n   \"ab\",\n   \"axxb\"\n]\n")
+
+	x, err = vm.EvaluateSnippet("test", `std.native("regexFindAll")("z", "-ab-")`)
+	check(t, err, x, "[ ]\n")
+}
+
+func TestRegexReplace(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	RegisterNativeFuncs(vm, NewIdentityResolver())
+
+	x, err := vm.EvaluateSnippet("test", `std.native("regexReplace")("a(x*)b", "-ab-axxb-", "${1}W")`)
+	check(t, err, x, "\"-W-xxW-\"\n")
+}
+
+func TestRegexpCache(t *testing.T) {
+	c := newRegexpCache()
+	r1, err := c.compile("a+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, _ := c.compile("a+")
+	if r1 != r2 {
+		t.Errorf("expected the compiled regexp to be reused")
+	}
+	if _, err := c.compile("[a"); err == nil {
+		t.Errorf("expected error for invalid regexp")
+	}
+}
+
+func TestJsonPath(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	RegisterNativeFuncs(vm, NewIdentityResolver())
+
+	_, err := vm.EvaluateSnippet("failtest", `std.native("jsonPath")({}, "{.foo[", false)`)
+	if err == nil {
+		t.Errorf("jsonPath succeeded with invalid path")
+	}
+
+	_, err = vm.EvaluateSnippet("failtest", `std.native("jsonPath")({a: 1}, "b", true)`)
+	if err == nil {
+		t.Errorf("jsonPath succeeded with no match in strict mode")
+	}
+
+	x, err := vm.EvaluateSnippet("test", `std.native("jsonPath")({a: 1}, "b", false)`)
+	check(t, err, x, "null\n")
+
+	x, err = vm.EvaluateSnippet("test", `std.native("jsonPath")({a: {b: "c"}}, "a.b", true)`)
+	check(t, err, x, "\"c\"\n")
+
+	x, err = vm.EvaluateSnippet("test", `std.native("jsonPath")({a: {b: "c"}}, "$.a.b", true)`)
+	check(t, err, x, "\"c\"\n")
+
+	x, err = vm.EvaluateSnippet("test", `
+    local pod = {spec: {containers: [{name: "foo"}, {name: "bar"}]}};
+    std.native("jsonPath")(pod, "{.spec.containers[*].name}", true)`)
+	check(t, err, x, "[\n   \"foo\",\n   \"bar\"\n]\n")
+}
+
+func TestMergePatchDiff(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	RegisterNativeFuncs(vm, NewIdentityResolver())
+
+	x, err := vm.EvaluateSnippet("test", `std.native("mergePatchDiff")({a: 1}, {a: 1, b: {c: 2}})`)
+	check(t, err, x, "{\n   \"b\": {\n      \"c\": 2\n   }\n}\n")
+
+	x, err = vm.EvaluateSnippet("test", `std.native("mergePatchDiff")({a: 1, b: [1]}, {a: 2, b: [2]})`)
+	check(t, err, x, "{\n   \"a\": 2,\n   \"b\": [\n      2\n   ]\n}\n")
+
+	x, err = vm.EvaluateSnippet("test", `std.native("mergePatchDiff")({a: 1, b: {c: 2, d: 3}}, {b: {c: 2}})`)
+	check(t, err, x, "{\n   \"a\": null,\n   \"b\": {\n      \"d\": null\n   }\n}\n")
+
+	x, err = vm.EvaluateSnippet("test", `std.native("mergePatchDiff")({a: 1}, {a: 1})`)
+	check(t, err, x, "{ }\n")
+}
+
+func TestMergePatch(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	RegisterNativeFuncs(vm, NewIdentityResolver())
+
+	for _, tc := range []struct {
+		target, patch, expected string
+	}{
+		{`{a: 1, b: {c: 2, d: 3}}`, `{b: {c: 4, d: null}, e: [5]}`, `{"a":1,"b":{"c":4},"e":[5]}`},
+		{`{a: [1, 2]}`, `{a: [3]}`, `{"a":[3]}`},
+		{`{a: 1}`, `{a: {b: null}}`, `{"a":{}}`},
+		{`{a: 1}`, `"x"`, `"x"`},
+		{`[1]`, `{a: 1}`, `{"a":1}`},
+	} {
+		x, err := vm.EvaluateSnippet("test", `std.manifestJsonMinified(std.native("mergePatch")(`+tc.target+`, `+tc.patch+`))`)
+		check(t, err, x, fmt.Sprintf("%q\n", tc.expected))
+	}
+
+	target := map[string]interface{}{"a": map[string]interface{}{"b": 1.0}}
+	if _, err := mergePatch(target, map[string]interface{}{"a": map[string]interface{}{"b": nil}}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(target, map[string]interface{}{"a": map[string]interface{}{"b": 1.0}}) {
+		t.Errorf("mergePatch modified its target: %v", target)
+	}
+}
+
+func TestMergeDeep(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	RegisterNativeFuncs(vm, NewIdentityResolver())
+
+	for _, tc := range []struct {
+		a, b, expected string
+	}{
+		{`{a: 1, b: {c: 2, d: {e: 3}}}`, `{b: {d: {f: 4}}, g: 5}`, `{"a":1,"b":{"c":2,"d":{"e":3,"f":4}},"g":5}`},
+		{`{a: [1, 2], b: {c: 1}}`, `{a: [3], b: "x"}`, `{"a":[3],"b":"x"}`},
+		{`{a: 1, b: 2}`, `{a: null}`, `{"a":null,"b":2}`},
+		{`{a: 1}`, `[1]`, `[1]`},
+	} {
+		x, err := vm.EvaluateSnippet("test", `std.manifestJsonMinified(std.native("mergeDeep")(`+tc.a+`, `+tc.b+`))`)
+		check(t, err, x, fmt.Sprintf("%q\n", tc.expected))
+	}
+
+	a := map[string]interface{}{"x": map[string]interface{}{"y": 1.0}}
+	b := map[string]interface{}{"x": map[string]interface{}{"z": 2.0}}
+	mergeDeep(a, b)
+	if !reflect.DeepEqual(a, map[string]interface{}{"x": map[string]interface{}{"y": 1.0}}) ||
+		!reflect.DeepEqual(b, map[string]interface{}{"x": map[string]interface{}{"z": 2.0}}) {
+		t.Errorf("mergeDeep modified its arguments: %v, %v", a, b)
+	}
+}
+
 func TestParseHelmChart(t *testing.T) {
 	log.SetLevel(log.DebugLevel)
 
@@ -184,3 +416,65 @@ func TestArrayReader(t *testing.T) {
 	r = &ArrayReader{[]interface{}{"bogus"}}
 	assertRead(0, errBadByte, nil)
 }
+
+func TestGetEnv(t *testing.T) {
+	t.Setenv("KUBECFG_TEST_GETENV", "set")
+
+	vm := jsonnet.MakeVM()
+	RegisterNativeFuncs(vm, NewIdentityResolver())
+	if _, err := vm.EvaluateSnippet("test", `std.native("getEnv")("KUBECFG_TEST_GETENV", "")`); err == nil {
+		t.Errorf("getEnv succeeded without alpha features")
+	}
+
+	vm = jsonnet.MakeVM()
+	RegisterNativeFuncs(vm, NewIdentityResolver(), WithAlphaNativeFuncs(true))
+	x, err := vm.EvaluateSnippet("test", `[
+      std.native("getEnv")("KUBECFG_TEST_GETENV", "default"),
+      std.native("getEnv")("KUBECFG_TEST_GETENV_UNSET", "default"),
+    ]`)
+	check(t, err, x, `[
+   "set",
+   "default"
+]
+`)
+}
+
+func TestSemverCompare(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	RegisterNativeFuncs(vm, NewIdentityResolver())
+
+	x, err := vm.EvaluateSnippet("test", `std.native("semverCompare")(">= 1.2, < 2", "1.10.0")`)
+	check(t, err, x, "true\n")
+
+	x, err = vm.EvaluateSnippet("test", `std.native("semverCompare")("~1.4", "v1.5.1")`)
+	check(t, err, x, "false\n")
+
+	_, err = vm.EvaluateSnippet("failtest", `std.native("semverCompare")(">= 1.2", "not-a-version")`)
+	if err == nil || !strings.Contains(err.Error(), `"not-a-version"`) {
+		t.Errorf("expected error naming the invalid version, got %v", err)
+	}
+
+	_, err = vm.EvaluateSnippet("failtest", `std.native("semverCompare")(">>> 1", "1.0.0")`)
+	if err == nil || !strings.Contains(err.Error(), `">>> 1"`) {
+		t.Errorf("expected error naming the invalid constraint, got %v", err)
+	}
+}
+
+func TestSemverSort(t *testing.T) {
+	vm := jsonnet.MakeVM()
+	RegisterNativeFuncs(vm, NewIdentityResolver())
+
+	x, err := vm.EvaluateSnippet("test", `std.native("semverSort")(["1.10.0", "v1.2", "1.2.0-rc.1", "0.9.1"])`)
+	check(t, err, x, `[
+   "0.9.1",
+   "1.2.0-rc.1",
+   "v1.2",
+   "1.10.0"
+]
+`)
+
+	_, err = vm.EvaluateSnippet("failtest", `std.native("semverSort")(["1.0.0", "bogus"])`)
+	if err == nil || !strings.Contains(err.Error(), `"bogus"`) {
+		t.Errorf("expected error naming the invalid version, got %v", err)
+	}
+}
@@ -27,10 +27,14 @@ import (
 	"io/fs"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/containerd/containerd/remotes"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
 	"oras.land/oras-go/pkg/auth/docker"
 )
 
@@ -66,13 +70,21 @@ func (o *OCIBundle) Open(path string) (io.ReadCloser, error) {
 }
 
 type ociImporter struct {
-	httpClient  *http.Client
-	bundleCache map[string]*OCIBundle
+	httpClient *http.Client
+
+	// bundles holds the bundles fetched, or being fetched, by package.
+	// The importers derived from one another, e.g. by the VMs ReadObjects
+	// evaluates paths with concurrently, share it.
+	mu      sync.Mutex
+	bundles map[string]*ociFetch
+	// layerCacheDir, if set, holds bundle layers fetched in previous
+	// runs, stored as <algorithm>/<hex digest>.
+	layerCacheDir string
 }
 
 func newOCIImporter() *ociImporter {
 	return &ociImporter{
-		bundleCache: make(map[string]*OCIBundle),
+		bundles: make(map[string]*ociFetch),
 	}
 }
 
@@ -80,14 +92,9 @@ func (o *ociImporter) RoundTrip(req *http.Request) (*http.Response, error) {
 	ctx := req.Context()
 	pkg, path := ociSplitURL(req.URL)
 
-	bundle, found := o.bundleCache[pkg]
-	if !found {
-		var err error
-		bundle, err = o.fetchBundle(ctx, pkg)
-		if err != nil {
-			return nil, err
-		}
-		o.bundleCache[pkg] = bundle
+	bundle, err := o.bundle(ctx, pkg)
+	if err != nil {
+		return nil, err
 	}
 	if path == "" {
 		// cannot just redirect via HTTP here because otherwise relative jsonnet imports
@@ -111,6 +118,45 @@ func (o *ociImporter) RoundTrip(req *http.Request) (*http.Response, error) {
 	return simpleHTTPResponse(req, status, r), nil
 }
 
+// ociFetch is a bundle fetch, done once done is closed.
+type ociFetch struct {
+	done   chan struct{}
+	bundle *OCIBundle
+	err    error
+}
+
+// bundle returns the bundle of pkg, fetching it if needed. Concurrent
+// callers share a single fetch; a failed one is retried by later callers,
+// and by those waiting for it if it failed because its caller gave up.
+func (o *ociImporter) bundle(ctx context.Context, pkg string) (*OCIBundle, error) {
+	o.mu.Lock()
+	f, found := o.bundles[pkg]
+	if !found {
+		f = &ociFetch{done: make(chan struct{})}
+		o.bundles[pkg] = f
+	}
+	o.mu.Unlock()
+
+	if !found {
+		f.bundle, f.err = o.fetchBundle(ctx, pkg)
+		if f.err != nil {
+			o.mu.Lock()
+			delete(o.bundles, pkg)
+			o.mu.Unlock()
+		}
+		close(f.done)
+	}
+	select {
+	case <-f.done:
+		if found && f.err != nil && ctx.Err() == nil && (errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded)) {
+			return o.bundle(ctx, pkg)
+		}
+		return f.bundle, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 func simpleHTTPResponse(req *http.Request, statusCode int, r io.ReadCloser) *http.Response {
 	return &http.Response{
 		Request:       req,
@@ -158,7 +204,7 @@ func (o *ociImporter) fetchBundle(ctx context.Context, pkg string) (*OCIBundle,
 		if l.MediaType != OCIBundleBodyMediaType {
 			continue
 		}
-		r, err := fetcher.Fetch(ctx, l)
+		r, err := o.fetchLayer(ctx, fetcher, l)
 		if err != nil {
 			return nil, err
 		}
@@ -167,6 +213,67 @@ func (o *ociImporter) fetchBundle(ctx context.Context, pkg string) (*OCIBundle,
 	return nil, fmt.Errorf("cannot find layer with mediatype %q", OCIBundleBodyMediaType)
 }
 
+// fetchLayer fetches a layer, going through the layer cache if one is
+// configured. Layers are addressed by digest, so cached copies never go
+// stale; they are still verified on read, since a truncated or tampered
+// file would otherwise be trusted forever.
+func (o *ociImporter) fetchLayer(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if o.layerCacheDir == "" {
+		return fetcher.Fetch(ctx, desc)
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(o.layerCacheDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	// Cached layers are checked against their digest, and fetched again
+	// if they don't match.
+	if b, err := os.ReadFile(path); err == nil {
+		if desc.Digest.Algorithm().FromBytes(b) == desc.Digest {
+			log.Debugf("Using cached OCI layer %s", path)
+			return io.NopCloser(bytes.NewReader(b)), nil
+		}
+		log.Warningf("Cached OCI layer %s is corrupted, fetching it again", path)
+	}
+
+	r, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if got := desc.Digest.Algorithm().FromBytes(b); got != desc.Digest {
+		return nil, fmt.Errorf("OCI layer %s does not match its digest (got %s)", desc.Digest, got)
+	}
+	if err := writeFileAtomic(path, b); err != nil {
+		log.Warningf("Cannot cache OCI layer %s: %v", desc.Digest, err)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// writeFileAtomic writes b to path via a temporary file, so that
+// concurrent readers never see a partial file.
+func writeFileAtomic(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
 func fetchInto(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, v interface{}) error {
 	c, err := fetcher.Fetch(ctx, desc)
 	if err != nil {
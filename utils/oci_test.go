@@ -2,6 +2,7 @@ package utils
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
 	"context"
 	"crypto/tls"
@@ -11,62 +12,54 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+
+	digest "github.com/opencontainers/go-digest"
 )
 
-func TestOCITransport(t *testing.T) {
-	const (
-		testFile1 = "guestbook.jsonnet"
-		testBody1 = "dummy string"
-		testFile2 = "other.jsonnet"
-		testBody2 = "other dummy string"
-	)
+const (
+	ociTestFile1 = "guestbook.jsonnet"
+	ociTestBody1 = "dummy string"
+	ociTestFile2 = "other.jsonnet"
+	ociTestBody2 = "other dummy string"
+)
 
+// newOCITestImporter returns an ociImporter talking to a fake gcr.io
+// registry serving oci://gcr.io/mkm-cloud/hello:v1. blobFetches counts the
+// requests for the bundle layer.
+func newOCITestImporter(t *testing.T) (oci *ociImporter, blobFetches *int32) {
+	blobFetches = new(int32)
+	layer := ociTestLayer(t)
+	layerDigest := digest.FromBytes(layer)
+	manifest := []byte(fmt.Sprintf("{\"schemaVersion\":2,\"mediaType\":\"application/vnd.oci.image.manifest.v1+json\",\"config\":{\"mediaType\":\"application/vnd.kubecfg.bundle.config.v1+json\",\"digest\":\"sha256:f554a2f13a74f54fa95e1e128ae349bfec6dad4b2d9b836abd90949ef5ea8731\",\"size\":40},\"layers\":[{\"mediaType\":\"application/vnd.kubecfg.bundle.tar+gzip\",\"digest\":\"%s\",\"size\":%d,\"annotations\":{\"io.deis.oras.content.digest\":\"sha256:146e6b19cd18a48247bf8be61821879886f84db9f57eb9f29769db8a9dde816f\",\"io.deis.oras.content.unpack\":\"true\",\"org.opencontainers.image.title\":\".\"}}],\"annotations\":{\"org.opencontainers.image.created\":\"2023-01-13T10:16:18Z\"}}", layerDigest, len(layer)))
+	manifestDigest := digest.FromBytes(manifest)
 	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// these mock responses are based on an actual traffic grab of a test artifact I pushed on gcr.io.
 		switch {
 		case r.Method == "HEAD" && r.URL.Path == "/v2/mkm-cloud/hello/manifests/v1":
 			w.Header().Add("Content-Type", "application/vnd.oci.image.manifest.v1+json")
 			w.WriteHeader(200)
-		case r.Method == "GET" && r.URL.Path == "/v2/mkm-cloud/hello/manifests/v1":
+		case r.Method == "GET" && (r.URL.Path == "/v2/mkm-cloud/hello/manifests/v1" || r.URL.Path == "/v2/mkm-cloud/hello/manifests/"+manifestDigest.String()):
 			w.Header().Add("Content-Type", "application/vnd.oci.image.manifest.v1+json")
-			fmt.Fprintf(w, "{\"schemaVersion\":2,\"mediaType\":\"application/vnd.oci.image.manifest.v1+json\",\"config\":{\"mediaType\":\"application/vnd.kubecfg.bundle.config.v1+json\",\"digest\":\"sha256:f554a2f13a74f54fa95e1e128ae349bfec6dad4b2d9b836abd90949ef5ea8731\",\"size\":40},\"layers\":[{\"mediaType\":\"application/vnd.kubecfg.bundle.tar+gzip\",\"digest\":\"sha256:cf7d50c45c421eb89cd969d509550abf137220c97e9257fb483c4f3a9548b29f\",\"size\":2036,\"annotations\":{\"io.deis.oras.content.digest\":\"sha256:146e6b19cd18a48247bf8be61821879886f84db9f57eb9f29769db8a9dde816f\",\"io.deis.oras.content.unpack\":\"true\",\"org.opencontainers.image.title\":\".\"}}],\"annotations\":{\"org.opencontainers.image.created\":\"2023-01-13T10:16:18Z\"}}")
-		case r.Method == "GET" && r.URL.Path == "/v2/mkm-cloud/hello/manifests/sha256:db94623ace77be069591d7b435f004ebee6c808fe6f6842df27bb1ce31e2b0ce":
-			w.Header().Add("Content-Type", "application/vnd.oci.image.manifest.v1+json")
-			fmt.Fprintf(w, "{\"schemaVersion\":2,\"mediaType\":\"application/vnd.oci.image.manifest.v1+json\",\"config\":{\"mediaType\":\"application/vnd.kubecfg.bundle.config.v1+json\",\"digest\":\"sha256:f554a2f13a74f54fa95e1e128ae349bfec6dad4b2d9b836abd90949ef5ea8731\",\"size\":40},\"layers\":[{\"mediaType\":\"application/vnd.kubecfg.bundle.tar+gzip\",\"digest\":\"sha256:cf7d50c45c421eb89cd969d509550abf137220c97e9257fb483c4f3a9548b29f\",\"size\":2036,\"annotations\":{\"io.deis.oras.content.digest\":\"sha256:146e6b19cd18a48247bf8be61821879886f84db9f57eb9f29769db8a9dde816f\",\"io.deis.oras.content.unpack\":\"true\",\"org.opencontainers.image.title\":\".\"}}],\"annotations\":{\"org.opencontainers.image.created\":\"2023-01-13T10:16:18Z\"}}")
+			w.Write(manifest)
 		case r.Method == "GET" && r.URL.Path == "/v2/mkm-cloud/hello/blobs/sha256:f554a2f13a74f54fa95e1e128ae349bfec6dad4b2d9b836abd90949ef5ea8731":
 			w.Header().Add("Content-Type", OCIBundleConfigMediaType)
 			fmt.Fprintf(w, `{"entrypoint": "guestbook.jsonnet"}`)
-		case r.Method == "GET" && r.URL.Path == "/v2/mkm-cloud/hello/blobs/sha256:cf7d50c45c421eb89cd969d509550abf137220c97e9257fb483c4f3a9548b29f":
-			// the OCI client doesn't really check the hash of the blob, so we can return some random test data.
+		case r.Method == "GET" && r.URL.Path == "/v2/mkm-cloud/hello/blobs/"+layerDigest.String():
+			atomic.AddInt32(blobFetches, 1)
 			w.Header().Add("Content-Type", OCIBundleBodyMediaType)
-			gw := gzip.NewWriter(w)
-			defer gw.Close()
-			tw := tar.NewWriter(gw)
-
-			tw.WriteHeader(&tar.Header{
-				Name: testFile1,
-				Mode: 0600,
-				Size: int64(len(testBody1)),
-			})
-			tw.Write([]byte(testBody1))
-
-			tw.WriteHeader(&tar.Header{
-				Name: testFile2,
-				Mode: 0600,
-				Size: int64(len(testBody2)),
-			})
-			tw.Write([]byte(testBody2))
-
-			tw.Close()
+			w.Write(layer)
 		default:
 			http.Error(w, fmt.Sprintf("unhandled request %v", r), 500)
 		}
 	}))
 	t.Cleanup(testServer.Close)
 
-	tr := &http.Transport{}
-	oci := newOCIImporter()
+	oci = newOCIImporter()
 	oci.httpClient = &http.Client{}
 	oci.httpClient.Transport = &http.Transport{
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -77,6 +70,37 @@ func TestOCITransport(t *testing.T) {
 		},
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
+	return oci, blobFetches
+}
+
+// ociTestLayer returns the bundle layer served by the fake registry.
+func ociTestLayer(t *testing.T) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, f := range []struct{ name, body string }{
+		{ociTestFile1, ociTestBody1},
+		{ociTestFile2, ociTestBody2},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.body))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOCITransport(t *testing.T) {
+	tr := &http.Transport{}
+	oci, _ := newOCITestImporter(t)
 	tr.RegisterProtocol("oci", oci)
 
 	cl := http.Client{Transport: tr}
@@ -87,15 +111,15 @@ func TestOCITransport(t *testing.T) {
 	}{
 		{
 			url:  "oci://gcr.io/mkm-cloud/hello:v1",
-			want: fmt.Sprintf("import %q", testFile1),
+			want: fmt.Sprintf("import %q", ociTestFile1),
 		},
 		{
-			url:  "oci://gcr.io/mkm-cloud/hello:v1/" + testFile1,
-			want: testBody1,
+			url:  "oci://gcr.io/mkm-cloud/hello:v1/" + ociTestFile1,
+			want: ociTestBody1,
 		},
 		{
-			url:  "oci://gcr.io/mkm-cloud/hello:v1/" + testFile2,
-			want: testBody2,
+			url:  "oci://gcr.io/mkm-cloud/hello:v1/" + ociTestFile2,
+			want: ociTestBody2,
 		},
 	}
 	for i, tc := range testCases {
@@ -116,6 +140,94 @@ func TestOCITransport(t *testing.T) {
 	}
 }
 
+func TestOCITransportParallel(t *testing.T) {
+	oci, blobFetches := newOCITestImporter(t)
+	importer := MakeUniversalImporter(nil, false)
+	importer.(*universalImporter).oci.httpClient = oci.httpClient
+
+	// Like the worker VMs of ReadObjects, derived importers share the
+	// bundles of the OCI importer.
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file := ociTestFile1
+			if i%2 == 1 {
+				file = ociTestFile2
+			}
+			_, _, errs[i] = DeriveImporter(importer).Import("", "oci://gcr.io/mkm-cloud/hello:v1/"+file)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(blobFetches); n != 1 {
+		t.Errorf("expected the bundle to be fetched once, got %d", n)
+	}
+}
+
+func TestOCILayerCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	for run := 0; run < 2; run++ {
+		oci, blobFetches := newOCITestImporter(t)
+		oci.layerCacheDir = cacheDir
+		tr := &http.Transport{}
+		tr.RegisterProtocol("oci", oci)
+		cl := http.Client{Transport: tr}
+
+		res, err := cl.Get("oci://gcr.io/mkm-cloud/hello:v1/" + ociTestFile2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), ociTestBody2; got != want {
+			t.Errorf("run %d: got %q, want %q", run, got, want)
+		}
+		if got, want := atomic.LoadInt32(blobFetches), int32(1-run); got != want {
+			t.Errorf("run %d: fetched the layer %d times, want %d", run, got, want)
+		}
+	}
+
+	// A corrupted cached layer is fetched again, and the cache repaired.
+	layers, err := filepath.Glob(filepath.Join(cacheDir, "sha256", "*"))
+	if err != nil || len(layers) != 1 {
+		t.Fatalf("expected one cached layer, got %v, %v", layers, err)
+	}
+	if err := os.WriteFile(layers[0], []byte("corrupted"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for run := 0; run < 2; run++ {
+		oci, blobFetches := newOCITestImporter(t)
+		oci.layerCacheDir = cacheDir
+		tr := &http.Transport{}
+		tr.RegisterProtocol("oci", oci)
+		cl := http.Client{Transport: tr}
+
+		res, err := cl.Get("oci://gcr.io/mkm-cloud/hello:v1/" + ociTestFile2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), ociTestBody2; got != want {
+			t.Errorf("corrupted run %d: got %q, want %q", run, got, want)
+		}
+		if got, want := atomic.LoadInt32(blobFetches), int32(1-run); got != want {
+			t.Errorf("corrupted run %d: fetched the layer %d times, want %d", run, got, want)
+		}
+	}
+}
+
 func TestOCISplitURL(t *testing.T) {
 	testCases := []struct {
 		url  string
@@ -17,7 +17,9 @@ package utils
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/kubecfg/kubecfg/internal/acquire"
 	log "github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -60,6 +62,102 @@ func NewOpenAPISchemaFor(delegate discovery.OpenAPISchemaInterface, gvk schema.G
 // Validate is the primary entrypoint into this class
 func (s *OpenAPISchema) Validate(obj *unstructured.Unstructured) []error {
 	gvk := obj.GroupVersionKind()
-	log.Infof("validate object %q", gvk)
+	log.Debugf("validate object %q", gvk)
 	return validation.ValidateModel(obj.UnstructuredContent(), s.schema, fmt.Sprintf("%s.%s", gvk.Version, gvk.Kind))
 }
+
+// WithSchemaValidation makes ReadObjects validate objects against the
+// OpenAPI schema served by schema, such as a discovery client or a
+// schema bundled with the caller. Objects whose kind is missing from the
+// schema, typically custom resources, are not validated.
+func WithSchemaValidation(schema discovery.OpenAPISchemaInterface) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.SchemaValidation = schema
+	}
+}
+
+// SchemaValidationError lists the objects that failed schema validation.
+type SchemaValidationError struct {
+	Objects []ObjectValidationError
+}
+
+// ObjectValidationError holds the schema errors of an object, with where
+// it was read from.
+type ObjectValidationError struct {
+	Provenance ProvenanceRecord
+	Errors     []error
+}
+
+func (e ObjectValidationError) Error() string {
+	p := e.Provenance
+	name := p.Name
+	if p.Namespace != "" {
+		name = p.Namespace + "/" + name
+	}
+	var source []string
+	if p.File != "" {
+		source = append(source, p.File)
+	}
+	if p.Line > 0 {
+		source = append(source, fmt.Sprintf("line %d", p.Line))
+	}
+	if p.Path != "" {
+		source = append(source, p.Path)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s", p.APIVersion, p.Kind, name)
+	if len(source) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(source, " "))
+	}
+	b.WriteString(":")
+	for _, err := range e.Errors {
+		fmt.Fprintf(&b, "\n    %v", err)
+	}
+	return b.String()
+}
+
+func (e *SchemaValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "schema validation failed for %d object(s):", len(e.Objects))
+	for _, o := range e.Objects {
+		fmt.Fprintf(&b, "\n  %v", o)
+	}
+	return b.String()
+}
+
+// ValidateSchemas validates objs, read with the same opts, against the
+// schema given to WithSchemaValidation, returning a *SchemaValidationError
+// listing all the invalid objects.
+func ValidateSchemas(objs []*unstructured.Unstructured, opts ...ReadOption) error {
+	opt := provenanceReadOptions(acquire.MakeReadOptions(opts))
+	if opt.SchemaValidation == nil {
+		return nil
+	}
+	doc, err := opt.SchemaValidation.OpenAPISchema()
+	if err != nil {
+		return fmt.Errorf("fetching OpenAPI schema: %w", err)
+	}
+	models, err := openapi.NewOpenAPIData(doc)
+	if err != nil {
+		return fmt.Errorf("parsing OpenAPI schema: %w", err)
+	}
+
+	var res SchemaValidationError
+	for _, obj := range objs {
+		gvk := obj.GroupVersionKind()
+		sc := models.LookupResource(gvk)
+		if sc == nil {
+			log.Debugf("No schema found for %s, skipping validation", gvk)
+			continue
+		}
+		errs := (&OpenAPISchema{schema: sc}).Validate(obj)
+		if len(errs) > 0 {
+			res.Objects = append(res.Objects, ObjectValidationError{Provenance: provenanceOf(obj, opt), Errors: errs})
+		}
+	}
+	if len(res.Objects) > 0 {
+		return &res
+	}
+	return nil
+}
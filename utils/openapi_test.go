@@ -92,3 +92,49 @@ func TestValidate(t *testing.T) {
 		t.Errorf("Wrong error2 produced from invalid object: %q", err)
 	}
 }
+
+func TestValidateSchemas(t *testing.T) {
+	schemaReader := schemaFromFile{dir: filepath.FromSlash("../testdata")}
+	svc := func(name string, spec map[string]interface{}) *unstructured.Unstructured {
+		o := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Service",
+			"metadata":   map[string]interface{}{"name": name, "namespace": "ns"},
+			"spec":       spec,
+		}}
+		SetMetaDataAnnotation(o, AnnotationProvenanceFile, "app.jsonnet")
+		SetMetaDataAnnotation(o, AnnotationProvenancePath, "$."+name)
+		return o
+	}
+	objs := []*unstructured.Unstructured{
+		svc("good", map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": 80}}}),
+		svc("bad", map[string]interface{}{"prots": []interface{}{}}),
+		{Object: map[string]interface{}{
+			"apiVersion": "example.com/v1",
+			"kind":       "Widget",
+			"metadata":   map[string]interface{}{"name": "w"},
+			"spec":       map[string]interface{}{"anything": true},
+		}},
+	}
+
+	if err := ValidateSchemas(objs); err != nil {
+		t.Errorf("validated without WithSchemaValidation: %v", err)
+	}
+
+	err := ValidateSchemas(objs, WithSchemaValidation(schemaReader))
+	verr, ok := err.(*SchemaValidationError)
+	if !ok {
+		t.Fatalf("expected a *SchemaValidationError, got %v", err)
+	}
+	if len(verr.Objects) != 1 {
+		t.Fatalf("expected 1 invalid object, got %v", err)
+	}
+	for _, want := range []string{
+		"v1 Service ns/bad (app.jsonnet $.bad):",
+		`unknown field "prots"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in error %q", want, err)
+		}
+	}
+}
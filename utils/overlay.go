@@ -0,0 +1,188 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/kubecfg/kubecfg/internal/acquire"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// WithStrategicOverlay patches the objects read by ReadObjects with the
+// objects in patchFile (yaml, json or jsonnet), using MergeObjects. Each
+// patch applies to the objects with the same group, kind and name, and
+// the same namespace if the patch sets one. Unlike WithOverlayURL this
+// can merge into lists by key, e.g. patch a single container by name.
+// May be given several times; patches apply in order.
+func WithStrategicOverlay(patchFile string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.StrategicOverlays = append(opts.StrategicOverlays, patchFile)
+	}
+}
+
+// ApplyStrategicPatches merges each patch into the matching objects of
+// objs, in place. Patches matching no object are logged and skipped.
+func ApplyStrategicPatches(objs, patches []*unstructured.Unstructured) error {
+	for _, p := range patches {
+		matched := false
+		for i, o := range objs {
+			if !patchMatches(p, o) {
+				continue
+			}
+			merged, err := MergeObjects(o, p)
+			if err != nil {
+				return fmt.Errorf("patching %s: %w", resourceKey(o), err)
+			}
+			objs[i] = merged
+			matched = true
+		}
+		if !matched {
+			log.Warningf("Strategic overlay %s matches no object", resourceKey(p))
+		}
+	}
+	return nil
+}
+
+func patchMatches(patch, o *unstructured.Unstructured) bool {
+	if patch.GroupVersionKind().GroupKind() != o.GroupVersionKind().GroupKind() || patch.GetName() != o.GetName() {
+		return false
+	}
+	return patch.GetNamespace() == "" || patch.GetNamespace() == o.GetNamespace()
+}
+
+// WithJSONPatchOverlay applies the RFC 6902 JSON patches in patchFile (see
+// JSONPatchOverlay) to the objects read by ReadObjects, after any
+// strategic overlays. May be given several times; files apply in order.
+func WithJSONPatchOverlay(patchFile string) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.JSONPatchOverlays = append(opts.JSONPatchOverlays, patchFile)
+	}
+}
+
+// WithStrictJSONPatchOverlay makes JSON patch overlays whose target
+// matches no object an error instead of a warning.
+func WithStrictJSONPatchOverlay(strict bool) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.JSONPatchOverlayStrict = strict
+	}
+}
+
+// JSONPatchOverlay is an entry of a JSON patch overlay file, which holds a
+// yaml or json list of them:
+//
+//	# overlays.yaml
+//	- target:
+//	    kind: Deployment          # required
+//	    name: app                 # required
+//	    apiVersion: apps/v1       # optional
+//	    namespace: prod           # optional
+//	  patch:
+//	  - op: remove
+//	    path: /metadata/annotations/example.com~1unwanted
+type JSONPatchOverlay struct {
+	Target JSONPatchTarget `json:"target"`
+	Patch  json.RawMessage `json:"patch"`
+}
+
+// JSONPatchTarget selects the objects a JSONPatchOverlay applies to.
+type JSONPatchTarget struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+}
+
+func (t JSONPatchTarget) String() string {
+	s := t.Kind + "/" + t.Name
+	if t.Namespace != "" {
+		s = t.Kind + "/" + t.Namespace + "/" + t.Name
+	}
+	if t.APIVersion != "" {
+		s = t.APIVersion + " " + s
+	}
+	return s
+}
+
+func (t JSONPatchTarget) matches(o *unstructured.Unstructured) bool {
+	return t.Kind == o.GetKind() && t.Name == o.GetName() &&
+		(t.APIVersion == "" || t.APIVersion == o.GetAPIVersion()) &&
+		(t.Namespace == "" || t.Namespace == o.GetNamespace())
+}
+
+// LoadJSONPatchOverlays reads and validates a JSON patch overlay file.
+func LoadJSONPatchOverlays(path string) ([]JSONPatchOverlay, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var overlays []JSONPatchOverlay
+	if err := yaml.UnmarshalStrict(b, &overlays); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i, o := range overlays {
+		if o.Target.Kind == "" || o.Target.Name == "" {
+			return nil, fmt.Errorf("%s: entry %d: target must have a kind and a name", path, i)
+		}
+		if _, err := jsonpatch.DecodePatch(o.Patch); err != nil {
+			return nil, fmt.Errorf("%s: entry %d: invalid patch: %w", path, i, err)
+		}
+	}
+	return overlays, nil
+}
+
+// ApplyJSONPatchOverlays applies each overlay to the matching objects of
+// objs, in place. Overlays matching no object are logged, or make it fail
+// if strict is set.
+func ApplyJSONPatchOverlays(objs []*unstructured.Unstructured, overlays []JSONPatchOverlay, strict bool) error {
+	for _, overlay := range overlays {
+		patch, err := jsonpatch.DecodePatch(overlay.Patch)
+		if err != nil {
+			return err
+		}
+		matched := false
+		for i, o := range objs {
+			if !overlay.Target.matches(o) {
+				continue
+			}
+			doc, err := o.MarshalJSON()
+			if err != nil {
+				return err
+			}
+			if doc, err = patch.Apply(doc); err != nil {
+				return fmt.Errorf("patching %s: %w", overlay.Target, err)
+			}
+			patched := &unstructured.Unstructured{}
+			if err := patched.UnmarshalJSON(doc); err != nil {
+				return fmt.Errorf("patching %s: %w", overlay.Target, err)
+			}
+			objs[i] = patched
+			matched = true
+		}
+		if !matched {
+			if strict {
+				return fmt.Errorf("JSON patch target %s matches no object", overlay.Target)
+			}
+			log.Warningf("JSON patch target %s matches no object", overlay.Target)
+		}
+	}
+	return nil
+}
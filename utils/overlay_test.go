@@ -0,0 +1,87 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestJSONPatchOverlays(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "patches.yaml")
+	if err := os.WriteFile(path, []byte(`
+- target:
+    kind: ConfigMap
+    name: a
+  patch:
+  - op: remove
+    path: /metadata/annotations/example.com~1unwanted
+  - op: add
+    path: /data/added
+    value: "yes"
+- target:
+    kind: ConfigMap
+    name: missing
+  patch:
+  - op: add
+    path: /data/x
+    value: "1"
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	overlays, err := LoadJSONPatchOverlays(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objs := func() []*unstructured.Unstructured {
+		return []*unstructured.Unstructured{
+			mustUnstructured(t, `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "a", "annotations": {"example.com/unwanted": "x", "keep": "y"}}, "data": {}}`),
+			mustUnstructured(t, `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "b"}}`),
+		}
+	}
+
+	res := objs()
+	if err := ApplyJSONPatchOverlays(res, overlays, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res[0].GetAnnotations(), map[string]string{"keep": "y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got annotations %v, want %v", got, want)
+	}
+	if got, _, _ := unstructured.NestedString(res[0].Object, "data", "added"); got != "yes" {
+		t.Errorf("patch not applied: %v", res[0].Object)
+	}
+	if !reflect.DeepEqual(res[1].Object, objs()[1].Object) {
+		t.Errorf("unexpected change to untargeted object: %v", res[1].Object)
+	}
+
+	err = ApplyJSONPatchOverlays(objs(), overlays, true)
+	if err == nil || !strings.Contains(err.Error(), "ConfigMap/missing matches no object") {
+		t.Errorf("expected unmatched target error, got %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(`[{"target": {"kind": "ConfigMap"}, "patch": []}]`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadJSONPatchOverlays(path); err == nil {
+		t.Errorf("expected error for target without name")
+	}
+}
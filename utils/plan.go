@@ -0,0 +1,294 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// AnnotationApplyWave holds an integer; objects in lower waves are
+	// applied first. Objects without it are in wave 0.
+	AnnotationApplyWave = "kubecfg.github.com/apply-wave"
+
+	// AnnotationDependsOn holds a comma separated list of objects that
+	// must be applied before this one, each given as "Kind/name" or
+	// "Kind/namespace/name". "Kind/name" refers to the object in the
+	// namespace of the annotated object if there is one, and to a
+	// cluster-scoped object otherwise.
+	AnnotationDependsOn = "kubecfg.github.com/depends-on"
+)
+
+// DefaultKindPriority lists kinds in the order they should be applied,
+// both by BuildApplyPlan and SortForApply: namespaces and CRDs first, then
+// policies and what workloads refer to (service accounts, config, storage,
+// RBAC), then services and workloads, and finally what routes traffic to
+// or intercepts requests for them. Kinds not in the list are applied after
+// all the listed ones.
+var DefaultKindPriority = []string{
+	"Namespace",
+	"CustomResourceDefinition",
+	"PriorityClass",
+	"ResourceQuota",
+	"LimitRange",
+	"NetworkPolicy",
+	"PodSecurityPolicy",
+	"PodDisruptionBudget",
+	"StorageClass",
+	"ServiceAccount",
+	"Secret",
+	"ConfigMap",
+	"PersistentVolume",
+	"PersistentVolumeClaim",
+	"ClusterRole",
+	"ClusterRoleBinding",
+	"Role",
+	"RoleBinding",
+	"Service",
+	"DaemonSet",
+	"Pod",
+	"ReplicationController",
+	"ReplicaSet",
+	"Deployment",
+	"HorizontalPodAutoscaler",
+	"StatefulSet",
+	"Job",
+	"CronJob",
+	"IngressClass",
+	"Ingress",
+	"APIService",
+	"MutatingWebhookConfiguration",
+	"ValidatingWebhookConfiguration",
+}
+
+// ApplyPlanOptions controls BuildApplyPlan.
+type ApplyPlanOptions struct {
+	// KindPriority overrides DefaultKindPriority when non-nil.
+	KindPriority []string
+}
+
+// ApplyPlan is an ordered list of groups of objects. Groups must be
+// applied sequentially; the objects within a group are independent of
+// each other and may be applied in parallel.
+type ApplyPlan struct {
+	Groups []ApplyGroup `json:"groups"`
+	// Cycles lists dependency cycles. Dependencies forming a cycle
+	// are ignored when ordering the plan.
+	Cycles [][]string `json:"cycles,omitempty"`
+	// Conflicts lists problems such as malformed annotations or
+	// dependencies on objects that are not part of the plan.
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// ApplyGroup is a set of objects that can be applied in parallel.
+type ApplyGroup struct {
+	Steps []ApplyStep `json:"steps"`
+}
+
+// ApplyStep is an object and the reason it ended up in its group.
+type ApplyStep struct {
+	Object *unstructured.Unstructured `json:"object"`
+	Reason string                     `json:"reason"`
+}
+
+// objectRef returns the "Kind/namespace/name" (or "Kind/name") reference
+// used by AnnotationDependsOn.
+func objectRef(o *unstructured.Unstructured) string {
+	if ns := o.GetNamespace(); ns != "" {
+		return fmt.Sprintf("%s/%s/%s", o.GetKind(), ns, o.GetName())
+	}
+	return fmt.Sprintf("%s/%s", o.GetKind(), o.GetName())
+}
+
+// kindRank returns the index of kind in priority, or len(priority) for
+// unlisted kinds.
+func kindRank(priority []string, kind string) int {
+	for i, k := range priority {
+		if k == kind {
+			return i
+		}
+	}
+	return len(priority)
+}
+
+type planNode struct {
+	obj    *unstructured.Unstructured
+	wave   int
+	rank   int
+	deps   []int
+	stage  int
+	reason string
+}
+
+// BuildApplyPlan orders objs by wave, then kind priority, then explicit
+// dependencies, and groups together objects that can be applied in
+// parallel.
+func BuildApplyPlan(objs []*unstructured.Unstructured, opts ApplyPlanOptions) *ApplyPlan {
+	priority := opts.KindPriority
+	if priority == nil {
+		priority = DefaultKindPriority
+	}
+
+	plan := &ApplyPlan{}
+	nodes := make([]*planNode, len(objs))
+	byRef := make(map[string]int, len(objs))
+	for i, o := range objs {
+		ref := objectRef(o)
+		if _, found := byRef[ref]; found {
+			plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("duplicate object %s", ref))
+		}
+		byRef[ref] = i
+
+		n := &planNode{obj: o, rank: kindRank(priority, o.GetKind())}
+		if w, found := o.GetAnnotations()[AnnotationApplyWave]; found {
+			wave, err := strconv.Atoi(strings.TrimSpace(w))
+			if err != nil {
+				plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("%s: invalid %s %q", ref, AnnotationApplyWave, w))
+			}
+			n.wave = wave
+		}
+		nodes[i] = n
+	}
+
+	for _, n := range nodes {
+		deps, found := n.obj.GetAnnotations()[AnnotationDependsOn]
+		if !found {
+			continue
+		}
+		for _, d := range strings.Split(deps, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			j, found := byRef[d]
+			if parts := strings.Split(d, "/"); len(parts) == 2 && n.obj.GetNamespace() != "" {
+				// Prefer the object in the same namespace, falling back
+				// to a cluster-scoped one, e.g. a Namespace or a CRD.
+				if k, ok := byRef[fmt.Sprintf("%s/%s/%s", parts[0], n.obj.GetNamespace(), parts[1])]; ok {
+					j, found = k, true
+				}
+			}
+			if !found {
+				plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("%s depends on %s, which is not part of the plan", objectRef(n.obj), d))
+				continue
+			}
+			n.deps = append(n.deps, j)
+		}
+	}
+
+	// Base stage: position of (wave, kind rank) among all the distinct
+	// pairs present in the input.
+	type tier struct{ wave, rank int }
+	var tiers []tier
+	seen := map[tier]bool{}
+	for _, n := range nodes {
+		t := tier{n.wave, n.rank}
+		if !seen[t] {
+			seen[t] = true
+			tiers = append(tiers, t)
+		}
+	}
+	sort.Slice(tiers, func(i, j int) bool {
+		if tiers[i].wave != tiers[j].wave {
+			return tiers[i].wave < tiers[j].wave
+		}
+		return tiers[i].rank < tiers[j].rank
+	})
+	tierIndex := make(map[tier]int, len(tiers))
+	for i, t := range tiers {
+		tierIndex[t] = i
+	}
+	for _, n := range nodes {
+		n.stage = tierIndex[tier{n.wave, n.rank}]
+		if n.wave != 0 {
+			n.reason = fmt.Sprintf("wave %d, kind %s", n.wave, n.obj.GetKind())
+		} else {
+			n.reason = fmt.Sprintf("kind %s", n.obj.GetKind())
+		}
+	}
+
+	// Raise each object past its dependencies (longest path), recording
+	// any cycles found on the way.
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(nodes))
+	var stack []int
+	var visit func(i int)
+	visit = func(i int) {
+		state[i] = visiting
+		stack = append(stack, i)
+		n := nodes[i]
+		for _, j := range n.deps {
+			switch state[j] {
+			case visiting:
+				var cycle []string
+				for k := len(stack) - 1; k >= 0; k-- {
+					cycle = append([]string{objectRef(nodes[stack[k]].obj)}, cycle...)
+					if stack[k] == j {
+						break
+					}
+				}
+				cycle = append(cycle, objectRef(nodes[j].obj))
+				plan.Cycles = append(plan.Cycles, cycle)
+				continue
+			case unvisited:
+				visit(j)
+			}
+			if s := nodes[j].stage + 1; s > n.stage {
+				n.stage = s
+				n.reason = fmt.Sprintf("depends on %s", objectRef(nodes[j].obj))
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[i] = done
+	}
+	for i := range nodes {
+		if state[i] == unvisited {
+			visit(i)
+		}
+	}
+
+	byStage := map[int][]*planNode{}
+	var stages []int
+	for _, n := range nodes {
+		if _, found := byStage[n.stage]; !found {
+			stages = append(stages, n.stage)
+		}
+		byStage[n.stage] = append(byStage[n.stage], n)
+	}
+	sort.Ints(stages)
+	for _, s := range stages {
+		members := byStage[s]
+		sort.SliceStable(members, func(i, j int) bool {
+			return AlphabeticalOrder{members[i].obj, members[j].obj}.Less(0, 1)
+		})
+		group := ApplyGroup{}
+		for _, n := range members {
+			group.Steps = append(group.Steps, ApplyStep{Object: n.obj, Reason: n.reason})
+		}
+		plan.Groups = append(plan.Groups, group)
+	}
+
+	return plan
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func planObj(kind, ns, name string, annotations map[string]interface{}) *unstructured.Unstructured {
+	meta := map[string]interface{}{"name": name}
+	if ns != "" {
+		meta["namespace"] = ns
+	}
+	if annotations != nil {
+		meta["annotations"] = annotations
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       kind,
+		"metadata":   meta,
+	}}
+}
+
+func planRefs(plan *ApplyPlan) [][]string {
+	var ret [][]string
+	for _, g := range plan.Groups {
+		var refs []string
+		for _, s := range g.Steps {
+			refs = append(refs, objectRef(s.Object))
+		}
+		ret = append(ret, refs)
+	}
+	return ret
+}
+
+func TestBuildApplyPlan(t *testing.T) {
+	objs := []*unstructured.Unstructured{
+		planObj("Deployment", "app", "web", nil),
+		planObj("ConfigMap", "app", "b", nil),
+		planObj("ConfigMap", "app", "a", nil),
+		planObj("Namespace", "", "app", nil),
+		planObj("Job", "app", "migrate", map[string]interface{}{AnnotationApplyWave: "-1"}),
+		planObj("Service", "app", "web", map[string]interface{}{AnnotationDependsOn: "Deployment/web"}),
+	}
+
+	plan := BuildApplyPlan(objs, ApplyPlanOptions{})
+	expected := [][]string{
+		{"Job/app/migrate"},
+		{"Namespace/app"},
+		{"ConfigMap/app/a", "ConfigMap/app/b"},
+		{"Deployment/app/web"},
+		{"Service/app/web"},
+	}
+	if got := planRefs(plan); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if reason := plan.Groups[4].Steps[0].Reason; reason != "depends on Deployment/app/web" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	if len(plan.Cycles) != 0 || len(plan.Conflicts) != 0 {
+		t.Errorf("unexpected problems: %v %v", plan.Cycles, plan.Conflicts)
+	}
+}
+
+func TestBuildApplyPlanClusterScopedDependencies(t *testing.T) {
+	objs := []*unstructured.Unstructured{
+		planObj("Deployment", "app", "web", map[string]interface{}{
+			AnnotationDependsOn: "CustomResourceDefinition/widgets.example.com, Namespace/app",
+			AnnotationApplyWave: "-1",
+		}),
+		planObj("CustomResourceDefinition", "", "widgets.example.com", nil),
+		planObj("Namespace", "", "app", nil),
+	}
+
+	plan := BuildApplyPlan(objs, ApplyPlanOptions{KindPriority: []string{"Deployment"}})
+	expected := [][]string{
+		{"Namespace/app", "CustomResourceDefinition/widgets.example.com"},
+		{"Deployment/app/web"},
+	}
+	if got := planRefs(plan); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if len(plan.Cycles) != 0 || len(plan.Conflicts) != 0 {
+		t.Errorf("unexpected problems: %v %v", plan.Cycles, plan.Conflicts)
+	}
+}
+
+func TestBuildApplyPlanKindPriority(t *testing.T) {
+	objs := []*unstructured.Unstructured{
+		planObj("ConfigMap", "", "a", nil),
+		planObj("Secret", "", "b", nil),
+	}
+	plan := BuildApplyPlan(objs, ApplyPlanOptions{KindPriority: []string{"ConfigMap", "Secret"}})
+	expected := [][]string{{"ConfigMap/a"}, {"Secret/b"}}
+	if got := planRefs(plan); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestBuildApplyPlanProblems(t *testing.T) {
+	objs := []*unstructured.Unstructured{
+		planObj("ConfigMap", "", "a", map[string]interface{}{AnnotationDependsOn: "ConfigMap/b"}),
+		planObj("ConfigMap", "", "b", map[string]interface{}{AnnotationDependsOn: "ConfigMap/a, Secret/missing"}),
+		planObj("ConfigMap", "", "c", map[string]interface{}{AnnotationApplyWave: "soon"}),
+	}
+	plan := BuildApplyPlan(objs, ApplyPlanOptions{})
+
+	expectedCycles := [][]string{{"ConfigMap/a", "ConfigMap/b", "ConfigMap/a"}}
+	if !reflect.DeepEqual(plan.Cycles, expectedCycles) {
+		t.Errorf("expected cycles %v, got %v", expectedCycles, plan.Cycles)
+	}
+	expectedConflicts := []string{
+		`ConfigMap/c: invalid kubecfg.github.com/apply-wave "soon"`,
+		"ConfigMap/b depends on Secret/missing, which is not part of the plan",
+	}
+	if !reflect.DeepEqual(plan.Conflicts, expectedConflicts) {
+		t.Errorf("expected conflicts %v, got %v", expectedConflicts, plan.Conflicts)
+	}
+	if n := len(planRefs(plan)); n == 0 {
+		t.Errorf("expected a plan despite problems")
+	}
+}
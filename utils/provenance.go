@@ -0,0 +1,224 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/kubecfg/kubecfg/internal/acquire"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// ProvenanceSidecarAPIVersion and ProvenanceSidecarKind identify the
+	// document written by WithProvenanceSidecar.
+	ProvenanceSidecarAPIVersion = "kubecfg.github.com/v1alpha1"
+	ProvenanceSidecarKind       = "Provenance"
+)
+
+// ProvenanceSidecar is the document written by WithProvenanceSidecar.
+type ProvenanceSidecar struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Objects    []ProvenanceRecord `json:"objects"`
+}
+
+// ProvenanceRecord tells where an object was found: the file, the path
+// within the value the file evaluated to (as in AnnotationProvenancePath)
+// and, for YAML files, the line its document starts at.
+type ProvenanceRecord struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	File       string `json:"file,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Line       int    `json:"line,omitempty"`
+}
+
+// WithProvenanceSidecar makes ReadObjects write a ProvenanceSidecar
+// document to w, in the order the objects are returned, instead of
+// annotating the objects. Annotations requested with WithProvenance are
+// still added.
+func WithProvenanceSidecar(w io.Writer) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.ProvenanceSidecar = w
+	}
+}
+
+// provenanceReadOptions returns the options Read uses: when a provenance
+// sidecar or schema validation errors need the provenance of objects, they
+// are annotated, with the default keys unless annotations were asked
+// for, so FinishProvenance can find it again.
+func provenanceReadOptions(opts acquire.ReadOptions) acquire.ReadOptions {
+	if (opts.ProvenanceSidecar != nil || opts.SchemaValidation != nil) && !opts.ShowProvenance {
+		opts.ShowProvenance = true
+		opts.ProvenanceKeysSet = false
+		opts.ProvenanceLineKeySet = false
+	}
+	return opts
+}
+
+// provenanceLineKey returns the annotation key used for YAML lines.
+func provenanceLineKey(opts acquire.ReadOptions) string {
+	if opts.ProvenanceLineKeySet {
+		return opts.ProvenanceLineKey
+	}
+	return AnnotationProvenanceLine
+}
+
+// ProvenanceStash carries the provenance of objects beside them while
+// they go through transforms, duplicate resolution and overlays, when
+// Read only annotated them for internal use (see provenanceReadOptions).
+// The zero value is ready to use, and safe for concurrent use.
+type ProvenanceStash struct {
+	mu          sync.Mutex
+	objs        []*unstructured.Unstructured
+	annotations map[*unstructured.Unstructured]map[string]string
+}
+
+// Strip removes from objs, read with opts, the provenance annotations
+// Read added for internal use, and keeps them in the stash. Annotations
+// asked for with WithProvenance are left alone.
+func (s *ProvenanceStash) Strip(objs []*unstructured.Unstructured, opts ...ReadOption) {
+	keys := internalProvenanceKeys(opts)
+	if len(keys) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.annotations == nil {
+		s.annotations = map[*unstructured.Unstructured]map[string]string{}
+	}
+	for _, o := range objs {
+		stashed := map[string]string{}
+		for _, k := range keys {
+			if v, found := o.GetAnnotations()[k]; found {
+				stashed[k] = v
+				DeleteMetaDataAnnotation(o, k)
+			}
+		}
+		if len(o.GetAnnotations()) == 0 {
+			o.SetAnnotations(nil)
+		}
+		s.objs = append(s.objs, o)
+		s.annotations[o] = stashed
+	}
+}
+
+// Restore annotates objs again with the provenance kept by Strip, so that
+// schema validation and FinishProvenance can find it. Objects Strip
+// hasn't seen, such as merged duplicates, get the provenance of the last
+// stripped object with the same kind, namespace and name.
+func (s *ProvenanceStash) Restore(objs []*unstructured.Unstructured) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.annotations) == 0 {
+		return
+	}
+	byKey := map[string]map[string]string{}
+	for _, o := range s.objs {
+		byKey[resourceKey(o)] = s.annotations[o]
+	}
+	for _, o := range objs {
+		stashed, found := s.annotations[o]
+		if !found {
+			stashed = byKey[resourceKey(o)]
+		}
+		for k, v := range stashed {
+			SetMetaDataAnnotation(o, k, v)
+		}
+	}
+}
+
+// internalProvenanceKeys returns the keys of the provenance annotations
+// Read adds, with opts, for internal use only.
+func internalProvenanceKeys(opts []ReadOption) []string {
+	orig := acquire.MakeReadOptions(opts)
+	opt := provenanceReadOptions(orig)
+	if opt.ShowProvenance == orig.ShowProvenance {
+		return nil
+	}
+	fileKey, pathKey := provenanceKeys(opt)
+	return []string{fileKey, pathKey, provenanceLineKey(opt)}
+}
+
+// FinishProvenance writes the provenance of objs, read with the same
+// opts, to the writer given to WithProvenanceSidecar if any. Unless
+// WithProvenance is set, it then removes the provenance annotations Read
+// added for internal use from objs.
+func FinishProvenance(objs []*unstructured.Unstructured, opts ...ReadOption) error {
+	orig := acquire.MakeReadOptions(opts)
+	opt := provenanceReadOptions(orig)
+	if opt.ShowProvenance == orig.ShowProvenance && orig.ProvenanceSidecar == nil {
+		return nil
+	}
+	fileKey, pathKey := provenanceKeys(opt)
+	lineKey := provenanceLineKey(opt)
+
+	sidecar := ProvenanceSidecar{
+		APIVersion: ProvenanceSidecarAPIVersion,
+		Kind:       ProvenanceSidecarKind,
+		Objects:    []ProvenanceRecord{},
+	}
+	for _, o := range objs {
+		sidecar.Objects = append(sidecar.Objects, provenanceOf(o, opt))
+
+		if !orig.ShowProvenance {
+			for _, k := range []string{fileKey, pathKey, lineKey} {
+				DeleteMetaDataAnnotation(o, k)
+			}
+			if len(o.GetAnnotations()) == 0 {
+				o.SetAnnotations(nil)
+			}
+		}
+	}
+
+	if orig.ProvenanceSidecar == nil {
+		return nil
+	}
+	b, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = orig.ProvenanceSidecar.Write(append(b, '\n'))
+	return err
+}
+
+// provenanceOf reads the provenance annotations Read added to o.
+func provenanceOf(o *unstructured.Unstructured, opts acquire.ReadOptions) ProvenanceRecord {
+	r := ProvenanceRecord{
+		APIVersion: o.GetAPIVersion(),
+		Kind:       o.GetKind(),
+		Namespace:  o.GetNamespace(),
+		Name:       o.GetName(),
+	}
+	annotations := o.GetAnnotations()
+	fileKey, pathKey := provenanceKeys(opts)
+	if fileKey != "" {
+		r.File = annotations[fileKey]
+	}
+	if pathKey != "" {
+		r.Path = annotations[pathKey]
+	}
+	if lineKey := provenanceLineKey(opts); lineKey != "" {
+		r.Line, _ = strconv.Atoi(annotations[lineKey])
+	}
+	return r
+}
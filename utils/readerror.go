@@ -0,0 +1,148 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// ReadErrorCategory tells what kind of failure a ReadError is.
+type ReadErrorCategory int
+
+const (
+	// ReadErrorOther is any failure not covered by the other categories.
+	ReadErrorOther ReadErrorCategory = iota
+	// ReadErrorNotFound means the path, or the URL it names, doesn't exist.
+	ReadErrorNotFound
+	// ReadErrorFormat means the format of the path is unknown.
+	ReadErrorFormat
+	// ReadErrorParse means the content is not valid YAML, JSON or gzip.
+	ReadErrorParse
+	// ReadErrorEval means jsonnet evaluation failed or ran out of time.
+	ReadErrorEval
+	// ReadErrorNotObject means the content is well formed but isn't made
+	// of kubernetes objects.
+	ReadErrorNotObject
+	// ReadErrorInvalidObject means the content is made of kubernetes
+	// objects, some of which are invalid, e.g. have no name.
+	ReadErrorInvalidObject
+)
+
+func (c ReadErrorCategory) String() string {
+	switch c {
+	case ReadErrorNotFound:
+		return "not found"
+	case ReadErrorFormat:
+		return "unknown format"
+	case ReadErrorParse:
+		return "parse error"
+	case ReadErrorEval:
+		return "evaluation error"
+	case ReadErrorNotObject:
+		return "not a kubernetes object"
+	case ReadErrorInvalidObject:
+		return "invalid kubernetes object"
+	}
+	return "other"
+}
+
+// ReadError is the error returned by Read and ReadStream.
+type ReadError struct {
+	Path     string
+	Category ReadErrorCategory
+	Err      error
+}
+
+func (e *ReadError) Error() string {
+	return fmt.Sprintf("error reading %s: %v", e.Path, e.Err)
+}
+
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// ReadErrors is returned by kubecfg.ReadObjects when reading several paths with
+// WithContinueOnError, listing the errors of the paths that failed in
+// path order. An error of the steps following the reads, such as
+// overlays or validation, comes last.
+type ReadErrors struct {
+	Errors []error
+}
+
+func (e *ReadErrors) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d errors:", len(e.Errors))
+	for _, err := range e.Errors {
+		fmt.Fprintf(&b, "\n  %v", err)
+	}
+	return b.String()
+}
+
+func (e *ReadErrors) Unwrap() []error {
+	return e.Errors
+}
+
+// categorizedError marks err as being of category until ReadStream turns
+// it into a ReadError.
+type categorizedError struct {
+	category ReadErrorCategory
+	err      error
+}
+
+func (e *categorizedError) Error() string { return e.err.Error() }
+func (e *categorizedError) Unwrap() error { return e.err }
+
+func categorize(category ReadErrorCategory, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &categorizedError{category: category, err: err}
+}
+
+// newReadError wraps err, returned reading path, in a ReadError. Errors
+// not categorized where they were made are categorized by their type.
+func newReadError(path string, err error) *ReadError {
+	var re *ReadError
+	if errors.As(err, &re) {
+		return re
+	}
+
+	category := ReadErrorOther
+	var (
+		ce        *categorizedError
+		budgetErr *BudgetExceededError
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &ce):
+		category = ce.category
+	case errors.Is(err, fs.ErrNotExist):
+		category = ReadErrorNotFound
+	case errors.As(err, &budgetErr):
+		category = ReadErrorEval
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		category = ReadErrorParse
+	}
+	return &ReadError{Path: path, Category: category, Err: err}
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-jsonnet"
+)
+
+func TestReadErrorCategory(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"parse.yaml":        "a: [\n",
+		"parse.json":        `{"a": `,
+		"notobject.yaml":    "a: 1\n",
+		"notobject.jsonnet": `{ a: [1] }`,
+		"eval.jsonnet":      `error "boom"`,
+		"format.tmp":        "not a manifest",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter(nil, false))
+	for name, want := range map[string]ReadErrorCategory{
+		"missing.yaml":      ReadErrorNotFound,
+		"missing.jsonnet":   ReadErrorNotFound,
+		"parse.yaml":        ReadErrorParse,
+		"parse.json":        ReadErrorParse,
+		"notobject.yaml":    ReadErrorNotObject,
+		"notobject.jsonnet": ReadErrorNotObject,
+		"eval.jsonnet":      ReadErrorEval,
+		"format.tmp":        ReadErrorFormat,
+	} {
+		path := filepath.Join(dir, name)
+		_, err := Read(vm, path)
+		var re *ReadError
+		if !errors.As(err, &re) {
+			t.Errorf("%s: expected a *ReadError, got %v", name, err)
+			continue
+		}
+		if re.Path != path || re.Category != want {
+			t.Errorf("%s: got path %q and category %q, want %q", name, re.Path, re.Category, want)
+		}
+		if re.Unwrap() == nil {
+			t.Errorf("%s: expected a cause", name)
+		}
+	}
+
+	_, err := Read(vm, filepath.Join(dir, "missing.yaml"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the cause to be os.ErrNotExist, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/docker/api/types"
+	"github.com/genuinetools/reg/repoutils"
+)
+
+// dockerHubConfigKey is the key Docker uses for Docker Hub credentials
+// in config.json.
+const dockerHubConfigKey = "https://index.docker.io/v1/"
+
+// RegistryCredentials are a username and password (or token) for a
+// registry.
+type RegistryCredentials struct {
+	Username string
+	Password string
+}
+
+// RegistryAuth configures how the registry resolver authenticates. The
+// zero value uses the default Docker config, like `docker pull` does.
+type RegistryAuth struct {
+	// DockerConfigDir is the directory holding the Docker config.json
+	// whose "auths", "credsStore" and "credHelpers" are used. Defaults
+	// to $DOCKER_CONFIG or ~/.docker.
+	DockerConfigDir string
+	// Credentials, keyed by registry host (eg "ghcr.io"), take
+	// precedence over the Docker config.
+	Credentials map[string]RegistryCredentials
+}
+
+// authConfig returns the credentials to use for the registry at domain.
+func (a RegistryAuth) authConfig(domain string) (types.AuthConfig, error) {
+	if c, found := a.Credentials[domain]; found {
+		return types.AuthConfig{
+			Username:      c.Username,
+			Password:      c.Password,
+			ServerAddress: registryAuthAddress(domain),
+		}, nil
+	}
+	if a.DockerConfigDir == "" {
+		return repoutils.GetAuthConfig("", "", domain)
+	}
+
+	cfg, err := config.Load(a.DockerConfigDir)
+	if err != nil {
+		return types.AuthConfig{}, fmt.Errorf("loading docker config from %s: %w", a.DockerConfigDir, err)
+	}
+	key := domain
+	if domain == "docker.io" {
+		key = dockerHubConfigKey
+	}
+	// Goes through credential helpers, which take care of refreshing
+	// short lived tokens (eg. for ECR and GCR).
+	creds, err := cfg.GetAuthConfig(key)
+	if err != nil {
+		return types.AuthConfig{}, fmt.Errorf("getting credentials for %s: %w", domain, err)
+	}
+	return types.AuthConfig{
+		Username:      creds.Username,
+		Password:      creds.Password,
+		IdentityToken: creds.IdentityToken,
+		RegistryToken: creds.RegistryToken,
+		ServerAddress: registryAuthAddress(domain),
+	}, nil
+}
+
+func registryAuthAddress(domain string) string {
+	if domain == "docker.io" {
+		return repoutils.DefaultDockerRegistry
+	}
+	return domain
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistryAuthConfig(t *testing.T) {
+	dir := t.TempDir()
+	encode := func(user, pass string) string {
+		return base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+	}
+	cfg := fmt.Sprintf(`{"auths": {
+		"harbor.example.com": {"auth": %q},
+		"https://index.docker.io/v1/": {"auth": %q}
+	}}`, encode("harbor-user", "harbor-pass"), encode("hub-user", "hub-pass"))
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth := RegistryAuth{
+		DockerConfigDir: dir,
+		Credentials: map[string]RegistryCredentials{
+			"ghcr.io": {Username: "gh-user", Password: "gh-token"},
+		},
+	}
+	for _, tc := range []struct {
+		domain, user, pass, server string
+	}{
+		{"ghcr.io", "gh-user", "gh-token", "ghcr.io"},
+		{"harbor.example.com", "harbor-user", "harbor-pass", "harbor.example.com"},
+		{"docker.io", "hub-user", "hub-pass", "https://registry-1.docker.io"},
+		{"quay.io", "", "", "quay.io"},
+	} {
+		c, err := auth.authConfig(tc.domain)
+		if err != nil {
+			t.Errorf("%s: %v", tc.domain, err)
+			continue
+		}
+		if c.Username != tc.user || c.Password != tc.pass || c.ServerAddress != tc.server {
+			t.Errorf("%s: unexpected credentials %+v", tc.domain, c)
+		}
+	}
+}
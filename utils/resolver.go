@@ -19,12 +19,14 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"net/http"
+	"sync"
 
+	"github.com/docker/docker/api/types"
 	"github.com/genuinetools/reg/registry"
-	"github.com/genuinetools/reg/repoutils"
 )
 
-const defaultRegistry = "registry-1.docker.io"	
+const defaultRegistry = "registry-1.docker.io"
 
 // ImageName represents the parts of a docker image name
 type ImageName struct {
@@ -77,6 +79,10 @@ func (n ImageName) RegistryURL() string {
 }
 
 // ParseImageName parses a docker image into an ImageName struct.
+// As in docker, the first component is taken to be the registry only if
+// it contains a dot or a colon (or is "localhost"), so the colon in
+// "localhost:5000/app:tag" is a port while the one in "app:5000" is a
+// tag.
 func ParseImageName(image string) (ImageName, error) {
 	ret := ImageName{}
 
@@ -98,6 +104,65 @@ type Resolver interface {
 	Resolve(image *ImageName) error
 }
 
+// ContextResolver is a Resolver whose lookups can be cancelled:
+// ResolveContext gives up, aborting the requests in flight, once ctx is
+// done. Resolve is ResolveContext with context.Background().
+type ContextResolver interface {
+	Resolver
+	ResolveContext(ctx context.Context, image *ImageName) error
+}
+
+// BatchResolver is a Resolver able to resolve many images more
+// efficiently than one at a time. ResolveAll returns one error for each
+// image, nil for those resolved successfully, and gives up once ctx is
+// done.
+type BatchResolver interface {
+	Resolver
+	ResolveAll(ctx context.Context, images []*ImageName) []error
+}
+
+// ResolveContext resolves image with resolver, giving up once ctx is done
+// if resolver is a ContextResolver.
+func ResolveContext(ctx context.Context, resolver Resolver, image *ImageName) error {
+	if c, ok := resolver.(ContextResolver); ok {
+		return c.ResolveContext(ctx, image)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return resolver.Resolve(image)
+}
+
+// ResolveAll resolves images with resolver, in a single batch if it is a
+// BatchResolver and one image at a time otherwise. It returns one error
+// for each image, as BatchResolver.ResolveAll.
+func ResolveAll(ctx context.Context, resolver Resolver, images []*ImageName) []error {
+	if b, ok := resolver.(BatchResolver); ok {
+		return b.ResolveAll(ctx, images)
+	}
+	errs := make([]error, len(images))
+	for i, n := range images {
+		errs[i] = ResolveContext(ctx, resolver, n)
+	}
+	return errs
+}
+
+// ResolverWithContext returns a Resolver resolving images with resolver
+// within ctx, for callers that don't pass a context, such as the
+// resolveImage native function.
+func ResolverWithContext(ctx context.Context, resolver Resolver) Resolver {
+	return contextResolver{ctx: ctx, inner: resolver}
+}
+
+type contextResolver struct {
+	ctx   context.Context
+	inner Resolver
+}
+
+func (r contextResolver) Resolve(image *ImageName) error {
+	return ResolveContext(r.ctx, r.inner, image)
+}
+
 // NewIdentityResolver returns a resolver that does only trivial
 // :latest canonicalisation
 func NewIdentityResolver() Resolver {
@@ -110,56 +175,208 @@ func (r identityResolver) Resolve(image *ImageName) error {
 	return nil
 }
 
+func (r identityResolver) ResolveContext(ctx context.Context, image *ImageName) error {
+	return nil
+}
+
+// NewNormalizingResolver returns a resolver that, without contacting any
+// registry, rewrites image names to their fully qualified form, e.g.
+// nginx to docker.io/library/nginx:latest. Names that don't parse are
+// reported as errors.
+func NewNormalizingResolver() Resolver {
+	return normalizingResolver{}
+}
+
+type normalizingResolver struct{}
+
+func (r normalizingResolver) ResolveContext(ctx context.Context, image *ImageName) error {
+	return r.Resolve(image)
+}
+
+func (r normalizingResolver) Resolve(image *ImageName) error {
+	ref := image.Name
+	if image.Repository != "" {
+		ref = image.Repository + "/" + ref
+	}
+	if image.Registry != "" {
+		ref = image.Registry + "/" + ref
+	}
+	if image.Tag != "" {
+		ref += ":" + image.Tag
+	}
+	if image.Digest != "" {
+		ref += "@" + image.Digest
+	}
+
+	n, err := ParseImageName(ref)
+	if err != nil {
+		return err
+	}
+	*image = n
+	return nil
+}
+
 // NewRegistryResolver returns a resolver that looks up a docker
 // registry to resolve digests
 func NewRegistryResolver(opt registry.Opt) Resolver {
+	return NewRegistryResolverWithAuth(opt, RegistryAuth{})
+}
+
+// NewRegistryResolverWithAuth is like NewRegistryResolver, using auth to
+// authenticate to the registries.
+func NewRegistryResolverWithAuth(opt registry.Opt, auth RegistryAuth) Resolver {
+	return NewRegistryResolverWithTransport(opt, auth, nil)
+}
+
+// NewRegistryResolverWithTransport is like NewRegistryResolverWithAuth,
+// sending the requests to the registries through transport. A nil
+// transport uses http.DefaultTransport.
+func NewRegistryResolverWithTransport(opt registry.Opt, auth RegistryAuth, transport http.RoundTripper) Resolver {
 	return &registryResolver{
-		opt:   opt,
-		cache: make(map[string]string),
+		opt:       opt,
+		auth:      auth,
+		transport: transport,
+		cache:     make(map[string]string),
 	}
 }
 
 type registryResolver struct {
-	opt   registry.Opt
+	opt       registry.Opt
+	auth      RegistryAuth
+	transport http.RoundTripper
+
+	mu    sync.Mutex
 	cache map[string]string
 }
 
 func (r *registryResolver) Resolve(n *ImageName) error {
-	// TODO: get context from caller.
-	ctx := context.Background()
+	return r.ResolveContext(context.Background(), n)
+}
 
-	if n.Digest != "" {
-		// Already has explicit digest
-		return nil
+func (r *registryResolver) ResolveContext(ctx context.Context, n *ImageName) error {
+	return r.ResolveAll(ctx, []*ImageName{n})[0]
+}
+
+// ResolveAll resolves images with one registry client per registry,
+// querying the registries concurrently.
+func (r *registryResolver) ResolveAll(ctx context.Context, images []*ImageName) []error {
+	errs := make([]error, len(images))
+	imgs := make([]registry.Image, len(images))
+	byDomain := map[string][]int{}
+	var domains []string
+	for i, n := range images {
+		if n.Digest != "" {
+			// Already has explicit digest
+			continue
+		}
+
+		r.mu.Lock()
+		digest, ok := r.cache[n.String()]
+		r.mu.Unlock()
+		if ok {
+			n.Digest = digest
+			continue
+		}
+
+		img, err := registry.ParseImage(n.String())
+		if err != nil {
+			errs[i] = fmt.Errorf("unable to parse image name: %v", err)
+			continue
+		}
+		imgs[i] = img
+		if _, found := byDomain[img.Domain]; !found {
+			domains = append(domains, img.Domain)
+		}
+		byDomain[img.Domain] = append(byDomain[img.Domain], i)
 	}
 
-	if digest, ok := r.cache[n.String()]; ok {
-		n.Digest = digest
-		return nil
+	var wg sync.WaitGroup
+	for _, domain := range domains {
+		wg.Add(1)
+		go func(domain string, indexes []int) {
+			defer wg.Done()
+			c, err := r.client(ctx, domain)
+			for _, i := range indexes {
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				errs[i] = r.resolveDigest(ctx, c, imgs[i], images[i])
+			}
+		}(domain, byDomain[domain])
 	}
+	wg.Wait()
+
+	return errs
+}
 
-	img, err := registry.ParseImage(n.String())
+func (r *registryResolver) client(ctx context.Context, domain string) (*registry.Registry, error) {
+	auth, err := r.auth.authConfig(domain)
 	if err != nil {
-		return fmt.Errorf("unable to parse image name: %v", err)
+		return nil, fmt.Errorf("unable to get auth config for registry: %v", err)
 	}
 
-	auth, err := repoutils.GetAuthConfig("", "", img.Domain)
-	if err != nil {
-		return fmt.Errorf("unable to get auth config for registry: %v", err)
+	return newRegistryClient(ctx, auth, r.opt, r.transport)
+}
+
+// newRegistryClient is like registry.New, sending the requests through
+// transport, if not nil, instead of http.DefaultTransport.
+func newRegistryClient(ctx context.Context, auth types.AuthConfig, opt registry.Opt, transport http.RoundTripper) (*registry.Registry, error) {
+	if transport == nil {
+		c, err := registry.New(ctx, auth, opt)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create registry client: %w", err)
+		}
+		return c, nil
 	}
 
-	c, err := registry.New(ctx, auth, r.opt)
+	// registry.New doesn't take a transport: swap it in at the bottom of
+	// the chain of authenticating transports it builds, and only then ping.
+	skipPing := opt.SkipPing
+	opt.SkipPing = true
+	c, err := registry.New(ctx, auth, opt)
 	if err != nil {
-		return fmt.Errorf("unable to create registry client: %v", err)
+		return nil, fmt.Errorf("unable to create registry client: %w", err)
 	}
+	if !setBaseTransport(c.Client.Transport, transport) {
+		return nil, fmt.Errorf("unable to create registry client: unexpected transport %T", c.Client.Transport)
+	}
+
+	if c.Pingable() && !skipPing {
+		if err := c.Ping(ctx); err != nil {
+			return nil, fmt.Errorf("unable to create registry client: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// setBaseTransport replaces the transport at the bottom of the chain built
+// by registry.New, returning false if rt isn't such a chain.
+func setBaseTransport(rt, base http.RoundTripper) bool {
+	switch t := rt.(type) {
+	case *registry.CustomTransport:
+		return setBaseTransport(t.Transport, base)
+	case *registry.ErrorTransport:
+		return setBaseTransport(t.Transport, base)
+	case *registry.BasicTransport:
+		return setBaseTransport(t.Transport, base)
+	case *registry.TokenTransport:
+		t.Transport = base
+		return true
+	}
+	return false
+}
 
-	digest, err := c.Digest(ctx, img)
+func (r *registryResolver) resolveDigest(ctx context.Context, c *registry.Registry, img registry.Image, n *ImageName) error {
+	d, err := c.Digest(ctx, img)
 	if err != nil {
-		return fmt.Errorf("unable to get digest from the registry: %v", err)
+		return fmt.Errorf("unable to get digest from the registry: %w", err)
 	}
 
-	n.Digest = digest.String()
-	r.cache[n.String()] = n.Digest
+	r.mu.Lock()
+	r.cache[n.String()] = d.String()
+	r.mu.Unlock()
+	n.Digest = d.String()
 
 	return nil
 }
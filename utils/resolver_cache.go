@@ -0,0 +1,151 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// ResolverCacheTTL is how long NewCachingResolver remembers a
+	// successful resolution.
+	ResolverCacheTTL = 10 * time.Minute
+	// ResolverNegativeCacheTTL is how long NewCachingResolver remembers
+	// a failed resolution.
+	ResolverNegativeCacheTTL = 30 * time.Second
+)
+
+type resolverCacheEntry struct {
+	result  ImageName
+	err     error
+	expires time.Time
+}
+
+type cachingResolver struct {
+	inner Resolver
+	now   func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]resolverCacheEntry
+}
+
+// NewCachingResolver returns a Resolver that remembers the results of
+// inner, keyed by the fully qualified image reference. Failures are
+// remembered too, for a shorter time. It is safe for concurrent use, and
+// a BatchResolver if inner is one.
+func NewCachingResolver(inner Resolver) Resolver {
+	r := &cachingResolver{
+		inner: inner,
+		now:   time.Now,
+		cache: map[string]resolverCacheEntry{},
+	}
+	if _, ok := inner.(BatchResolver); ok {
+		return batchCachingResolver{r}
+	}
+	return r
+}
+
+// batchCachingResolver is a cachingResolver of a BatchResolver. Other
+// resolvers are better left to resolve images concurrently, one at a time.
+type batchCachingResolver struct {
+	*cachingResolver
+}
+
+func (r *cachingResolver) Resolve(n *ImageName) error {
+	return r.ResolveContext(context.Background(), n)
+}
+
+func (r *cachingResolver) ResolveContext(ctx context.Context, n *ImageName) error {
+	key := n.String()
+
+	r.mu.Lock()
+	e, found := r.cache[key]
+	r.mu.Unlock()
+	if found && r.now().Before(e.expires) {
+		if e.err == nil {
+			*n = e.result
+		}
+		return e.err
+	}
+
+	res := *n
+	err := ResolveContext(ctx, r.inner, &res)
+	// Failures caused by ctx say nothing about the image.
+	if ctx.Err() == nil {
+		ttl := ResolverCacheTTL
+		if err != nil {
+			ttl = ResolverNegativeCacheTTL
+		}
+		r.mu.Lock()
+		r.cache[key] = resolverCacheEntry{result: res, err: err, expires: r.now().Add(ttl)}
+		r.mu.Unlock()
+	}
+
+	if err == nil {
+		*n = res
+	}
+	return err
+}
+
+// ResolveAll resolves the images not found in the cache in a single batch.
+func (r batchCachingResolver) ResolveAll(ctx context.Context, images []*ImageName) []error {
+	errs := make([]error, len(images))
+	var missIdx []int
+	var misses []*ImageName
+	now := r.now()
+
+	r.mu.Lock()
+	for i, n := range images {
+		if e, found := r.cache[n.String()]; found && now.Before(e.expires) {
+			if e.err == nil {
+				*n = e.result
+			}
+			errs[i] = e.err
+			continue
+		}
+		res := *n
+		missIdx = append(missIdx, i)
+		misses = append(misses, &res)
+	}
+	r.mu.Unlock()
+
+	if len(misses) == 0 {
+		return errs
+	}
+	missErrs := ResolveAll(ctx, r.inner, misses)
+
+	now = r.now()
+	cancelled := ctx.Err() != nil
+	r.mu.Lock()
+	for j, i := range missIdx {
+		err := missErrs[j]
+		ttl := ResolverCacheTTL
+		if err != nil {
+			ttl = ResolverNegativeCacheTTL
+		}
+		if !cancelled {
+			r.cache[images[i].String()] = resolverCacheEntry{result: *misses[j], err: err, expires: now.Add(ttl)}
+		}
+		if err == nil {
+			*images[i] = *misses[j]
+		}
+		errs[i] = err
+	}
+	r.mu.Unlock()
+	return errs
+}
@@ -0,0 +1,137 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type countingResolver struct {
+	calls map[string]int
+	fail  bool
+}
+
+func (r *countingResolver) Resolve(n *ImageName) error {
+	r.calls[n.String()]++
+	if r.fail {
+		return errors.New("unavailable")
+	}
+	n.Digest = "sha256:0123"
+	return nil
+}
+
+func TestCachingResolver(t *testing.T) {
+	inner := &countingResolver{calls: map[string]int{}}
+	now := time.Unix(0, 0)
+	r := NewCachingResolver(inner).(*cachingResolver)
+	r.now = func() time.Time { return now }
+
+	resolve := func(image string) (ImageName, error) {
+		n, err := ParseImageName(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = r.Resolve(&n)
+		return n, err
+	}
+
+	for i := 0; i < 3; i++ {
+		n, err := resolve("nginx:1.23")
+		if err != nil || n.Digest != "sha256:0123" {
+			t.Fatalf("unexpected result %v, %v", n, err)
+		}
+	}
+	if got := inner.calls["docker.io/library/nginx:1.23"]; got != 1 {
+		t.Errorf("expected 1 call to the inner resolver, got %d", got)
+	}
+
+	inner.fail = true
+	for i := 0; i < 2; i++ {
+		if n, err := resolve("busybox"); err == nil || n.Digest != "" {
+			t.Errorf("expected a failure, got %v, %v", n, err)
+		}
+	}
+	if got := inner.calls["docker.io/library/busybox:latest"]; got != 1 {
+		t.Errorf("expected failures to be cached, got %d calls", got)
+	}
+
+	now = now.Add(ResolverNegativeCacheTTL + time.Second)
+	inner.fail = false
+	if n, err := resolve("busybox"); err != nil || n.Digest == "" {
+		t.Errorf("expected the failure to expire, got %v, %v", n, err)
+	}
+	if _, err := resolve("nginx:1.23"); err != nil {
+		t.Error(err)
+	}
+	if got := inner.calls["docker.io/library/nginx:1.23"]; got != 1 {
+		t.Errorf("expected the success to still be cached, got %d calls", got)
+	}
+}
+
+type batchCountingResolver struct {
+	countingResolver
+	batches [][]string
+}
+
+func (r *batchCountingResolver) ResolveAll(ctx context.Context, images []*ImageName) []error {
+	var batch []string
+	errs := make([]error, len(images))
+	for i, n := range images {
+		batch = append(batch, n.String())
+		errs[i] = r.Resolve(n)
+	}
+	r.batches = append(r.batches, batch)
+	return errs
+}
+
+func TestCachingResolverBatch(t *testing.T) {
+	inner := &batchCountingResolver{countingResolver: countingResolver{calls: map[string]int{}}}
+	r := NewCachingResolver(inner)
+
+	names := func(images ...string) []*ImageName {
+		var res []*ImageName
+		for _, image := range images {
+			n, err := ParseImageName(image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, &n)
+		}
+		return res
+	}
+
+	if err := r.Resolve(names("nginx:1.23")[0]); err != nil {
+		t.Fatal(err)
+	}
+	batch := names("nginx:1.23", "busybox", "redis")
+	for i, err := range ResolveAll(context.Background(), r, batch) {
+		if err != nil || batch[i].Digest != "sha256:0123" {
+			t.Errorf("unexpected result %v, %v", batch[i], err)
+		}
+	}
+	// nginx was cached by Resolve, so only the misses make up the batch.
+	want := [][]string{{"docker.io/library/busybox:latest", "docker.io/library/redis:latest"}}
+	if !reflect.DeepEqual(inner.batches, want) {
+		t.Errorf("got batches %v, want %v", inner.batches, want)
+	}
+	if got := inner.calls["docker.io/library/nginx:1.23"]; got != 1 {
+		t.Errorf("expected 1 call for nginx, got %d", got)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// RegistryMirror rewrites the images under From, a registry host
+// optionally followed by a repository path, to be under To instead.
+type RegistryMirror struct {
+	From string
+	To   string
+}
+
+type mirroringResolver struct {
+	inner   Resolver
+	mirrors []RegistryMirror
+}
+
+// NewMirroringResolver returns a Resolver that rewrites image names
+// according to the first of mirrors matching them, then resolves them
+// with inner. For example with the mirror docker.io ->
+// registry.internal/dockerhub, nginx:1.25 is resolved as
+// registry.internal/dockerhub/library/nginx:1.25. The repository path,
+// tag and digest are kept.
+func NewMirroringResolver(inner Resolver, mirrors []RegistryMirror) Resolver {
+	return &mirroringResolver{inner: inner, mirrors: mirrors}
+}
+
+func (r *mirroringResolver) Resolve(n *ImageName) error {
+	return r.ResolveContext(context.Background(), n)
+}
+
+func (r *mirroringResolver) ResolveContext(ctx context.Context, n *ImageName) error {
+	if n.Registry == "" {
+		if err := NewNormalizingResolver().Resolve(n); err != nil {
+			return err
+		}
+	}
+
+	repo := n.Name
+	if n.Repository != "" {
+		repo = n.Repository + "/" + repo
+	}
+	full := n.Registry + "/" + repo
+	for _, m := range r.mirrors {
+		from := strings.TrimSuffix(m.From, "/")
+		if full != from && !strings.HasPrefix(full, from+"/") {
+			continue
+		}
+		rest := strings.TrimPrefix(full[len(from):], "/")
+		to := strings.TrimSuffix(m.To, "/")
+		host, path, _ := strings.Cut(to, "/")
+		if path != "" && rest != "" {
+			path += "/"
+		}
+		if host == "" || path+rest == "" {
+			return fmt.Errorf("registry mirror %s -> %s leaves no repository for %s", m.From, m.To, n)
+		}
+		n.Registry, n.Repository, n.Name = host, "", path+rest
+		break
+	}
+	return ResolveContext(ctx, r.inner, n)
+}
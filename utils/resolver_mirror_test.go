@@ -0,0 +1,98 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+type recordingResolver struct {
+	resolved []string
+}
+
+func (r *recordingResolver) Resolve(n *ImageName) error {
+	r.resolved = append(r.resolved, n.String())
+	return nil
+}
+
+func TestMirroringResolver(t *testing.T) {
+	mirrors := []RegistryMirror{
+		{From: "docker.io/bitnami", To: "registry.internal/bitnami-mirror"},
+		{From: "docker.io", To: "registry.internal/dockerhub"},
+		{From: "gcr.io/", To: "gcr.internal:5000/"},
+	}
+	for _, tc := range []struct {
+		image string
+		want  string
+	}{
+		{"nginx", "registry.internal/dockerhub/library/nginx:latest"},
+		{"nginx:1.25", "registry.internal/dockerhub/library/nginx:1.25"},
+		{"docker.io/bitnami/redis:7", "registry.internal/bitnami-mirror/redis:7"},
+		{"gcr.io/distroless/static@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", "gcr.internal:5000/distroless/static@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"},
+		// Host prefixes match whole path components only.
+		{"gcr.io.example.com/app:v1", "gcr.io.example.com/app:v1"},
+		{"quay.io/org/app:v1", "quay.io/org/app:v1"},
+	} {
+		inner := &recordingResolver{}
+		n, err := ParseImageName(tc.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := NewMirroringResolver(inner, mirrors).Resolve(&n); err != nil {
+			t.Errorf("%s: %v", tc.image, err)
+			continue
+		}
+		if got := n.String(); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.image, got, tc.want)
+		}
+		if len(inner.resolved) != 1 || inner.resolved[0] != tc.want {
+			t.Errorf("%s: expected the inner resolver to resolve %q, got %v", tc.image, tc.want, inner.resolved)
+		}
+	}
+
+	// Unqualified names are normalized before matching.
+	n := ImageName{Name: "nginx", Tag: "1.25"}
+	if err := NewMirroringResolver(&recordingResolver{}, mirrors).Resolve(&n); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n.String(), "registry.internal/dockerhub/library/nginx:1.25"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMirroringResolverPinImages(t *testing.T) {
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": "p"},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "c", "image": "nginx:1.25"},
+			},
+		},
+	}}
+	resolver := NewMirroringResolver(fakeDigestResolver{}, []RegistryMirror{{From: "docker.io", To: "registry.internal/dockerhub"}})
+	if err := PinImages(context.Background(), []*unstructured.Unstructured{pod}, resolver, 0); err != nil {
+		t.Fatal(err)
+	}
+	containers, _, _ := unstructured.NestedSlice(pod.Object, "spec", "containers")
+	if got, want := containers[0].(map[string]interface{})["image"], "registry.internal/dockerhub/library/nginx@sha256:0123"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// registryStatusRE extracts the HTTP status from the errors returned by
+// the registry client, which are not typed.
+var registryStatusRE = regexp.MustCompile(`(?:status=|status code: )(\d{3})`)
+
+type retryingResolver struct {
+	inner       Resolver
+	maxAttempts int
+	baseDelay   time.Duration
+	sleep       func(context.Context, time.Duration)
+}
+
+// NewRetryingResolver returns a Resolver that retries the lookups of
+// inner failing with a network error, a 429 or a 5xx status, up to
+// maxAttempts attempts in total. The delay between attempts starts at
+// baseDelay and doubles every time, with up to 50% random jitter added.
+// Other errors, such as 404 or 401, are returned straight away.
+func NewRetryingResolver(inner Resolver, maxAttempts int, baseDelay time.Duration) Resolver {
+	return &retryingResolver{
+		inner:       inner,
+		maxAttempts: maxAttempts,
+		baseDelay:   baseDelay,
+		sleep:       sleepContext,
+	}
+}
+
+func (r *retryingResolver) Resolve(n *ImageName) error {
+	return r.ResolveContext(context.Background(), n)
+}
+
+func (r *retryingResolver) ResolveContext(ctx context.Context, n *ImageName) error {
+	delay := r.baseDelay
+	for attempt := 1; ; attempt++ {
+		res := *n
+		err := ResolveContext(ctx, r.inner, &res)
+		if err == nil {
+			*n = res
+			return nil
+		}
+		if attempt >= r.maxAttempts || ctx.Err() != nil || !isRetryableResolveError(err) {
+			return err
+		}
+		jitter := time.Duration(0)
+		if delay > 0 {
+			jitter = time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		}
+		r.sleep(ctx, delay+jitter)
+		delay *= 2
+	}
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+func isRetryableResolveError(err error) bool {
+	if m := registryStatusRE.FindStringSubmatch(err.Error()); m != nil {
+		status, _ := strconv.Atoi(m[1])
+		return status == http.StatusTooManyRequests || status >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+type flakyResolver struct {
+	errs  []error
+	calls int
+}
+
+func (r *flakyResolver) Resolve(n *ImageName) error {
+	r.calls++
+	if len(r.errs) > 0 {
+		err := r.errs[0]
+		r.errs = r.errs[1:]
+		return err
+	}
+	n.Digest = "sha256:0123"
+	return nil
+}
+
+func TestRetryingResolver(t *testing.T) {
+	netErr := fmt.Errorf("unable to create registry client: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")})
+	unavailable := errors.New(`unable to get digest from the registry: http: non-successful response (status=503 body="")`)
+	throttled := errors.New("unable to get digest from the registry: got status code: 429")
+	unauthorized := errors.New(`unable to create registry client: http: non-successful response (status=401 body="")`)
+	notFound := errors.New("unable to get digest from the registry: got status code: 404")
+
+	for _, tc := range []struct {
+		name      string
+		errs      []error
+		calls     int
+		expectErr bool
+	}{
+		{"network error", []error{netErr}, 2, false},
+		{"5xx and 429", []error{unavailable, throttled}, 3, false},
+		{"exhausted", []error{unavailable, unavailable, unavailable, unavailable}, 3, true},
+		{"unauthorized", []error{unauthorized}, 1, true},
+		{"not found", []error{notFound}, 1, true},
+	} {
+		inner := &flakyResolver{errs: tc.errs}
+		r := NewRetryingResolver(inner, 3, time.Second).(*retryingResolver)
+		var delays []time.Duration
+		r.sleep = func(_ context.Context, d time.Duration) { delays = append(delays, d) }
+
+		n := ImageName{Name: "nginx", Tag: "latest"}
+		err := r.Resolve(&n)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if inner.calls != tc.calls {
+			t.Errorf("%s: expected %d calls, got %d", tc.name, tc.calls, inner.calls)
+		}
+		for i, d := range delays {
+			base := time.Second << i
+			if d < base || d > base+base/2 {
+				t.Errorf("%s: delay %d out of range: %v", tc.name, i, d)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/genuinetools/reg/registry"
+)
+
+func TestParseImageNamePorts(t *testing.T) {
+	const digest = "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	for _, tc := range []struct {
+		image string
+		want  ImageName
+	}{
+		{"localhost:5000/myapp:tag", ImageName{Registry: "localhost:5000", Name: "myapp", Tag: "tag"}},
+		{"localhost:5000/myapp", ImageName{Registry: "localhost:5000", Name: "myapp", Tag: "latest"}},
+		{"registry.internal:8443/team/app@" + digest, ImageName{Registry: "registry.internal:8443", Name: "team/app", Digest: digest}},
+		{"registry.internal:8443/team/app:v1.2", ImageName{Registry: "registry.internal:8443", Name: "team/app", Tag: "v1.2"}},
+		{"10.0.0.1:5000/app:1", ImageName{Registry: "10.0.0.1:5000", Name: "app", Tag: "1"}},
+		{"localhost/app:1", ImageName{Registry: "localhost", Name: "app", Tag: "1"}},
+		// Without a dot or colon before the first slash, the first
+		// component is a repository on the default registry.
+		{"team/app:5000", ImageName{Registry: "docker.io", Name: "team/app", Tag: "5000"}},
+		{"myapp:5000", ImageName{Registry: "docker.io", Name: "library/myapp", Tag: "5000"}},
+	} {
+		got, err := ParseImageName(tc.image)
+		if err != nil {
+			t.Errorf("%s: %v", tc.image, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %#v, want %#v", tc.image, got, tc.want)
+		}
+		if tc.want.Digest == "" && got.String() != tc.want.String() {
+			t.Errorf("%s: got %q, want %q", tc.image, got.String(), tc.want.String())
+		}
+	}
+}
+
+func TestNormalizingResolver(t *testing.T) {
+	const digest = "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	for _, tc := range []struct {
+		image ImageName
+		want  string
+	}{
+		{ImageName{Name: "nginx"}, "docker.io/library/nginx:latest"},
+		{ImageName{Name: "nginx", Tag: "1.25"}, "docker.io/library/nginx:1.25"},
+		{ImageName{Repository: "bitnami", Name: "redis"}, "docker.io/bitnami/redis:latest"},
+		{ImageName{Registry: "docker.io", Name: "nginx"}, "docker.io/library/nginx:latest"},
+		{ImageName{Registry: "gcr.io", Repository: "distroless", Name: "static", Tag: "nonroot"}, "gcr.io/distroless/static:nonroot"},
+		{ImageName{Registry: "localhost:5000", Name: "app"}, "localhost:5000/app:latest"},
+		{ImageName{Name: "nginx", Digest: digest}, "docker.io/library/nginx@" + digest},
+	} {
+		n := tc.image
+		if err := NewNormalizingResolver().Resolve(&n); err != nil {
+			t.Errorf("%+v: %v", tc.image, err)
+			continue
+		}
+		if got := n.String(); got != tc.want {
+			t.Errorf("%+v: got %q, want %q", tc.image, got, tc.want)
+		}
+	}
+
+	if err := NewNormalizingResolver().Resolve(&ImageName{Name: "Nginx"}); err == nil {
+		t.Errorf("expected an error for an invalid image name")
+	}
+
+	// Already normalized names are left as they are.
+	n, err := ParseImageName("quay.io/org/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := n
+	if err := NewNormalizingResolver().Resolve(&n); err != nil || n != want {
+		t.Errorf("got %+v, %v, want %+v", n, err, want)
+	}
+}
+
+type countingTransport struct {
+	inner    http.RoundTripper
+	requests int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	return c.inner.RoundTrip(req)
+}
+
+func TestRegistryResolverTransport(t *testing.T) {
+	const digest = "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/", "/v2":
+		case "/v2/app/manifests/v1":
+			w.Header().Set("Docker-Content-Digest", digest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "https://")
+	auth := RegistryAuth{Credentials: map[string]RegistryCredentials{host: {}}}
+
+	// The server's certificate is only trusted by its own client.
+	n, err := ParseImageName(host + "/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRegistryResolverWithAuth(registry.Opt{}, auth).Resolve(&n); err == nil {
+		t.Errorf("expected the default transport to reject the certificate")
+	}
+
+	transport := &countingTransport{inner: s.Client().Transport}
+	if err := NewRegistryResolverWithTransport(registry.Opt{}, auth, transport).Resolve(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Digest != digest {
+		t.Errorf("got digest %q, want %q", n.Digest, digest)
+	}
+	if transport.requests == 0 {
+		t.Errorf("expected requests through the transport")
+	}
+}
+
+func TestRegistryResolverContext(t *testing.T) {
+	started, aborted := make(chan struct{}), make(chan struct{})
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/", "/v2":
+		case "/v2/app/manifests/v1":
+			close(started)
+			<-r.Context().Done()
+			close(aborted)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+	host := strings.TrimPrefix(s.URL, "https://")
+	auth := RegistryAuth{Credentials: map[string]RegistryCredentials{host: {}}}
+	resolver := NewRegistryResolverWithTransport(registry.Opt{}, auth, s.Client().Transport)
+
+	n, err := ParseImageName(host + "/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-started
+		cancel()
+	}()
+	if err := ResolveContext(ctx, resolver, &n); err == nil {
+		t.Errorf("expected the resolution to fail")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the lookup in flight wasn't aborted")
+	}
+	if n.Digest != "" {
+		t.Errorf("unexpected digest %q", n.Digest)
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/genuinetools/reg/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// cosignSignatureAnnotation holds the base64 signature of a layer of
+	// a cosign signature manifest.
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// maxCosignPayload bounds the size of the signed payloads downloaded.
+	maxCosignPayload = 1 << 20
+)
+
+// cosignSignature is a signed payload found in a cosign signature
+// manifest.
+type cosignSignature struct {
+	payload   []byte
+	signature []byte
+}
+
+// cosignPayload is the part of the cosign "simple signing" payload that
+// names the signed image.
+type cosignPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+type verifyingResolver struct {
+	inner Resolver
+	key   crypto.PublicKey
+	// signatures fetches the cosign signatures of an image with a digest.
+	signatures func(ctx context.Context, n ImageName) ([]cosignSignature, error)
+}
+
+// NewVerifyingResolver returns a Resolver that, once inner has resolved an
+// image to a digest, checks that the registry holds a cosign signature of
+// that digest made with the public key in the PEM file keyRef. Images
+// without such a signature fail to resolve and keep the digest they had.
+func NewVerifyingResolver(inner Resolver, keyRef string) (Resolver, error) {
+	return NewVerifyingResolverWithAuth(inner, keyRef, registry.Opt{}, RegistryAuth{})
+}
+
+// NewVerifyingResolverWithAuth is like NewVerifyingResolver, using opt and
+// auth to fetch the signatures.
+func NewVerifyingResolverWithAuth(inner Resolver, keyRef string, opt registry.Opt, auth RegistryAuth) (Resolver, error) {
+	return NewVerifyingResolverWithTransport(inner, keyRef, opt, auth, nil)
+}
+
+// NewVerifyingResolverWithTransport is like NewVerifyingResolverWithAuth,
+// fetching the signatures through transport (http.DefaultTransport if nil).
+func NewVerifyingResolverWithTransport(inner Resolver, keyRef string, opt registry.Opt, auth RegistryAuth, transport http.RoundTripper) (Resolver, error) {
+	key, err := loadCosignKey(keyRef)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingResolver{
+		inner: inner,
+		key:   key,
+		signatures: func(ctx context.Context, n ImageName) ([]cosignSignature, error) {
+			return fetchCosignSignatures(ctx, n, opt, auth, transport)
+		},
+	}, nil
+}
+
+func loadCosignKey(keyRef string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(strings.TrimPrefix(keyRef, "file://"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read signature verification key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in signature verification key %s", keyRef)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature verification key %s: %w", keyRef, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported signature verification key type %T in %s", key, keyRef)
+}
+
+func (r *verifyingResolver) Resolve(n *ImageName) error {
+	return r.ResolveContext(context.Background(), n)
+}
+
+func (r *verifyingResolver) ResolveContext(ctx context.Context, n *ImageName) error {
+	orig := n.Digest
+	if err := ResolveContext(ctx, r.inner, n); err != nil {
+		return err
+	}
+	if n.Digest == "" {
+		return fmt.Errorf("cannot verify the signature of %s: no digest", n)
+	}
+
+	err := r.verify(ctx, *n)
+	if err != nil {
+		n.Digest = orig
+	}
+	return err
+}
+
+func (r *verifyingResolver) verify(ctx context.Context, n ImageName) error {
+	sigs, err := r.signatures(ctx, n)
+	if err != nil {
+		return fmt.Errorf("unable to get the signatures of %s: %w", n, err)
+	}
+	if len(sigs) == 0 {
+		return fmt.Errorf("image %s is not signed", n)
+	}
+	for _, s := range sigs {
+		if err = verifyCosignSignature(r.key, s, n); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no valid signature for image %s: %w", n, err)
+}
+
+// verifyCosignSignature checks that s is a signature made with key of a
+// payload naming the repository and digest of n. Checking the repository
+// prevents a signature from being replayed for a copy of the image pushed
+// to another repository.
+func verifyCosignSignature(key crypto.PublicKey, s cosignSignature, n ImageName) error {
+	hash := sha256.Sum256(s.payload)
+	var ok bool
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(k, hash[:], s.signature)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], s.signature) == nil
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(k, s.payload, s.signature)
+	}
+	if !ok {
+		return fmt.Errorf("signature does not match the key")
+	}
+
+	var p cosignPayload
+	if err := json.Unmarshal(s.payload, &p); err != nil {
+		return fmt.Errorf("invalid signed payload: %w", err)
+	}
+	if got := p.Critical.Image.DockerManifestDigest; got != n.Digest {
+		return fmt.Errorf("signature is for digest %s", got)
+	}
+	ref, err := ParseImageName(p.Critical.Identity.DockerReference)
+	if err != nil {
+		return fmt.Errorf("invalid signed docker-reference %q: %w", p.Critical.Identity.DockerReference, err)
+	}
+	if got, want := cosignRepository(ref), cosignRepository(n); got != want {
+		return fmt.Errorf("signature is for repository %s, not %s", got, want)
+	}
+	return nil
+}
+
+// cosignRepository returns the repository of n without tag or digest, so
+// that names spelled differently (e.g. "nginx" and
+// "index.docker.io/library/nginx") compare equal.
+func cosignRepository(n ImageName) string {
+	n.Tag, n.Digest = "", ""
+	if n.Registry == "index.docker.io" || n.Registry == defaultRegistry {
+		n.Registry = "docker.io"
+	}
+	return strings.TrimSuffix(n.String(), ":")
+}
+
+// fetchCosignSignatures returns the signatures in the manifest cosign
+// stores next to an image, tagged after its digest ("sha256-<hex>.sig").
+// An image without that manifest has no signatures.
+func fetchCosignSignatures(ctx context.Context, n ImageName, opt registry.Opt, auth RegistryAuth, transport http.RoundTripper) ([]cosignSignature, error) {
+	img, err := registry.ParseImage(n.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse image name: %v", err)
+	}
+	authConfig, err := auth.authConfig(img.Domain)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get auth config for registry: %v", err)
+	}
+	c, err := newRegistryClient(ctx, authConfig, opt, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	tag := strings.Replace(n.Digest, ":", "-", 1) + ".sig"
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/v2/%s/manifests/%s", c.URL, img.Path, tag), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/vnd.oci.image.manifest.v1+json")
+	req.Header.Add("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status code: %d", resp.StatusCode)
+	}
+
+	var manifest struct {
+		Layers []struct {
+			Digest      digest.Digest     `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"layers"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxCosignPayload)).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid signature manifest: %w", err)
+	}
+
+	var res []cosignSignature
+	for _, l := range manifest.Layers {
+		sig, err := base64.StdEncoding.DecodeString(l.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(sig) == 0 {
+			continue
+		}
+		payload, err := downloadPayload(ctx, c, img.Path, l.Digest)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, cosignSignature{payload: payload, signature: sig})
+	}
+	return res, nil
+}
+
+func downloadPayload(ctx context.Context, c *registry.Registry, repository string, d digest.Digest) ([]byte, error) {
+	body, err := c.DownloadLayer(ctx, repository, d)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download signed payload: %w", err)
+	}
+	defer body.Close()
+	payload, err := io.ReadAll(io.LimitReader(body, maxCosignPayload))
+	if err != nil {
+		return nil, fmt.Errorf("unable to download signed payload: %w", err)
+	}
+	if err := d.Validate(); err != nil || d.Algorithm().FromBytes(payload) != d {
+		return nil, fmt.Errorf("signed payload does not match its digest %s", d)
+	}
+	return payload, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/genuinetools/reg/registry"
+	digest "github.com/opencontainers/go-digest"
+)
+
+var testImageDigest = digest.FromString("image").String()
+
+type digestResolver struct{}
+
+func (digestResolver) Resolve(n *ImageName) error {
+	n.Digest = testImageDigest
+	return nil
+}
+
+// cosignRegistry serves the cosign signature of the "signed" repository,
+// signed with key. The "copied" repository serves the same signature, as if
+// the image and its signature had been copied there, and any other
+// repository has no signature.
+func cosignRegistry(t *testing.T, key *ecdsa.PrivateKey) *httptest.Server {
+	sigTag := strings.Replace(testImageDigest, ":", "-", 1) + ".sig"
+	s := httptest.NewUnstartedServer(nil)
+	s.StartTLS()
+	t.Cleanup(s.Close)
+
+	ref := strings.TrimPrefix(s.URL, "https://") + "/signed"
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":%q},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, ref, testImageDigest))
+	hash := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadDigest := digest.FromBytes(payload)
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"layers": []interface{}{map[string]interface{}{
+			"mediaType":   "application/vnd.dev.cosign.simplesigning.v1+json",
+			"digest":      payloadDigest,
+			"size":        len(payload),
+			"annotations": map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/", "/v2":
+		case "/v2/signed/manifests/" + sigTag, "/v2/copied/manifests/" + sigTag:
+			w.Write(manifest)
+		case "/v2/signed/blobs/" + payloadDigest.String(), "/v2/copied/blobs/" + payloadDigest.String():
+			w.Write(payload)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	return s
+}
+
+func writeCosignKey(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyingResolver(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := cosignRegistry(t, key)
+	host := strings.TrimPrefix(s.URL, "https://")
+	auth := RegistryAuth{Credentials: map[string]RegistryCredentials{host: {}}}
+
+	resolver, err := NewVerifyingResolverWithAuth(digestResolver{}, writeCosignKey(t, key), registry.Opt{Insecure: true}, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failures []string
+	for _, image := range []string{host + "/signed:v1", host + "/unsigned:v1"} {
+		n, err := ParseImageName(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := resolver.Resolve(&n); err != nil {
+			failures = append(failures, err.Error())
+			if n.Digest != "" {
+				t.Errorf("expected %s to be left unpinned, got %s", image, n)
+			}
+		} else if n.Digest != testImageDigest {
+			t.Errorf("expected %s to be pinned, got %s", image, n)
+		}
+	}
+	if len(failures) != 1 || !strings.Contains(failures[0], "/unsigned@"+testImageDigest+" is not signed") {
+		t.Errorf("expected exactly one failure, for the unsigned image, got %q", failures)
+	}
+
+	// A signature made with another key doesn't verify.
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver, err = NewVerifyingResolverWithAuth(digestResolver{}, writeCosignKey(t, other), registry.Opt{Insecure: true}, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := ParseImageName(host + "/signed:v1")
+	if err := resolver.Resolve(&n); err == nil || !strings.Contains(err.Error(), "signature does not match the key") {
+		t.Errorf("expected a key mismatch, got %v", err)
+	}
+
+	// A signature copied along with the image to another repository
+	// doesn't verify either.
+	resolver, err = NewVerifyingResolverWithAuth(digestResolver{}, writeCosignKey(t, key), registry.Opt{Insecure: true}, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ = ParseImageName(host + "/copied:v1")
+	if err := resolver.Resolve(&n); err == nil || !strings.Contains(err.Error(), "signature is for repository "+host+"/signed") {
+		t.Errorf("expected a repository mismatch, got %v", err)
+	}
+
+	if _, err := NewVerifyingResolver(digestResolver{}, filepath.Join(t.TempDir(), "missing.pub")); err == nil {
+		t.Errorf("expected an error for a missing key")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var gkConfigMap = schema.GroupKind{Group: "", Kind: "ConfigMap"}
+
+// SecretPattern describes a kind of secret material that should never
+// appear in a ConfigMap.
+type SecretPattern struct {
+	Name   string
+	Regexp *regexp.Regexp
+}
+
+// SecretPatterns is the set of patterns ScanForSecrets looks for.
+// Callers may append their own.
+var SecretPatterns = []SecretPattern{
+	{"private key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)},
+	{"AWS access key id", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"JSON web token", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)},
+}
+
+// SecretFinding records a ConfigMap value that looks like a secret.
+type SecretFinding struct {
+	GroupVersionKind schema.GroupVersionKind
+	Namespace        string
+	Name             string
+	Key              string
+	Pattern          string
+}
+
+func (f SecretFinding) String() string {
+	name := f.Name
+	if f.Namespace != "" {
+		name = fmt.Sprintf("%s.%s", f.Namespace, f.Name)
+	}
+	return fmt.Sprintf("%s %q key %q looks like a %s", f.GroupVersionKind.Kind, name, f.Key, f.Pattern)
+}
+
+// ScanForSecrets looks for ConfigMap values matching any of the
+// SecretPatterns. Secret objects are never scanned.
+func ScanForSecrets(objs []*unstructured.Unstructured) []SecretFinding {
+	var findings []SecretFinding
+	for _, o := range objs {
+		if o.GroupVersionKind().GroupKind() != gkConfigMap {
+			continue
+		}
+		data, _, _ := unstructured.NestedStringMap(o.Object, "data")
+
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			for _, p := range SecretPatterns {
+				if p.Regexp.MatchString(data[k]) {
+					findings = append(findings, SecretFinding{
+						GroupVersionKind: o.GroupVersionKind(),
+						Namespace:        o.GetNamespace(),
+						Name:             o.GetName(),
+						Key:              k,
+						Pattern:          p.Name,
+					})
+				}
+			}
+		}
+	}
+	return findings
+}
@@ -157,3 +157,31 @@ func (l AlphabeticalOrder) Less(i, j int) bool {
 	}
 	return a.GetKind() < b.GetKind()
 }
+
+// SortForApply sorts objs by kind in DefaultKindPriority, so that objects
+// come after the namespaces and definitions they need. Unlike
+// DependencyOrder it needs no cluster access.
+func SortForApply(objs []*unstructured.Unstructured) {
+	SortForApplyByKinds(objs, DefaultKindPriority)
+}
+
+// SortForApplyByKinds sorts objs by the position of their kind in order.
+// Kinds missing from order, such as custom resources, go last. The sort is
+// stable, so objects of the same kind keep their relative order.
+func SortForApplyByKinds(objs []*unstructured.Unstructured, order []string) {
+	tiers := make(map[string]int, len(order))
+	for i, kind := range order {
+		if _, found := tiers[kind]; !found {
+			tiers[kind] = i
+		}
+	}
+	tier := func(o *unstructured.Unstructured) int {
+		if t, found := tiers[o.GetKind()]; found {
+			return t
+		}
+		return len(order)
+	}
+	sort.SliceStable(objs, func(i, j int) bool {
+		return tier(objs[i]) < tier(objs[j])
+	})
+}
@@ -165,3 +165,43 @@ func TestAlphaSort(t *testing.T) {
 		t.Errorf("actual != expected: %v != %v", objs, expected)
 	}
 }
+
+func TestSortForApply(t *testing.T) {
+	newObj := func(name, kind string) *unstructured.Unstructured {
+		o := unstructured.Unstructured{}
+		o.SetName(name)
+		o.SetKind(kind)
+		return &o
+	}
+	names := func(objs []*unstructured.Unstructured) []string {
+		var res []string
+		for _, o := range objs {
+			res = append(res, o.GetName())
+		}
+		return res
+	}
+
+	objs := []*unstructured.Unstructured{
+		newObj("widget", "Widget"),
+		newObj("web", "Deployment"),
+		newObj("cfg-b", "ConfigMap"),
+		newObj("ns", "Namespace"),
+		newObj("cfg-a", "ConfigMap"),
+		newObj("crd", "CustomResourceDefinition"),
+		newObj("sa", "ServiceAccount"),
+	}
+
+	sorted := append([]*unstructured.Unstructured(nil), objs...)
+	SortForApply(sorted)
+	want := []string{"ns", "crd", "sa", "cfg-b", "cfg-a", "web", "widget"}
+	if got := names(sorted); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	sorted = append([]*unstructured.Unstructured(nil), objs...)
+	SortForApplyByKinds(sorted, []string{"Widget", "Deployment"})
+	want = []string{"widget", "web", "cfg-b", "ns", "cfg-a", "crd", "sa"}
+	if got := names(sorted); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
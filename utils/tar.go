@@ -0,0 +1,145 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tarImporter serves files from tar or tar.gz archives, from URLs like:
+//
+//	tar:///abs/path/app.tar.gz//main.jsonnet
+//	tar://relative/path/app.tar.gz//main.jsonnet
+//
+// Relative archive paths are resolved against the working directory.
+// Relative imports from a file in an archive resolve inside the archive.
+// Each archive is read once and its files are kept in memory.
+type tarImporter struct {
+	mu      sync.Mutex
+	bundles map[string]map[string][]byte // archive path -> file name -> contents
+}
+
+func newTarImporter() *tarImporter {
+	return &tarImporter{bundles: map[string]map[string][]byte{}}
+}
+
+func (t *tarImporter) RoundTrip(req *http.Request) (*http.Response, error) {
+	archive, file, err := tarSplitURL(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	files, err := t.bundle(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	b, found := files[file]
+	if !found {
+		return simpleHTTPResponse(req, http.StatusNotFound, http.NoBody), nil
+	}
+	return simpleHTTPResponse(req, http.StatusOK, io.NopCloser(bytes.NewReader(b))), nil
+}
+
+// tarSplitURL splits a tar import URL into the absolute path of the
+// archive and the name of the file within it.
+func tarSplitURL(u *url.URL) (archive, file string, err error) {
+	archivePath, file, found := strings.Cut(u.Path, "//")
+	if !found || file == "" {
+		return "", "", fmt.Errorf("tar import %q must have the form <archive>//<path>", u)
+	}
+	file = path.Clean(file)
+	if file == "." || strings.HasPrefix(file, "../") {
+		return "", "", fmt.Errorf("tar import %q has an invalid path", u)
+	}
+
+	archive, err = filepath.Abs(filepath.FromSlash(u.Host + archivePath))
+	if err != nil {
+		return "", "", err
+	}
+	return archive, file, nil
+}
+
+// bundle returns the files of archive, reading it if needed.
+func (t *tarImporter) bundle(archive string) (map[string][]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if files, found := t.bundles[archive]; found {
+		return files, nil
+	}
+	log.Debugf("Reading tar archive %s", archive)
+	files, err := readTar(archive)
+	if err != nil {
+		return nil, fmt.Errorf("reading tar archive %s: %w", archive, err)
+	}
+	t.bundles[archive] = files
+	return files, nil
+}
+
+// readTar indexes the regular files of a tar archive, which is
+// decompressed first if it's gzipped.
+func readTar(archive string) (map[string][]byte, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[path.Clean(strings.TrimPrefix(hdr.Name, "/"))] = b
+	}
+	return files, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsonnet "github.com/google/go-jsonnet"
+)
+
+func writeTar(t *testing.T, name string, compress bool, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if compress {
+		zw := gzip.NewWriter(f)
+		defer zw.Close()
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTarImport(t *testing.T) {
+	files := map[string]string{
+		"./main.jsonnet":        `(import "lib/foo.libsonnet") + { main: true }`,
+		"lib/foo.libsonnet":     `{ version: (import "version.libsonnet") }`,
+		"lib/version.libsonnet": `1`,
+		"other.libsonnet":       `"other"`,
+	}
+
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprint("gzip=", compress), func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), "app.tar.gz")
+			writeTar(t, archive, compress, files)
+
+			vm := jsonnet.MakeVM()
+			vm.Importer(MakeUniversalImporter(nil, false))
+			out, err := vm.EvaluateAnonymousSnippet("test.jsonnet", fmt.Sprintf(`(import "tar://%s//main.jsonnet").version`, archive))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(out); got != "1" {
+				t.Errorf("got %s, want 1", got)
+			}
+
+			// The archive is indexed once, later imports don't read it.
+			if err := os.Remove(archive); err != nil {
+				t.Fatal(err)
+			}
+			out, err = vm.EvaluateAnonymousSnippet("test.jsonnet", fmt.Sprintf(`import "tar://%s//other.libsonnet"`, archive))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(out); got != `"other"` {
+				t.Errorf("got %s, want \"other\"", got)
+			}
+
+			_, err = vm.EvaluateAnonymousSnippet("test.jsonnet", fmt.Sprintf(`import "tar://%s//missing.libsonnet"`, archive))
+			if err == nil || !strings.Contains(err.Error(), "Couldn't open import") {
+				t.Errorf("expected missing file error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+
+	"github.com/kubecfg/kubecfg/internal/acquire"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Transform modifies an object read by ReadObjects.
+type Transform func(*unstructured.Unstructured) error
+
+// WithTransform makes ReadObjects run fn over every object, after
+// flattening Lists and before resolving duplicates. May be repeated;
+// transforms run in the order they are given, after the built-in ones
+// (WithCommonLabels, then WithDefaultNamespace).
+func WithTransform(fn Transform) ReadOption {
+	return func(opts *acquire.ReadOptions) {
+		opts.Transforms = append(opts.Transforms, fn)
+	}
+}
+
+// LabelsTransform returns a Transform doing AddLabels.
+func LabelsTransform(labels map[string]string) Transform {
+	return func(o *unstructured.Unstructured) error {
+		AddLabels([]*unstructured.Unstructured{o}, labels)
+		return nil
+	}
+}
+
+// DefaultNamespaceTransform returns a Transform doing DefaultNamespace.
+func DefaultNamespaceTransform(ns string, mapper meta.RESTMapper) Transform {
+	return func(o *unstructured.Unstructured) error {
+		return DefaultNamespace([]*unstructured.Unstructured{o}, ns, mapper)
+	}
+}
+
+// ReadTransforms returns the transforms ReadObjects runs for opts: the
+// built-in ones enabled by opts followed by those given to
+// WithTransform.
+func ReadTransforms(opts ...ReadOption) []Transform {
+	opt := acquire.MakeReadOptions(opts)
+	var res []Transform
+	if len(opt.CommonLabels) > 0 {
+		res = append(res, LabelsTransform(opt.CommonLabels))
+	}
+	if opt.DefaultNamespace != "" {
+		res = append(res, DefaultNamespaceTransform(opt.DefaultNamespace, opt.RESTMapper))
+	}
+	for _, t := range opt.Transforms {
+		res = append(res, t)
+	}
+	return res
+}
+
+// ApplyTransforms runs transforms, in order, over every object of objs.
+func ApplyTransforms(objs []*unstructured.Unstructured, transforms []Transform) error {
+	for _, o := range objs {
+		for _, t := range transforms {
+			if err := t(o); err != nil {
+				return fmt.Errorf("error transforming %s %s: %w", o.GetKind(), FqName(o), err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// virtualImporter serves the files registered with WithVirtualImport from
+// URLs like virtual:///mylib.libsonnet.
+type virtualImporter map[string][]byte
+
+// virtualName normalizes the name of a virtual file.
+func virtualName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (v virtualImporter) RoundTrip(req *http.Request) (*http.Response, error) {
+	b, found := v[virtualName(req.URL.Path)]
+	if !found {
+		return simpleHTTPResponse(req, http.StatusNotFound, http.NoBody), nil
+	}
+	return simpleHTTPResponse(req, http.StatusOK, io.NopCloser(bytes.NewReader(b))), nil
+}
+
+// WithVirtualImport registers content as a file that `import name`
+// resolves to, ahead of the importing file's directory and the library
+// search path, without it existing anywhere. Relative imports from a
+// virtual file resolve to other virtual files first, then to the library
+// search path. May be repeated.
+func WithVirtualImport(name string, content []byte) ImporterOption {
+	return func(importer *universalImporter) {
+		if importer.virtual == nil {
+			importer.virtual = virtualImporter{}
+		}
+		importer.virtual[virtualName(name)] = content
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2023 The kubecfg authors
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	jsonnet "github.com/google/go-jsonnet"
+)
+
+func TestVirtualImport(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"main.jsonnet":       `import "mylib"`,
+		"mylib":              `{ name: "file" }`,
+		"lib/real.libsonnet": `"real"`,
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vm := jsonnet.MakeVM()
+	vm.Importer(MakeUniversalImporter([]*url.URL{dirURL(filepath.Join(dir, "lib"))}, false,
+		WithVirtualImport("mylib", []byte(`{ name: import "helpers/name.libsonnet", real: import "real.libsonnet" }`)),
+		WithVirtualImport("/helpers/name.libsonnet", []byte(`"virtual"`)),
+	))
+	raw, err := EvaluateRaw(vm, filepath.Join(dir, "main.jsonnet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The virtual file wins over the file next to main.jsonnet, and
+	// can import both virtual files and files in the search path.
+	var got map[string]string
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"name": "virtual", "real": "real"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}